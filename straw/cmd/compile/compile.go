@@ -1,30 +1,32 @@
 package main
 
+// compile translates a straw program read from stdin into rv64 assembly.
+
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 
-	"github.com/yjp20/turtle/straw/pkg/ast"
-	"github.com/yjp20/turtle/straw/pkg/compiler/rv64"
-	"github.com/yjp20/turtle/straw/pkg/generator"
-	"github.com/yjp20/turtle/straw/pkg/parser"
-	"github.com/yjp20/turtle/straw/pkg/token"
+	"github.com/yjp20/turtle/straw"
+	"github.com/yjp20/turtle/straw/pkg/codegen/rv64"
 )
 
 func main() {
-	b, _ := ioutil.ReadAll(os.Stdin)
-
-	errors := token.NewErrorList()
-	file := token.NewFile(b)
-	lex := parser.NewLexer(file, &errors)
-	par := parser.NewParser(lex, &errors)
-	gen := generator.NewGenerator(&errors)
-
-	node := par.ParseProgram()
-	code := gen.Generate(node)
+	b, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-	println(ast.Print(node))
-	println(code.String())
+	code, _, err := straw.Compile("<stdin>", b)
+	if err != nil {
+		if err, ok := err.(*straw.Error); ok {
+			fmt.Fprint(os.Stderr, err.Print())
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
 
 	os.Stdout.WriteString(rv64.Compile(code))
 }
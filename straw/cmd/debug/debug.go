@@ -0,0 +1,38 @@
+package main
+
+// debug runs a straw program under the debugger, which reads commands from
+// stdin. With -json, it speaks the JSON protocol that editors use.
+//
+//	debug [-json] [-I dir]... file.st
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/yjp20/turtle/straw"
+	"github.com/yjp20/turtle/straw/pkg/debugger"
+)
+
+type paths []string
+
+func (p *paths) String() string     { return strings.Join(*p, ",") }
+func (p *paths) Set(s string) error { *p = append(*p, s); return nil }
+
+func main() {
+	var imports paths
+	flag.Var(&imports, "I", "directory to search for imports, can be repeated")
+	json := flag.Bool("json", false, "speak the JSON protocol instead of text")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: debug [-json] [-I dir]... file.st")
+		os.Exit(2)
+	}
+
+	d := debugger.New(os.Stdin, os.Stdout, *json)
+	if err := d.Run(context.Background(), straw.Options{ImportPaths: imports}, flag.Arg(0)); err != nil {
+		os.Exit(1)
+	}
+}
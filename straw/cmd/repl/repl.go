@@ -2,48 +2,47 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 
-	"github.com/yjp20/turtle/straw/pkg/ast"
-	"github.com/yjp20/turtle/straw/pkg/generator"
-	"github.com/yjp20/turtle/straw/pkg/parser"
-	"github.com/yjp20/turtle/straw/pkg/token"
+	"github.com/yjp20/turtle/straw"
 	"github.com/yjp20/turtle/straw/pkg/vm"
 )
 
 var PROMPT = ">>> "
 
 func main() {
-	errors := token.NewErrorList()
-
 	scn := bufio.NewScanner(os.Stdin)
-	env := vm.NewVM(&errors)
-	frame := vm.NewFunctionFrame(nil)
+	in := straw.New(straw.Options{})
+	in.Register("open", straw.Open)
 
 	for {
-		fmt.Fprintf(os.Stdout, PROMPT)
+		fmt.Fprint(os.Stdout, PROMPT)
 		scanned := scn.Scan()
 		if !scanned {
 			return
 		}
 
-		line := scn.Bytes()
-		file := token.NewFile(line)
-		lex := parser.NewLexer(file, &errors)
-		par := parser.NewParser(lex, &errors)
-		gen := generator.NewGenerator(&errors)
-
-		node := par.ParseProgram()
-		code := gen.Generate(node)
-
-		if len(errors) != 0 {
-			errors.Print()
-			ast.Print(node)
+		res, err := eval(in, scn.Text())
+		if err != nil {
+			if err, ok := err.(*straw.Error); ok {
+				fmt.Print(err.Print())
+			} else {
+				fmt.Println(err)
+			}
 			continue
 		}
-
-		res := env.Eval(code, frame)
-		println(res.Inspect())
+		if res != vm.NULL {
+			fmt.Println(vm.Pretty(res))
+		}
 	}
 }
+
+// eval runs line, stopping it if the user presses ctrl-c while it runs.
+func eval(in *straw.Interpreter, line string) (vm.Object, error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	return in.EvalContext(ctx, line)
+}
@@ -0,0 +1,65 @@
+package main
+
+// report writes an html page showing a straw program through every phase of
+// the compiler, and optionally the control flow graphs of the optimized ir in
+// the Graphviz DOT language.
+//
+//	report [-o ssa.html] [-dot cfg.dot] [file.st]
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/yjp20/turtle/straw/pkg/report"
+)
+
+func main() {
+	out := flag.String("o", "ssa.html", "where to write the html report")
+	dot := flag.String("dot", "", "where to write the DOT graph of the optimized ir")
+	flag.Parse()
+
+	title := "<stdin>"
+	var source []byte
+	var err error
+	if flag.NArg() > 0 {
+		title = flag.Arg(0)
+		source, err = ioutil.ReadFile(title)
+	} else {
+		source, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	r, code, errors := report.Compile(title, source)
+	if err := writeFile(*out, r.WriteHTML); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *dot != "" && len(errors) == 0 {
+		if err := writeFile(*dot, code.WriteDot); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if len(errors) != 0 {
+		errors.Print()
+		os.Exit(1)
+	}
+}
+
+func writeFile(name string, write func(w io.Writer) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -1,36 +1,128 @@
 package main
 
+// run runs a straw program from a file, or from stdin if no file is given,
+// and prints the value of its last expression.
+//
+//	run [-I dir]... [-timeout d] [-max-instructions n] [-trace text|json|histogram|tokens]
+//	    [-profile out.pprof] [-profile-period n] [-profile-report] [file.st]
+
 import (
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
-	"github.com/yjp20/turtle/straw/pkg/ast"
-	"github.com/yjp20/turtle/straw/pkg/generator"
-	"github.com/yjp20/turtle/straw/pkg/parser"
+	"github.com/yjp20/turtle/straw"
+	"github.com/yjp20/turtle/straw/pkg/profiler"
 	"github.com/yjp20/turtle/straw/pkg/token"
 	"github.com/yjp20/turtle/straw/pkg/vm"
 )
 
+type paths []string
+
+func (p *paths) String() string     { return strings.Join(*p, ",") }
+func (p *paths) Set(s string) error { *p = append(*p, s); return nil }
+
 func main() {
-	bytes, _ := ioutil.ReadAll(os.Stdin)
+	var imports paths
+	var limits vm.Limits
+	flag.Var(&imports, "I", "directory to search for imports, can be repeated")
+	flag.DurationVar(&limits.Timeout, "timeout", 0, "stop the program after this long")
+	flag.Int64Var(&limits.MaxInstructions, "max-instructions", 0, "stop the program after this many instructions")
+	flag.IntVar(&limits.MaxCallDepth, "max-call-depth", 0, "maximum depth of calls")
+	flag.Int64Var(&limits.MaxBytes, "max-bytes", 0, "maximum bytes the program may allocate")
+	trace := flag.String("trace", "", "trace the program to stderr as text, json, a histogram of instructions, or the tokens it's parsed from")
+	profile := flag.String("profile", "", "write a pprof profile of the program to this file")
+	period := flag.Int("profile-period", 0, "read the clock every this many instructions when profiling, instead of on every one")
+	report := flag.Bool("profile-report", false, "print a profile of the program to stderr")
+	flag.Parse()
+
+	var tracer vm.Tracer
+	var parseTrace func(*token.File, token.Token, token.Pos, string)
+	histogram := vm.NewHistogram()
+	switch *trace {
+	case "":
+	case "tokens":
+		parseTrace = func(file *token.File, tok token.Token, pos token.Pos, lit string) {
+			fmt.Fprintf(os.Stderr, "%s %s %q\n", file.Position(pos), tok, lit)
+		}
+	case "text":
+		tracer = &vm.TextTracer{W: os.Stderr}
+	case "json":
+		tracer = vm.NewJSONTracer(os.Stderr)
+	case "histogram":
+		tracer = histogram
+	default:
+		fail(fmt.Errorf("unknown trace format %s", *trace))
+	}
 
-	errors := token.NewErrorList()
+	var prof *profiler.Profiler
+	if *profile != "" || *report {
+		prof = profiler.NewSampling(*period)
+		if tracer != nil {
+			tracer = vm.MultiTracer{tracer, prof}
+		} else {
+			tracer = prof
+		}
+	}
 
-	file := token.NewFile(bytes)
-	lex := parser.NewLexer(file, &errors)
-	par := parser.NewParser(lex, &errors)
-	gen := generator.NewGenerator(&errors)
+	in := straw.New(straw.Options{ImportPaths: imports, Limits: limits, Tracer: tracer, ParseTrace: parseTrace})
+	in.Register("open", straw.Open)
 
-	node := par.ParseProgram()
-	code := gen.Generate(node)
-	println(code.String())
+	var result vm.Object
+	var err error
+	if prof != nil {
+		prof.Start()
+	}
+	if flag.NArg() > 0 {
+		result, err = in.EvalFile(flag.Arg(0))
+	} else {
+		var src []byte
+		src, err = ioutil.ReadAll(os.Stdin)
+		if err == nil {
+			result, err = in.Eval(string(src))
+		}
+	}
+	if *trace == "histogram" {
+		histogram.Report(os.Stderr)
+	}
+	if prof != nil {
+		prof.Stop()
+		if *report {
+			prof.Report(os.Stderr, 10)
+		}
+		if *profile != "" {
+			if err := writeProfile(prof, *profile); err != nil {
+				fail(err)
+			}
+		}
+	}
+	if err != nil {
+		fail(err)
+	}
+	if result != vm.NULL {
+		fmt.Println(result.String())
+	}
+}
 
-	if len(errors) != 0 {
-		errors.Print()
-		ast.Print(node)
-		return
+func writeProfile(prof *profiler.Profiler, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := prof.WriteProfile(f); err != nil {
+		f.Close()
+		return err
 	}
+	return f.Close()
+}
 
-	eval := vm.Eval(code, &errors, nil)
-	println(eval.String())
+func fail(err error) {
+	if err, ok := err.(*straw.Error); ok {
+		fmt.Fprint(os.Stderr, err.Print())
+	} else {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	os.Exit(1)
 }
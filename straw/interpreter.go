@@ -0,0 +1,314 @@
+// Package straw runs straw programs from Go. An Interpreter compiles source
+// through every phase of the compiler and runs it on the vm, keeping the
+// globals that programs define so that later calls can use them.
+//
+//	in := straw.New(straw.Options{})
+//	in.Register("hello", func(name string) string { return "hi " + name })
+//	in.Eval(`greet: λ (name string) → .hello name`)
+//	greeting, err := in.Call("greet", "straw")
+package straw
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/yjp20/turtle/straw/pkg/astgen"
+	"github.com/yjp20/turtle/straw/pkg/ir"
+	"github.com/yjp20/turtle/straw/pkg/irgen"
+	"github.com/yjp20/turtle/straw/pkg/macro"
+	"github.com/yjp20/turtle/straw/pkg/opt"
+	"github.com/yjp20/turtle/straw/pkg/token"
+	"github.com/yjp20/turtle/straw/pkg/vm"
+)
+
+type Options struct {
+	// Stdout is where programs print, os.Stdout if nil
+	Stdout io.Writer
+
+	// ImportPaths are the directories that import searches, in order. If
+	// empty, only the current directory is searched.
+	ImportPaths []string
+
+	Limits vm.Limits
+
+	// Tracer, if set, is told about everything that programs do
+	Tracer vm.Tracer
+
+	// ParseTrace, if set, is called with every token that the parser reads,
+	// and the file it's reading
+	ParseTrace func(file *token.File, tok token.Token, pos token.Pos, lit string)
+}
+
+type Interpreter struct {
+	options Options
+	machine *vm.Machine
+
+	// macros runs the compile time code of everything the interpreter
+	// evaluates, on a machine of its own
+	macros *macro.Expander
+
+	// modules caches imports by path, and loading holds the ones that are
+	// being imported, to catch cycles
+	modules map[string]*vm.Module
+	loading map[string]bool
+}
+
+func New(options Options) *Interpreter {
+	if options.Stdout == nil {
+		options.Stdout = os.Stdout
+	}
+	if len(options.ImportPaths) == 0 {
+		options.ImportPaths = []string{"."}
+	}
+	in := &Interpreter{
+		options: options,
+		modules: map[string]*vm.Module{},
+		loading: map[string]bool{},
+	}
+	in.machine = in.newMachine()
+	in.macros = macro.NewExpander(in.newMachine())
+	return in
+}
+
+func (in *Interpreter) newMachine() *vm.Machine {
+	m := vm.NewMachine()
+	m.Stdout = in.options.Stdout
+	m.Limits = in.options.Limits
+	m.Tracer = in.options.Tracer
+	m.Import = in.load
+	if in.machine != nil {
+		m.Builtins = in.machine.Builtins
+	}
+	return m
+}
+
+// Register exposes a Go function to programs, see vm.Builtins.Register.
+func (in *Interpreter) Register(name string, fn interface{}) error {
+	return in.machine.Builtins.Register(name, fn)
+}
+
+// Eval runs src, returning the value of its last expression.
+func (in *Interpreter) Eval(src string) (vm.Object, error) {
+	return in.EvalContext(context.Background(), src)
+}
+
+// EvalContext is like Eval, but stops the program once ctx is done.
+func (in *Interpreter) EvalContext(ctx context.Context, src string) (vm.Object, error) {
+	return in.eval(ctx, in.machine, "", []byte(src))
+}
+
+func (in *Interpreter) EvalFile(path string) (vm.Object, error) {
+	return in.EvalFileContext(context.Background(), path)
+}
+
+func (in *Interpreter) EvalFileContext(ctx context.Context, path string) (vm.Object, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return in.eval(ctx, in.machine, path, src)
+}
+
+func (in *Interpreter) eval(ctx context.Context, m *vm.Machine, name string, src []byte) (vm.Object, error) {
+	code, file, err := compile(ctx, name, src, in.macros, in.options.ParseTrace)
+	if err != nil {
+		return nil, err
+	}
+	result, err := m.Eval(ctx, code)
+	if err != nil {
+		return nil, &Error{File: file, Errors: token.ErrorList{err}}
+	}
+	return result, nil
+}
+
+// Call calls the global procedure name, converting args with vm.FromGo.
+func (in *Interpreter) Call(name string, args ...interface{}) (vm.Object, error) {
+	return in.CallContext(context.Background(), name, args...)
+}
+
+func (in *Interpreter) CallContext(ctx context.Context, name string, args ...interface{}) (vm.Object, error) {
+	fn := in.Get(name)
+	if fn == nil {
+		return nil, fmt.Errorf("undefined: %s", name)
+	}
+	objects := make([]vm.Object, len(args))
+	for i, arg := range args {
+		obj, err := vm.FromGo(reflect.ValueOf(arg))
+		if err != nil {
+			return nil, err
+		}
+		objects[i] = obj
+	}
+	return in.machine.Call(ctx, fn, objects)
+}
+
+// Set defines the global name, converting value with vm.FromGo.
+func (in *Interpreter) Set(name string, value interface{}) error {
+	obj, err := vm.FromGo(reflect.ValueOf(value))
+	if err != nil {
+		return err
+	}
+	in.machine.Globals.SetVar(name, obj)
+	return nil
+}
+
+// Get returns the global name, or nil if it isn't defined.
+func (in *Interpreter) Get(name string) vm.Object {
+	return in.machine.Globals.GetVar(name)
+}
+
+// Open returns a reader over the file at path, which the lines builtin reads
+// a line at a time. Programs can't open files unless the host registers it.
+func Open(path string) (*vm.Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &vm.Reader{Name: path, R: f}, nil
+}
+
+// load imports the module at path, which is either a file path.st or a
+// directory of .st files in one of the import paths. Each module is loaded
+// once, on a machine of its own.
+func (in *Interpreter) load(ctx context.Context, path string) (*vm.Module, error) {
+	if module, ok := in.modules[path]; ok {
+		return module, nil
+	}
+	if in.loading[path] {
+		return nil, fmt.Errorf("import cycle through %s", path)
+	}
+	in.loading[path] = true
+	defer delete(in.loading, path)
+
+	files, err := in.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	m := in.newMachine()
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := in.eval(ctx, m, file, src); err != nil {
+			return nil, err
+		}
+	}
+	module := &vm.Module{Name: path, Globals: m.Globals}
+	in.modules[path] = module
+	return module, nil
+}
+
+func (in *Interpreter) resolve(path string) ([]string, error) {
+	for _, dir := range in.options.ImportPaths {
+		base := filepath.Join(dir, filepath.FromSlash(path))
+		if info, err := os.Stat(base + ".st"); err == nil && !info.IsDir() {
+			return []string{base + ".st"}, nil
+		}
+		entries, err := os.ReadDir(base)
+		if err != nil {
+			continue
+		}
+		files := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".st") {
+				files = append(files, filepath.Join(base, entry.Name()))
+			}
+		}
+		if len(files) != 0 {
+			sort.Strings(files)
+			return files, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find module %s in %s", path, strings.Join(in.options.ImportPaths, ", "))
+}
+
+// Compile parses src, expands its macros, generates its ir and optimizes it.
+func Compile(name string, src []byte) (ir.Program, *token.File, error) {
+	return compile(context.Background(), name, src, macro.NewExpander(vm.NewMachine()), nil)
+}
+
+func compile(ctx context.Context, name string, src []byte, macros *macro.Expander, trace func(*token.File, token.Token, token.Pos, string)) (ir.Program, *token.File, error) {
+	errors := token.NewErrorList()
+	file := token.NewFile(src)
+	file.Name = name
+	par := astgen.NewParser(astgen.NewLexer(file, &errors), &errors)
+	if trace != nil {
+		par.SetTrace(func(tok token.Token, pos token.Pos, lit string) {
+			trace(file, tok, pos, lit)
+		})
+	}
+	node := par.ParseProgram()
+	if len(errors) != 0 {
+		return ir.Program{}, file, &Error{File: file, Errors: errors}
+	}
+	macros.Expand(ctx, node, file, &errors)
+	if len(errors) != 0 {
+		return ir.Program{}, file, &Error{File: file, Errors: errors}
+	}
+	code := irgen.NewGenerator(&errors).Generate(node)
+	if len(errors) != 0 {
+		return code, file, &Error{File: file, Errors: errors}
+	}
+	opt.Optimize(&code)
+	code.File = file
+	return code, file, nil
+}
+
+// Error holds the errors from compiling or running a file.
+type Error struct {
+	File   *token.File
+	Errors token.ErrorList
+}
+
+func (e *Error) Error() string {
+	msg := e.describe(e.Errors[0])
+	if len(e.Errors) > 1 {
+		msg += fmt.Sprintf(" (and %d more errors)", len(e.Errors)-1)
+	}
+	return msg
+}
+
+// Unwrap returns the first error, so that errors.As finds a *vm.RuntimeError.
+func (e *Error) Unwrap() error {
+	return e.Errors[0]
+}
+
+func (e *Error) describe(err error) string {
+	if e.File != nil {
+		switch err := err.(type) {
+		case token.Error:
+			return fmt.Sprintf("%s: %s", e.File.Position(err.Pos()), err.Error())
+		case *vm.RuntimeError:
+			return fmt.Sprintf("%s: %s", e.File.Position(err.Pos), err.Error())
+		}
+	}
+	return err.Error()
+}
+
+// Print formats every error with the source it points at.
+func (e *Error) Print() string {
+	sb := strings.Builder{}
+	for _, err := range e.Errors {
+		switch err := err.(type) {
+		case token.Error:
+			if e.File != nil {
+				sb.WriteString(err.Print(e.File))
+				continue
+			}
+		case *vm.RuntimeError:
+			if e.File != nil {
+				sb.WriteString(err.Print(e.File))
+				continue
+			}
+		}
+		sb.WriteString(err.Error() + "\n")
+	}
+	return sb.String()
+}
@@ -96,7 +96,12 @@ type Branch struct {
 }
 
 func (bs *Branch) Pos() token.Pos { return bs.KeywordPos }
-func (bs *Branch) End() token.Pos { return bs.Label.End() }
+func (bs *Branch) End() token.Pos {
+	if bs.Label == nil {
+		return bs.KeywordPos + token.Pos(len(bs.Keyword.String()))
+	}
+	return bs.Label.End()
+}
 
 type Return struct {
 	KeywordPos token.Pos
@@ -104,7 +109,12 @@ type Return struct {
 }
 
 func (rs *Return) Pos() token.Pos { return rs.KeywordPos }
-func (rs *Return) End() token.Pos { return rs.Body.End() }
+func (rs *Return) End() token.Pos {
+	if rs.Body == nil {
+		return rs.KeywordPos + token.Pos(len("return"))
+	}
+	return rs.Body.End()
+}
 
 type For struct {
 	KeywordPos    token.Pos
@@ -130,8 +140,13 @@ type Call struct {
 	Arguments []Node
 }
 
-func (c *Call) Pos() token.Pos { return c.Arguments[0].Pos() }
-func (c *Call) End() token.Pos { return c.Arguments[0].End() }
+func (c *Call) Pos() token.Pos { return c.CallPos }
+func (c *Call) End() token.Pos {
+	if len(c.Arguments) == 0 {
+		return c.Procedure.End()
+	}
+	return c.Arguments[len(c.Arguments)-1].End()
+}
 
 type Construct struct {
 	Construct token.Pos
@@ -165,7 +180,7 @@ type Tuple struct {
 }
 
 func (t *Tuple) Pos() token.Pos { return t.LeftPos }
-func (t *Tuple) End() token.Pos { return t.RightPos }
+func (t *Tuple) End() token.Pos { return t.RightPos + 1 }
 
 type Block struct {
 	LeftPos  token.Pos
@@ -174,7 +189,7 @@ type Block struct {
 }
 
 func (b *Block) Pos() token.Pos { return b.LeftPos }
-func (b *Block) End() token.Pos { return b.RightPos }
+func (b *Block) End() token.Pos { return b.RightPos + 1 }
 
 type If struct {
 	Condition Node
@@ -182,8 +197,13 @@ type If struct {
 	FalseBody Node
 }
 
-func (i *If) Pos() token.Pos { return i.TrueBody.Pos() }
-func (i *If) End() token.Pos { return i.FalseBody.End() }
+func (i *If) Pos() token.Pos { return i.Condition.Pos() }
+func (i *If) End() token.Pos {
+	if i.FalseBody == nil {
+		return i.TrueBody.End()
+	}
+	return i.FalseBody.End()
+}
 
 type DefaultLiteral struct {
 	KeywordPos token.Pos
@@ -210,21 +230,25 @@ type FloatLiteral struct {
 func (fl *FloatLiteral) Pos() token.Pos { return fl.LiteralPos }
 func (fl *FloatLiteral) End() token.Pos { return fl.LiteralPos + token.Pos(len(fl.Literal)) }
 
+// StringLiteral and RuneLiteral hold the Literal as it's written, with quotes
+// and escapes, and the Value it stands for.
 type StringLiteral struct {
 	LiteralPos token.Pos
+	Literal    string
 	Value      string
 }
 
 func (sl *StringLiteral) Pos() token.Pos { return sl.LiteralPos }
-func (sl *StringLiteral) End() token.Pos { return sl.LiteralPos + token.Pos(len(sl.Value)) }
+func (sl *StringLiteral) End() token.Pos { return sl.LiteralPos + token.Pos(len(sl.Literal)) }
 
 type RuneLiteral struct {
 	LiteralPos token.Pos
+	Literal    string
 	Value      string
 }
 
 func (rl *RuneLiteral) Pos() token.Pos { return rl.LiteralPos }
-func (rl *RuneLiteral) End() token.Pos { return rl.LiteralPos + token.Pos(len(rl.Value)) }
+func (rl *RuneLiteral) End() token.Pos { return rl.LiteralPos + token.Pos(len(rl.Literal)) }
 
 type RangeLiteral struct {
 	RangePos       token.Pos
@@ -257,11 +281,17 @@ type ProcedureType struct {
 	Name       *Identifier
 	Params     []Field
 	Arguments  []Field
+	RightPos   token.Pos
 	ReturnType Node
 }
 
 func (ft *ProcedureType) Pos() token.Pos { return ft.KeywordPos }
-func (ft *ProcedureType) End() token.Pos { return -1 }
+func (ft *ProcedureType) End() token.Pos {
+	if ft.ReturnType == nil {
+		return ft.RightPos + 1
+	}
+	return ft.ReturnType.End()
+}
 
 type ProcedureDefinition struct {
 	ProcedureType *ProcedureType
@@ -287,7 +317,12 @@ type Prefix struct {
 }
 
 func (p *Prefix) Pos() token.Pos { return p.OperatorPos }
-func (p *Prefix) End() token.Pos { return p.Node.End() }
+func (p *Prefix) End() token.Pos {
+	if p.Node == nil {
+		return p.OperatorPos + 1
+	}
+	return p.Node.End()
+}
 
 type Infix struct {
 	Operator    token.Token
@@ -297,7 +332,12 @@ type Infix struct {
 }
 
 func (i *Infix) Pos() token.Pos { return i.Left.Pos() }
-func (i *Infix) End() token.Pos { return i.Right.End() }
+func (i *Infix) End() token.Pos {
+	if i.Right == nil {
+		return i.OperatorPos + 1
+	}
+	return i.Right.End()
+}
 
 type TypeSpec struct {
 	Type    token.Token
@@ -325,3 +365,60 @@ type Match struct {
 
 func (m *Match) Pos() token.Pos { return m.KeywordPos }
 func (m *Match) End() token.Pos { return m.Tuple.End() }
+
+// Go runs a call as a new task.
+type Go struct {
+	KeywordPos token.Pos
+	Call       *Call
+}
+
+func (g *Go) Pos() token.Pos { return g.KeywordPos }
+func (g *Go) End() token.Pos { return g.Call.End() }
+
+// Select waits on whichever of the sends and receives in the tuple can go
+// ahead first, like a match.
+type Select struct {
+	KeywordPos token.Pos
+	Tuple      *Tuple
+}
+
+func (s *Select) Pos() token.Pos { return s.KeywordPos }
+func (s *Select) End() token.Pos { return s.Tuple.End() }
+
+// Defer runs a node when the procedure it's in returns.
+type Defer struct {
+	KeywordPos token.Pos
+	Node       Node
+}
+
+func (d *Defer) Pos() token.Pos { return d.KeywordPos }
+func (d *Defer) End() token.Pos { return d.Node.End() }
+
+// Yield hands a value to the loop iterating over the generator it's in.
+type Yield struct {
+	KeywordPos token.Pos
+	Node       Node
+}
+
+func (y *Yield) Pos() token.Pos { return y.KeywordPos }
+func (y *Yield) End() token.Pos { return y.Node.End() }
+
+// Quote is a node as a value, which programs can inspect and build code with.
+type Quote struct {
+	KeywordPos token.Pos
+	Node       Node
+}
+
+func (q *Quote) Pos() token.Pos { return q.KeywordPos }
+func (q *Quote) End() token.Pos { return q.Node.End() }
+
+// CompileTime is a node that's run while compiling, in the form of `σ node`.
+// Top level assignments define macros and the procedures they use, and
+// anything else is replaced by the code it evaluates to.
+type CompileTime struct {
+	KeywordPos token.Pos
+	Node       Node
+}
+
+func (ct *CompileTime) Pos() token.Pos { return ct.KeywordPos }
+func (ct *CompileTime) End() token.Pos { return ct.Node.End() }
@@ -220,41 +220,34 @@ func (l *Lexer) readNumber() (string, bool) {
 }
 
 func (l *Lexer) readStringLiteral() string {
-	// " was consumed, so the start is l.begin - 1
-	begin := l.begin - 1
-	valid := true
-	for {
-		l.readRune()
-		if l.ch == eof {
-			valid = false
-		}
-		if l.ch == '"' {
-			l.readRune()
-			break
-		}
-	}
-	if !valid {
-		l.appendError("Expected string to be terminated with a \" before EOF", token.Pos(begin), token.Pos(l.begin))
-	}
-	return string(l.file.Source[begin:l.begin])
+	return l.readQuoted('"', "Expected string to be terminated with a \" before EOF")
 }
 
 func (l *Lexer) readRuneLiteral() string {
-	// " was consumed, so the start is l.begin - 1
+	return l.readQuoted('\'', "Expected rune literal to be terminated with a ' before EOF")
+}
+
+// readQuoted reads a literal up to the closing quote, which a backslash
+// escapes. The opening quote was consumed, so the start is l.begin - 1.
+func (l *Lexer) readQuoted(quote rune, msg string) string {
 	begin := l.begin - 1
-	valid := true
 	for {
-		l.readRune()
+		if l.ch == '\\' {
+			l.readRune()
+			if l.ch != eof {
+				l.readRune()
+				continue
+			}
+		}
 		if l.ch == eof {
-			valid = false
+			l.appendError(msg, token.Pos(begin), token.Pos(l.begin))
+			break
 		}
-		if l.ch == '\'' {
+		if l.ch == quote {
 			l.readRune()
 			break
 		}
-	}
-	if !valid {
-		l.appendError("Expected rune literal to be terminated with a before EOF", token.Pos(begin), token.Pos(l.begin))
+		l.readRune()
 	}
 	return string(l.file.Source[begin:l.begin])
 }
@@ -6,6 +6,8 @@ package astgen
 import (
 	"fmt"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/yjp20/turtle/straw/pkg/ast"
 	"github.com/yjp20/turtle/straw/pkg/token"
@@ -22,6 +24,8 @@ type Parser struct {
 
 	errors       *token.ErrorList
 	commentGroup *ast.CommentGroup
+
+	trace func(tok token.Token, pos token.Pos, lit string)
 }
 
 func NewParser(lexer *Lexer, errors *token.ErrorList) *Parser {
@@ -38,6 +42,15 @@ func (p *Parser) ParseProgram() *ast.Program {
 	return program
 }
 
+// SetTrace makes the parser call trace with every token it reads, starting
+// with the one it is looking at.
+func (p *Parser) SetTrace(trace func(tok token.Token, pos token.Pos, lit string)) {
+	p.trace = trace
+	if trace != nil {
+		trace(p.tok, p.pos, p.lit)
+	}
+}
+
 // Increments the token currently looked at by the parser. It is different
 // from nextToken in that it "skips" and consumes comment groups.
 func (p *Parser) next() {
@@ -49,6 +62,9 @@ func (p *Parser) next() {
 // Increments the token currently looked at by the parser.
 func (p *Parser) nextToken() {
 	p.tok, p.pos, p.lit = p.lexer.Next()
+	if p.trace != nil {
+		p.trace(p.tok, p.pos, p.lit)
+	}
 }
 
 // Consumes multiple nodes until we don't have a valid atomic node, and returns
@@ -74,7 +90,6 @@ func (p *Parser) parseNode(precedence Precedence) ast.Node {
 		return nil
 	}
 
-	fmt.Printf("%s\n", p.tok.String())
 	lp, rp := GetPrecedence(p.tok)
 	if precedence > lp {
 		return left
@@ -82,10 +97,9 @@ func (p *Parser) parseNode(precedence Precedence) ast.Node {
 
 	for {
 		switch p.tok {
-		case token.ADD, token.SUB, token.MUL, token.QUO, token.EQUAL, token.LESS_EQUAL, token.LESS, token.GREATER_EQUAL, token.GREATER, token.NOT_EQUAL, token.AND, token.OR, token.XOR:
+		case token.ADD, token.SUB, token.MUL, token.QUO, token.EQUAL, token.LESS_EQUAL, token.LESS, token.GREATER_EQUAL, token.GREATER, token.NOT_EQUAL, token.AND, token.OR, token.XOR, token.LEFT_ARROW:
 			tok := p.tok
-			pos := p.consume(p.tok)
-			expr := p.parseNode(rp)
+			pos, expr := p.parseOperand(rp)
 			left = &ast.Infix{
 				Operator:    tok,
 				OperatorPos: pos,
@@ -93,15 +107,13 @@ func (p *Parser) parseNode(precedence Precedence) ast.Node {
 				Right:       expr,
 			}
 		case token.ASSIGN:
-			p.consume(p.tok)
-			expr := p.parseNode(rp)
+			_, expr := p.parseOperand(rp)
 			left = &ast.Assign{
 				Left:  left,
 				Right: expr,
 			}
 		case token.EACH:
-			p.consume(p.tok)
-			expr := p.parseNode(rp)
+			_, expr := p.parseOperand(rp)
 			left = &ast.Each{
 				Left:  left,
 				Right: expr,
@@ -117,7 +129,7 @@ func (p *Parser) parseNode(precedence Precedence) ast.Node {
 			}
 			left = i
 		case token.IDENT:
-			t := p.parseNode(LOWEST)
+			t := p.parseNode(rp)
 			left = &ast.As{Node: left, Type: t}
 
 		default:
@@ -126,6 +138,24 @@ func (p *Parser) parseNode(precedence Precedence) ast.Node {
 	}
 }
 
+// parseOperand consumes an operator and parses its right side, returning
+// where the operator is. If there isn't a right side, it's reported and an
+// empty block is left in its place.
+func (p *Parser) parseOperand(precedence Precedence) (token.Pos, ast.Node) {
+	lit := p.lit
+	pos := p.consume(p.tok)
+	node := p.parseNode(precedence)
+	if node == nil {
+		p.missingOperand(pos, lit)
+		node = &ast.Block{LeftPos: pos, RightPos: pos}
+	}
+	return pos, node
+}
+
+func (p *Parser) missingOperand(pos token.Pos, lit string) {
+	p.appendError(fmt.Sprintf("Expected an expression after '%s'", lit), pos, pos+token.Pos(len(lit)))
+}
+
 // Attempts to parse an atomic node, which is an expression that is not joined
 // by infix operators or is a part of an expression list, ie.  expressions that
 // are prefix, postfix, or literals. Returns nil if the current cursor is not
@@ -133,12 +163,18 @@ func (p *Parser) parseNode(precedence Precedence) ast.Node {
 func (p *Parser) parseAtomicNode() ast.Node {
 	var expression ast.Node
 	switch p.tok {
-	case token.NOT, token.SUB, token.MUL, token.AND:
-		tok := p.tok
+	case token.NOT, token.SUB, token.MUL, token.AND, token.LEFT_ARROW:
+		tok, lit := p.tok, p.lit
+		pos := p.consume(p.tok)
+		node := p.parseAtomicNode()
+		if node == nil {
+			p.missingOperand(pos, lit)
+			node = &ast.Block{LeftPos: pos, RightPos: pos}
+		}
 		expression = &ast.Prefix{
 			Operator:    tok,
-			OperatorPos: p.consume(p.tok),
-			Node:        p.parseAtomicNode(),
+			OperatorPos: pos,
+			Node:        node,
 		}
 	case token.LEFT_BRACE:
 		expression = p.consumeBlock()
@@ -157,9 +193,9 @@ func (p *Parser) parseAtomicNode() ast.Node {
 	case token.RANGE:
 		expression = p.consumeRangeLiteral()
 	case token.TRUE:
-		expression = &ast.TrueLiteral{p.consume(token.TRUE)}
+		expression = &ast.TrueLiteral{LiteralPos: p.consume(token.TRUE)}
 	case token.FALSE:
-		expression = &ast.FalseLiteral{p.consume(token.FALSE)}
+		expression = &ast.FalseLiteral{LiteralPos: p.consume(token.FALSE)}
 	case token.IDENT:
 		expression = p.consumeIdentifier()
 	case token.FUNC:
@@ -170,6 +206,13 @@ func (p *Parser) parseAtomicNode() ast.Node {
 		expression = p.consumeTypeSpec()
 	case token.MATCH:
 		expression = p.consumeMatch()
+	case token.SELECT:
+		expression = p.consumeSelect()
+	case token.GO:
+		expression = p.consumeGo()
+	case token.CHAN:
+		// chan is a keyword, but its type is applied like any other
+		expression = &ast.Identifier{Value: "chan", WordPos: p.consume(token.CHAN)}
 	case token.PERIOD:
 		expression = p.consumeCallNode()
 	case token.CONSTRUCT:
@@ -180,6 +223,14 @@ func (p *Parser) parseAtomicNode() ast.Node {
 		expression = p.consumeFor()
 	case token.RETURN:
 		expression = p.consumeReturn()
+	case token.DEFER:
+		expression = p.consumeDefer()
+	case token.YIELD:
+		expression = p.consumeYield()
+	case token.QUOTE:
+		expression = p.consumeQuote()
+	case token.COMPILE_TIME:
+		expression = p.consumeCompileTime()
 	default:
 		return nil
 	}
@@ -274,27 +325,57 @@ func (p *Parser) consumeFloatLiteral() *ast.FloatLiteral {
 func (p *Parser) consumeStringLiteral() *ast.StringLiteral {
 	lit := p.lit
 	pos := p.consume(token.STRING)
-	// FIXME, currently assumes that the string is well formed, which it is not
-	// guaranteed to be. Also, there is no support for escape characters which
-	// will eventually be needed
+	value, err := unquote(lit, '"')
+	if err != nil {
+		p.appendError("Invalid escape in string literal", pos, pos+token.Pos(len(lit)))
+	}
 	return &ast.StringLiteral{
 		LiteralPos: pos,
-		Value:      lit[1 : len(lit)-1],
+		Literal:    lit,
+		Value:      value,
 	}
 }
 
 func (p *Parser) consumeRuneLiteral() *ast.RuneLiteral {
 	lit := p.lit
 	pos := p.consume(token.RUNE)
-	// FIXME, currently assumes that the rune is well formed, which it is not
-	// guaranteed to be. Also, there is no support for escape characters which
-	// will eventually be needed
+	value, err := unquote(lit, '\'')
+	if err != nil {
+		p.appendError("Invalid escape in rune literal", pos, pos+token.Pos(len(lit)))
+	} else if utf8.RuneCountInString(value) != 1 {
+		p.appendError("Expected rune literal to hold a single character", pos, pos+token.Pos(len(lit)))
+	}
 	return &ast.RuneLiteral{
 		LiteralPos: pos,
-		Value:      lit[1 : len(lit)-1],
+		Literal:    lit,
+		Value:      value,
 	}
 }
 
+// unquote removes the quotes around a literal and interprets its escapes,
+// which are the same as Go's.
+func unquote(lit string, quote byte) (string, error) {
+	if len(lit) < 2 || lit[len(lit)-1] != quote {
+		// Unterminated, which the lexer reported already
+		return strings.TrimPrefix(lit, string(quote)), nil
+	}
+	s := lit[1 : len(lit)-1]
+	sb := strings.Builder{}
+	for len(s) > 0 {
+		r, multibyte, tail, err := strconv.UnquoteChar(s, quote)
+		if err != nil {
+			return sb.String(), err
+		}
+		if r < utf8.RuneSelf || !multibyte {
+			sb.WriteByte(byte(r))
+		} else {
+			sb.WriteRune(r)
+		}
+		s = tail
+	}
+	return sb.String(), nil
+}
+
 func (p *Parser) consumeRangeLiteral() *ast.RangeLiteral {
 	rl := &ast.RangeLiteral{RangePos: p.consume(token.RANGE)}
 
@@ -346,6 +427,13 @@ func (p *Parser) consumeProcedure() ast.Node {
 	pos := p.consume(token.FUNC)
 	pt := &ast.ProcedureType{KeywordPos: pos}
 	node = pt
+	if p.tok == token.LEFT_BRACE {
+		// λ {...} is a block that's run when it's called, rather than where
+		// it's written
+		block := p.consumeBlock()
+		pt.RightPos = block.LeftPos
+		return &ast.ProcedureDefinition{ProcedureType: pt, KeywordPos: block.LeftPos, Body: block}
+	}
 	if p.tok == token.IDENT {
 		pt.Name = p.tryConsumeIdentifier()
 	}
@@ -355,6 +443,7 @@ func (p *Parser) consumeProcedure() ast.Node {
 	}
 	t := p.consumeTuple()
 	pt.Arguments = toFields(t)
+	pt.RightPos = t.RightPos
 	pt.ReturnType = p.parseAtomicNode()
 	if p.tok == token.RIGHT_ARROW {
 		node = &ast.ProcedureDefinition{
@@ -382,9 +471,10 @@ func (p *Parser) consumeTypeSpec() *ast.TypeSpec {
 	if p.tok != token.INTERFACE && p.tok != token.STRUCT {
 		// TODO handle error
 	}
+	tok := p.tok
 	ts := &ast.TypeSpec{
-		Type:    p.tok,
-		TypePos: p.consume(p.tok),
+		Type:    tok,
+		TypePos: p.consume(tok),
 	}
 	if p.tok == token.LEFT_BRACK {
 		ts.Params = p.consumeBrackTuple()
@@ -406,8 +496,30 @@ func (p *Parser) consumeMatch() *ast.Match {
 	}
 }
 
+func (p *Parser) consumeSelect() *ast.Select {
+	return &ast.Select{
+		KeywordPos: p.consume(token.SELECT),
+		Tuple:      p.consumeTuple(),
+	}
+}
+
+func (p *Parser) consumeGo() ast.Node {
+	pos := p.consume(token.GO)
+	node := p.parseAtomicNode()
+	call, ok := node.(*ast.Call)
+	if !ok {
+		end := pos + 2
+		if node != nil {
+			end = node.End()
+		}
+		p.appendError("Expected a call after 'go'", pos, end)
+		return node
+	}
+	return &ast.Go{KeywordPos: pos, Call: call}
+}
+
 func (p *Parser) consumeCallNode() ast.Node {
-	p.consume(token.PERIOD)
+	pos := p.consume(token.PERIOD)
 	arguments := make([]ast.Node, 0)
 	proc := p.parseAtomicNode()
 	for {
@@ -417,7 +529,7 @@ func (p *Parser) consumeCallNode() ast.Node {
 		}
 		arguments = append(arguments, expr)
 	}
-	return &ast.Call{Procedure: proc, Arguments: arguments}
+	return &ast.Call{CallPos: pos, Procedure: proc, Arguments: arguments}
 }
 
 func (p *Parser) consumeBranch() *ast.Branch {
@@ -436,10 +548,10 @@ func (p *Parser) consumeFor() *ast.For {
 		Body          = p.parseNode(LOWEST)
 	)
 	return &ast.For{
-		KeywordPos,
-		Clause,
-		RightArrowPos,
-		Body,
+		KeywordPos:    KeywordPos,
+		Clause:        Clause,
+		RightArrowPos: RightArrowPos,
+		Body:          Body,
 	}
 }
 
@@ -450,6 +562,39 @@ func (p *Parser) consumeReturn() *ast.Return {
 	}
 }
 
+func (p *Parser) consumeDefer() *ast.Defer {
+	return &ast.Defer{
+		KeywordPos: p.consume(token.DEFER),
+		Node:       p.parseNode(LOWEST),
+	}
+}
+
+func (p *Parser) consumeYield() *ast.Yield {
+	return &ast.Yield{
+		KeywordPos: p.consume(token.YIELD),
+		Node:       p.parseNode(LOWEST),
+	}
+}
+
+// consumeQuote only quotes an atomic node, so that quoted code can be passed
+// as an argument.
+func (p *Parser) consumeQuote() *ast.Quote {
+	quote := &ast.Quote{KeywordPos: p.consume(token.QUOTE)}
+	quote.Node = p.parseAtomicNode()
+	if quote.Node == nil {
+		p.appendError("Expected something to quote", p.pos, p.pos+token.Pos(len(p.lit)))
+		quote.Node = &ast.Block{LeftPos: p.pos, RightPos: p.pos}
+	}
+	return quote
+}
+
+func (p *Parser) consumeCompileTime() *ast.CompileTime {
+	return &ast.CompileTime{
+		KeywordPos: p.consume(token.COMPILE_TIME),
+		Node:       p.parseNode(LOWEST),
+	}
+}
+
 func (p *Parser) consumeCommentGroup() *ast.CommentGroup {
 	if p.tok != token.COMMENT {
 		return nil
@@ -481,8 +626,9 @@ func (p *Parser) consume(tok token.Token) token.Pos {
 		)
 		return NoPos
 	}
+	pos := p.pos
 	p.next()
-	return p.pos
+	return pos
 }
 
 func (p *Parser) appendError(msg string, pos token.Pos, end token.Pos) {
@@ -7,6 +7,7 @@ type Precedence int
 const (
 	LOWEST Precedence = iota * 2
 	ASSIGN
+	SEND
 	EACH
 	IF
 	COMPARE
@@ -19,6 +20,8 @@ func GetPrecedence(tok token.Token) (Precedence, Precedence) {
 	switch tok {
 	case token.ASSIGN:
 		return ASSIGN, ASSIGN
+	case token.LEFT_ARROW:
+		return SEND, SEND
 	case token.EACH:
 		return EACH, EACH
 	case token.THEN:
@@ -2,157 +2,342 @@ package rv64
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/yjp20/turtle/straw/pkg/ir"
 )
 
-func Compile(program ir.Prog) []Instruction {
-	insts := codegen{}
+// Compile translates the program into rv64 assembly. For now, every
+// assignment lives in a slot of its procedure's stack frame, and each
+// instruction loads its operands into temporaries and stores its result back.
+//
+// Phis are resolved by having every predecessor store the incoming value into
+// a shadow slot of the phi, which the phi copies at the start of its block.
+// This way all phis of a block read their inputs before any of them is
+// written.
+//
+// Procedures are values that point to a closure record, which holds the
+// address of the code followed by the captured values. Records for
+// procedures without captures are static, others are allocated with
+// straw_alloc. The callee receives its record in t6.
+//
+// Arrays and slices point to a record that starts with their length, which
+// Len and the bounds checks read.
+//
+// Arguments and results are passed in a0 to a7. A call whose results are
+// extracted stores every result register into consecutive slots, so that
+// Extract can read them back.
+func Compile(program ir.Program) string {
+	c := codegen{}
+	fmt.Fprintf(&c.sb, ".text\n")
 	for _, procedure := range program.Procedures {
-		insts.compileProcedure(procedure)
+		c.compileProcedure(procedure)
 	}
-	return insts
+	fmt.Fprintf(&c.sb, ".data\n")
+	for _, procedure := range program.Procedures {
+		fmt.Fprintf(&c.sb, "%s_closure:\n", procLabel(procedure))
+		c.emit(".dword %s", procLabel(procedure))
+	}
+	return c.sb.String()
+}
+
+type codegen struct {
+	sb    strings.Builder
+	proc  *ir.Proc
+	frame frame
+	label int
 }
 
-type codegen []Instruction
+type frame struct {
+	slots   map[ir.Assignment]int
+	shadow  map[ir.Assignment]int
+	results map[ir.Assignment]int
+	size    int
+}
+
+func (c *codegen) emit(format string, args ...interface{}) {
+	fmt.Fprintf(&c.sb, "  "+format+"\n", args...)
+}
 
 func (c *codegen) compileProcedure(procedure *ir.Proc) {
-	for _, block := range procedure.Blocks {
-		c.compileBlock(block.Instructions)
+	c.proc = procedure
+	c.frame = frame{
+		slots:   map[ir.Assignment]int{},
+		shadow:  map[ir.Assignment]int{},
+		results: map[ir.Assignment]int{},
 	}
-}
 
-func (c *codegen) compileBlock(block []*ir.Inst) {
-	am := addressMap{addresses: make([]addressDescriptor, len(block))}
-	for i := 0; i < len(block); i++ {
-		am.addresses[block[i].Left].LastUsed = ir.Assignment(i + 1)
-		am.addresses[block[i].Right].LastUsed = ir.Assignment(i + 1)
+	extracted := map[ir.Assignment]bool{}
+	for _, block := range procedure.Blocks {
+		for _, inst := range block.Instructions {
+			if inst.Kind == ir.Extract {
+				extracted[inst.Args[0]] = true
+			}
+		}
 	}
 
-	for _, inst := range block {
-		switch inst.Kind {
-		case ir.ProcedureDefinition:
-			fmt.Fprintf(&sb, "%s:\n", inst.Literal.(string))
-		case ir.Pop:
-			am.addresses[inst.Index].MemoryAddress = 4 + stackAddress(inst.Literal.(int))
-		case ir.Add:
-			dest, r1, r2 := am.getReg(&sb, inst)
-			fmt.Fprintf(&sb, "  add %s, %s, %s\n", dest, r1, r2)
-		case ir.Mul:
-			dest, r1, r2 := am.getReg(&sb, inst)
-			fmt.Fprintf(&sb, "  mul %s, %s, %s\n", dest, r1, r2)
-		case ir.I64:
-			dest, _, _ := am.getReg(&sb, inst)
-			fmt.Fprintf(&sb, "  li %s, %d\n", dest, inst.Literal.(int64))
-		default:
-			fmt.Printf("NOT HANDLED IN COMPILE rv64: %s\n", inst.Kind)
+	// ra, s0 and the closure record take up the first three slots
+	offset := 24
+	for _, block := range procedure.Blocks {
+		for _, inst := range block.Instructions {
+			offset += 8
+			c.frame.slots[inst.Index] = -offset
+			if inst.Kind == ir.Phi {
+				offset += 8
+				c.frame.shadow[inst.Index] = -offset
+			}
+			if inst.Kind == ir.Call && extracted[inst.Index] {
+				offset += 8 * 8
+				c.frame.results[inst.Index] = -offset
+			}
 		}
 	}
-}
+	c.frame.size = (offset + 15) &^ 15
+
+	fmt.Fprintf(&c.sb, "%s:\n", procLabel(procedure))
+	c.emit("addi sp, sp, -%d", c.frame.size)
+	c.emit("sd ra, %d(sp)", c.frame.size-8)
+	c.emit("sd s0, %d(sp)", c.frame.size-16)
+	c.emit("addi s0, sp, %d", c.frame.size)
+	c.emit("sd t6, -24(s0)")
 
-func (c *codegen) getReg(am *addressMap, inst *ir.Inst) (dest registerAddress, r1 registerAddress, r2 registerAddress) {
-	for i := registerAddress(5); i < 32; i++ {
-		am.registers[i].Used = false
+	for _, block := range procedure.Blocks {
+		c.compileBlock(block)
 	}
 
-	// If left is already register allocated, then assign that value
-	if inst.Left != 0 {
-		for i := registerAddress(5); i < 32; i++ {
-			if am.registers[i].Assignment == inst.Left {
-				am.registers[i].Used = true
-				r1 = i
+	fmt.Fprintf(&c.sb, "%s_ret:\n", procLabel(procedure))
+	c.emit("ld ra, %d(sp)", c.frame.size-8)
+	c.emit("ld s0, %d(sp)", c.frame.size-16)
+	c.emit("addi sp, sp, %d", c.frame.size)
+	c.emit("ret")
+	fmt.Fprintf(&c.sb, "\n")
+}
+
+func (c *codegen) compileBlock(block *ir.Block) {
+	fmt.Fprintf(&c.sb, "%s:\n", c.blockLabel(block.Index))
+	for _, inst := range block.Instructions {
+		switch inst.Kind {
+		case ir.Phi:
+			c.emit("ld t0, %d(s0)", c.frame.shadow[inst.Index])
+			c.store("t0", inst.Index)
+
+		case ir.I64:
+			c.emit("li t0, %d", inst.Int)
+			c.store("t0", inst.Index)
+		case ir.Bool:
+			v := 0
+			if inst.Bool {
+				v = 1
+			}
+			c.emit("li t0, %d", v)
+			c.store("t0", inst.Index)
+		case ir.Default:
+			c.emit("li t0, 0")
+			c.store("t0", inst.Index)
+
+		case ir.Add, ir.Sub, ir.Mul, ir.Quo, ir.Mod, ir.And, ir.Or:
+			op := map[ir.InstKind]string{
+				ir.Add: "add", ir.Sub: "sub", ir.Mul: "mul", ir.Quo: "div",
+				ir.Mod: "rem", ir.And: "and", ir.Or: "or",
+			}[inst.Kind]
+			c.load("t0", inst.Args[0])
+			c.load("t1", inst.Args[1])
+			c.emit("%s t2, t0, t1", op)
+			c.store("t2", inst.Index)
+		case ir.Less:
+			c.load("t0", inst.Args[0])
+			c.load("t1", inst.Args[1])
+			c.emit("slt t2, t0, t1")
+			c.store("t2", inst.Index)
+		case ir.Greater:
+			c.load("t0", inst.Args[0])
+			c.load("t1", inst.Args[1])
+			c.emit("slt t2, t1, t0")
+			c.store("t2", inst.Index)
+		case ir.Equals, ir.NotEquals:
+			c.load("t0", inst.Args[0])
+			c.load("t1", inst.Args[1])
+			c.emit("sub t2, t0, t1")
+			if inst.Kind == ir.Equals {
+				c.emit("seqz t2, t2")
+			} else {
+				c.emit("snez t2, t2")
+			}
+			c.store("t2", inst.Index)
+		case ir.Not:
+			c.load("t0", inst.Args[0])
+			c.emit("seqz t0, t0")
+			c.store("t0", inst.Index)
+		case ir.Move:
+			c.load("t0", inst.Args[0])
+			c.store("t0", inst.Index)
+
+		case ir.ProcedureDefinition:
+			c.emit("la t0, %s_closure", procLabelIndex(inst.Proc))
+			c.store("t0", inst.Index)
+		case ir.MakeClosure:
+			c.emit("li a0, %d", 8*(len(inst.Args)+1))
+			c.emit("call straw_alloc")
+			c.emit("mv t1, a0")
+			c.emit("la t0, %s", procLabelIndex(inst.Proc))
+			c.emit("sd t0, 0(t1)")
+			for i, arg := range inst.Args {
+				c.load("t0", arg)
+				c.emit("sd t0, %d(t1)", 8*(i+1))
+			}
+			c.store("t1", inst.Index)
+		case ir.Capture:
+			c.emit("ld t0, -24(s0)")
+			c.emit("ld t0, %d(t0)", 8*(inst.Int+1))
+			c.store("t0", inst.Index)
+		case ir.Self:
+			c.emit("ld t0, -24(s0)")
+			c.store("t0", inst.Index)
+		case ir.Global:
+			// Globals are closure records provided by the runtime
+			c.emit("la t0, straw_global_%s", inst.Symbol)
+			c.store("t0", inst.Index)
+		case ir.Param:
+			if inst.Int >= 8 {
+				c.unsupported(inst, "more than 8 arguments")
 				break
 			}
-		}
-	}
-	// If right is already register allocated, then assign that value
-	if inst.Right != 0 {
-		for i := registerAddress(5); i < 32; i++ {
-			if am.registers[i].Assignment == inst.Right {
-				am.registers[i].Used = true
-				r2 = i
+			c.store(fmt.Sprintf("a%d", inst.Int), inst.Index)
+		case ir.Call:
+			args := inst.Args[1:]
+			if len(args) > 8 {
+				c.unsupported(inst, "more than 8 arguments")
 				break
 			}
-		}
-	}
+			for i, arg := range args {
+				c.load(fmt.Sprintf("a%d", i), arg)
+			}
+			c.load("t6", inst.Args[0])
+			c.emit("ld t0, 0(t6)")
+			c.emit("jalr t0")
+			c.store("a0", inst.Index)
+			if offset, ok := c.frame.results[inst.Index]; ok {
+				for i := 0; i < 8; i++ {
+					c.emit("sd a%d, %d(s0)", i, offset+8*i)
+				}
+			}
+		case ir.Extract:
+			offset, ok := c.frame.results[inst.Args[0]]
+			if !ok || inst.Int >= 8 {
+				c.unsupported(inst, "extracting from a tuple in memory")
+				break
+			}
+			c.emit("ld t0, %d(s0)", offset+8*int(inst.Int))
+			c.store("t0", inst.Index)
 
-	if inst.Left != 0 && r1 == 0 {
-		r1 = c.getBest(am, inst.Index)
-		fmt.Fprintf(sb, "  lw %s %d(sp)\n", r1, am.addresses[inst.Left].MemoryAddress)
-	}
-	if inst.Right != 0 && r2 == 0 {
-		r2 = c.getBest(am, inst.Index)
-		fmt.Fprintf(sb, "  lw %s %d(sp)\n", r2, am.addresses[inst.Right].MemoryAddress)
-	}
+		case ir.Len:
+			c.load("t0", inst.Args[0])
+			c.emit("ld t0, 0(t0)")
+			c.store("t0", inst.Index)
 
-	for i := registerAddress(5); i < 32; i++ {
-		am.registers[i].Used = false
-	}
+		case ir.Unwind:
+			// Runtime errors end the program, so there's nothing to unwind
 
-	dest = c.getBest(am, inst.Index)
+		case ir.BoundsCheck:
+			c.load("t0", inst.Args[0])
+			c.load("t1", inst.Args[1])
+			// Comparing unsigned also catches negative indices
+			c.emit("bgeu t0, t1, straw_bounds_fail")
+		case ir.BoundsCheckRange:
+			skip := c.newLabel()
+			c.load("t0", inst.Args[0])
+			c.load("t1", inst.Args[1])
+			c.emit("bge t0, t1, %s", skip)
+			c.emit("bltz t0, straw_bounds_fail")
+			// Args[2] is the value being indexed, rather than its length
+			c.load("t2", inst.Args[2])
+			c.emit("ld t2, 0(t2)")
+			c.emit("blt t2, t1, straw_bounds_fail")
+			fmt.Fprintf(&c.sb, "%s:\n", skip)
 
-	if inst.Left != 0 {
-		am.registers[r1].Assignment = inst.Left
-	}
-	if inst.Right != 0 {
-		am.registers[r2].Assignment = inst.Right
+		case ir.GotoIf:
+			skip := c.newLabel()
+			c.load("t0", inst.Args[0])
+			c.emit("beqz t0, %s", skip)
+			c.resolvePhis(block, inst.Block)
+			c.emit("j %s", c.blockLabel(inst.Block))
+			fmt.Fprintf(&c.sb, "%s:\n", skip)
+		case ir.Goto:
+			c.resolvePhis(block, inst.Block)
+			c.emit("j %s", c.blockLabel(inst.Block))
+			return
+		case ir.Ret, ir.End:
+			if len(inst.Args) > 8 {
+				c.unsupported(inst, "more than 8 results")
+			}
+			for i, arg := range inst.Args {
+				if i < 8 {
+					c.load(fmt.Sprintf("a%d", i), arg)
+				}
+			}
+			c.emit("j %s_ret", procLabel(c.proc))
+			return
+
+		default:
+			c.unsupported(inst, "not implemented")
+		}
 	}
 
-	am.registers[dest].Assignment = inst.Index
-	return dest, r1, r2
+	if block.Index+1 < len(c.proc.Blocks) {
+		c.resolvePhis(block, block.Index+1)
+	}
 }
 
-func (c *codegen) getBest(am *addressMap, current ir.Assignment) registerAddress {
-	best := 0x3FFFFFFF
-	idx := registerAddress(0)
-
-	for i := registerAddress(5); i < 10; i++ {
-		score := 0
-		if am.registers[i].Used {
-			score += 0xFFFFFF
-		}
-		if am.registers[i].Assignment != 0 && am.addresses[am.registers[i].Assignment].LastUsed > current {
-			score += 0xFFFF
+// resolvePhis stores the values that the phis of the target block take when
+// coming from block into their shadow slots.
+func (c *codegen) resolvePhis(block *ir.Block, target int) {
+	for _, inst := range c.proc.Blocks[target].Instructions {
+		if inst.Kind != ir.Phi {
+			continue
 		}
-		// fmt.Fprintf(sb, "! i:%d score:%d a:%d current:%d lu:%d\n", i, score, am.registers[i].Assignment, current, am.addresses[am.registers[i].Assignment].LastUsed)
-		if score < best {
-			idx = i
-			best = score
+		for _, phi := range inst.Phis {
+			if phi.BlockIndex == block.Index {
+				c.load("t0", phi.Assignment)
+				c.emit("sd t0, %d(s0)", c.frame.shadow[inst.Index])
+			}
 		}
 	}
-
-	// TODO: Handle if need spill
-	am.registers[idx].Used = true
-	return idx
 }
 
-func (c *codegen) spill(am *addressMap) {
+func (c *codegen) load(reg string, a ir.Assignment) {
+	if a == 0 {
+		c.emit("li %s, 0", reg)
+		return
+	}
+	offset, ok := c.frame.slots[a]
+	if !ok {
+		c.emit("li %s, 0 # unsupported: %s is defined in another procedure", reg, a)
+		return
+	}
+	c.emit("ld %s, %d(s0)", reg, offset)
+}
 
+func (c *codegen) store(reg string, a ir.Assignment) {
+	c.emit("sd %s, %d(s0)", reg, c.frame.slots[a])
 }
 
-func (c *codegen) Binary() {
-	for _, i := range *c {
-		i.Binary()
-	}
+func (c *codegen) unsupported(inst *ir.Inst, reason string) {
+	c.emit("# unsupported (%s): %s", reason, strings.TrimSpace(inst.String()))
 }
 
-type addressMap struct {
-	addresses  []addressDescriptor
-	registers  [32]registerDescriptor
-	stackUsage int
+func (c *codegen) newLabel() string {
+	c.label++
+	return fmt.Sprintf(".L%d", c.label)
 }
 
-type addressDescriptor struct {
-	LastUsed        ir.Assignment
-	Assignment      ir.Assignment
-	RegisterAddress registerAddress
-	MemoryAddress   stackAddress
+func (c *codegen) blockLabel(block int) string {
+	return fmt.Sprintf(".L%s_%d", procLabel(c.proc), block)
 }
 
-type registerDescriptor struct {
-	Used       bool
-	Assignment ir.Assignment
+func procLabel(proc *ir.Proc) string {
+	return procLabelIndex(proc.Index)
 }
 
-type registerAddress int
-type stackAddress int
+func procLabelIndex(index int) string {
+	return fmt.Sprintf("straw_proc_%d", index)
+}
@@ -0,0 +1,454 @@
+// Package debugger pauses straw programs at breakpoints and steps through
+// them. A Debugger is a vm.Tracer: it is told about every instruction the
+// program runs, and whenever it stops it reads commands, either typed by a
+// person or sent as JSON by an editor.
+package debugger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/yjp20/turtle/straw"
+	"github.com/yjp20/turtle/straw/pkg/token"
+	"github.com/yjp20/turtle/straw/pkg/vm"
+)
+
+type mode int
+
+const (
+	modeContinue mode = iota
+	modeStep
+	modeNext
+	modeFinish
+)
+
+type Debugger struct {
+	vm.NopTracer
+	ui frontend
+
+	breakpoints []*Breakpoint
+	watches     []*Watch
+	ids         int
+
+	// mode is how the program was resumed, and depth the depth it was at
+	// then, which next and finish compare against
+	mode  mode
+	depth int
+
+	// lines holds where each frame was last seen, so that the debugger only
+	// stops when a frame gets to a new line
+	lines []line
+
+	// entered is the procedure that was just called, until its first line
+	// is reached, and returned the value of the call that finish is waiting
+	// for
+	entered  string
+	returned vm.Object
+	finished bool
+
+	// level is the frame that inspection commands look at, counted out from
+	// the innermost one
+	level int
+
+	cancel context.CancelFunc
+	quit   bool
+}
+
+type line struct {
+	fn   *vm.Func
+	line int
+	pc   int
+}
+
+// Breakpoint stops the program when it reaches Line of File, or when Proc
+// is called.
+type Breakpoint struct {
+	ID   int    `json:"id"`
+	File string `json:"file,omitempty"`
+	Line int    `json:"line,omitempty"`
+	Proc string `json:"proc,omitempty"`
+}
+
+// Watch is an expression that is evaluated every time the program stops.
+type Watch struct {
+	ID   int    `json:"id"`
+	Expr string `json:"expr"`
+}
+
+// New creates a debugger that reads commands from in and writes to out. With
+// json set, it speaks the JSON protocol instead of text.
+func New(in io.Reader, out io.Writer, json bool) *Debugger {
+	d := &Debugger{}
+	if json {
+		d.ui = newJSONFrontend(in, out)
+	} else {
+		d.ui = newTextFrontend(in, out)
+	}
+	return d
+}
+
+// Run debugs the program at path. Commands are read before it starts, until
+// one of them runs it.
+func (d *Debugger) Run(ctx context.Context, options straw.Options, path string) error {
+	ctx, d.cancel = context.WithCancel(ctx)
+	defer d.cancel()
+
+	options.Tracer = d
+	if options.Stdout == nil {
+		options.Stdout = d.ui.output()
+	}
+	in := straw.New(options)
+
+	if !d.prompt(nil) {
+		return nil
+	}
+	result, err := in.EvalFileContext(ctx, path)
+	if d.quit {
+		return nil
+	}
+	exited := &Exited{}
+	if err != nil {
+		exited.Error = err.Error()
+		if err, ok := err.(*straw.Error); ok {
+			exited.Error = strings.TrimSuffix(err.Print(), "\n")
+		}
+	} else {
+		exited.Result = result.String()
+	}
+	d.ui.event("exited", exited)
+	return err
+}
+
+func (d *Debugger) OnInstruction(x *vm.Execution, op *vm.Op, result vm.Object) {
+	d.check(x)
+}
+
+func (d *Debugger) OnCall(x *vm.Execution, fn vm.Object, args []vm.Object) {
+	if procedure, ok := fn.(*vm.Procedure); ok {
+		d.entered = procedure.Name
+		d.check(x)
+	}
+}
+
+func (d *Debugger) OnReturn(x *vm.Execution, result vm.Object) {
+	if d.mode == modeFinish && x.Depth() == d.depth {
+		d.returned, d.finished = result, true
+	}
+}
+
+func (d *Debugger) OnError(x *vm.Execution, err *vm.RuntimeError) {
+	if d.quit {
+		return
+	}
+	d.stop(x, &Stopped{Reason: "error", Error: err.Error()})
+}
+
+// check stops the program if it is about to start a line that it should stop
+// at.
+func (d *Debugger) check(x *vm.Execution) {
+	if d.quit {
+		return
+	}
+	if d.finished {
+		d.stop(x, &Stopped{Reason: "finish", Value: show(d.returned)})
+		return
+	}
+	next := x.Next()
+	if !positioned(next) || x.File() == nil {
+		return
+	}
+	pos := x.File().Position(next.Inst.Pos)
+	if !d.newLine(x, pos.Line) {
+		return
+	}
+
+	stopped := &Stopped{}
+	switch {
+	case d.breakpoint(pos) != nil:
+		stopped.Reason = "breakpoint"
+		stopped.Breakpoint = d.breakpoint(pos).ID
+	case d.mode == modeStep:
+		stopped.Reason = "step"
+	case d.mode == modeNext && x.Depth() <= d.depth:
+		stopped.Reason = "step"
+	}
+	d.entered = ""
+	if stopped.Reason != "" {
+		d.stop(x, stopped)
+	}
+}
+
+// newLine reports whether the innermost frame is at a different line than it
+// was last time, or went back to the start of a loop.
+func (d *Debugger) newLine(x *vm.Execution, n int) bool {
+	depth := x.Depth()
+	if len(d.lines) > depth {
+		d.lines = d.lines[:depth]
+	}
+	for len(d.lines) < depth {
+		d.lines = append(d.lines, line{})
+	}
+	pc := x.PC()
+	last := &d.lines[depth-1]
+	changed := last.fn != x.Func() || last.line != n || pc < last.pc
+	*last = line{fn: x.Func(), line: n, pc: pc}
+	return changed
+}
+
+func (d *Debugger) breakpoint(pos token.Position) *Breakpoint {
+	for _, bp := range d.breakpoints {
+		if bp.Proc != "" {
+			if bp.Proc == d.entered {
+				return bp
+			}
+			continue
+		}
+		if bp.Line == pos.Line && matchFile(bp.File, pos.Filename) {
+			return bp
+		}
+	}
+	return nil
+}
+
+// positioned reports whether op comes from a piece of source, rather than
+// being added by the compiler.
+func positioned(op *vm.Op) bool {
+	return op != nil && op.Inst != nil && op.Inst.Pos < op.Inst.End
+}
+
+func matchFile(pattern, name string) bool {
+	return pattern == "" || pattern == name || strings.HasSuffix(name, "/"+pattern)
+}
+
+// stop reports where the program stopped and reads commands until one of
+// them resumes it.
+func (d *Debugger) stop(x *vm.Execution, stopped *Stopped) {
+	d.level = 0
+	d.finished, d.returned = false, nil
+	stopped.Location = d.location(x, 0)
+	for _, watch := range d.watches {
+		stopped.Watches = append(stopped.Watches, d.watch(x, watch))
+	}
+	d.ui.event("stopped", stopped)
+	d.prompt(x)
+}
+
+// prompt answers commands until one resumes the program, and returns false
+// if the user quit instead. x is nil before the program starts.
+func (d *Debugger) prompt(x *vm.Execution) bool {
+	for {
+		command, args, ok := d.ui.read()
+		if !ok {
+			d.quit = true
+			d.cancel()
+			return false
+		}
+		body, resume, err := d.execute(x, command, args)
+		d.ui.respond(command, body, err)
+		if d.quit {
+			d.cancel()
+			return false
+		}
+		if resume {
+			if x != nil {
+				d.depth = x.Depth()
+			}
+			return true
+		}
+	}
+}
+
+var errNotRunning = fmt.Errorf("the program isn't running")
+
+// execute runs a command, returning what it answers with and whether it
+// resumes the program.
+func (d *Debugger) execute(x *vm.Execution, command string, args []string) (interface{}, bool, error) {
+	arg := strings.Join(args, " ")
+	switch command {
+	case "run", "r", "continue", "c":
+		d.mode = modeContinue
+		return nil, true, nil
+	case "step", "s":
+		d.mode = modeStep
+		return nil, true, nil
+	case "next", "n":
+		d.mode = modeNext
+		return nil, true, nil
+	case "finish", "f":
+		if x == nil {
+			return nil, false, errNotRunning
+		}
+		d.mode = modeFinish
+		return nil, true, nil
+	case "quit", "q":
+		d.quit = true
+		return nil, false, nil
+
+	case "break", "b":
+		bp, err := parseBreakpoint(arg)
+		if err != nil {
+			return nil, false, err
+		}
+		d.ids++
+		bp.ID = d.ids
+		d.breakpoints = append(d.breakpoints, bp)
+		return bp, false, nil
+	case "breakpoints":
+		return d.breakpoints, false, nil
+	case "delete", "d":
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, false, fmt.Errorf("expected the id of a breakpoint, got %q", arg)
+		}
+		for i, bp := range d.breakpoints {
+			if bp.ID == id {
+				d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+				return nil, false, nil
+			}
+		}
+		return nil, false, fmt.Errorf("no breakpoint %d", id)
+
+	case "watch", "w":
+		if arg == "" {
+			return nil, false, fmt.Errorf("expected an expression to watch")
+		}
+		d.ids++
+		watch := &Watch{ID: d.ids, Expr: arg}
+		d.watches = append(d.watches, watch)
+		if x != nil {
+			return d.watch(x, watch), false, nil
+		}
+		return watch, false, nil
+	case "unwatch":
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, false, fmt.Errorf("expected the id of a watch, got %q", arg)
+		}
+		for i, watch := range d.watches {
+			if watch.ID == id {
+				d.watches = append(d.watches[:i], d.watches[i+1:]...)
+				return nil, false, nil
+			}
+		}
+		return nil, false, fmt.Errorf("no watch %d", id)
+	}
+
+	if x == nil {
+		return nil, false, fmt.Errorf("unknown command %q, or %s", command, errNotRunning)
+	}
+	switch command {
+	case "backtrace", "bt":
+		frames := make([]*Location, x.Depth())
+		for i := range frames {
+			frames[i] = d.location(x, i)
+		}
+		return frames, false, nil
+	case "frame":
+		level, err := strconv.Atoi(arg)
+		if err != nil || level < 0 || level >= x.Depth() {
+			return nil, false, fmt.Errorf("expected a frame between 0 and %d", x.Depth()-1)
+		}
+		d.level = level
+		return d.location(x, level), false, nil
+	case "locals", "l":
+		return variables(x.Locals(d.level)), false, nil
+	case "registers", "regs":
+		return variables(x.Registers(d.level)), false, nil
+	case "globals":
+		return variables(x.Machine().Globals.Variables()), false, nil
+	case "print", "p":
+		obj, err := d.eval(x, arg)
+		if err != nil {
+			return nil, false, err
+		}
+		return &Value{Expr: arg, Value: show(obj)}, false, nil
+	}
+	return nil, false, fmt.Errorf("unknown command %q", command)
+}
+
+// parseBreakpoint parses file:line, a line of the program being debugged,
+// or the name of a procedure.
+func parseBreakpoint(arg string) (*Breakpoint, error) {
+	if arg == "" {
+		return nil, fmt.Errorf("expected file:line, a line or a procedure")
+	}
+	file := ""
+	if i := strings.LastIndexByte(arg, ':'); i >= 0 {
+		file, arg = arg[:i], arg[i+1:]
+	}
+	if n, err := strconv.Atoi(arg); err == nil {
+		return &Breakpoint{File: file, Line: n}, nil
+	}
+	if file != "" {
+		return nil, fmt.Errorf("expected a line after %s:", file)
+	}
+	return &Breakpoint{Proc: arg}, nil
+}
+
+// eval evaluates src in the selected frame, with its locals in scope.
+func (d *Debugger) eval(x *vm.Execution, src string) (vm.Object, error) {
+	code, _, err := straw.Compile("<expr>", []byte(src))
+	if err != nil {
+		return nil, err
+	}
+	parent := x.Machine()
+	m := vm.NewMachine()
+	m.Builtins = parent.Builtins
+	m.Stdout = parent.Stdout
+	m.Limits = vm.Limits{MaxInstructions: 1000000}
+	m.Globals = vm.NewFrame(parent.Globals)
+	for _, local := range x.Locals(d.level) {
+		m.Globals.SetVar(local.Name, local.Value)
+	}
+	return m.Eval(context.Background(), code)
+}
+
+func (d *Debugger) watch(x *vm.Execution, watch *Watch) *Value {
+	value := &Value{ID: watch.ID, Expr: watch.Expr}
+	if obj, err := d.eval(x, watch.Expr); err != nil {
+		value.Error = err.Error()
+	} else {
+		value.Value = show(obj)
+	}
+	return value
+}
+
+// location describes where the frame level calls out from the innermost one
+// is.
+func (d *Debugger) location(x *vm.Execution, level int) *Location {
+	frame := x.Backtrace()[level]
+	loc := &Location{Func: frame.Name}
+	if file := x.File(); file != nil {
+		pos := file.Position(frame.Pos)
+		if level == 0 {
+			if next := x.Next(); positioned(next) {
+				pos = file.Position(next.Inst.Pos)
+			}
+		}
+		loc.File, loc.Line, loc.Column = pos.Filename, pos.Line, pos.Column
+		if pos.IsValid() {
+			start := file.StartOfLine(pos.Line - 1)
+			end := file.StartOfLine(pos.Line)
+			loc.Source = strings.TrimRight(string(file.Source[start:end]), "\n")
+		}
+	}
+	return loc
+}
+
+func variables(vars []vm.Variable) []Variable {
+	out := make([]Variable, len(vars))
+	for i, v := range vars {
+		out[i] = Variable{Name: v.Name, Value: show(v.Value)}
+	}
+	return out
+}
+
+func show(obj vm.Object) string {
+	if obj == nil {
+		return vm.NULL.String()
+	}
+	return obj.String()
+}
@@ -0,0 +1,61 @@
+package debugger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/yjp20/turtle/straw"
+)
+
+func TestSession(t *testing.T) {
+	in := strings.Join([]string{
+		`{"seq": 1, "command": "break", "args": ["fibo"]}`,
+		`{"seq": 2, "command": "run"}`,
+		`{"seq": 3, "command": "watch", "args": ["n + 1"]}`,
+		`{"seq": 4, "command": "next"}`,
+		`{"seq": 5, "command": "next"}`,
+		`{"seq": 6, "command": "locals"}`,
+		`{"seq": 7, "command": "backtrace"}`,
+		`{"seq": 8, "command": "finish"}`,
+		`{"seq": 9, "command": "continue"}`,
+	}, "\n")
+	out := bytes.Buffer{}
+	d := New(strings.NewReader(in), &out, true)
+	if err := d.Run(context.Background(), straw.Options{}, "../../examples/fibo_iteration.st"); err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []message
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		msg := message{}
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			t.Fatalf("invalid message %s: %s", line, err)
+		}
+		if msg.Success != nil && !*msg.Success {
+			t.Errorf("request %d failed: %s", msg.Seq, msg.Message)
+		}
+		messages = append(messages, msg)
+	}
+
+	expect := []string{
+		`"reason":"breakpoint","breakpoint":1,"func":"fibo","file":"../../examples/fibo_iteration.st","line":2`,
+		`"expr":"n + 1","value":"<i64 21>"`,
+		`"reason":"step","func":"fibo","file":"../../examples/fibo_iteration.st","line":3`,
+		`"reason":"step","func":"fibo","file":"../../examples/fibo_iteration.st","line":4`,
+		`{"name":"a","value":"<i64 0>"}`,
+		`{"name":"n","value":"<i64 20>"}`,
+		`{"func":"_init","file":"../../examples/fibo_iteration.st","line":12`,
+		`"reason":"finish","func":"_init"`,
+		`"value":"<i64 6765>"`,
+		`"event":"exited","body":{"result":"<i64 6765>"}`,
+	}
+	got := out.String()
+	for _, s := range expect {
+		if !strings.Contains(got, s) {
+			t.Errorf("expected %s in the session:\n%s", s, got)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package debugger
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The bodies of responses and events. With the JSON protocol they're sent as
+// they are, and the text frontend prints them for people.
+type (
+	Location struct {
+		Func   string `json:"func"`
+		File   string `json:"file,omitempty"`
+		Line   int    `json:"line,omitempty"`
+		Column int    `json:"column,omitempty"`
+		Source string `json:"source,omitempty"`
+	}
+
+	Stopped struct {
+		Reason     string `json:"reason"`
+		Breakpoint int    `json:"breakpoint,omitempty"`
+		*Location
+		Watches []*Value `json:"watches,omitempty"`
+
+		// Value is what the call returned, when finish stops, and Error the
+		// error that stopped the program
+		Value string `json:"value,omitempty"`
+		Error string `json:"error,omitempty"`
+	}
+
+	Value struct {
+		ID    int    `json:"id,omitempty"`
+		Expr  string `json:"expr"`
+		Value string `json:"value,omitempty"`
+		Error string `json:"error,omitempty"`
+	}
+
+	Variable struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+
+	Exited struct {
+		Result string `json:"result,omitempty"`
+		Error  string `json:"error,omitempty"`
+	}
+
+	Output struct {
+		Text string `json:"text"`
+	}
+)
+
+type frontend interface {
+	// read returns the next command, or false once there are none
+	read() (command string, args []string, ok bool)
+	respond(command string, body interface{}, err error)
+	event(name string, body interface{})
+
+	// output is where the program prints
+	output() io.Writer
+}
+
+// textFrontend reads commands a line at a time, like "break fibo".
+type textFrontend struct {
+	in  *bufio.Scanner
+	out io.Writer
+}
+
+func newTextFrontend(in io.Reader, out io.Writer) *textFrontend {
+	return &textFrontend{in: bufio.NewScanner(in), out: out}
+}
+
+func (t *textFrontend) read() (string, []string, bool) {
+	for {
+		fmt.Fprint(t.out, "(straw) ")
+		if !t.in.Scan() {
+			fmt.Fprintln(t.out)
+			return "", nil, false
+		}
+		fields := strings.Fields(t.in.Text())
+		if len(fields) != 0 {
+			return fields[0], fields[1:], true
+		}
+	}
+}
+
+func (t *textFrontend) respond(command string, body interface{}, err error) {
+	if err != nil {
+		fmt.Fprintf(t.out, "error: %s\n", err)
+		return
+	}
+	switch body := body.(type) {
+	case *Breakpoint:
+		fmt.Fprintf(t.out, "breakpoint %d at %s\n", body.ID, body)
+	case []*Breakpoint:
+		for _, bp := range body {
+			fmt.Fprintf(t.out, "%d\t%s\n", bp.ID, bp)
+		}
+	case *Watch:
+		fmt.Fprintf(t.out, "watch %d: %s\n", body.ID, body.Expr)
+	case *Value:
+		t.value(body)
+	case *Location:
+		fmt.Fprintln(t.out, body)
+	case []*Location:
+		for i, loc := range body {
+			fmt.Fprintf(t.out, "#%d %s\n", i, loc)
+		}
+	case []Variable:
+		for _, v := range body {
+			fmt.Fprintf(t.out, "%s = %s\n", v.Name, v.Value)
+		}
+	}
+}
+
+func (t *textFrontend) value(v *Value) {
+	prefix := ""
+	if v.ID != 0 {
+		prefix = fmt.Sprintf("watch %d: ", v.ID)
+	}
+	if v.Error != "" {
+		fmt.Fprintf(t.out, "%s%s: %s\n", prefix, v.Expr, v.Error)
+	} else {
+		fmt.Fprintf(t.out, "%s%s = %s\n", prefix, v.Expr, v.Value)
+	}
+}
+
+func (t *textFrontend) event(name string, body interface{}) {
+	switch body := body.(type) {
+	case *Stopped:
+		reason := body.Reason
+		if body.Breakpoint != 0 {
+			reason = fmt.Sprintf("breakpoint %d", body.Breakpoint)
+		}
+		fmt.Fprintf(t.out, "stopped (%s) in %s\n", reason, body.Location)
+		if body.Error != "" {
+			fmt.Fprintln(t.out, body.Error)
+		}
+		if body.Value != "" {
+			fmt.Fprintf(t.out, "returned %s\n", body.Value)
+		}
+		if body.Source != "" {
+			fmt.Fprintf(t.out, "%4d | %s\n", body.Line, body.Source)
+		}
+		for _, watch := range body.Watches {
+			t.value(watch)
+		}
+	case *Exited:
+		if body.Error != "" {
+			fmt.Fprintln(t.out, body.Error)
+		} else {
+			fmt.Fprintf(t.out, "exited with %s\n", body.Result)
+		}
+	}
+}
+
+func (t *textFrontend) output() io.Writer {
+	return t.out
+}
+
+func (bp *Breakpoint) String() string {
+	if bp.Proc != "" {
+		return bp.Proc
+	}
+	if bp.File != "" {
+		return fmt.Sprintf("%s:%d", bp.File, bp.Line)
+	}
+	return fmt.Sprintf("line %d", bp.Line)
+}
+
+func (loc *Location) String() string {
+	if loc.Line == 0 {
+		return loc.Func
+	}
+	file := loc.File
+	if file == "" {
+		file = "<input>"
+	}
+	return fmt.Sprintf("%s at %s:%d:%d", loc.Func, file, loc.Line, loc.Column)
+}
+
+// jsonFrontend speaks the JSON protocol. Every line of input is a request
+// like {"seq": 1, "command": "break", "args": ["fibo"]}, and every line of
+// output either a response to one, or an event like the program stopping:
+//
+//	{"type": "response", "seq": 1, "command": "break", "success": true, "body": {"id": 1, "proc": "fibo"}}
+//	{"type": "event", "event": "stopped", "body": {"reason": "breakpoint", ...}}
+type jsonFrontend struct {
+	in  *bufio.Scanner
+	enc *json.Encoder
+	seq int
+}
+
+type request struct {
+	Seq     int      `json:"seq"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+type message struct {
+	Type    string      `json:"type"`
+	Seq     int         `json:"seq,omitempty"`
+	Command string      `json:"command,omitempty"`
+	Event   string      `json:"event,omitempty"`
+	Success *bool       `json:"success,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Body    interface{} `json:"body,omitempty"`
+}
+
+func newJSONFrontend(in io.Reader, out io.Writer) *jsonFrontend {
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	return &jsonFrontend{in: bufio.NewScanner(in), enc: enc}
+}
+
+func (j *jsonFrontend) read() (string, []string, bool) {
+	for j.in.Scan() {
+		if strings.TrimSpace(j.in.Text()) == "" {
+			continue
+		}
+		req := request{}
+		if err := json.Unmarshal(j.in.Bytes(), &req); err != nil {
+			j.respond("", nil, fmt.Errorf("invalid request: %s", err))
+			continue
+		}
+		j.seq = req.Seq
+		return req.Command, req.Args, true
+	}
+	return "", nil, false
+}
+
+func (j *jsonFrontend) respond(command string, body interface{}, err error) {
+	success := err == nil
+	msg := message{Type: "response", Seq: j.seq, Command: command, Success: &success, Body: body}
+	if err != nil {
+		msg.Message = err.Error()
+	}
+	j.enc.Encode(msg)
+}
+
+func (j *jsonFrontend) event(name string, body interface{}) {
+	j.enc.Encode(message{Type: "event", Event: name, Body: body})
+}
+
+func (j *jsonFrontend) output() io.Writer {
+	return outputWriter{j}
+}
+
+// outputWriter sends what the program prints as output events.
+type outputWriter struct {
+	j *jsonFrontend
+}
+
+func (w outputWriter) Write(p []byte) (int, error) {
+	w.j.event("output", &Output{Text: string(p)})
+	return len(p), nil
+}
@@ -0,0 +1,83 @@
+package ir
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteDot writes the control flow graphs of the program in the Graphviz DOT
+// language, with a cluster for every procedure. Solid edges are control flow,
+// and dashed edges show which value a phi takes when coming from a block.
+func (p Program) WriteDot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph program {\n")
+	fmt.Fprintf(bw, "\tnode [shape=box fontname=monospace fontsize=10];\n")
+	fmt.Fprintf(bw, "\tedge [fontname=monospace fontsize=9];\n")
+	for _, proc := range p.Procedures {
+		proc.writeDot(bw)
+	}
+	fmt.Fprintf(bw, "}\n")
+	return bw.Flush()
+}
+
+// WriteDot writes the control flow graph of a single procedure as its own
+// DOT graph.
+func (p Proc) WriteDot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph %s {\n", dotQuote(p.Name))
+	fmt.Fprintf(bw, "\tnode [shape=box fontname=monospace fontsize=10];\n")
+	fmt.Fprintf(bw, "\tedge [fontname=monospace fontsize=9];\n")
+	p.writeDot(bw)
+	fmt.Fprintf(bw, "}\n")
+	return bw.Flush()
+}
+
+func (p Proc) writeDot(w io.Writer) {
+	fmt.Fprintf(w, "\tsubgraph cluster_%d {\n", p.Index)
+	fmt.Fprintf(w, "\t\tlabel=%s;\n", dotQuote(fmt.Sprintf("[%s()] %d", p.Name, p.Index)))
+	for _, block := range p.Blocks {
+		label := strings.Builder{}
+		label.WriteString(fmt.Sprintf("%s %d\n", block.Name, block.Index))
+		for _, inst := range block.Instructions {
+			label.WriteString(inst.String())
+			label.WriteRune('\n')
+		}
+		fmt.Fprintf(w, "\t\t%s [label=%s];\n", p.dotNode(block.Index), dotLabel(label.String()))
+	}
+	for _, block := range p.Blocks {
+		for _, succ := range p.Successors(block) {
+			fmt.Fprintf(w, "\t\t%s -> %s;\n", p.dotNode(block.Index), p.dotNode(succ))
+		}
+	}
+	for _, block := range p.Blocks {
+		for _, inst := range block.Instructions {
+			if inst.Kind != Phi {
+				continue
+			}
+			for _, phi := range inst.Phis {
+				fmt.Fprintf(w, "\t\t%s -> %s [style=dashed color=gray40 label=%s];\n",
+					p.dotNode(phi.BlockIndex), p.dotNode(block.Index),
+					dotQuote(fmt.Sprintf("%s←%s", inst.Index, phi.Assignment)))
+			}
+		}
+	}
+	fmt.Fprintf(w, "\t}\n")
+}
+
+func (p Proc) dotNode(block int) string {
+	return fmt.Sprintf("p%d_b%d", p.Index, block)
+}
+
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// dotLabel quotes a multiline label, left justifying each line.
+func dotLabel(s string) string {
+	q := dotQuote(s)
+	return strings.ReplaceAll(q, "\n", `\l`)
+}
@@ -5,75 +5,112 @@ package ir
 import (
 	"fmt"
 	"strings"
+
+	"github.com/yjp20/turtle/straw/pkg/token"
 )
 
 type Inst struct {
 	Kind InstKind
 
+	// Pos and End are the range of the source that the instruction was
+	// generated from
+	Pos token.Pos
+	End token.Pos
+
 	Type   Type
 	Symbol string
 	Index  Assignment
-	Left   Assignment
-	Right  Assignment
-
-	Static  bool
-	Literal interface{}
+	Static bool
+
+	// Args are the values the instruction reads, in order. For Call, the
+	// first argument is the procedure being called.
+	Args []Assignment
+
+	// Names labels Args for ConstructTuple and MakeType, and the arguments of a Call that
+	// are passed by name, with the rest left empty. For Select, they're
+	// "recv" or "send" for the channel of each case, and "value" for what a
+	// send sends, after its channel
+	Names []string
+
+	// The remaining operands are only used by some kinds of instruction
+	Int   int64        // I8 to I64 and Rune, and the index for Param, Passed, Extract and Capture
+	Float float64      // F32 and F64
+	Text  string       // String
+	Bool  bool         // Bool, whether a Select has a default case, and whether a Param has one
+	Block int          // target of Goto and GotoIf
+	Proc  int          // ProcedureDefinition and MakeClosure
+	Phis  []PhiLiteral // Phi
 }
 
 func (i *Inst) String() string {
+	args := make([]string, 0, len(i.Args)+1)
+	for idx, a := range i.Args {
+		if i.Names != nil && i.Names[idx] != "" {
+			args = append(args, fmt.Sprintf("%s:%s", i.Names[idx], a))
+		} else {
+			args = append(args, a.String())
+		}
+	}
+
 	switch i.Kind {
-	case Add, Sub, Mul, Quo,
-		Equals, NotEquals, Less, Move,
-		And, Or:
-		return fmt.Sprintf("%4s = %s(%s, %s)", i.Index, i.Kind, i.Left, i.Right)
+	case Bool:
+		return fmt.Sprintf("%4s = Bool(%t)", i.Index, i.Bool)
 
-	case Not, Push, Ret, End:
-		return fmt.Sprintf("%4s = %s(%s)", i.Index, i.Kind, i.Left)
+	case I8, I16, I32, I64:
+		return fmt.Sprintf("%4s = Int(%d)", i.Index, i.Int)
 
-	case Pop:
-		return fmt.Sprintf("%4s = %s()", i.Index, i.Kind)
+	case F32, F64:
+		return fmt.Sprintf("%4s = Float(%g)", i.Index, i.Float)
 
-	case LoadEnv:
-		return fmt.Sprintf("%4s = %s(%s)", i.Index, i.Kind, i.Literal.(Assignment))
+	case String:
+		return fmt.Sprintf("%4s = String(%q)", i.Index, i.Text)
 
-	case Env:
-		return fmt.Sprintf("%4s = %s(\"%s\")", i.Index, i.Kind, i.Literal)
+	case Rune:
+		return fmt.Sprintf("%4s = Rune(%q)", i.Index, rune(i.Int))
 
-	case Bool:
-		return fmt.Sprintf("%4s = Bool(%t)", i.Index, i.Literal.(bool))
+	case Member, Export:
+		args = append(args, i.Symbol)
 
-	case I64:
-		return fmt.Sprintf("%4s = Int(%d)", i.Index, i.Literal.(int64))
+	case Convert:
+		args = append(args, strings.ToLower(i.Type.Kind.String()))
 
-	case ProcedureType:
-		return fmt.Sprintf("%4s = ProcedureType(params: %s, args: %s, return: %s)", i.Index, i.Left, i.Right, i.Literal.(Assignment))
+	case Param:
+		return fmt.Sprintf("%4s = Param(%d)", i.Index, i.Int)
+
+	case Capture:
+		return fmt.Sprintf("%4s = Capture(%d)", i.Index, i.Int)
+
+	case Global:
+		return fmt.Sprintf("%4s = Global(%s)", i.Index, i.Symbol)
+
+	case Extract:
+		return fmt.Sprintf("%4s = Extract(%s, %d)", i.Index, i.Args[0], i.Int)
 
 	case ProcedureDefinition:
-		return fmt.Sprintf("%4s = ProcedureDefinition(func: %d)", i.Index, i.Literal.(int))
+		return fmt.Sprintf("%4s = ProcedureDefinition(func: %d)", i.Index, i.Proc)
 
-	case Call:
-		sb := strings.Builder{}
-		sb.WriteString(fmt.Sprintf("%4s = Call(%s)", i.Index, i.Left))
-		return sb.String()
+	case MakeClosure:
+		args = append([]string{fmt.Sprintf("func: %d", i.Proc)}, args...)
 
 	case Phi:
 		sb := strings.Builder{}
-		sb.WriteString(fmt.Sprintf("%4s = Phi(%s", i.Index, i.Symbol))
-		for _, phi := range i.Literal.([]PhiLiteral) {
-			sb.WriteString(fmt.Sprintf(", %d:%s", phi.BlockIndex, phi.Assignment))
+		sb.WriteString(fmt.Sprintf("%4s = Phi(", i.Index))
+		sep := ""
+		if i.Symbol != "" {
+			sb.WriteString(i.Symbol)
+			sep = ", "
+		}
+		for _, phi := range i.Phis {
+			sb.WriteString(fmt.Sprintf("%s%d:%s", sep, phi.BlockIndex, phi.Assignment))
+			sep = ", "
 		}
 		sb.WriteString(")")
 		return sb.String()
 
-	case GotoIf:
-		return fmt.Sprintf("%4s = %s(%s, block:%d)", i.Index, i.Kind, i.Left, i.Literal)
-
-	case Goto:
-		return fmt.Sprintf("%4s = %s(block:%d)", i.Index, i.Kind, i.Literal)
-
-	default:
-		return fmt.Sprintf("WTF %s", i.Kind)
+	case GotoIf, Goto:
+		args = append(args, fmt.Sprintf("block:%d", i.Block))
 	}
+	return fmt.Sprintf("%4s = %s(%s)", i.Index, i.Kind, strings.Join(args, ", "))
 }
 
 type InstKind int8
@@ -96,6 +133,7 @@ const (
 	Or
 
 	Not
+	Convert // Args[0] converted to the kind of Type
 
 	// Literals
 	Default
@@ -106,22 +144,60 @@ const (
 	I64
 	F32
 	F64
+	String
+	Rune
 	ProcedureType
 	ProcedureDefinition
 	ConstructTuple
 
 	// Extra
-	LoadEnv
-	Env
 	Phi
-	Ret
+	Ret // returns every argument, which the caller sees as a tuple if there are several
 	End
 
 	GotoIf
 	Goto
 	Call
-	Push
-	Pop
+	Param   // the Int-th argument of the procedure, named Symbol
+	Passed  // whether the Int-th argument was passed, rather than left to its default
+	Extract // the Int-th field of a tuple
+	Unwind  // calls Args[0] if a runtime error unwinds the procedure, or nothing without Args
+
+	// Closures
+	MakeClosure // a procedure along with the values it captures, in Args
+	Capture     // the Int-th value captured by the running closure
+	Self        // the running closure, so that named procedures can recurse
+	Global      // the value named Symbol, provided by whoever runs the program
+	Export      // makes Args[0] visible as the global named Symbol
+	Member      // the member named Symbol of a module or tuple
+
+	// Types
+	MakeType // a struct or interface type named Symbol, of the kind in Int, with fields named by Names of the types in Args
+
+	// Arrays, slices and maps
+	Construct    // a value of the type Args[0], made from the rest of Args
+	ConstructMap // a map of the type Args[0], from keys and values alternating in the rest of Args
+	Len          // the length of Args[0], or null for maps, whose indices are keys
+	Index        // the Args[1]-th element of Args[0], or its value for the key Args[1]
+	SetIndex     // sets the Args[1]-th element, or key, of Args[0] to Args[2]
+	Slice        // the elements [Args[1], Args[2]) of Args[0], sharing them
+
+	// Iteration
+	Iterate // an iterator over Args[0]
+	Next    // advances the iterator Args[0], and is whether it had another value
+	Current // the value the iterator Args[0] is at
+	Close   // closes the iterator Args[0], which a loop returns from before it's done
+	Yield   // hands Args[0] to whoever is iterating over the running generator
+
+	// Tasks and channels
+	Go      // calls Args[0] with the rest of Args in a new task
+	Send    // sends Args[1] on the channel Args[0]
+	Receive // receives from the channel Args[0]
+	Select  // the index of the first case in Args that can go ahead, and what it received
+
+	// Checks
+	BoundsCheck      // fails unless 0 ≤ Args[0] < Args[1], or Args[1] is null
+	BoundsCheckRange // fails unless [Args[0], Args[1]) is empty or within the length of Args[2], or Args[2] is a map
 )
 
 type PhiLiteral struct {
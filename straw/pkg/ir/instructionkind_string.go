@@ -22,32 +22,59 @@ func _() {
 	_ = x[And-11]
 	_ = x[Or-12]
 	_ = x[Not-13]
-	_ = x[Default-14]
-	_ = x[Bool-15]
-	_ = x[I8-16]
-	_ = x[I16-17]
-	_ = x[I32-18]
-	_ = x[I64-19]
-	_ = x[F32-20]
-	_ = x[F64-21]
-	_ = x[ProcedureType-22]
-	_ = x[ProcedureDefinition-23]
-	_ = x[ConstructTuple-24]
-	_ = x[LoadEnv-25]
-	_ = x[Env-26]
-	_ = x[Phi-27]
-	_ = x[Ret-28]
-	_ = x[End-29]
-	_ = x[GotoIf-30]
-	_ = x[Goto-31]
-	_ = x[Call-32]
-	_ = x[Push-33]
-	_ = x[Pop-34]
+	_ = x[Convert-14]
+	_ = x[Default-15]
+	_ = x[Bool-16]
+	_ = x[I8-17]
+	_ = x[I16-18]
+	_ = x[I32-19]
+	_ = x[I64-20]
+	_ = x[F32-21]
+	_ = x[F64-22]
+	_ = x[String-23]
+	_ = x[Rune-24]
+	_ = x[ProcedureType-25]
+	_ = x[ProcedureDefinition-26]
+	_ = x[ConstructTuple-27]
+	_ = x[Phi-28]
+	_ = x[Ret-29]
+	_ = x[End-30]
+	_ = x[GotoIf-31]
+	_ = x[Goto-32]
+	_ = x[Call-33]
+	_ = x[Param-34]
+	_ = x[Passed-35]
+	_ = x[Extract-36]
+	_ = x[Unwind-37]
+	_ = x[MakeClosure-38]
+	_ = x[Capture-39]
+	_ = x[Self-40]
+	_ = x[Global-41]
+	_ = x[Export-42]
+	_ = x[Member-43]
+	_ = x[MakeType-44]
+	_ = x[Construct-45]
+	_ = x[ConstructMap-46]
+	_ = x[Len-47]
+	_ = x[Index-48]
+	_ = x[SetIndex-49]
+	_ = x[Slice-50]
+	_ = x[Iterate-51]
+	_ = x[Next-52]
+	_ = x[Current-53]
+	_ = x[Close-54]
+	_ = x[Yield-55]
+	_ = x[Go-56]
+	_ = x[Send-57]
+	_ = x[Receive-58]
+	_ = x[Select-59]
+	_ = x[BoundsCheck-60]
+	_ = x[BoundsCheckRange-61]
 }
 
-const _InstructionKind_name = "UndefinedAddSubMulQuoModLessGreaterEqualsNotEqualsMoveAndOrNotDefaultBoolI8I16I32I64F32F64ProcedureTypeProcedureDefinitionConstructTupleLoadEnvEnvPhiRetEndGotoIfGotoCallPushPop"
+const _InstructionKind_name = "UndefinedAddSubMulQuoModLessGreaterEqualsNotEqualsMoveAndOrNotConvertDefaultBoolI8I16I32I64F32F64StringRuneProcedureTypeProcedureDefinitionConstructTuplePhiRetEndGotoIfGotoCallParamPassedExtractUnwindMakeClosureCaptureSelfGlobalExportMemberMakeTypeConstructConstructMapLenIndexSetIndexSliceIterateNextCurrentCloseYieldGoSendReceiveSelectBoundsCheckBoundsCheckRange"
 
-var _InstructionKind_index = [...]uint8{0, 9, 12, 15, 18, 21, 24, 28, 35, 41, 50, 54, 57, 59, 62, 69, 73, 75, 78, 81, 84, 87, 90, 103, 122, 136, 143, 146, 149, 152, 155, 161, 165, 169, 173, 176}
+var _InstructionKind_index = [...]uint16{0, 9, 12, 15, 18, 21, 24, 28, 35, 41, 50, 54, 57, 59, 62, 69, 76, 80, 82, 85, 88, 91, 94, 97, 103, 107, 120, 139, 153, 156, 159, 162, 168, 172, 176, 181, 187, 194, 200, 211, 218, 222, 228, 234, 240, 248, 257, 269, 272, 277, 285, 290, 297, 301, 308, 313, 318, 320, 324, 331, 337, 348, 364}
 
 func (i InstKind) String() string {
 	if i < 0 || i >= InstKind(len(_InstructionKind_index)-1) {
@@ -3,11 +3,16 @@ package ir
 import (
 	"fmt"
 	"strings"
+
+	"github.com/yjp20/turtle/straw/pkg/token"
 )
 
 type Program struct {
 	Procedures []*Proc
 	Names      map[string]int
+
+	// File is the source the program was generated from, if known
+	File *token.File
 }
 
 func (p *Program) AppendProcdeure(procedure *Proc) {
@@ -36,6 +41,10 @@ type Proc struct {
 	Name   string
 	Blocks []*Block
 	Names  map[string]int
+
+	// Generator is set if the procedure yields, so that calling it makes
+	// an iterator rather than running it
+	Generator bool
 }
 
 func (p *Proc) AppendBlock(block *Block) {
@@ -51,6 +60,37 @@ func (p Proc) Next(block *Block) *Block {
 	return p.Blocks[block.Index+1]
 }
 
+// Successors returns the indices of the blocks that control can flow to from
+// block, which are the targets of its branches and the next block if it
+// falls through. Blocks can branch from the middle, so this looks at every
+// instruction rather than just the last.
+func (p Proc) Successors(block *Block) []int {
+	succs := make([]int, 0, 2)
+	add := func(b int) {
+		for _, s := range succs {
+			if s == b {
+				return
+			}
+		}
+		succs = append(succs, b)
+	}
+	for _, inst := range block.Instructions {
+		switch inst.Kind {
+		case GotoIf:
+			add(inst.Block)
+		case Goto:
+			add(inst.Block)
+			return succs
+		case Ret, End:
+			return succs
+		}
+	}
+	if block.Index+1 < len(p.Blocks) {
+		add(block.Index + 1)
+	}
+	return succs
+}
+
 func (p Proc) String() string {
 	var sb strings.Builder
 	sb.WriteString(fmt.Sprintf("[%s()] %d\n", p.Name, p.Index))
@@ -0,0 +1,69 @@
+package irgen
+
+import (
+	"github.com/yjp20/turtle/straw/pkg/ast"
+	"github.com/yjp20/turtle/straw/pkg/ir"
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+// namedArguments returns the fields of a last call argument like
+// (b: 2, a: 1), which are passed by name. Procedures without arguments by
+// those names get the tuple instead.
+func namedArguments(node ast.Node) ([]*ast.Assign, bool) {
+	tuple, ok := node.(*ast.Tuple)
+	if !ok || len(tuple.Nodes) == 0 {
+		return nil, false
+	}
+	fields := make([]*ast.Assign, len(tuple.Nodes))
+	for i, n := range tuple.Nodes {
+		assign, ok := n.(*ast.Assign)
+		if !ok {
+			return nil, false
+		}
+		if _, ok := assign.Left.(*ast.Identifier); !ok {
+			return nil, false
+		}
+		fields[i] = assign
+	}
+	return fields, true
+}
+
+// generateDefault generates the default value of the idx-th parameter, for
+// when it isn't passed:
+//
+//	block:
+//	  %0 = passed idx
+//	  goto_if(%0, next)
+//	default:
+//	  %1 = ...
+//	next:
+//	  %2 = phi(block: param, default: %1)
+//
+// Defaults are generated in the procedure, so they can use the parameters
+// before them. Numbers have to be of the kind of the parameter, which
+// typeNumbers checks.
+func (g *Generator) generateDefault(arg ast.Field, idx int, procedure *ir.Proc, block *ir.Block) *ir.Block {
+	param := block.Symbols[arg.Name]
+	passedA := g.insertInstruction(block, ir.Inst{
+		Kind: ir.Passed,
+		Type: ir.Type{Kind: kind.Bool},
+		Int:  int64(idx),
+	})
+	gotoIfA := g.insertInstruction(block, ir.Inst{
+		Kind: ir.GotoIf,
+		Type: ir.Type{Kind: kind.None},
+		Args: []ir.Assignment{passedA},
+	})
+
+	valueA, _, defaultEnd := g.GenerateBlock("default", procedure, []*ir.Block{block}, true, arg.Value)
+
+	nextBlock := g.NewBlock("next", procedure, []*ir.Block{block, defaultEnd}, true)
+	block.Get(gotoIfA).Block = nextBlock.Index
+	nextBlock.Symbols[arg.Name] = g.insertInstruction(nextBlock, ir.Inst{
+		Kind: ir.Phi,
+		Type: typeOf(arg.Type),
+		Phis: []ir.PhiLiteral{{BlockIndex: block.Index, Assignment: param}, {BlockIndex: defaultEnd.Index, Assignment: valueA}},
+	})
+	g.defaults[nextBlock.Symbols[arg.Name]] = arg.Name
+	return nextBlock
+}
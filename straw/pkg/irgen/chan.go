@@ -0,0 +1,158 @@
+package irgen
+
+import (
+	"fmt"
+
+	"github.com/yjp20/turtle/straw/pkg/ast"
+	"github.com/yjp20/turtle/straw/pkg/ir"
+	"github.com/yjp20/turtle/straw/pkg/kind"
+	"github.com/yjp20/turtle/straw/pkg/token"
+)
+
+// generateGo generates go .f a b, which calls f in a new task.
+func (g *Generator) generateGo(node *ast.Go, procedure *ir.Proc, block *ir.Block) (ir.Assignment, *ir.Block) {
+	var proc ir.Assignment
+	proc, block = g.generate(node.Call.Procedure, procedure, block)
+	args := []ir.Assignment{proc}
+	for _, n := range node.Call.Arguments {
+		var arg ir.Assignment
+		arg, block = g.generate(n, procedure, block)
+		args = append(args, arg)
+	}
+	return g.insertInstruction(block, ir.Inst{
+		Kind: ir.Go,
+		Args: args,
+	}), block
+}
+
+// generateSelect generates a select, whose cases are like those of a match
+// but with sends and receives to wait on:
+//
+//	select (
+//		← a: ...
+//		(v: ← b): ...
+//		c ← 1: ...
+//		_: ...
+//	)
+//
+// The second case binds what it receives to v, and _ is done if no other case
+// can go ahead straight away.
+func (g *Generator) generateSelect(node *ast.Select, procedure *ir.Proc, block *ir.Block) (ir.Assignment, *ir.Block) {
+	args := []ir.Assignment{}
+	names := []string{}
+	bound := make([]string, len(node.Tuple.Nodes))
+	picks := make([]int64, len(node.Tuple.Nodes))
+	hasDefault := false
+	cases := 0
+	for idx, n := range node.Tuple.Nodes {
+		assign, ok := n.(*ast.Assign)
+		if !ok {
+			g.appendError("Expected a case, like (← ch: body)", n.Pos(), n.End())
+			continue
+		}
+		left := assign.Left
+		if tuple, ok := left.(*ast.Tuple); ok && len(tuple.Nodes) == 1 {
+			if inner, ok := tuple.Nodes[0].(*ast.Assign); ok {
+				if identifier, ok := inner.Left.(*ast.Identifier); ok {
+					bound[idx] = identifier.Value
+					left = inner.Right
+				}
+			}
+		}
+
+		var ca, va ir.Assignment
+		switch l := left.(type) {
+		case *ast.DefaultLiteral:
+			if hasDefault {
+				g.appendError("Select can only have one default case", l.Pos(), l.End())
+			}
+			hasDefault = true
+			picks[idx] = -1
+			continue
+		case *ast.Prefix:
+			if l.Operator != token.LEFT_ARROW {
+				break
+			}
+			ca, block = g.generate(l.Node, procedure, block)
+			args, names = append(args, ca), append(names, "recv")
+			picks[idx] = int64(cases)
+			cases++
+			continue
+		case *ast.Infix:
+			if l.Operator != token.LEFT_ARROW || bound[idx] != "" {
+				break
+			}
+			ca, block = g.generate(l.Left, procedure, block)
+			va, block = g.generate(l.Right, procedure, block)
+			args, names = append(args, ca, va), append(names, "send", "value")
+			picks[idx] = int64(cases)
+			cases++
+			continue
+		}
+		g.appendError("Expected to send or receive", left.Pos(), left.End())
+	}
+
+	sa := g.insertInstruction(block, ir.Inst{
+		Kind:  ir.Select,
+		Args:  args,
+		Names: names,
+		Bool:  hasDefault,
+	})
+	pa := g.insertInstruction(block, ir.Inst{
+		Kind: ir.Extract,
+		Args: []ir.Assignment{sa},
+		Int:  0,
+	})
+	ra := g.insertInstruction(block, ir.Inst{
+		Kind: ir.Extract,
+		Args: []ir.Assignment{sa},
+		Int:  1,
+	})
+
+	blocks := make([]*ir.Block, len(node.Tuple.Nodes))
+	for idx := range node.Tuple.Nodes {
+		blocks[idx] = g.NewBlock(fmt.Sprintf("select_%d", idx), procedure, []*ir.Block{block}, true)
+	}
+	blockNext := g.NewBlock("select_next", procedure, []*ir.Block{block}, true)
+
+	phi := make([]ir.PhiLiteral, 0)
+	for idx, n := range node.Tuple.Nodes {
+		assign, ok := n.(*ast.Assign)
+		if !ok {
+			continue
+		}
+		ia := g.insertInstruction(block, ir.Inst{
+			Type:   ir.Type{Kind: kind.IntConstant},
+			Static: true,
+			Kind:   ir.I64,
+			Int:    picks[idx],
+		})
+		ea := g.insertInstruction(block, ir.Inst{
+			Kind: ir.Equals,
+			Args: []ir.Assignment{pa, ia},
+		})
+		g.insertInstruction(block, ir.Inst{
+			Kind:  ir.GotoIf,
+			Args:  []ir.Assignment{ea},
+			Block: blocks[idx].Index,
+		})
+
+		if bound[idx] != "" {
+			blocks[idx].Symbols[bound[idx]] = ra
+		}
+		var ba ir.Assignment
+		ba, blocks[idx] = g.generate(assign.Right, procedure, blocks[idx])
+		g.insertInstruction(blocks[idx], ir.Inst{
+			Kind:  ir.Goto,
+			Block: blockNext.Index,
+		})
+		blockNext.AddPredecesor(blocks[idx])
+		phi = append(phi, ir.PhiLiteral{BlockIndex: blocks[idx].Index, Assignment: ba})
+	}
+
+	return g.insertInstruction(blockNext, ir.Inst{
+		Kind: ir.Phi,
+		Type: ir.Type{Kind: kind.None},
+		Phis: phi,
+	}), blockNext
+}
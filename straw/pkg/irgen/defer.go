@@ -0,0 +1,150 @@
+package irgen
+
+import (
+	"github.com/yjp20/turtle/straw/pkg/ast"
+	"github.com/yjp20/turtle/straw/pkg/ir"
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+// Deferred nodes are lowered to closures, chained so that each one runs its
+// node and then calls the closure of the defer before it. The chain is kept
+// in a hidden symbol of the procedure, which starts as a procedure that does
+// nothing, and is called before every Ret. Unwind hands the chain to the
+// runtime as well, to be called if the procedure fails instead. Like any
+// other closure, the values a deferred node uses are captured when the defer
+// is reached.
+const defersSymbol = "·defers"
+
+type deferred struct {
+	used bool
+
+	// rets are the returns generated before the first defer, which a loop
+	// can still reach after it
+	rets []ret
+}
+
+type ret struct {
+	block *ir.Block
+	a     ir.Assignment
+}
+
+func (g *Generator) deferred(procedure *ir.Proc) *deferred {
+	d, ok := g.defers[procedure]
+	if !ok {
+		d = &deferred{}
+		g.defers[procedure] = d
+	}
+	return d
+}
+
+// insertRet inserts a Ret or End, which closes the iterators of the loops
+// it's in and runs the deferred nodes first.
+func (g *Generator) insertRet(procedure *ir.Proc, block *ir.Block, inst ir.Inst) ir.Assignment {
+	iterators := g.iterators[procedure]
+	for i := len(iterators) - 1; i >= 0; i-- {
+		g.insertInstruction(block, ir.Inst{
+			Kind: ir.Close,
+			Args: []ir.Assignment{iterators[i]},
+		})
+	}
+	d := g.deferred(procedure)
+	if d.used {
+		g.callDefers(block)
+		return g.insertInstruction(block, inst)
+	}
+	a := g.insertInstruction(block, inst)
+	d.rets = append(d.rets, ret{block, a})
+	return a
+}
+
+func (g *Generator) callDefers(block *ir.Block) {
+	g.insertInstruction(block, ir.Inst{
+		Kind: ir.Unwind,
+	})
+	g.insertInstruction(block, ir.Inst{
+		Kind: ir.Call,
+		Args: []ir.Assignment{g.lookupSymbol(defersSymbol, block)},
+	})
+}
+
+func (g *Generator) generateDefer(node *ast.Defer, procedure *ir.Proc, block *ir.Block) (ir.Assignment, *ir.Block) {
+	d := g.deferred(procedure)
+	if !d.used {
+		d.used = true
+		start := procedure.Blocks[0]
+		start.Symbols[defersSymbol] = g.prependInstruction(start, ir.Inst{
+			Kind:   ir.ProcedureDefinition,
+			Type:   ir.Type{Kind: kind.Function},
+			Static: true,
+			Proc:   g.nop().Index,
+		})
+		for _, r := range d.rets {
+			// Calls the chain just before the return
+			at := r.block.Map[r.a]
+			tail := append([]*ir.Inst{}, r.block.Instructions[at:]...)
+			r.block.Instructions = r.block.Instructions[:at]
+			g.callDefers(r.block)
+			for _, inst := range tail {
+				r.block.Map[inst.Index] = len(r.block.Instructions)
+				r.block.Instructions = append(r.block.Instructions, inst)
+			}
+		}
+		d.rets = nil
+	}
+
+	thunk := g.NewProcedure("defer")
+	thunkBlock := g.NewBlock("_start", thunk, []*ir.Block{}, true)
+	c := &closure{}
+	g.closures[thunkBlock] = c
+	prev := g.lookupSymbol(defersSymbol, thunkBlock)
+	_, thunkBlock = g.generate(node.Node, thunk, thunkBlock)
+	g.insertInstruction(thunkBlock, ir.Inst{
+		Kind: ir.Call,
+		Args: []ir.Assignment{prev},
+	})
+	g.insertRet(thunk, thunkBlock, ir.Inst{
+		Kind: ir.Ret,
+	})
+
+	captured := make([]ir.Assignment, len(c.captures))
+	for idx, name := range c.captures {
+		captured[idx] = g.lookupSymbol(name, block)
+	}
+	chain := g.insertInstruction(block, ir.Inst{
+		Kind: ir.MakeClosure,
+		Type: ir.Type{Kind: kind.Function},
+		Proc: thunk.Index,
+		Args: captured,
+	})
+	block.Symbols[defersSymbol] = chain
+	g.insertInstruction(block, ir.Inst{
+		Kind: ir.Unwind,
+		Args: []ir.Assignment{chain},
+	})
+	return 0, block
+}
+
+// nop returns a procedure that does nothing, which the chain of deferred
+// nodes ends with.
+func (g *Generator) nop() *ir.Proc {
+	if g.nopProc == nil {
+		g.nopProc = g.NewProcedure("nop")
+		block := g.NewBlock("_start", g.nopProc, []*ir.Block{}, true)
+		g.insertInstruction(block, ir.Inst{
+			Kind: ir.Ret,
+		})
+	}
+	return g.nopProc
+}
+
+// prependInstruction inserts inst at the start of block.
+func (g *Generator) prependInstruction(block *ir.Block, inst ir.Inst) ir.Assignment {
+	a := g.insertInstruction(block, inst)
+	last := block.Instructions[len(block.Instructions)-1]
+	copy(block.Instructions[1:], block.Instructions[:len(block.Instructions)-1])
+	block.Instructions[0] = last
+	for i, inst := range block.Instructions {
+		block.Map[inst.Index] = i
+	}
+	return a
+}
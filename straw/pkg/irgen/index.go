@@ -0,0 +1,193 @@
+package irgen
+
+import (
+	"github.com/yjp20/turtle/straw/pkg/ast"
+	"github.com/yjp20/turtle/straw/pkg/ir"
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+// generateIndex generates x[...], which is a generic type applied to its
+// parameters like array[i64], an element like xs[i], or a slice like
+// xs[range[1‥3)].
+func (g *Generator) generateIndex(node *ast.Indexor, index *ast.Tuple, procedure *ir.Proc, block *ir.Block) (ir.Assignment, *ir.Block) {
+	if _, ok := genericType(node); ok {
+		// array[i64] is the same as .array i64
+		args := make([]ir.Assignment, 1, len(index.Nodes)+1)
+		args[0], block = g.generate(node.Node, procedure, block)
+		for _, n := range index.Nodes {
+			var a ir.Assignment
+			a, block = g.generate(n, procedure, block)
+			args = append(args, a)
+		}
+		return g.insertInstruction(block, ir.Inst{
+			Kind: ir.Call,
+			Args: args,
+		}), block
+	}
+	if len(index.Nodes) != 1 {
+		g.appendError("Expected a single index", index.Pos(), index.End())
+		return 0, block
+	}
+
+	var xa ir.Assignment
+	xa, block = g.generate(node.Node, procedure, block)
+	if r, ok := index.Nodes[0].(*ast.RangeLiteral); ok {
+		var from, to ir.Assignment
+		from, to, block = g.generateRange(r, procedure, block)
+		return g.insertInstruction(block, ir.Inst{
+			Kind: ir.Slice,
+			Type: ir.Type{Kind: kind.Slice},
+			Args: []ir.Assignment{xa, from, to},
+		}), block
+	}
+
+	var ia ir.Assignment
+	ia, block = g.generate(index.Nodes[0], procedure, block)
+	g.boundsCheck(block, xa, ia)
+	return g.insertInstruction(block, ir.Inst{
+		Kind: ir.Index,
+		Args: []ir.Assignment{xa, ia},
+	}), block
+}
+
+// generateSetIndex generates xs[i]: value, which sets an element and results
+// in the value.
+func (g *Generator) generateSetIndex(node *ast.Indexor, value ast.Node, procedure *ir.Proc, block *ir.Block) (ir.Assignment, *ir.Block) {
+	index, ok := node.Index.(*ast.Tuple)
+	if !ok {
+		g.appendError("Cannot assign to a member", node.Index.Pos(), node.Index.End())
+		return 0, block
+	}
+	if len(index.Nodes) != 1 {
+		g.appendError("Can only assign to a single element", node.Index.Pos(), node.Index.End())
+		return 0, block
+	}
+	if _, ok := index.Nodes[0].(*ast.RangeLiteral); ok {
+		g.appendError("Cannot assign to a slice, use .copy instead", node.Index.Pos(), node.Index.End())
+		return 0, block
+	}
+
+	var xa, ia, va ir.Assignment
+	xa, block = g.generate(node.Node, procedure, block)
+	ia, block = g.generate(index.Nodes[0], procedure, block)
+	va, block = g.generate(value, procedure, block)
+	g.boundsCheck(block, xa, ia)
+	g.insertInstruction(block, ir.Inst{
+		Kind: ir.SetIndex,
+		Args: []ir.Assignment{xa, ia, va},
+	})
+	return va, block
+}
+
+// boundsCheck checks that ia is an index of xa. Checks are separate from the
+// indexing so that they can be optimized, see opt.HoistBoundsChecks.
+func (g *Generator) boundsCheck(block *ir.Block, xa, ia ir.Assignment) {
+	la := g.insertInstruction(block, ir.Inst{
+		Kind: ir.Len,
+		Type: ir.Type{Kind: kind.I64},
+		Args: []ir.Assignment{xa},
+	})
+	g.insertInstruction(block, ir.Inst{
+		Kind: ir.BoundsCheck,
+		Args: []ir.Assignment{ia, la},
+	})
+}
+
+// generateRange generates the bounds of a range literal as a half open
+// range [from, to).
+func (g *Generator) generateRange(r *ast.RangeLiteral, procedure *ir.Proc, block *ir.Block) (ir.Assignment, ir.Assignment, *ir.Block) {
+	var from, to ir.Assignment
+	from, block = g.generate(r.Left, procedure, block)
+	to, block = g.generate(r.Right, procedure, block)
+	if r.LeftInclusive && !r.RightInclusive {
+		return from, to, block
+	}
+	one := g.insertInstruction(block, ir.Inst{
+		Kind:   ir.I64,
+		Type:   ir.Type{Kind: kind.IntConstant},
+		Static: true,
+		Int:    1,
+	})
+	if !r.LeftInclusive {
+		from = g.insertInstruction(block, ir.Inst{
+			Kind: ir.Add,
+			Args: []ir.Assignment{from, one},
+		})
+	}
+	if r.RightInclusive {
+		to = g.insertInstruction(block, ir.Inst{
+			Kind: ir.Add,
+			Args: []ir.Assignment{to, one},
+		})
+	}
+	return from, to, block
+}
+
+// generateConstruct generates ■ T (a, b, ...), which makes a value of type T
+// from the elements.
+func (g *Generator) generateConstruct(node *ast.Construct, procedure *ir.Proc, block *ir.Block) (ir.Assignment, *ir.Block) {
+	t := typeOf(node.Type)
+	if t.Kind == kind.Map || t.Kind == kind.Unresolved && hasKeys(node.Value) {
+		return g.generateConstructMap(node, t, procedure, block)
+	}
+	args := make([]ir.Assignment, 1, len(node.Value.Nodes)+1)
+	args[0], block = g.generate(node.Type, procedure, block)
+	for _, n := range node.Value.Nodes {
+		if _, ok := n.(*ast.Assign); ok {
+			g.appendError("Named fields are not supported by constructors yet", n.Pos(), n.End())
+			continue
+		}
+		var a ir.Assignment
+		a, block = g.generate(n, procedure, block)
+		args = append(args, a)
+	}
+	return g.insertInstruction(block, ir.Inst{
+		Kind: ir.Construct,
+		Type: t,
+		Args: args,
+	}), block
+}
+
+// generateConstructMap generates ■ map[K, V] (k: v, ...). A key that's an
+// identifier is a string, like the name of a field of a tuple, and any other
+// key is evaluated.
+func (g *Generator) generateConstructMap(node *ast.Construct, t ir.Type, procedure *ir.Proc, block *ir.Block) (ir.Assignment, *ir.Block) {
+	args := make([]ir.Assignment, 1, 2*len(node.Value.Nodes)+1)
+	args[0], block = g.generate(node.Type, procedure, block)
+	for _, n := range node.Value.Nodes {
+		assign, ok := n.(*ast.Assign)
+		if !ok {
+			g.appendError("Expected a key and value, like (key: value)", n.Pos(), n.End())
+			continue
+		}
+		var ka, va ir.Assignment
+		if identifier, ok := assign.Left.(*ast.Identifier); ok {
+			ka = g.insertInstruction(block, ir.Inst{
+				Kind:   ir.String,
+				Type:   ir.Type{Kind: kind.StringConstant},
+				Static: true,
+				Text:   identifier.Value,
+			})
+		} else {
+			ka, block = g.generate(assign.Left, procedure, block)
+		}
+		va, block = g.generate(assign.Right, procedure, block)
+		args = append(args, ka, va)
+	}
+	return g.insertInstruction(block, ir.Inst{
+		Kind: ir.ConstructMap,
+		Type: t,
+		Args: args,
+	}), block
+}
+
+// hasKeys reports whether the elements of a construction have keys, which
+// makes it a map when its type isn't known statically.
+func hasKeys(value *ast.Tuple) bool {
+	for _, n := range value.Nodes {
+		if _, ok := n.(*ast.Assign); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -3,6 +3,8 @@ package irgen
 import (
 	"fmt"
 	"sort"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/yjp20/turtle/straw/pkg/ast"
 	"github.com/yjp20/turtle/straw/pkg/ir"
@@ -14,13 +16,55 @@ type Generator struct {
 	program ir.Program
 	counter ir.Assignment
 	errors  *token.ErrorList
+
+	// pos and end are the range of the node being generated, which every
+	// inserted instruction is tagged with
+	pos token.Pos
+	end token.Pos
+
+	// name is given to the next procedure definition, if it's being assigned
+	// to a symbol
+	name string
+
+	// closures maps the first block of every procedure to the symbols it
+	// captures from the procedure it's defined in
+	closures map[*ir.Block]*closure
+
+	// entry is the first block of the program, where symbols that are never
+	// defined are looked up as globals
+	entry *ir.Block
+
+	// exports are the symbols defined at the top level of the program, in
+	// the order they're first defined
+	exports []string
+
+	// defers tracks the deferred nodes of each procedure, see defer.go, and
+	// nopProc is the procedure their chains end with
+	defers  map[*ir.Proc]*deferred
+	nopProc *ir.Proc
+
+	// iterators are the iterators of the loops being generated in each
+	// procedure, innermost last, which returning closes
+	iterators map[*ir.Proc][]ir.Assignment
+
+	// defaults maps the phis that pick between a parameter and its default,
+	// see args.go, to the name of the parameter
+	defaults map[ir.Assignment]string
+}
+
+type closure struct {
+	captures []string
 }
 
 func NewGenerator(errors *token.ErrorList) *Generator {
 	return &Generator{
-		counter: 1,
-		program: ir.Program{Procedures: make([]*ir.Proc, 0), Names: make(map[string]int)},
-		errors:  errors,
+		counter:   1,
+		program:   ir.Program{Procedures: make([]*ir.Proc, 0), Names: make(map[string]int)},
+		errors:    errors,
+		closures:  make(map[*ir.Block]*closure),
+		defers:    make(map[*ir.Proc]*deferred),
+		defaults:  make(map[ir.Assignment]string),
+		iterators: make(map[*ir.Proc][]ir.Assignment),
 	}
 }
 
@@ -55,15 +99,17 @@ func (g *Generator) GenerateBlock(name string, procedure *ir.Proc, predecesors [
 
 func (g *Generator) Generate(n ast.Node) ir.Program {
 	g.generate(n, g.NewProcedure("_init"), nil)
+	g.typeNumbers()
 
 	// Post-process outputted ir programs
 	indexMap := map[ir.Assignment]ir.Assignment{}
 	ct := ir.Assignment(1)
 	for _, proc := range g.program.Procedures {
 		for _, block := range proc.Blocks {
-			// First, move phi nodes to the start of each block
+			// First, move phi nodes to the start of each block, followed by
+			// captures, which may have been inserted after a branch
 			sort.SliceStable(block.Instructions, func(a, b int) bool {
-				return block.Instructions[a].Kind == ir.Phi
+				return leading(block.Instructions[a]) < leading(block.Instructions[b])
 			})
 			// Second, relabel each node to linearize instructions
 			for _, inst := range block.Instructions {
@@ -78,27 +124,42 @@ func (g *Generator) Generate(n ast.Node) ir.Program {
 		for _, block := range proc.Blocks {
 			for _, inst := range block.Instructions {
 				inst.Index = indexMap[inst.Index]
-				if inst.Left != 0 {
-					inst.Left = indexMap[inst.Left]
-				}
-				if inst.Right != 0 {
-					inst.Right = indexMap[inst.Right]
+				for i := range inst.Args {
+					inst.Args[i] = indexMap[inst.Args[i]]
 				}
-				if inst.Kind == ir.Phi {
-					for i := range inst.Literal.([]ir.PhiLiteral) {
-						inst.Literal.([]ir.PhiLiteral)[i].Assignment = indexMap[inst.Literal.([]ir.PhiLiteral)[i].Assignment]
-					}
+				for i := range inst.Phis {
+					inst.Phis[i].Assignment = indexMap[inst.Phis[i].Assignment]
 				}
 			}
+			for name, a := range block.Symbols {
+				block.Symbols[name] = indexMap[a]
+			}
 		}
 	}
 
 	return g.program
 }
 
+// leading orders the instructions that belong at the start of a block
+func leading(inst *ir.Inst) int {
+	switch inst.Kind {
+	case ir.Phi:
+		return 0
+	case ir.Capture, ir.Global:
+		return 1
+	}
+	return 2
+}
+
 func (g *Generator) generate(node ast.Node, procedure *ir.Proc, block *ir.Block) (ir.Assignment, *ir.Block) {
 	if block == nil {
 		block = g.NewBlock("_init", procedure, []*ir.Block{}, true)
+		g.entry = block
+	}
+	if node != nil {
+		pos, end := g.pos, g.end
+		g.pos, g.end = node.Pos(), node.End()
+		defer func() { g.pos, g.end = pos, end }()
 	}
 	var a ir.Assignment
 	switch node := node.(type) {
@@ -106,9 +167,22 @@ func (g *Generator) generate(node ast.Node, procedure *ir.Proc, block *ir.Block)
 		for _, stmt := range node.Nodes {
 			a, block = g.generate(stmt, procedure, block)
 		}
-		g.insertInstruction(block, ir.Inst{
+		// What follows isn't part of any statement, so it gets an empty range
+		// at the end of the program
+		g.pos = node.End()
+		for _, name := range g.exports {
+			if !defines(block, name, map[*ir.Block]bool{}) {
+				continue
+			}
+			g.insertInstruction(block, ir.Inst{
+				Kind:   ir.Export,
+				Symbol: name,
+				Args:   []ir.Assignment{g.lookupSymbol(name, block)},
+			})
+		}
+		g.insertRet(procedure, block, ir.Inst{
 			Kind: ir.End,
-			Left: a,
+			Args: g.args(a),
 		})
 
 	case *ast.Block:
@@ -119,45 +193,68 @@ func (g *Generator) generate(node ast.Node, procedure *ir.Proc, block *ir.Block)
 	case *ast.Assign:
 		switch left := node.Left.(type) {
 		case *ast.Identifier:
+			switch node.Right.(type) {
+			case *ast.ProcedureDefinition, *ast.TypeSpec:
+				g.name = left.Value
+			}
 			a, block = g.generate(node.Right, procedure, block)
-			block.Symbols[left.Value] = a
+			g.checkCaptured(procedure, left)
+			g.define(procedure, block, left.Value, a)
+
+		case *ast.Tuple:
+			// Destructures the right side, which is a tuple or the results of a
+			// procedure returning several values
+			a, block = g.generate(node.Right, procedure, block)
+			for idx, n := range left.Nodes {
+				identifier, ok := n.(*ast.Identifier)
+				if !ok {
+					g.appendError("Can only destructure into identifiers", n.Pos(), n.End())
+					continue
+				}
+				g.checkCaptured(procedure, identifier)
+				g.define(procedure, block, identifier.Value, g.insertInstruction(block, ir.Inst{
+					Kind: ir.Extract,
+					Args: []ir.Assignment{a},
+					Int:  int64(idx),
+				}))
+			}
+
+		case *ast.Indexor:
+			a, block = g.generateSetIndex(left, node.Right, procedure, block)
 		}
 
 	case *ast.Return:
-		a, block = g.generate(node.Body, procedure, block)
-		g.insertInstruction(block, ir.Inst{
+		var results []ir.Assignment
+		results, block = g.generateResults(node.Body, procedure, block)
+		g.insertRet(procedure, block, ir.Inst{
 			Kind: ir.Ret,
-			Left: a,
+			Args: results,
 		})
 
 	case *ast.Tuple:
-		fields := make([]ir.Field, 0)
+		args := make([]ir.Assignment, 0, len(node.Nodes))
+		names := make([]string, 0, len(node.Nodes))
 		for idx, n := range node.Nodes {
+			var ra ir.Assignment
 			switch n := n.(type) {
 			case *ast.Assign:
-				var ra ir.Assignment
+				identifier, ok := n.Left.(*ast.Identifier)
+				if !ok {
+					g.appendError("Expected tuple field name to be an identifier", n.Left.Pos(), n.Left.End())
+					continue
+				}
 				ra, block = g.generate(n.Right, procedure, block)
-				fields = append(fields, ir.Field{
-					Name:  n.Left.(*ast.Identifier).Value,
-					Value: ra,
-				})
-			case *ast.As:
-				fields = append(fields, ir.Field{
-					Name:  n.Node.(*ast.Identifier).Value,
-					Value: -1,
-				})
+				names = append(names, identifier.Value)
 			default:
-				var ra ir.Assignment
 				ra, block = g.generate(n, procedure, block)
-				fields = append(fields, ir.Field{
-					Name:  fmt.Sprintf("%d", idx),
-					Value: ra,
-				})
+				names = append(names, fmt.Sprintf("%d", idx))
 			}
+			args = append(args, ra)
 		}
 		a = g.insertInstruction(block, ir.Inst{
-			Kind:    ir.ConstructTuple,
-			Literal: fields,
+			Kind:  ir.ConstructTuple,
+			Args:  args,
+			Names: names,
 		})
 
 	case *ast.If:
@@ -179,12 +276,12 @@ func (g *Generator) generate(node ast.Node, procedure *ir.Proc, block *ir.Block)
 		notA := g.insertInstruction(block, ir.Inst{
 			Kind: ir.Not,
 			Type: ir.Type{Kind: kind.Bool},
-			Left: condA,
+			Args: []ir.Assignment{condA},
 		})
 		gotoIfA := g.insertInstruction(block, ir.Inst{
 			Kind: ir.GotoIf,
 			Type: ir.Type{Kind: kind.None},
-			Left: notA,
+			Args: []ir.Assignment{notA},
 		})
 
 		// Generate the true, false, and next blocks which look like
@@ -195,7 +292,7 @@ func (g *Generator) generate(node ast.Node, procedure *ir.Proc, block *ir.Block)
 		//   %4 = ...
 		// next:
 		//
-		trueA, trueBlock, trueBlockEnd := g.GenerateBlock("true", procedure, []*ir.Block{block}, true, node.TrueBody)
+		trueA, _, trueBlockEnd := g.GenerateBlock("true", procedure, []*ir.Block{block}, true, node.TrueBody)
 		gotoA := g.insertInstruction(trueBlockEnd, ir.Inst{
 			Kind: ir.Goto,
 			Type: ir.Type{Kind: kind.None},
@@ -203,112 +300,106 @@ func (g *Generator) generate(node ast.Node, procedure *ir.Proc, block *ir.Block)
 		goto_ := trueBlockEnd.Get(gotoA)
 
 		falseA, falseBlock, falseBlockEnd := g.GenerateBlock("false", procedure, []*ir.Block{block}, true, node.FalseBody)
-		block.Get(gotoIfA).Literal = falseBlock.Index
+		block.Get(gotoIfA).Block = falseBlock.Index
 
 		nextBlock := g.NewBlock("next", procedure, []*ir.Block{trueBlockEnd, falseBlockEnd}, true)
 		a = g.insertInstruction(nextBlock, ir.Inst{
-			Kind:    ir.Phi,
-			Type:    ir.Type{Kind: kind.None},
-			Literal: []ir.PhiLiteral{{trueBlock.Index, trueA}, {falseBlock.Index, falseA}},
+			Kind: ir.Phi,
+			Type: ir.Type{Kind: kind.None},
+			Phis: []ir.PhiLiteral{{BlockIndex: trueBlockEnd.Index, Assignment: trueA}, {BlockIndex: falseBlockEnd.Index, Assignment: falseA}},
 		})
-		goto_.Literal = nextBlock.Index
+		goto_.Block = nextBlock.Index
 
 		block = nextBlock
 
 	case *ast.For:
-		if clause, ok := node.Clause.(*ast.Each); ok {
-			// FIXME: Currently only works for clauses which work over a range. It
-			// is probably a better fix in the long term to have a transformer that
-			// maps this to a while loop in terms of an ast node, either in some
-			// in-between phase if there is a need for many such tranformations
-			// or just inlined in this function, and then call generate again on the
-			// reconstructed node.
-
-			l := clause.Left.(*ast.Identifier)
-			r := clause.Right.(*ast.RangeLiteral)
-
-			var la, ra ir.Assignment
-			la, block = g.generate(r.Left, procedure, block)
-			ra, block = g.generate(r.Right, procedure, block)
-			onea := g.insertInstruction(block, ir.Inst{
-				Kind:    ir.I64,
-				Literal: int64(1),
-			})
-			if !r.LeftInclusive {
-				la = g.insertInstruction(block, ir.Inst{
-					Kind:  ir.Add,
-					Left:  la,
-					Right: onea,
-				})
-			}
-			if r.RightInclusive {
-				ra = g.insertInstruction(block, ir.Inst{
-					Kind:  ir.Add,
-					Left:  ra,
-					Right: onea,
-				})
-			}
-
-			block.Symbols[l.Value] = la
-
-			headBlock := g.NewBlock("loop", procedure, []*ir.Block{block}, false)
-			iterA := g.insertInstruction(headBlock, ir.Inst{
-				Kind:   ir.Phi,
-				Symbol: l.Value,
-				Type:   ir.Type{Kind: kind.I64},
-			})
-			headBlock.Symbols[l.Value] = iterA
-			iterInst := headBlock.Get(iterA)
-
-			lessA := g.insertInstruction(headBlock, ir.Inst{
-				Kind:  ir.Less,
-				Type:  ir.Type{Kind: kind.Bool},
-				Left:  iterA,
-				Right: ra,
-			})
-			notA := g.insertInstruction(headBlock, ir.Inst{
-				Kind: ir.Not,
-				Type: ir.Type{Kind: kind.Bool},
-				Left: lessA,
-			})
-			jumpA := g.insertInstruction(headBlock, ir.Inst{
-				Kind:    ir.GotoIf,
-				Type:    ir.Type{Kind: kind.I64},
-				Left:    notA,
-				Literal: headBlock.Index,
-			})
-			jumpInst := headBlock.Get(jumpA)
+		clause, ok := node.Clause.(*ast.Each)
+		if !ok {
+			g.appendError("Expected loop clause of the form 'x ∈ range[a‥b)'", node.Clause.Pos(), node.Clause.End())
+			break
+		}
+		// FIXME: It is probably a better fix in the long term to have a
+		// transformer that maps this to a while loop in terms of an ast node,
+		// either in some in-between phase if there is a need for many such
+		// tranformations or just inlined in this function, and then call
+		// generate again on the reconstructed node.
+
+		var name string
+		switch l := clause.Left.(type) {
+		case *ast.Identifier:
+			name = l.Value
+		case *ast.DefaultLiteral:
+			name = "_"
+		default:
+			g.appendError("Expected loop variable to be an identifier", clause.Left.Pos(), clause.Left.End())
+			break
+		}
+		// Ranges are counted through directly, anything else with an
+		// iterator
+		r, ok := clause.Right.(*ast.RangeLiteral)
+		if !ok {
+			block = g.generateIteration(name, clause.Right, node.Body, procedure, block)
+			break
+		}
+		var la, ra ir.Assignment
+		la, ra, block = g.generateRange(r, procedure, block)
+		block.Symbols[name] = la
 
-			bodyBlock := g.NewBlock("loop_body", procedure, []*ir.Block{headBlock}, false)
-			_, bodyBlock = g.generate(node.Body, procedure, bodyBlock)
+		headBlock := g.NewBlock("loop", procedure, []*ir.Block{block}, false)
+		iterA := g.insertInstruction(headBlock, ir.Inst{
+			Kind:   ir.Phi,
+			Symbol: name,
+		})
+		headBlock.Symbols[name] = iterA
+		iterInst := headBlock.Get(iterA)
 
-			endBlock := g.NewBlock("loop_end", procedure, []*ir.Block{bodyBlock}, true)
-			oneA := g.insertInstruction(endBlock, ir.Inst{
-				Kind:    ir.I64,
-				Type:    ir.Type{Kind: kind.I64},
-				Literal: int64(1),
-			})
-			endA := g.insertInstruction(endBlock, ir.Inst{
-				Kind:  ir.Add,
-				Type:  ir.Type{Kind: kind.I64},
-				Left:  oneA,
-				Right: iterA,
-			})
-			g.insertInstruction(endBlock, ir.Inst{
-				Kind:    ir.Goto,
-				Literal: headBlock.Index,
-			})
-			headBlock.AddPredecesor(endBlock)
-			nextBlock := g.NewBlock("next", procedure, []*ir.Block{headBlock}, true)
-			iterInst.Literal = []ir.PhiLiteral{{endBlock.Index, endA}, {block.Index, la}}
-			jumpInst.Literal = nextBlock.Index
-			g.sealBlock(block)
-			g.sealBlock(headBlock)
-			g.sealBlock(bodyBlock)
-			g.sealBlock(endBlock)
-			g.sealBlock(nextBlock)
-			block = nextBlock
-		}
+		lessA := g.insertInstruction(headBlock, ir.Inst{
+			Kind: ir.Less,
+			Type: ir.Type{Kind: kind.Bool},
+			Args: []ir.Assignment{iterA, ra},
+		})
+		notA := g.insertInstruction(headBlock, ir.Inst{
+			Kind: ir.Not,
+			Type: ir.Type{Kind: kind.Bool},
+			Args: []ir.Assignment{lessA},
+		})
+		jumpA := g.insertInstruction(headBlock, ir.Inst{
+			Kind: ir.GotoIf,
+			Type: ir.Type{Kind: kind.None},
+			Args: []ir.Assignment{notA},
+		})
+		jumpInst := headBlock.Get(jumpA)
+
+		bodyBlock := g.NewBlock("loop_body", procedure, []*ir.Block{headBlock}, false)
+		bodyStart := bodyBlock
+		_, bodyBlock = g.generate(node.Body, procedure, bodyBlock)
+
+		endBlock := g.NewBlock("loop_end", procedure, []*ir.Block{bodyBlock}, true)
+		oneA := g.insertInstruction(endBlock, ir.Inst{
+			Kind:   ir.I64,
+			Type:   ir.Type{Kind: kind.IntConstant},
+			Static: true,
+			Int:    1,
+		})
+		endA := g.insertInstruction(endBlock, ir.Inst{
+			Kind: ir.Add,
+			Args: []ir.Assignment{oneA, iterA},
+		})
+		g.insertInstruction(endBlock, ir.Inst{
+			Kind:  ir.Goto,
+			Block: headBlock.Index,
+		})
+		headBlock.AddPredecesor(endBlock)
+		nextBlock := g.NewBlock("next", procedure, []*ir.Block{headBlock}, true)
+		iterInst.Phis = []ir.PhiLiteral{{BlockIndex: endBlock.Index, Assignment: endA}, {BlockIndex: block.Index, Assignment: la}}
+		jumpInst.Block = nextBlock.Index
+		g.sealBlock(block)
+		g.sealBlock(headBlock)
+		g.sealBlock(bodyStart)
+		g.sealBlock(bodyBlock)
+		g.sealBlock(endBlock)
+		g.sealBlock(nextBlock)
+		block = nextBlock
 
 	case *ast.Match:
 		var na ir.Assignment
@@ -328,122 +419,185 @@ func (g *Generator) generate(node ast.Node, procedure *ir.Proc, block *ir.Block)
 				// Left side of assignment, then check if match
 				la, block = g.generate(n.Left, procedure, block)
 				ea = g.insertInstruction(block, ir.Inst{
-					Kind:  ir.Equals,
-					Left:  na,
-					Right: la,
+					Kind: ir.Equals,
+					Args: []ir.Assignment{na, la},
 				})
 				g.insertInstruction(block, ir.Inst{
-					Kind:    ir.GotoIf,
-					Left:    ea,
-					Literal: blocks[idx].Index,
+					Kind:  ir.GotoIf,
+					Args:  []ir.Assignment{ea},
+					Block: blocks[idx].Index,
 				})
 
 				// Execute command if match, then go to next
-				blockBodyIndex := blocks[idx].Index
 				ra, blocks[idx] = g.generate(n.Right, procedure, blocks[idx])
 				g.insertInstruction(blocks[idx], ir.Inst{
-					Kind:    ir.Goto,
-					Literal: blockNext.Index,
+					Kind:  ir.Goto,
+					Block: blockNext.Index,
 				})
 
 				blockNext.AddPredecesor(blocks[idx])
-				phi = append(phi, ir.PhiLiteral{blockBodyIndex, ra})
+				phi = append(phi, ir.PhiLiteral{BlockIndex: blocks[idx].Index, Assignment: ra})
 			}
 		}
 
 		a = g.insertInstruction(blockNext, ir.Inst{
-			Kind:    ir.Phi,
-			Type:    ir.Type{Kind: kind.None},
-			Literal: phi,
+			Kind: ir.Phi,
+			Type: ir.Type{Kind: kind.None},
+			Phis: phi,
 		})
 		block = blockNext
 
 	case *ast.ProcedureType:
-		var ret ir.Assignment
-
-		if node.ReturnType != nil {
-			ret, block = g.generate(node.ReturnType, procedure, block)
-		}
-
 		a = g.insertInstruction(block, ir.Inst{
-			Kind:    ir.ProcedureType,
-			Type:    ir.Type{Kind: kind.Type},
-			Static:  true,
-			Literal: ret,
+			Kind:   ir.ProcedureType,
+			Type:   procedureType(node),
+			Static: true,
 		})
 
 	case *ast.ProcedureDefinition:
-		newProcedure := g.NewProcedure("anon")
+		name := "anon"
+		if node.ProcedureType.Name != nil {
+			name = node.ProcedureType.Name.Value
+		} else if g.name != "" {
+			name = g.name
+		}
+		g.name = ""
+		newProcedure := g.NewProcedure(name)
 		newBlock := g.NewBlock("_start", newProcedure, []*ir.Block{}, true)
-
-		a = g.insertInstruction(block, ir.Inst{
-			Kind:    ir.ProcedureDefinition,
-			Type:    ir.Type{Kind: kind.Function},
-			Static:  true,
-			Literal: newProcedure.Index,
-		})
+		c := &closure{}
+		g.closures[newBlock] = c
 
 		if node.ProcedureType.Name != nil {
-			block.Symbols[node.ProcedureType.Name.Value] = a
-			newBlock.Symbols[node.ProcedureType.Name.Value] = a
+			newBlock.Symbols[node.ProcedureType.Name.Value] = g.insertInstruction(newBlock, ir.Inst{
+				Kind: ir.Self,
+			})
 		}
 
-		for _, arg := range node.ProcedureType.Arguments {
-			var t ir.Assignment
-			t, newBlock = g.generate(arg.Type, newProcedure, newBlock)
+		for idx, arg := range node.ProcedureType.Arguments {
 			newBlock.Symbols[arg.Name] = g.insertInstruction(newBlock, ir.Inst{
-				Kind: ir.Pop,
-				Left: t,
+				Kind:   ir.Param,
+				Type:   typeOf(arg.Type),
+				Symbol: arg.Name,
+				Int:    int64(idx),
+				Bool:   arg.Value != nil,
 			})
+			if arg.Value != nil {
+				newBlock = g.generateDefault(arg, idx, newProcedure, newBlock)
+			}
 		}
 
-		var returnBody ir.Assignment
-		returnBody, newBlock = g.generate(node.Body, newProcedure, newBlock)
-		_ = g.insertInstruction(newBlock, ir.Inst{
+		var results []ir.Assignment
+		results, newBlock = g.generateResults(node.Body, newProcedure, newBlock)
+		_ = g.insertRet(newProcedure, newBlock, ir.Inst{
 			Kind: ir.Ret,
-			Left: returnBody,
+			Args: results,
 		})
 
+		// The body is generated first, so that we know which values it captures
+		if len(c.captures) == 0 {
+			a = g.insertInstruction(block, ir.Inst{
+				Kind:   ir.ProcedureDefinition,
+				Type:   procedureType(node.ProcedureType),
+				Static: true,
+				Proc:   newProcedure.Index,
+			})
+		} else {
+			captured := make([]ir.Assignment, len(c.captures))
+			for idx, name := range c.captures {
+				captured[idx] = g.lookupSymbol(name, block)
+			}
+			a = g.insertInstruction(block, ir.Inst{
+				Kind: ir.MakeClosure,
+				Type: procedureType(node.ProcedureType),
+				Proc: newProcedure.Index,
+				Args: captured,
+			})
+		}
+
+		if node.ProcedureType.Name != nil {
+			g.define(procedure, block, node.ProcedureType.Name.Value, a)
+		}
+
 	case *ast.Call:
 		var proc ir.Assignment
 		proc, block = g.generate(node.Procedure, procedure, block)
 
-		for _, node := range node.Arguments {
+		args := []ir.Assignment{proc}
+		var names []string
+		for idx, n := range node.Arguments {
+			if fields, ok := namedArguments(n); ok && idx == len(node.Arguments)-1 {
+				if names == nil {
+					names = make([]string, len(args))
+				}
+				for _, field := range fields {
+					var arg ir.Assignment
+					arg, block = g.generate(field.Right, procedure, block)
+					args = append(args, arg)
+					names = append(names, field.Left.(*ast.Identifier).Value)
+				}
+				continue
+			}
 			var arg ir.Assignment
-			arg, block = g.generate(node, procedure, block)
-			_ = g.insertInstruction(block, ir.Inst{
-				Kind: ir.Push,
-				Left: arg,
-			})
+			arg, block = g.generate(n, procedure, block)
+			args = append(args, arg)
+			if names != nil {
+				names = append(names, "")
+			}
 		}
 
 		a = g.insertInstruction(block, ir.Inst{
-			Kind: ir.Call,
-			Left: proc,
+			Kind:  ir.Call,
+			Args:  args,
+			Names: names,
 		})
 
 	case *ast.TrueLiteral:
 		a = g.insertInstruction(block, ir.Inst{
-			Type:    ir.Type{Kind: kind.Bool},
-			Static:  true,
-			Kind:    ir.Bool,
-			Literal: true,
+			Type:   ir.Type{Kind: kind.Bool},
+			Static: true,
+			Kind:   ir.Bool,
+			Bool:   true,
 		})
 
 	case *ast.FalseLiteral:
 		a = g.insertInstruction(block, ir.Inst{
-			Type:    ir.Type{Kind: kind.Bool},
-			Static:  true,
-			Kind:    ir.Bool,
-			Literal: false,
+			Type:   ir.Type{Kind: kind.Bool},
+			Static: true,
+			Kind:   ir.Bool,
+			Bool:   false,
 		})
 
 	case *ast.IntLiteral:
 		a = g.insertInstruction(block, ir.Inst{
-			Type:    ir.Type{Kind: kind.IntConstant},
-			Static:  true,
-			Kind:    ir.I64,
-			Literal: node.Value,
+			Type:   ir.Type{Kind: kind.IntConstant},
+			Static: true,
+			Kind:   ir.I64,
+			Int:    node.Value,
+		})
+
+	case *ast.FloatLiteral:
+		a = g.insertInstruction(block, ir.Inst{
+			Type:   ir.Type{Kind: kind.FloatConstant},
+			Static: true,
+			Kind:   ir.F64,
+			Float:  node.Value,
+		})
+
+	case *ast.StringLiteral:
+		a = g.insertInstruction(block, ir.Inst{
+			Type:   ir.Type{Kind: kind.StringConstant},
+			Static: true,
+			Kind:   ir.String,
+			Text:   node.Value,
+		})
+
+	case *ast.RuneLiteral:
+		r, _ := utf8.DecodeRuneInString(node.Value)
+		a = g.insertInstruction(block, ir.Inst{
+			Type:   ir.Type{Kind: kind.Rune},
+			Static: true,
+			Kind:   ir.Rune,
+			Int:    int64(r),
 		})
 
 	case *ast.DefaultLiteral:
@@ -451,53 +605,35 @@ func (g *Generator) generate(node ast.Node, procedure *ir.Proc, block *ir.Block)
 			Kind: ir.Default,
 		})
 
+	case *ast.Go:
+		a, block = g.generateGo(node, procedure, block)
+
+	case *ast.Select:
+		a, block = g.generateSelect(node, procedure, block)
+
+	case *ast.Defer:
+		a, block = g.generateDefer(node, procedure, block)
+
+	case *ast.Yield:
+		a, block = g.generateYield(node, procedure, block)
+
 	case *ast.Infix:
 		var la, ra ir.Assignment
 		la, block = g.generate(node.Left, procedure, block)
 		ra, block = g.generate(node.Right, procedure, block)
-		switch node.Operator {
-		case token.ADD:
-			a = g.insertInstruction(block, ir.Inst{
-				Kind:  ir.Add,
-				Left:  la,
-				Right: ra,
-			})
-		case token.SUB:
-			a = g.insertInstruction(block, ir.Inst{
-				Kind:  ir.Sub,
-				Left:  la,
-				Right: ra,
+		if node.Operator == token.LEFT_ARROW {
+			g.insertInstruction(block, ir.Inst{
+				Kind: ir.Send,
+				Args: []ir.Assignment{la, ra},
 			})
-		case token.MUL:
+			a = ra
+		} else if k, ok := infixKinds[node.Operator]; ok {
 			a = g.insertInstruction(block, ir.Inst{
-				Kind:  ir.Mul,
-				Left:  la,
-				Right: ra,
-			})
-		case token.QUO:
-			a = g.insertInstruction(block, ir.Inst{
-				Kind:  ir.Quo,
-				Left:  la,
-				Right: ra,
-			})
-		case token.AND:
-			a = g.insertInstruction(block, ir.Inst{
-				Kind:  ir.And,
-				Left:  la,
-				Right: ra,
-			})
-		case token.EQUAL:
-			a = g.insertInstruction(block, ir.Inst{
-				Kind:  ir.Equals,
-				Left:  la,
-				Right: ra,
-			})
-		case token.NOT_EQUAL:
-			a = g.insertInstruction(block, ir.Inst{
-				Kind:  ir.NotEquals,
-				Left:  la,
-				Right: ra,
+				Kind: k,
+				Args: []ir.Assignment{la, ra},
 			})
+		} else {
+			g.appendError(fmt.Sprintf("Operator '%s' is not supported", node.Operator), node.OperatorPos, node.OperatorPos+1)
 		}
 
 	case *ast.Prefix:
@@ -507,44 +643,211 @@ func (g *Generator) generate(node ast.Node, procedure *ir.Proc, block *ir.Block)
 		case token.NOT:
 			a = g.insertInstruction(block, ir.Inst{
 				Kind: ir.Not,
-				Left: exprA,
+				Args: []ir.Assignment{exprA},
 			})
+		case token.SUB:
+			zeroA := g.insertInstruction(block, ir.Inst{
+				Type:   ir.Type{Kind: kind.IntConstant},
+				Static: true,
+				Kind:   ir.I64,
+			})
+			a = g.insertInstruction(block, ir.Inst{
+				Kind: ir.Sub,
+				Args: []ir.Assignment{zeroA, exprA},
+			})
+		case token.LEFT_ARROW:
+			a = g.insertInstruction(block, ir.Inst{
+				Kind: ir.Receive,
+				Args: []ir.Assignment{exprA},
+			})
+		default:
+			g.appendError(fmt.Sprintf("Operator '%s' is not supported", node.Operator), node.OperatorPos, node.OperatorPos+1)
+		}
+
+	case *ast.As:
+		a, block = g.generate(node.Node, procedure, block)
+		t := typeOf(node.Type)
+		if !t.Kind.IsInteger() && !t.Kind.IsFloat() && t.Kind != kind.Rune && t.Kind != kind.String {
+			g.appendError("Can only convert to numbers, runes and strings", node.Type.Pos(), node.Type.End())
+			break
 		}
+		a = g.insertInstruction(block, ir.Inst{
+			Kind: ir.Convert,
+			Type: t,
+			Args: []ir.Assignment{a},
+		})
 	case *ast.Identifier:
 		a = g.lookupSymbol(node.Value, block)
 
+	case *ast.Indexor:
+		switch index := node.Index.(type) {
+		case *ast.Identifier:
+			var na ir.Assignment
+			na, block = g.generate(node.Node, procedure, block)
+			a = g.insertInstruction(block, ir.Inst{
+				Kind:   ir.Member,
+				Symbol: index.Value,
+				Args:   []ir.Assignment{na},
+			})
+		case *ast.Tuple:
+			a, block = g.generateIndex(node, index, procedure, block)
+		}
+
+	case *ast.Construct:
+		a, block = g.generateConstruct(node, procedure, block)
+
+	case *ast.TypeSpec:
+		a, block = g.generateTypeSpec(node, procedure, block)
+
+	case nil:
+
 	default:
-		fmt.Printf("NOT GENERATED: %T\n", node)
+		g.appendError(fmt.Sprintf("%s is not supported yet", strings.TrimPrefix(fmt.Sprintf("%T", node), "*ast.")), node.Pos(), node.End())
 	}
 	return a, block
 }
 
+var infixKinds = map[token.Token]ir.InstKind{
+	token.ADD:       ir.Add,
+	token.SUB:       ir.Sub,
+	token.MUL:       ir.Mul,
+	token.QUO:       ir.Quo,
+	token.AND:       ir.And,
+	token.OR:        ir.Or,
+	token.EQUAL:     ir.Equals,
+	token.NOT_EQUAL: ir.NotEquals,
+	token.LESS:      ir.Less,
+	token.GREATER:   ir.Greater,
+}
+
+// generateResults generates the values that a procedure returns. A tuple of
+// unnamed values like `(a+b, a-b)` is returned as several values, rather than
+// constructing a tuple.
+func (g *Generator) generateResults(node ast.Node, procedure *ir.Proc, block *ir.Block) ([]ir.Assignment, *ir.Block) {
+	tuple, ok := node.(*ast.Tuple)
+	if !ok || len(tuple.Nodes) == 1 {
+		var a ir.Assignment
+		a, block = g.generate(node, procedure, block)
+		return g.args(a), block
+	}
+	for _, n := range tuple.Nodes {
+		if _, ok := n.(*ast.Assign); ok {
+			var a ir.Assignment
+			a, block = g.generate(node, procedure, block)
+			return g.args(a), block
+		}
+	}
+
+	results := make([]ir.Assignment, 0, len(tuple.Nodes))
+	for _, n := range tuple.Nodes {
+		var a ir.Assignment
+		a, block = g.generate(n, procedure, block)
+		results = append(results, a)
+	}
+	return results, block
+}
+
+// args returns a as the only argument of an instruction, or no arguments if
+// a is empty.
+func (g *Generator) args(a ir.Assignment) []ir.Assignment {
+	if a == 0 {
+		return nil
+	}
+	return []ir.Assignment{a}
+}
+
+// define binds name to a in block, exporting it if it's at the top level.
+func (g *Generator) define(procedure *ir.Proc, block *ir.Block, name string, a ir.Assignment) {
+	block.Symbols[name] = a
+	if procedure.Index != 0 || name == "_" {
+		return
+	}
+	for _, export := range g.exports {
+		if export == name {
+			return
+		}
+	}
+	g.exports = append(g.exports, name)
+}
+
+// checkCaptured reports assigning a name that the procedure captured, which
+// would only change its own copy, and leave the one it captured alone. That
+// goes for blocks too, even ones that only run during the call they're passed
+// to, like `.times 3 λ { count: count + 1 }`, since captures are always
+// copies. Values that a block should change go in an array or map instead,
+// which the copy shares.
+func (g *Generator) checkCaptured(procedure *ir.Proc, name *ast.Identifier) {
+	c, ok := g.closures[procedure.Blocks[0]]
+	if !ok {
+		return
+	}
+	for _, captured := range c.captures {
+		if captured == name.Value {
+			g.appendError(fmt.Sprintf("Can't assign %s, which is captured from outside of the procedure, keep it in an array or map to change it", name.Value), name.Pos(), name.End())
+			return
+		}
+	}
+}
+
+// defines reports whether name is defined on every path to block, so that
+// looking it up won't fall back to a global. Names that are only defined in
+// the body of a loop, for example, aren't.
+func defines(block *ir.Block, name string, seen map[*ir.Block]bool) bool {
+	if _, ok := block.Symbols[name]; ok {
+		return true
+	}
+	if seen[block] {
+		return true
+	}
+	seen[block] = true
+	if len(block.Predecesors) == 0 {
+		return false
+	}
+	for _, pred := range block.Predecesors {
+		if !defines(pred, name, seen) {
+			return false
+		}
+	}
+	return true
+}
+
 func (g *Generator) resolvePhi(name string, phi *ir.Inst, block *ir.Block) ir.Assignment {
 	for _, pred := range block.Predecesors {
 		res := g.lookupSymbol(name, pred)
-		if res != -1 {
-			phi.Literal = append(phi.Literal.([]ir.PhiLiteral), ir.PhiLiteral{pred.Index, res})
-		}
+		phi.Phis = append(phi.Phis, ir.PhiLiteral{BlockIndex: pred.Index, Assignment: res})
 	}
 
 	return block.Symbols[name]
 }
 
 func (g *Generator) lookupSymbol(name string, block *ir.Block) ir.Assignment {
-	switch name {
-	case "i64":
-		//TODO
-		return -1
-	}
-
 	if a, ok := block.Symbols[name]; ok {
 		return a
 	}
 
+	// Symbols that aren't defined by the time we reach the start of a
+	// procedure are captured from where the procedure is defined
+	if c, ok := g.closures[block]; ok {
+		block.Symbols[name] = g.insertInstruction(block, ir.Inst{
+			Kind:   ir.Capture,
+			Symbol: name,
+			Int:    int64(len(c.captures)),
+		})
+		c.captures = append(c.captures, name)
+		return block.Symbols[name]
+	}
+	if block == g.entry {
+		block.Symbols[name] = g.insertInstruction(block, ir.Inst{
+			Kind:   ir.Global,
+			Symbol: name,
+		})
+		return block.Symbols[name]
+	}
+
 	block.Symbols[name] = g.insertInstruction(block, ir.Inst{
-		Kind:    ir.Phi,
-		Symbol:  name,
-		Literal: []ir.PhiLiteral{},
+		Kind:   ir.Phi,
+		Symbol: name,
+		Phis:   []ir.PhiLiteral{},
 	})
 	phi := block.Get(block.Symbols[name])
 	if !block.Sealed {
@@ -569,7 +872,14 @@ func (g *Generator) sealBlock(block *ir.Block) {
 func (g *Generator) insertInstruction(block *ir.Block, inst ir.Inst) ir.Assignment {
 	inst.Index = g.counter
 	g.counter += 1
+	if inst.Pos == 0 && inst.End == 0 {
+		inst.Pos, inst.End = g.pos, g.end
+	}
 	block.Map[inst.Index] = len(block.Instructions)
 	block.Instructions = append(block.Instructions, &inst)
 	return inst.Index
 }
+
+func (g *Generator) appendError(msg string, pos token.Pos, end token.Pos) {
+	*g.errors = append(*g.errors, token.NewError("[irgen] "+msg, pos, end))
+}
@@ -0,0 +1,89 @@
+package irgen
+
+import (
+	"github.com/yjp20/turtle/straw/pkg/ast"
+	"github.com/yjp20/turtle/straw/pkg/ir"
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+// generateIteration generates ∀ name ∈ x body for anything other than a
+// range, which asks an iterator over x for each value in turn:
+//
+//	it = Iterate(x)
+//	loop: if not Next(it), go to next
+//	loop_body: name = Current(it); body
+//	loop_end: go to loop
+//	next:
+//
+// Returning from the body closes the iterator first, so that generators and
+// readers it was left partway through get to clean up.
+func (g *Generator) generateIteration(name string, x ast.Node, body ast.Node, procedure *ir.Proc, block *ir.Block) *ir.Block {
+	var xa ir.Assignment
+	xa, block = g.generate(x, procedure, block)
+	ia := g.insertInstruction(block, ir.Inst{
+		Kind: ir.Iterate,
+		Type: ir.Type{Kind: kind.Iterator},
+		Args: []ir.Assignment{xa},
+	})
+
+	headBlock := g.NewBlock("loop", procedure, []*ir.Block{block}, false)
+	okA := g.insertInstruction(headBlock, ir.Inst{
+		Kind: ir.Next,
+		Type: ir.Type{Kind: kind.Bool},
+		Args: []ir.Assignment{ia},
+	})
+	notA := g.insertInstruction(headBlock, ir.Inst{
+		Kind: ir.Not,
+		Type: ir.Type{Kind: kind.Bool},
+		Args: []ir.Assignment{okA},
+	})
+	jumpA := g.insertInstruction(headBlock, ir.Inst{
+		Kind: ir.GotoIf,
+		Type: ir.Type{Kind: kind.None},
+		Args: []ir.Assignment{notA},
+	})
+	jumpInst := headBlock.Get(jumpA)
+
+	bodyBlock := g.NewBlock("loop_body", procedure, []*ir.Block{headBlock}, false)
+	bodyStart := bodyBlock
+	bodyBlock.Symbols[name] = g.insertInstruction(bodyBlock, ir.Inst{
+		Kind: ir.Current,
+		Args: []ir.Assignment{ia},
+	})
+	g.iterators[procedure] = append(g.iterators[procedure], ia)
+	_, bodyBlock = g.generate(body, procedure, bodyBlock)
+	g.iterators[procedure] = g.iterators[procedure][:len(g.iterators[procedure])-1]
+
+	endBlock := g.NewBlock("loop_end", procedure, []*ir.Block{bodyBlock}, true)
+	g.insertInstruction(endBlock, ir.Inst{
+		Kind:  ir.Goto,
+		Block: headBlock.Index,
+	})
+	headBlock.AddPredecesor(endBlock)
+	nextBlock := g.NewBlock("next", procedure, []*ir.Block{headBlock}, true)
+	jumpInst.Block = nextBlock.Index
+	g.sealBlock(block)
+	g.sealBlock(headBlock)
+	g.sealBlock(bodyStart)
+	g.sealBlock(bodyBlock)
+	g.sealBlock(endBlock)
+	g.sealBlock(nextBlock)
+	return nextBlock
+}
+
+// generateYield generates yield x, which makes the procedure it's in a
+// generator.
+func (g *Generator) generateYield(node *ast.Yield, procedure *ir.Proc, block *ir.Block) (ir.Assignment, *ir.Block) {
+	if procedure.Index == 0 {
+		g.appendError("Can't yield outside of a procedure", node.Pos(), node.End())
+		return 0, block
+	}
+	procedure.Generator = true
+	var a ir.Assignment
+	a, block = g.generate(node.Node, procedure, block)
+	g.insertInstruction(block, ir.Inst{
+		Kind: ir.Yield,
+		Args: []ir.Assignment{a},
+	})
+	return 0, block
+}
@@ -0,0 +1,351 @@
+package irgen
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/yjp20/turtle/straw/pkg/ir"
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+// Numbers are typed statically where that's possible. Literals are untyped
+// constants, which take the kind of whatever they're combined with, and
+// combining two different kinds is an error. Where kinds aren't known, like
+// the arguments of a procedure without types, the vm checks them instead.
+//
+// Untyped constants are i64s and f64s at runtime, so using one as another
+// kind needs a conversion, which is inserted by typeNumbers.
+
+var arithmetic = map[ir.InstKind]string{
+	ir.Add: "+", ir.Sub: "-", ir.Mul: "*", ir.Quo: "%", ir.Mod: "mod",
+}
+
+var comparisons = map[ir.InstKind]string{
+	ir.Less: "<", ir.Greater: ">", ir.Equals: "=", ir.NotEquals: "≠",
+}
+
+// unify returns the kind that numbers of kinds a and b combine into.
+func unify(a, b kind.Kind) (kind.Kind, bool) {
+	switch {
+	case a == b:
+		return a, true
+	case a == kind.IntConstant:
+		return b, true
+	case b == kind.IntConstant:
+		return a, true
+	case a == kind.FloatConstant && b.IsFloat():
+		return b, true
+	case b == kind.FloatConstant && a.IsFloat():
+		return a, true
+	}
+	return 0, false
+}
+
+// runtimeKind is the kind that a number of kind k has in the vm.
+func runtimeKind(k kind.Kind) kind.Kind {
+	switch k {
+	case kind.IntConstant:
+		return kind.I64
+	case kind.FloatConstant:
+		return kind.F64
+	}
+	return k
+}
+
+type numbers struct {
+	g     *Generator
+	insts map[ir.Assignment]*ir.Inst
+	block map[ir.Assignment]*ir.Block
+	procs map[*ir.Block]*ir.Proc
+
+	// kinds holds the kind of every value that is known so far
+	kinds map[ir.Assignment]kind.Kind
+}
+
+// typeNumbers infers the kinds of arithmetic and phis from their operands.
+// Phis can depend on themselves through loops, so this starts out knowing
+// nothing about them, and goes over the program until nothing changes.
+func (g *Generator) typeNumbers() {
+	n := &numbers{
+		g:     g,
+		insts: map[ir.Assignment]*ir.Inst{},
+		block: map[ir.Assignment]*ir.Block{},
+		procs: map[*ir.Block]*ir.Proc{},
+		kinds: map[ir.Assignment]kind.Kind{},
+	}
+	for _, proc := range g.program.Procedures {
+		for _, block := range proc.Blocks {
+			n.procs[block] = proc
+			for _, inst := range block.Instructions {
+				n.insts[inst.Index] = inst
+				n.block[inst.Index] = block
+				switch {
+				case inst.Kind == ir.Phi, arithmetic[inst.Kind] != "":
+				case comparisons[inst.Kind] != "":
+					n.kinds[inst.Index] = kind.Bool
+				default:
+					n.kinds[inst.Index] = inst.Type.Kind
+				}
+			}
+		}
+	}
+
+	// Kinds only ever get less specific, from a constant to a kind of
+	// number to unresolved, so this stops
+	for changed := true; changed; {
+		changed = false
+		n.each(func(inst *ir.Inst) {
+			if inst.Kind != ir.Phi && arithmetic[inst.Kind] == "" {
+				return
+			}
+			k, ok := n.infer(inst)
+			if old, known := n.kinds[inst.Index]; ok && (!known || old != k) {
+				n.kinds[inst.Index] = k
+				changed = true
+			}
+		})
+	}
+
+	n.each(func(inst *ir.Inst) {
+		switch {
+		case inst.Kind == ir.Phi:
+			if name, ok := n.g.defaults[inst.Index]; ok {
+				n.defaultValue(inst, name)
+			}
+			n.phi(inst)
+		case arithmetic[inst.Kind] != "", comparisons[inst.Kind] != "":
+			n.operands(inst)
+		case inst.Kind == ir.Convert:
+			n.convert(inst)
+		}
+	})
+}
+
+func (n *numbers) each(fn func(inst *ir.Inst)) {
+	for _, proc := range n.g.program.Procedures {
+		for _, block := range proc.Blocks {
+			// fn can insert instructions into the block
+			for _, inst := range append([]*ir.Inst{}, block.Instructions...) {
+				fn(inst)
+			}
+		}
+	}
+}
+
+// infer works out the kind of a phi or arithmetic, once it knows enough of
+// the kinds it depends on. Anything that doesn't combine is unresolved.
+func (n *numbers) infer(inst *ir.Inst) (kind.Kind, bool) {
+	if inst.Kind == ir.Phi {
+		var k kind.Kind
+		known := false
+		for _, phi := range inst.Phis {
+			pk, ok := n.kinds[phi.Assignment]
+			switch {
+			case !ok:
+				continue
+			case !known:
+				k, known = pk, true
+			case k.IsNumber() && pk.IsNumber():
+				if k, ok = unify(k, pk); !ok {
+					return kind.Unresolved, true
+				}
+			case k != pk:
+				return kind.Unresolved, true
+			}
+		}
+		return k, known
+	}
+
+	l, lok := n.kinds[inst.Args[0]]
+	r, rok := n.kinds[inst.Args[1]]
+	if !lok || !rok {
+		return 0, false
+	}
+	if k, ok := unify(l, r); ok && k.IsNumber() {
+		return k, true
+	}
+	return kind.Unresolved, true
+}
+
+// operands checks that the operands of arithmetic or a comparison are the
+// same kind, converting untyped constants where they need to be.
+func (n *numbers) operands(inst *ir.Inst) {
+	l, r := n.kinds[inst.Args[0]], n.kinds[inst.Args[1]]
+	if !l.IsNumber() || !r.IsNumber() {
+		return
+	}
+	k, ok := unify(l, r)
+	if !ok {
+		op := arithmetic[inst.Kind] + comparisons[inst.Kind]
+		n.g.appendError(fmt.Sprintf("Mismatched types %s and %s in %s", typeName(l), typeName(r), op), inst.Pos, inst.End)
+		return
+	}
+	if arithmetic[inst.Kind] != "" {
+		inst.Type = ir.Type{Kind: k}
+	}
+	block := n.block[inst.Index]
+	for i, a := range inst.Args {
+		inst.Args[i] = n.constant(a, k, block, func(c *ir.Inst) { n.insertBefore(block, inst, c) })
+	}
+}
+
+// phi converts the constants that flow into a phi of a known kind of
+// number, at the end of the blocks they come from.
+func (n *numbers) phi(inst *ir.Inst) {
+	k := n.kinds[inst.Index]
+	if !k.IsNumber() {
+		return
+	}
+	inst.Type = ir.Type{Kind: k}
+	proc := n.procs[n.block[inst.Index]]
+	for i, phi := range inst.Phis {
+		pred := proc.Blocks[phi.BlockIndex]
+		inst.Phis[i].Assignment = n.constant(phi.Assignment, k, pred, func(c *ir.Inst) { n.insertAtEnd(pred, c) })
+	}
+}
+
+// defaultValue checks that the default of the parameter name, which is what
+// the phi inst picks from its second block, is of the parameter's kind.
+func (n *numbers) defaultValue(inst *ir.Inst, name string) {
+	want, got := inst.Type.Kind, n.kinds[inst.Phis[1].Assignment]
+	if !want.IsNumber() || !got.IsNumber() {
+		return
+	}
+	if k, ok := unify(want, got); !ok || k != want {
+		n.g.appendError(fmt.Sprintf("Cannot use %s as %s, the default of %s", typeName(got), typeName(want), name), inst.Pos, inst.End)
+	}
+}
+
+// convert checks conversions whose operand is known not to be a number.
+func (n *numbers) convert(inst *ir.Inst) {
+	from := n.kinds[inst.Args[0]]
+	to := inst.Type.Kind
+	switch {
+	case from == kind.Unresolved, from == kind.Any, from.IsNumber() && to != kind.String:
+	case from == kind.Rune && (to.IsInteger() || to.IsFloat() || to == kind.Rune || to == kind.String):
+	case (from == kind.String || from == kind.StringConstant) && to == kind.String:
+	default:
+		n.g.appendError(fmt.Sprintf("Cannot convert %s to %s", typeName(from), typeName(to)), inst.Pos, inst.End)
+	}
+}
+
+// constant returns a, converted to the kind k if it's an untyped constant
+// which isn't already that kind at runtime. Literals are converted as they
+// are generated, and anything else with a Convert, both of which are
+// inserted by insert.
+func (n *numbers) constant(a ir.Assignment, k kind.Kind, block *ir.Block, insert func(*ir.Inst)) ir.Assignment {
+	from := n.kinds[a]
+	if from != kind.IntConstant && from != kind.FloatConstant || runtimeKind(from) == runtimeKind(k) {
+		return a
+	}
+	inst := n.insts[a]
+	c := &ir.Inst{Kind: ir.Convert, Type: ir.Type{Kind: runtimeKind(k)}, Args: []ir.Assignment{a}, Pos: inst.Pos, End: inst.End}
+	if inst.Kind == ir.I64 || inst.Kind == ir.F64 {
+		c = n.literal(inst, k)
+	}
+	c.Index = n.g.counter
+	n.g.counter++
+	n.insts[c.Index] = c
+	n.block[c.Index] = block
+	n.kinds[c.Index] = k
+	insert(c)
+	return c.Index
+}
+
+// literal makes a literal of kind k with the value of the constant literal
+// inst, which has to fit.
+func (n *numbers) literal(inst *ir.Inst, k kind.Kind) *ir.Inst {
+	c := &ir.Inst{Type: ir.Type{Kind: k}, Static: true, Pos: inst.Pos, End: inst.End}
+	switch k {
+	case kind.I8:
+		c.Kind = ir.I8
+	case kind.I16:
+		c.Kind = ir.I16
+	case kind.I32:
+		c.Kind = ir.I32
+	case kind.F32:
+		c.Kind = ir.F32
+	case kind.F64, kind.FloatConstant:
+		c.Kind = ir.F64
+	default:
+		c.Kind = ir.I64
+	}
+
+	if c.Kind == ir.F32 || c.Kind == ir.F64 {
+		c.Float = inst.Float
+		if inst.Kind == ir.I64 {
+			c.Float = float64(inst.Int)
+		}
+		return c
+	}
+	c.Int = inst.Int
+	if !fits(k, inst.Int) {
+		n.g.appendError(fmt.Sprintf("Constant %d overflows %s", inst.Int, typeName(k)), inst.Pos, inst.End)
+	}
+	return c
+}
+
+// fits reports whether the constant v is in the range of the integer kind k.
+func fits(k kind.Kind, v int64) bool {
+	switch k {
+	case kind.I8:
+		return math.MinInt8 <= v && v <= math.MaxInt8
+	case kind.I16:
+		return math.MinInt16 <= v && v <= math.MaxInt16
+	case kind.I32:
+		return math.MinInt32 <= v && v <= math.MaxInt32
+	case kind.U8:
+		return 0 <= v && v <= math.MaxUint8
+	case kind.U16:
+		return 0 <= v && v <= math.MaxUint16
+	case kind.U32:
+		return 0 <= v && v <= math.MaxUint32
+	case kind.U64:
+		return 0 <= v
+	}
+	return true
+}
+
+func (n *numbers) insertBefore(block *ir.Block, before *ir.Inst, inst *ir.Inst) {
+	for i, other := range block.Instructions {
+		if other == before {
+			n.insertAt(block, i, inst)
+			return
+		}
+	}
+}
+
+// insertAtEnd inserts inst before the branches at the end of block, so that
+// it's available on every edge out of it.
+func (n *numbers) insertAtEnd(block *ir.Block, inst *ir.Inst) {
+	at := len(block.Instructions)
+	for at > 0 {
+		switch block.Instructions[at-1].Kind {
+		case ir.Goto, ir.GotoIf, ir.Ret, ir.End:
+			at--
+			continue
+		}
+		break
+	}
+	n.insertAt(block, at, inst)
+}
+
+func (n *numbers) insertAt(block *ir.Block, at int, inst *ir.Inst) {
+	block.Instructions = append(block.Instructions, nil)
+	copy(block.Instructions[at+1:], block.Instructions[at:])
+	block.Instructions[at] = inst
+}
+
+// typeName is the name of the type of kind k, as it's written in programs.
+func typeName(k kind.Kind) string {
+	switch k {
+	case kind.IntConstant:
+		return "integer constant"
+	case kind.FloatConstant:
+		return "float constant"
+	case kind.StringConstant:
+		return "string"
+	}
+	return strings.ToLower(k.String())
+}
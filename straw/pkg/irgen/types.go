@@ -0,0 +1,123 @@
+package irgen
+
+import (
+	"github.com/yjp20/turtle/straw/pkg/ast"
+	"github.com/yjp20/turtle/straw/pkg/ir"
+	"github.com/yjp20/turtle/straw/pkg/kind"
+	"github.com/yjp20/turtle/straw/pkg/token"
+)
+
+var typeNames = map[string]kind.Kind{
+	"bool":   kind.Bool,
+	"i8":     kind.I8,
+	"i16":    kind.I16,
+	"i32":    kind.I32,
+	"i64":    kind.I64,
+	"u8":     kind.U8,
+	"u16":    kind.U16,
+	"u32":    kind.U32,
+	"u64":    kind.U64,
+	"f32":    kind.F32,
+	"f64":    kind.F64,
+	"string": kind.String,
+	"rune":   kind.Rune,
+	"any":    kind.Any,
+}
+
+// genericTypes are the builtin types which take the types of their elements
+// in brackets, like array[i64] or map[string, i64].
+var genericTypes = map[string]kind.Kind{
+	"array": kind.Array,
+	"slice": kind.Slice,
+	"map":   kind.Map,
+	"chan":  kind.Chan,
+}
+
+// typeOf resolves a type annotation statically. Anything that isn't the name
+// of a builtin type is left unresolved, to be checked at runtime.
+func typeOf(node ast.Node) ir.Type {
+	switch node := node.(type) {
+	case *ast.Identifier:
+		if k, ok := typeNames[node.Value]; ok {
+			return ir.Type{Kind: k}
+		}
+	case *ast.Indexor:
+		if k, ok := genericType(node); ok {
+			return ir.Type{Kind: k}
+		}
+	}
+	return ir.Type{Kind: kind.Unresolved}
+}
+
+// genericType returns the kind of a generic type applied to its parameters,
+// like array[i64].
+func genericType(node *ast.Indexor) (kind.Kind, bool) {
+	identifier, ok := node.Node.(*ast.Identifier)
+	if _, isTuple := node.Index.(*ast.Tuple); !ok || !isTuple {
+		return 0, false
+	}
+	k, ok := genericTypes[identifier.Value]
+	return k, ok
+}
+
+func procedureType(node *ast.ProcedureType) ir.Type {
+	t := ir.Type{Kind: kind.Function}
+	for _, arg := range node.Arguments {
+		t.Extra = append(t.Extra, ir.Field{Name: arg.Name, Type: typeOf(arg.Type)})
+	}
+	if node.ReturnType != nil {
+		t.Returns = append(t.Returns, ir.Field{Type: typeOf(node.ReturnType)})
+	}
+	return t
+}
+
+// generateTypeSpec generates struct (a T, b U, ...) or interface (...), which
+// makes a type with those fields. It takes its name from what it's assigned
+// to, if anything.
+func (g *Generator) generateTypeSpec(node *ast.TypeSpec, procedure *ir.Proc, block *ir.Block) (ir.Assignment, *ir.Block) {
+	name := g.name
+	g.name = ""
+	if node.Params != nil {
+		g.appendError("Type parameters are not supported yet", node.Params.Pos(), node.Params.End())
+	}
+	k := kind.Struct
+	if node.Type == token.INTERFACE {
+		k = kind.Interface
+	}
+	if name == "" {
+		name = typeName(k)
+	}
+
+	var args []ir.Assignment
+	var names []string
+	for _, n := range node.Spec.Nodes {
+		var t ir.Assignment
+		switch n := n.(type) {
+		case *ast.Identifier:
+			// A field without a type can hold anything, which a default
+			// stands for
+			t = g.insertInstruction(block, ir.Inst{Kind: ir.Default})
+			names = append(names, n.Value)
+		case *ast.As:
+			identifier, ok := n.Node.(*ast.Identifier)
+			if !ok {
+				g.appendError("Expected the name of a field", n.Node.Pos(), n.Node.End())
+				continue
+			}
+			t, block = g.generate(n.Type, procedure, block)
+			names = append(names, identifier.Value)
+		default:
+			g.appendError("Expected a field, like (name type)", n.Pos(), n.End())
+			continue
+		}
+		args = append(args, t)
+	}
+	return g.insertInstruction(block, ir.Inst{
+		Kind:   ir.MakeType,
+		Type:   ir.Type{Kind: kind.Type},
+		Symbol: name,
+		Names:  names,
+		Args:   args,
+		Int:    int64(k),
+	}), block
+}
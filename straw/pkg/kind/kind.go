@@ -15,6 +15,7 @@ const (
 	Bool
 
 	IntConstant
+	FloatConstant
 	I8
 	I16
 	I32
@@ -28,12 +29,17 @@ const (
 
 	StringConstant
 	String
+	Rune
 
 	Function
 	BuiltinFunction
 
 	Array
 	Slice
+	Map
+	Chan
+	Iterator
+	Reader
 	Struct
 	Interface
 	Tuple
@@ -41,4 +47,16 @@ const (
 
 	Type
 	Factory
+	Module
 )
+
+// IsInteger reports whether k is one of the sized integers, which doesn't
+// include IntConstant.
+func (k Kind) IsInteger() bool { return I8 <= k && k <= U64 }
+
+func (k Kind) IsUnsigned() bool { return U8 <= k && k <= U64 }
+
+func (k Kind) IsFloat() bool { return k == F32 || k == F64 }
+
+// IsNumber reports whether k is a number, including constants.
+func (k Kind) IsNumber() bool { return IntConstant <= k && k <= F64 }
@@ -16,33 +16,40 @@ func _() {
 	_ = x[Frame-5]
 	_ = x[Bool-6]
 	_ = x[IntConstant-7]
-	_ = x[I8-8]
-	_ = x[I16-9]
-	_ = x[I32-10]
-	_ = x[I64-11]
-	_ = x[U8-12]
-	_ = x[U16-13]
-	_ = x[U32-14]
-	_ = x[U64-15]
-	_ = x[F32-16]
-	_ = x[F64-17]
-	_ = x[StringConstant-18]
-	_ = x[String-19]
-	_ = x[Function-20]
-	_ = x[BuiltinFunction-21]
-	_ = x[Array-22]
-	_ = x[Slice-23]
-	_ = x[Struct-24]
-	_ = x[Interface-25]
-	_ = x[Tuple-26]
-	_ = x[Range-27]
-	_ = x[Type-28]
-	_ = x[Factory-29]
+	_ = x[FloatConstant-8]
+	_ = x[I8-9]
+	_ = x[I16-10]
+	_ = x[I32-11]
+	_ = x[I64-12]
+	_ = x[U8-13]
+	_ = x[U16-14]
+	_ = x[U32-15]
+	_ = x[U64-16]
+	_ = x[F32-17]
+	_ = x[F64-18]
+	_ = x[StringConstant-19]
+	_ = x[String-20]
+	_ = x[Rune-21]
+	_ = x[Function-22]
+	_ = x[BuiltinFunction-23]
+	_ = x[Array-24]
+	_ = x[Slice-25]
+	_ = x[Map-26]
+	_ = x[Chan-27]
+	_ = x[Iterator-28]
+	_ = x[Reader-29]
+	_ = x[Struct-30]
+	_ = x[Interface-31]
+	_ = x[Tuple-32]
+	_ = x[Range-33]
+	_ = x[Type-34]
+	_ = x[Factory-35]
+	_ = x[Module-36]
 }
 
-const _Kind_name = "UnresolvedNoneNullDefaultAnyFrameBoolIntConstantI8I16I32I64U8U16U32U64F32F64StringConstantStringFunctionBuiltinFunctionArraySliceStructInterfaceTupleRangeTypeFactory"
+const _Kind_name = "UnresolvedNoneNullDefaultAnyFrameBoolIntConstantFloatConstantI8I16I32I64U8U16U32U64F32F64StringConstantStringRuneFunctionBuiltinFunctionArraySliceMapChanIteratorReaderStructInterfaceTupleRangeTypeFactoryModule"
 
-var _Kind_index = [...]uint8{0, 10, 14, 18, 25, 28, 33, 37, 48, 50, 53, 56, 59, 61, 64, 67, 70, 73, 76, 90, 96, 104, 119, 124, 129, 135, 144, 149, 154, 158, 165}
+var _Kind_index = [...]uint8{0, 10, 14, 18, 25, 28, 33, 37, 48, 61, 63, 66, 69, 72, 74, 77, 80, 83, 86, 89, 103, 109, 113, 121, 136, 141, 146, 149, 153, 161, 167, 173, 182, 187, 192, 196, 203, 209}
 
 func (i Kind) String() string {
 	if i < 0 || i >= Kind(len(_Kind_index)-1) {
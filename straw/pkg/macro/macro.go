@@ -0,0 +1,209 @@
+// Package macro expands the compile time parts of a program before irgen
+// sees it. Quotes are replaced by the code values they stand for, σ nodes
+// are run on a machine of their own, and calls to the macros they define are
+// replaced by the code the macros return, given their arguments as code.
+//
+//	σ square: λ (x any) → (kind: "Infix", operator: "MUL", left: x, right: x)
+//	.square 7
+package macro
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/yjp20/turtle/straw/pkg/ast"
+	"github.com/yjp20/turtle/straw/pkg/irgen"
+	"github.com/yjp20/turtle/straw/pkg/opt"
+	"github.com/yjp20/turtle/straw/pkg/token"
+	"github.com/yjp20/turtle/straw/pkg/vm"
+)
+
+// maxDepth is how deep macros can expand to code that calls macros, which
+// stops a macro that expands to itself.
+const maxDepth = 100
+
+type Expander struct {
+	ctx     context.Context
+	file    *token.File
+	errors  *token.ErrorList
+	machine *vm.Machine
+
+	// macros are the procedures defined by σ, by name
+	macros map[string]vm.Object
+	depth  int
+}
+
+// NewExpander makes an expander that runs compile time code on m. The
+// macros it defines stay defined for the programs it expands later.
+func NewExpander(m *vm.Machine) *Expander {
+	return &Expander{machine: m, macros: map[string]vm.Object{}}
+}
+
+// Expand expands program, parsed from file, in place. Macros can only be
+// called after they're defined, and take the place of anything else with
+// their name. The compile time code stops once ctx is done.
+func (e *Expander) Expand(ctx context.Context, program *ast.Program, file *token.File, errors *token.ErrorList) {
+	e.ctx, e.file, e.errors = ctx, file, errors
+	nodes := make([]ast.Node, 0, len(program.Nodes))
+	for _, node := range program.Nodes {
+		ct, ok := node.(*ast.CompileTime)
+		if !ok {
+			nodes = append(nodes, e.expand(node))
+			continue
+		}
+		var name string
+		switch n := ct.Node.(type) {
+		case *ast.Assign:
+			identifier, ok := n.Left.(*ast.Identifier)
+			if !ok {
+				e.appendError("Expected a name to define", n.Left.Pos(), n.Left.End())
+				continue
+			}
+			name = identifier.Value
+		case *ast.ProcedureDefinition:
+			if n.ProcedureType.Name != nil {
+				name = n.ProcedureType.Name.Value
+			}
+		}
+		if name == "" {
+			nodes = append(nodes, e.expand(node))
+			continue
+		}
+		if _, ok := e.run(ct.Node); !ok {
+			continue
+		}
+		if obj := e.machine.Globals.GetVar(name); obj != nil {
+			if _, ok := obj.(*vm.Procedure); ok {
+				e.macros[name] = obj
+			}
+		}
+	}
+	program.Nodes = nodes
+}
+
+// expand returns node with everything in it expanded.
+func (e *Expander) expand(node ast.Node) ast.Node {
+	switch n := node.(type) {
+	case *ast.Quote:
+		lit, err := Literal(Value(n.Node), n.Pos())
+		if err != nil {
+			e.appendError(err.Error(), n.Pos(), n.End())
+			return node
+		}
+		return lit
+	case *ast.CompileTime:
+		obj, ok := e.run(n.Node)
+		if !ok {
+			return node
+		}
+		if _, err := Node(obj, n.Pos()); err == nil {
+			return e.splice(obj, n)
+		}
+		lit, err := Literal(obj, n.Pos())
+		if err != nil {
+			e.appendError(err.Error(), n.Pos(), n.End())
+			return node
+		}
+		return lit
+	case *ast.Call:
+		if identifier, ok := n.Procedure.(*ast.Identifier); ok {
+			if macro, ok := e.macros[identifier.Value]; ok {
+				return e.call(macro, n)
+			}
+		}
+	}
+	if node == nil || reflect.ValueOf(node).IsNil() {
+		return node
+	}
+
+	v := reflect.ValueOf(node).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		e.expandField(v.Field(i), node)
+	}
+	return node
+}
+
+func (e *Expander) expandField(v reflect.Value, parent ast.Node) {
+	switch {
+	case v.Type() == fieldType:
+		f := v.Addr().Interface().(*ast.Field)
+		f.Type, f.Value = e.expand(f.Type), e.expand(f.Value)
+	case v.Type().Implements(nodeType):
+		if v.IsNil() {
+			return
+		}
+		expanded := e.expand(v.Interface().(ast.Node))
+		if !reflect.TypeOf(expanded).AssignableTo(v.Type()) {
+			e.appendError(fmt.Sprintf("Expanded to %s where %s is needed", typeName(reflect.TypeOf(expanded)), typeName(v.Type())), parent.Pos(), parent.End())
+			return
+		}
+		v.Set(reflect.ValueOf(expanded))
+	case v.Kind() == reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			e.expandField(v.Index(i), parent)
+		}
+	}
+}
+
+// call expands a call to a macro.
+func (e *Expander) call(macro vm.Object, call *ast.Call) ast.Node {
+	args := make([]vm.Object, len(call.Arguments))
+	for i, arg := range call.Arguments {
+		args[i] = Value(arg)
+	}
+	obj, err := e.machine.Call(e.ctx, macro, args)
+	if err != nil {
+		e.appendRuntimeError(err, call)
+		return call
+	}
+	return e.splice(obj, call)
+}
+
+// splice turns the code a macro or σ node returned into a node in place of
+// at, and expands it.
+func (e *Expander) splice(obj vm.Object, at ast.Node) ast.Node {
+	node, err := Node(obj, at.Pos())
+	if err != nil {
+		e.appendError(fmt.Sprintf("Cannot use the result as code: %s", err), at.Pos(), at.End())
+		return at
+	}
+	if e.depth >= maxDepth {
+		e.appendError(fmt.Sprintf("Macros expanded more than %d times over", maxDepth), at.Pos(), at.End())
+		return at
+	}
+	e.depth++
+	defer func() { e.depth-- }()
+	return e.expand(node)
+}
+
+// run runs node at compile time, after expanding it, and returns its value.
+func (e *Expander) run(node ast.Node) (vm.Object, bool) {
+	errors := token.NewErrorList()
+	program := &ast.Program{Nodes: []ast.Node{e.expand(node)}}
+	code := irgen.NewGenerator(&errors).Generate(program)
+	if len(errors) != 0 {
+		*e.errors = append(*e.errors, errors...)
+		return nil, false
+	}
+	opt.Optimize(&code)
+	code.File = e.file
+	obj, err := e.machine.Eval(e.ctx, code)
+	if err != nil {
+		e.appendRuntimeError(err, node)
+		return nil, false
+	}
+	return obj, true
+}
+
+func (e *Expander) appendError(msg string, pos token.Pos, end token.Pos) {
+	*e.errors = append(*e.errors, token.NewError("[macro] "+msg, pos, end))
+}
+
+func (e *Expander) appendRuntimeError(err error, at ast.Node) {
+	if rerr, ok := err.(*vm.RuntimeError); ok {
+		*e.errors = append(*e.errors, token.NewTracedError("[macro] "+rerr.Msg, rerr.Pos, rerr.End, rerr.Trace))
+		return
+	}
+	e.appendError(err.Error(), at.Pos(), at.End())
+}
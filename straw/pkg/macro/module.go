@@ -0,0 +1,73 @@
+package macro
+
+import (
+	"github.com/yjp20/turtle/straw/pkg/ast"
+	"github.com/yjp20/turtle/straw/pkg/astgen"
+	"github.com/yjp20/turtle/straw/pkg/token"
+	"github.com/yjp20/turtle/straw/pkg/vm"
+)
+
+// The ast module has procedures to inspect and build code with, for macros.
+func init() {
+	b := vm.NewBuiltins(nil)
+	b.MustRegister("parse", parse)
+	b.MustRegister("children", children)
+	b.MustRegister("ident", func(name string) vm.Object {
+		return Value(&ast.Identifier{Value: name})
+	})
+	b.MustRegister("literal", func(obj vm.Object) (vm.Object, error) {
+		node, err := Literal(obj, 0)
+		if err != nil {
+			return nil, err
+		}
+		return Value(node), nil
+	})
+	b.MustRegister("call", func(proc vm.Object, args ...vm.Object) vm.Object {
+		return &vm.Tuple{Fields: []vm.Field{
+			{Name: "kind", Value: &vm.String{Value: "Call"}},
+			{Name: "procedure", Value: proc},
+			{Name: "arguments", Value: &vm.Array{Objects: args}},
+		}}
+	})
+	vm.Modules["ast"] = b
+}
+
+// parse parses src into code, which is a block if it has more than one node.
+func parse(src string) (vm.Object, error) {
+	errors := token.NewErrorList()
+	file := token.NewFile([]byte(src))
+	program := astgen.NewParser(astgen.NewLexer(file, &errors), &errors).ParseProgram()
+	if len(errors) != 0 {
+		return nil, vm.Errorf(vm.ArgumentError, "cannot parse %q: %s", src, errors[0].Error())
+	}
+	if len(program.Nodes) == 1 {
+		return Value(program.Nodes[0]), nil
+	}
+	return Value(&ast.Block{Nodes: program.Nodes}), nil
+}
+
+// children returns the nodes directly in code, in order.
+func children(code *vm.Tuple) *vm.Array {
+	nodes := []vm.Object{}
+	var add func(obj vm.Object)
+	add = func(obj vm.Object) {
+		switch obj := obj.(type) {
+		case *vm.Tuple:
+			if kind, ok := field(obj, "kind").(*vm.String); ok && kind.Value == "Field" {
+				for _, f := range obj.Fields {
+					add(f.Value)
+				}
+			} else if ok {
+				nodes = append(nodes, obj)
+			}
+		case *vm.Array:
+			for _, item := range obj.Objects {
+				add(item)
+			}
+		}
+	}
+	for _, f := range code.Fields {
+		add(f.Value)
+	}
+	return &vm.Array{Objects: nodes}
+}
@@ -0,0 +1,336 @@
+package macro
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/yjp20/turtle/straw/pkg/ast"
+	"github.com/yjp20/turtle/straw/pkg/kind"
+	"github.com/yjp20/turtle/straw/pkg/token"
+	"github.com/yjp20/turtle/straw/pkg/vm"
+)
+
+// Code is a tuple mirroring the ast node it was made from. Its kind field is
+// the name of the node's type, and the rest of its fields are the node's,
+// named the same but starting in lower case:
+//
+//	(kind: "Infix", operator: "ADD", left: (kind: "Identifier", value: "a"), ...)
+//
+// Lists of nodes are arrays, tokens are their names, and positions are left
+// out, as are nodes that are missing. Turning a value back into a node gives
+// every part of it the position of where it's put.
+
+var nodeTypes = map[string]reflect.Type{}
+
+func init() {
+	for _, node := range []ast.Node{
+		&ast.Program{}, &ast.Comment{}, &ast.CommentGroup{}, &ast.Assign{}, &ast.Each{}, &ast.Branch{},
+		&ast.Return{}, &ast.For{}, &ast.Identifier{}, &ast.Call{}, &ast.Construct{}, &ast.Selector{},
+		&ast.Indexor{}, &ast.Tuple{}, &ast.Block{}, &ast.If{}, &ast.DefaultLiteral{}, &ast.IntLiteral{},
+		&ast.FloatLiteral{}, &ast.StringLiteral{}, &ast.RuneLiteral{}, &ast.RangeLiteral{},
+		&ast.TrueLiteral{}, &ast.FalseLiteral{}, &ast.ProcedureType{}, &ast.ProcedureDefinition{},
+		&ast.Spread{}, &ast.Prefix{}, &ast.Infix{}, &ast.TypeSpec{}, &ast.As{}, &ast.Match{}, &ast.Go{},
+		&ast.Select{}, &ast.Defer{}, &ast.Yield{}, &ast.Quote{}, &ast.CompileTime{},
+	} {
+		t := reflect.TypeOf(node).Elem()
+		nodeTypes[t.Name()] = t
+	}
+	for tok := token.ILLEGAL; tok <= token.STRUCT; tok++ {
+		tokens[tok.String()] = tok
+	}
+}
+
+var tokens = map[string]token.Token{}
+
+var (
+	posType   = reflect.TypeOf(token.Pos(0))
+	tokenType = reflect.TypeOf(token.Token(0))
+	nodeType  = reflect.TypeOf((*ast.Node)(nil)).Elem()
+	fieldType = reflect.TypeOf(ast.Field{})
+)
+
+// fieldName is what the field of a node is called in its value.
+func fieldName(name string) string {
+	r, size := utf8.DecodeRuneInString(name)
+	return string(unicode.ToLower(r)) + name[size:]
+}
+
+// Value makes the value that mirrors node.
+func Value(node ast.Node) vm.Object {
+	if node == nil || reflect.ValueOf(node).IsNil() {
+		return vm.NULL
+	}
+	v := reflect.ValueOf(node).Elem()
+	t := v.Type()
+	fields := []vm.Field{{Name: "kind", Value: &vm.String{Value: t.Name()}}}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Type == posType {
+			continue
+		}
+		obj := fieldValue(v.Field(i))
+		if obj == nil {
+			continue
+		}
+		fields = append(fields, vm.Field{Name: fieldName(f.Name), Value: obj})
+	}
+	return &vm.Tuple{Fields: fields}
+}
+
+func fieldValue(v reflect.Value) vm.Object {
+	switch {
+	case v.Type() == tokenType:
+		return &vm.String{Value: token.Token(v.Int()).String()}
+	case v.Type() == fieldType:
+		f := v.Interface().(ast.Field)
+		fields := []vm.Field{{Name: "kind", Value: &vm.String{Value: "Field"}}, {Name: "name", Value: &vm.String{Value: f.Name}}}
+		if f.Type != nil {
+			fields = append(fields, vm.Field{Name: "type", Value: Value(f.Type)})
+		}
+		if f.Value != nil {
+			fields = append(fields, vm.Field{Name: "value", Value: Value(f.Value)})
+		}
+		return &vm.Tuple{Fields: fields}
+	case v.Type().Implements(nodeType):
+		if v.IsNil() {
+			return nil
+		}
+		return Value(v.Interface().(ast.Node))
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		objects := make([]vm.Object, v.Len())
+		for i := range objects {
+			objects[i] = fieldValue(v.Index(i))
+		}
+		return &vm.Array{Objects: objects}
+	case reflect.String:
+		return &vm.String{Value: v.String()}
+	case reflect.Int64:
+		return &vm.I64{Value: v.Int()}
+	case reflect.Float64:
+		return &vm.F64{Value: v.Float()}
+	case reflect.Bool:
+		if v.Bool() {
+			return vm.TRUE
+		}
+		return vm.FALSE
+	}
+	return nil
+}
+
+// Node turns a value back into the node it mirrors, at pos.
+func Node(obj vm.Object, pos token.Pos) (ast.Node, error) {
+	tuple, ok := obj.(*vm.Tuple)
+	if !ok {
+		return nil, fmt.Errorf("expected code, got %s", obj.String())
+	}
+	name, ok := field(tuple, "kind").(*vm.String)
+	if !ok {
+		return nil, fmt.Errorf("expected code, got %s", obj.String())
+	}
+	t, ok := nodeTypes[name.Value]
+	if !ok {
+		return nil, fmt.Errorf("there is no kind of node called %s", name.Value)
+	}
+	v := reflect.New(t)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Type == posType {
+			v.Elem().Field(i).SetInt(int64(pos))
+			continue
+		}
+		obj := field(tuple, fieldName(f.Name))
+		if obj == nil {
+			continue
+		}
+		if err := setField(v.Elem().Field(i), obj, pos); err != nil {
+			return nil, fmt.Errorf("%s of %s: %w", fieldName(f.Name), name.Value, err)
+		}
+	}
+	return v.Interface().(ast.Node), nil
+}
+
+func setField(v reflect.Value, obj vm.Object, pos token.Pos) error {
+	switch {
+	case v.Type() == tokenType:
+		s, ok := obj.(*vm.String)
+		if !ok {
+			return fmt.Errorf("expected the name of a token, got %s", obj.String())
+		}
+		tok, ok := tokens[s.Value]
+		if !ok {
+			return fmt.Errorf("there is no token called %s", s.Value)
+		}
+		v.SetInt(int64(tok))
+		return nil
+	case v.Type() == fieldType:
+		tuple, ok := obj.(*vm.Tuple)
+		if !ok {
+			return fmt.Errorf("expected a field, got %s", obj.String())
+		}
+		f := ast.Field{}
+		if name, ok := field(tuple, "name").(*vm.String); ok {
+			f.Name = name.Value
+		}
+		for _, part := range []struct {
+			name string
+			node *ast.Node
+		}{{"type", &f.Type}, {"value", &f.Value}} {
+			if obj := field(tuple, part.name); obj != nil {
+				node, err := Node(obj, pos)
+				if err != nil {
+					return err
+				}
+				*part.node = node
+			}
+		}
+		v.Set(reflect.ValueOf(f))
+		return nil
+	case v.Type().Implements(nodeType) || v.Kind() == reflect.Interface:
+		if obj.Kind() == kind.Null {
+			return nil
+		}
+		node, err := Node(obj, pos)
+		if err != nil {
+			return err
+		}
+		if !reflect.TypeOf(node).AssignableTo(v.Type()) {
+			return fmt.Errorf("expected %s, got %s", typeName(v.Type()), typeName(reflect.TypeOf(node)))
+		}
+		v.Set(reflect.ValueOf(node))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Slice:
+		var objects []vm.Object
+		switch list := obj.(type) {
+		case *vm.Array:
+			objects = list.Objects
+		case *vm.Slice:
+			objects = list.Objects
+		default:
+			return fmt.Errorf("expected an array, got %s", obj.String())
+		}
+		s := reflect.MakeSlice(v.Type(), len(objects), len(objects))
+		for i, item := range objects {
+			if err := setField(s.Index(i), item, pos); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	case reflect.String:
+		if s, ok := obj.(*vm.String); ok {
+			v.SetString(s.Value)
+			return nil
+		}
+	case reflect.Int64:
+		if i, ok := obj.(*vm.I64); ok {
+			v.SetInt(i.Value)
+			return nil
+		}
+	case reflect.Float64:
+		switch f := obj.(type) {
+		case *vm.F64:
+			v.SetFloat(f.Value)
+			return nil
+		case *vm.I64:
+			v.SetFloat(float64(f.Value))
+			return nil
+		}
+	case reflect.Bool:
+		if b, ok := obj.(*vm.Bool); ok {
+			v.SetBool(b.IsTrue)
+			return nil
+		}
+	}
+	return fmt.Errorf("expected %s, got %s", v.Kind(), obj.String())
+}
+
+// typeName names the type of a node the way values do.
+func typeName(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nodeType {
+		return "a node"
+	}
+	return t.Name()
+}
+
+// field returns the field of tuple called name, or nil if it has none.
+func field(tuple *vm.Tuple, name string) vm.Object {
+	for _, f := range tuple.Fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return nil
+}
+
+// Literal returns a node that evaluates to obj, which can be code or any
+// value that can be written out: numbers, strings, runes, bools, tuples and
+// arrays.
+func Literal(obj vm.Object, pos token.Pos) (ast.Node, error) {
+	switch obj := obj.(type) {
+	case *vm.I64:
+		return &ast.IntLiteral{LiteralPos: pos, Literal: strconv.FormatInt(obj.Value, 10), Value: obj.Value}, nil
+	case *vm.F64:
+		return &ast.FloatLiteral{LiteralPos: pos, Literal: strconv.FormatFloat(obj.Value, 'g', -1, 64), Value: obj.Value}, nil
+	case *vm.String:
+		return &ast.StringLiteral{LiteralPos: pos, Literal: strconv.Quote(obj.Value), Value: obj.Value}, nil
+	case *vm.Rune:
+		return &ast.RuneLiteral{LiteralPos: pos, Literal: strconv.QuoteRune(obj.Value), Value: string(obj.Value)}, nil
+	case *vm.Bool:
+		if obj.IsTrue {
+			return &ast.TrueLiteral{LiteralPos: pos}, nil
+		}
+		return &ast.FalseLiteral{LiteralPos: pos}, nil
+	case *vm.Tuple:
+		tuple := &ast.Tuple{LeftPos: pos, RightPos: pos}
+		for _, f := range obj.Fields {
+			node, err := Literal(f.Value, pos)
+			if err != nil {
+				return nil, err
+			}
+			if f.Name != "" {
+				if _, err := strconv.Atoi(f.Name); err != nil {
+					node = &ast.Assign{Left: &ast.Identifier{WordPos: pos, Value: f.Name}, Right: node}
+				}
+			}
+			tuple.Nodes = append(tuple.Nodes, node)
+		}
+		// In a block, so that a tuple of named fields isn't taken for named
+		// arguments
+		return &ast.Block{LeftPos: pos, Nodes: []ast.Node{tuple}, RightPos: pos}, nil
+	case *vm.Array, *vm.Slice:
+		var objects []vm.Object
+		if array, ok := obj.(*vm.Array); ok {
+			objects = array.Objects
+		} else {
+			objects = obj.(*vm.Slice).Objects
+		}
+		items := &ast.Tuple{LeftPos: pos, RightPos: pos}
+		for _, item := range objects {
+			node, err := Literal(item, pos)
+			if err != nil {
+				return nil, err
+			}
+			items.Nodes = append(items.Nodes, node)
+		}
+		return &ast.Construct{
+			Construct: pos,
+			Type: &ast.Indexor{
+				Node:  &ast.Identifier{WordPos: pos, Value: "array"},
+				Index: &ast.Tuple{LeftPos: pos, Nodes: []ast.Node{&ast.Identifier{WordPos: pos, Value: "any"}}, RightPos: pos},
+			},
+			Value: items,
+		}, nil
+	}
+	return nil, fmt.Errorf("cannot write %s as code", obj.String())
+}
@@ -0,0 +1,160 @@
+package opt
+
+import (
+	"github.com/yjp20/turtle/straw/pkg/ir"
+)
+
+// HoistBoundsChecks replaces the bounds checks of a loop which index with its
+// induction variable by a single check of the whole range in the preheader.
+// This only applies to loops whose induction variable counts up by one and
+// exits once it reaches an invariant limit, like `∀ i ∈ range[a‥b)`, and
+// only to checks that run on every iteration. A failing check will therefore
+// fail before the loop starts rather than on the iteration that goes out of
+// bounds. Loops that can be left some other way, like by returning, might
+// never get to that iteration, so they're left alone.
+func HoistBoundsChecks(program *ir.Program) {
+	eachLoop(program, func(loop *Loop, forest *LoopForest, d *defs) {
+		proc := forest.Dom.Graph.Proc
+		preheader := proc.Blocks[loop.Preheader]
+		if !onlyExitsFromHeader(loop, forest.Dom.Graph) {
+			return
+		}
+
+		for _, iv := range findInductionVars(loop, proc, d) {
+			limit, ok := exitLimit(iv, loop, proc, d)
+			if !ok || !isConstant(iv.step, 1, d) {
+				continue
+			}
+
+			hoisted := map[ir.Assignment]bool{}
+			lengths := map[ir.Assignment]bool{}
+			for _, b := range loop.Blocks {
+				// Checks in the header can run once more than the body, with the
+				// induction variable equal to the limit
+				if b == loop.Header || !forest.Dom.Dominates(b, iv.latch) {
+					continue
+				}
+				block := proc.Blocks[b]
+				kept := block.Instructions[:0]
+				for _, inst := range block.Instructions {
+					x, ok := indexed(inst, iv, loop, d)
+					if !ok {
+						kept = append(kept, inst)
+						continue
+					}
+					lengths[inst.Args[1]] = true
+					if !hoisted[x] {
+						hoisted[x] = true
+						check := &ir.Inst{
+							Kind:  ir.BoundsCheckRange,
+							Index: d.fresh(),
+							Args:  []ir.Assignment{iv.init, limit, x},
+						}
+						insertBeforeBranch(preheader, check)
+						d.add(check, preheader.Index)
+					}
+				}
+				block.Instructions = kept
+			}
+			removeUnused(proc, lengths)
+		}
+	})
+}
+
+// removeUnused deletes the instructions in candidates that nothing in proc
+// reads anymore.
+func removeUnused(proc *ir.Proc, candidates map[ir.Assignment]bool) {
+	used := map[ir.Assignment]bool{}
+	for _, block := range proc.Blocks {
+		for _, inst := range block.Instructions {
+			for _, a := range operands(inst) {
+				used[a] = true
+			}
+		}
+	}
+	for _, block := range proc.Blocks {
+		kept := block.Instructions[:0]
+		for _, inst := range block.Instructions {
+			if !candidates[inst.Index] || used[inst.Index] {
+				kept = append(kept, inst)
+			}
+		}
+		block.Instructions = kept
+	}
+}
+
+// onlyExitsFromHeader reports whether the only way out of loop is through
+// its header. Generators count as left when they yield, since whoever is
+// iterating over them can stop.
+func onlyExitsFromHeader(loop *Loop, g *Graph) bool {
+	for _, b := range loop.Blocks {
+		if b == loop.Header {
+			continue
+		}
+		for _, s := range g.Succs[b] {
+			if !loop.Contains(s) {
+				return false
+			}
+		}
+		for _, inst := range g.Proc.Blocks[b].Instructions {
+			switch inst.Kind {
+			case ir.Ret, ir.End, ir.Yield:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// indexed returns the invariant value that inst checks an index into, if
+// it's a bounds check of iv, ie.
+//
+//	%1 = Len(x)
+//	%2 = BoundsCheck(iv, %1)
+//
+// The range check takes x rather than its length, since values without one
+// would fail even if the loop never indexes them.
+func indexed(inst *ir.Inst, iv *inductionVar, loop *Loop, d *defs) (ir.Assignment, bool) {
+	if inst.Kind != ir.BoundsCheck || d.copyOf(inst.Args[0]) != iv.phi.Index {
+		return 0, false
+	}
+	length, ok := d.inst[inst.Args[1]]
+	if !ok || length.Kind != ir.Len || !invariant(length.Args[0], loop, d) {
+		return 0, false
+	}
+	return length.Args[0], true
+}
+
+// exitLimit finds the invariant limit that the header compares iv against to
+// leave the loop, ie. the header contains
+//
+//	%1 = Less(iv, limit)
+//	%2 = Not(%1)
+//	%3 = GotoIf(%2, exit)
+func exitLimit(iv *inductionVar, loop *Loop, proc *ir.Proc, d *defs) (ir.Assignment, bool) {
+	for _, inst := range proc.Blocks[loop.Header].Instructions {
+		if inst.Kind != ir.GotoIf || loop.Contains(inst.Block) {
+			continue
+		}
+		not, ok := d.inst[inst.Args[0]]
+		if !ok || not.Kind != ir.Not {
+			continue
+		}
+		less, ok := d.inst[not.Args[0]]
+		if !ok || less.Kind != ir.Less {
+			continue
+		}
+		if d.copyOf(less.Args[0]) == iv.phi.Index && invariant(less.Args[1], loop, d) {
+			return less.Args[1], true
+		}
+	}
+	return 0, false
+}
+
+func isConstant(a ir.Assignment, value int64, d *defs) bool {
+	inst, ok := d.inst[a]
+	if !ok || inst.Kind != ir.I64 {
+		return false
+	}
+	return inst.Int == value
+}
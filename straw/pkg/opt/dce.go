@@ -0,0 +1,46 @@
+package opt
+
+import (
+	"github.com/yjp20/turtle/straw/pkg/ir"
+)
+
+// EliminateDeadCode deletes pure instructions whose results are never read,
+// including cycles of phis that only feed each other, such as induction
+// variables left behind by ReduceInductionVars.
+func EliminateDeadCode(program *ir.Program) {
+	d := newDefs(program)
+	live := map[ir.Assignment]bool{}
+	work := make([]*ir.Inst, 0)
+	for _, proc := range program.Procedures {
+		for _, block := range proc.Blocks {
+			for _, inst := range block.Instructions {
+				if !pure(inst) {
+					live[inst.Index] = true
+					work = append(work, inst)
+				}
+			}
+		}
+	}
+	for len(work) > 0 {
+		inst := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, a := range operands(inst) {
+			if def, ok := d.inst[a]; ok && !live[a] {
+				live[a] = true
+				work = append(work, def)
+			}
+		}
+	}
+
+	for _, proc := range program.Procedures {
+		for _, block := range proc.Blocks {
+			kept := block.Instructions[:0]
+			for _, inst := range block.Instructions {
+				if live[inst.Index] {
+					kept = append(kept, inst)
+				}
+			}
+			block.Instructions = kept
+		}
+	}
+}
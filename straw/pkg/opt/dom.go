@@ -0,0 +1,106 @@
+package opt
+
+// DomTree is the dominator tree of a Graph, computed with the iterative
+// algorithm from Cooper, Harvey and Kennedy's "A Simple, Fast Dominance
+// Algorithm". Unreachable blocks have an Idom of -1.
+type DomTree struct {
+	Graph    *Graph
+	Idom     []int
+	Children [][]int
+
+	// pre and post are the entry and exit times of a walk over the tree,
+	// which turns dominance queries into an interval check
+	pre  []int
+	post []int
+}
+
+func Dominators(g *Graph) *DomTree {
+	n := len(g.Succs)
+	d := &DomTree{
+		Graph:    g,
+		Idom:     make([]int, n),
+		Children: make([][]int, n),
+		pre:      make([]int, n),
+		post:     make([]int, n),
+	}
+	for i := range d.Idom {
+		d.Idom[i] = -1
+	}
+	if n == 0 {
+		return d
+	}
+
+	rpo := g.ReversePostorder()
+	order := make([]int, n)
+	for i := range order {
+		order[i] = -1
+	}
+	for i, b := range rpo {
+		order[b] = i
+	}
+
+	intersect := func(a, b int) int {
+		for a != b {
+			for order[a] > order[b] {
+				a = d.Idom[a]
+			}
+			for order[b] > order[a] {
+				b = d.Idom[b]
+			}
+		}
+		return a
+	}
+
+	d.Idom[0] = 0
+	for changed := true; changed; {
+		changed = false
+		for _, b := range rpo[1:] {
+			idom := -1
+			for _, p := range g.Preds[b] {
+				if d.Idom[p] == -1 {
+					continue
+				}
+				if idom == -1 {
+					idom = p
+				} else {
+					idom = intersect(p, idom)
+				}
+			}
+			if d.Idom[b] != idom {
+				d.Idom[b] = idom
+				changed = true
+			}
+		}
+	}
+
+	for _, b := range rpo[1:] {
+		d.Children[d.Idom[b]] = append(d.Children[d.Idom[b]], b)
+	}
+
+	clock := 0
+	var walk func(b int)
+	walk = func(b int) {
+		d.pre[b] = clock
+		clock++
+		for _, c := range d.Children[b] {
+			walk(c)
+		}
+		d.post[b] = clock
+		clock++
+	}
+	walk(0)
+	return d
+}
+
+// Dominates reports whether every path from the entry block to b goes
+// through a. Every block dominates itself.
+func (d *DomTree) Dominates(a, b int) bool {
+	if !d.Reachable(a) || !d.Reachable(b) {
+		return false
+	}
+	return d.pre[a] <= d.pre[b] && d.post[b] <= d.post[a]
+}
+
+func (d *DomTree) Reachable(b int) bool {
+	return d.Idom[b] != -1
+}
@@ -0,0 +1,56 @@
+package opt
+
+// This package implements optimization passes over the ir. The passes only
+// ever move, insert and delete instructions; blocks are never created or
+// renumbered, since the vm uses block indices to resolve phis.
+
+import (
+	"github.com/yjp20/turtle/straw/pkg/ir"
+)
+
+// Graph is the control flow graph of a procedure, see ir.Proc.Successors.
+type Graph struct {
+	Proc  *ir.Proc
+	Succs [][]int
+	Preds [][]int
+}
+
+func NewGraph(proc *ir.Proc) *Graph {
+	n := len(proc.Blocks)
+	g := &Graph{
+		Proc:  proc,
+		Succs: make([][]int, n),
+		Preds: make([][]int, n),
+	}
+	for _, block := range proc.Blocks {
+		g.Succs[block.Index] = proc.Successors(block)
+		for _, s := range g.Succs[block.Index] {
+			g.Preds[s] = append(g.Preds[s], block.Index)
+		}
+	}
+	return g
+}
+
+// ReversePostorder returns the blocks reachable from the entry block in
+// reverse postorder.
+func (g *Graph) ReversePostorder() []int {
+	visited := make([]bool, len(g.Succs))
+	order := make([]int, 0, len(g.Succs))
+	var visit func(b int)
+	visit = func(b int) {
+		visited[b] = true
+		for _, s := range g.Succs[b] {
+			if !visited[s] {
+				visit(s)
+			}
+		}
+		order = append(order, b)
+	}
+	if len(g.Succs) > 0 {
+		visit(0)
+	}
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	return order
+}
@@ -0,0 +1,154 @@
+package opt
+
+import (
+	"github.com/yjp20/turtle/straw/pkg/ir"
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+// inductionVar is an integer phi in a loop header which starts at init and
+// is incremented by the same invariant step on every iteration, ie. the shape
+// that irgen lowers `∀ i ∈ range[a‥b)` into. Floats don't count, since adding
+// up a product rounds differently from multiplying.
+type inductionVar struct {
+	phi   *ir.Inst
+	init  ir.Assignment
+	step  ir.Assignment
+	latch int
+}
+
+func findInductionVars(loop *Loop, proc *ir.Proc, d *defs) []*inductionVar {
+	if len(loop.Latches) != 1 {
+		return nil
+	}
+	latch := loop.Latches[0]
+
+	ivs := make([]*inductionVar, 0)
+	for _, inst := range proc.Blocks[loop.Header].Instructions {
+		if inst.Kind != ir.Phi {
+			break
+		}
+		phis := inst.Phis
+		if len(phis) != 2 || !inst.Type.Kind.IsInteger() && inst.Type.Kind != kind.IntConstant {
+			continue
+		}
+		iv := &inductionVar{phi: inst, latch: latch}
+		var next ir.Assignment
+		for _, phi := range phis {
+			switch phi.BlockIndex {
+			case loop.Preheader:
+				iv.init = phi.Assignment
+			case latch:
+				next = phi.Assignment
+			}
+		}
+		if iv.init == 0 || next == 0 {
+			continue
+		}
+
+		add, ok := d.inst[d.copyOf(next)]
+		if !ok || add.Kind != ir.Add {
+			continue
+		}
+		switch {
+		case d.copyOf(add.Args[0]) == inst.Index && invariant(add.Args[1], loop, d):
+			iv.step = add.Args[1]
+		case d.copyOf(add.Args[1]) == inst.Index && invariant(add.Args[0], loop, d):
+			iv.step = add.Args[0]
+		default:
+			continue
+		}
+		ivs = append(ivs, iv)
+	}
+	return ivs
+}
+
+// ReduceInductionVars strength reduces multiplications of an induction
+// variable by a loop invariant value. For `i*k`, a new induction variable
+// starting at `init*k` and stepping by `step*k` replaces the multiplication,
+// so the loop only ever adds. Induction variables which end up unused are
+// left for EliminateDeadCode.
+func ReduceInductionVars(program *ir.Program) {
+	eachLoop(program, func(loop *Loop, forest *LoopForest, d *defs) {
+		proc := forest.Dom.Graph.Proc
+		ivs := findInductionVars(loop, proc, d)
+		if len(ivs) == 0 {
+			return
+		}
+
+		// Collect the candidates first, since reducing inserts instructions
+		// into the blocks of the loop
+		muls := make([]*ir.Inst, 0)
+		for _, b := range loop.Blocks {
+			for _, inst := range proc.Blocks[b].Instructions {
+				// The products go in the preheader, which runs even if the
+				// loop doesn't, so they mustn't be able to fail
+				if inst.Kind == ir.Mul && pure(inst) {
+					muls = append(muls, inst)
+				}
+			}
+		}
+
+		for _, inst := range muls {
+			for _, iv := range ivs {
+				var factor ir.Assignment
+				switch {
+				case d.copyOf(inst.Args[0]) == iv.phi.Index && invariant(inst.Args[1], loop, d):
+					factor = inst.Args[1]
+				case d.copyOf(inst.Args[1]) == iv.phi.Index && invariant(inst.Args[0], loop, d):
+					factor = inst.Args[0]
+				default:
+					continue
+				}
+				reduced := reduce(iv, factor, loop, proc, d)
+				replaceAll(program, inst.Index, reduced)
+				break
+			}
+		}
+	})
+}
+
+// reduce creates the induction variable that tracks iv*factor, and returns
+// its phi.
+func reduce(iv *inductionVar, factor ir.Assignment, loop *Loop, proc *ir.Proc, d *defs) ir.Assignment {
+	preheader := proc.Blocks[loop.Preheader]
+	header := proc.Blocks[loop.Header]
+	latch := proc.Blocks[iv.latch]
+	typ := iv.phi.Type
+	if typ.Kind == kind.IntConstant {
+		typ = ir.Type{Kind: kind.I64}
+	}
+
+	init := &ir.Inst{Kind: ir.Mul, Type: typ, Index: d.fresh(), Args: []ir.Assignment{iv.init, factor}}
+	step := &ir.Inst{Kind: ir.Mul, Type: typ, Index: d.fresh(), Args: []ir.Assignment{iv.step, factor}}
+	phi := &ir.Inst{Kind: ir.Phi, Type: typ, Index: d.fresh()}
+	next := &ir.Inst{Kind: ir.Add, Type: typ, Index: d.fresh(), Args: []ir.Assignment{phi.Index, step.Index}}
+	phi.Phis = []ir.PhiLiteral{{BlockIndex: iv.latch, Assignment: next.Index}, {BlockIndex: loop.Preheader, Assignment: init.Index}}
+
+	insertBeforeBranch(preheader, init)
+	insertBeforeBranch(preheader, step)
+	insertAt(header, 0, phi)
+	insertBeforeBranch(latch, next)
+	d.add(init, preheader.Index)
+	d.add(step, preheader.Index)
+	d.add(phi, header.Index)
+	d.add(next, latch.Index)
+	return phi.Index
+}
+
+// replaceAll rewrites every use of from in the program into a use of to.
+// Procedures can read assignments of the procedures enclosing them, so this
+// has to look further than the procedure that defines from.
+func replaceAll(program *ir.Program, from, to ir.Assignment) {
+	for _, proc := range program.Procedures {
+		for _, block := range proc.Blocks {
+			for _, inst := range block.Instructions {
+				replace(inst, from, to)
+			}
+			for name, a := range block.Symbols {
+				if a == from {
+					block.Symbols[name] = to
+				}
+			}
+		}
+	}
+}
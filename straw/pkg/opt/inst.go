@@ -0,0 +1,154 @@
+package opt
+
+import (
+	"github.com/yjp20/turtle/straw/pkg/ir"
+)
+
+// operands returns every assignment that inst reads.
+func operands(inst *ir.Inst) []ir.Assignment {
+	ops := make([]ir.Assignment, 0, len(inst.Args))
+	for _, arg := range inst.Args {
+		if arg != 0 {
+			ops = append(ops, arg)
+		}
+	}
+	for _, phi := range inst.Phis {
+		ops = append(ops, phi.Assignment)
+	}
+	return ops
+}
+
+// replace rewrites every read of from in inst into a read of to.
+func replace(inst *ir.Inst, from, to ir.Assignment) {
+	for i := range inst.Args {
+		if inst.Args[i] == from {
+			inst.Args[i] = to
+		}
+	}
+	for i := range inst.Phis {
+		if inst.Phis[i].Assignment == from {
+			inst.Phis[i].Assignment = to
+		}
+	}
+}
+
+// pure reports whether inst can be moved or deleted freely, ie. it has no
+// side effects and cannot fail at runtime. Adding, subtracting and
+// multiplying only count once irgen has typed them as numbers, since they
+// fail on operands of other kinds, and integers wrap rather than overflow.
+func pure(inst *ir.Inst) bool {
+	switch inst.Kind {
+	case ir.Move, ir.Default, ir.Bool, ir.I8, ir.I16, ir.I32, ir.I64, ir.F32, ir.F64,
+		ir.ProcedureDefinition, ir.MakeClosure, ir.Self, ir.Phi:
+		return true
+	case ir.Add, ir.Sub, ir.Mul:
+		return inst.Type.Kind.IsNumber()
+	}
+	return false
+}
+
+// terminator reports whether inst transfers control out of its block.
+func terminator(inst *ir.Inst) bool {
+	switch inst.Kind {
+	case ir.Goto, ir.GotoIf, ir.Ret, ir.End:
+		return true
+	}
+	return false
+}
+
+// insertBeforeBranch inserts inst into block before the first instruction
+// that can transfer control, so it runs on every path through the block.
+func insertBeforeBranch(block *ir.Block, inst *ir.Inst) {
+	at := len(block.Instructions)
+	for i, other := range block.Instructions {
+		if terminator(other) {
+			at = i
+			break
+		}
+	}
+	insertAt(block, at, inst)
+}
+
+// insertAfterPhis inserts inst after the phis at the start of block.
+func insertAfterPhis(block *ir.Block, inst *ir.Inst) {
+	at := 0
+	for at < len(block.Instructions) && block.Instructions[at].Kind == ir.Phi {
+		at++
+	}
+	insertAt(block, at, inst)
+}
+
+func insertAt(block *ir.Block, at int, inst *ir.Inst) {
+	block.Instructions = append(block.Instructions, nil)
+	copy(block.Instructions[at+1:], block.Instructions[at:])
+	block.Instructions[at] = inst
+}
+
+// defs maps every assignment in a procedure to the index of the block which
+// defines it.
+type defs struct {
+	block map[ir.Assignment]int
+	inst  map[ir.Assignment]*ir.Inst
+	next  ir.Assignment
+}
+
+func newDefs(program *ir.Program) *defs {
+	d := &defs{block: map[ir.Assignment]int{}, inst: map[ir.Assignment]*ir.Inst{}}
+	for _, proc := range program.Procedures {
+		for _, block := range proc.Blocks {
+			for _, inst := range block.Instructions {
+				d.inst[inst.Index] = inst
+				if inst.Index >= d.next {
+					d.next = inst.Index + 1
+				}
+			}
+		}
+	}
+	return d
+}
+
+func (d *defs) scan(proc *ir.Proc) {
+	for _, block := range proc.Blocks {
+		for _, inst := range block.Instructions {
+			d.block[inst.Index] = block.Index
+		}
+	}
+}
+
+// fresh returns a new assignment which is unused in the program.
+func (d *defs) fresh() ir.Assignment {
+	a := d.next
+	d.next++
+	return a
+}
+
+func (d *defs) add(inst *ir.Inst, block int) {
+	d.block[inst.Index] = block
+	d.inst[inst.Index] = inst
+}
+
+// copyOf looks through phis which only ever take a single value, which irgen
+// leaves behind whenever a symbol is looked up in a new block.
+func (d *defs) copyOf(a ir.Assignment) ir.Assignment {
+	for seen := 0; seen < 64; seen++ {
+		inst, ok := d.inst[a]
+		if !ok || inst.Kind != ir.Phi {
+			return a
+		}
+		var only ir.Assignment
+		for _, phi := range inst.Phis {
+			if phi.Assignment == a || phi.Assignment == only {
+				continue
+			}
+			if only != 0 {
+				return a
+			}
+			only = phi.Assignment
+		}
+		if only == 0 {
+			return a
+		}
+		a = only
+	}
+	return a
+}
@@ -0,0 +1,42 @@
+package opt
+
+import (
+	"github.com/yjp20/turtle/straw/pkg/ir"
+)
+
+// HoistInvariants moves pure instructions whose operands are all computed
+// outside of a loop into the loop's preheader. Since inner loops are visited
+// first, an instruction can be hoisted through several levels of nesting.
+func HoistInvariants(program *ir.Program) {
+	eachLoop(program, func(loop *Loop, forest *LoopForest, d *defs) {
+		proc := forest.Dom.Graph.Proc
+		preheader := proc.Blocks[loop.Preheader]
+
+		for _, b := range loopOrder(loop, forest.Dom.Graph) {
+			block := proc.Blocks[b]
+			kept := block.Instructions[:0]
+			for _, inst := range block.Instructions {
+				if !hoistable(inst, loop, d) {
+					kept = append(kept, inst)
+					continue
+				}
+				insertBeforeBranch(preheader, inst)
+				d.block[inst.Index] = preheader.Index
+			}
+			block.Instructions = kept
+		}
+	})
+}
+
+func hoistable(inst *ir.Inst, loop *Loop, d *defs) bool {
+	// Phis depend on the edge the loop was entered from, so they never move
+	if !pure(inst) || inst.Kind == ir.Phi {
+		return false
+	}
+	for _, a := range operands(inst) {
+		if !invariant(a, loop, d) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package opt
+
+import "sort"
+
+// Loop is a natural loop, the set of blocks that can reach one of the
+// latches without going through the header.
+type Loop struct {
+	Header  int
+	Latches []int
+	Blocks  []int
+	Exits   []int
+
+	// Preheader is the only predecessor of the header outside of the loop, or
+	// -1 if there isn't exactly one, or if it doesn't unconditionally flow into
+	// the header.
+	Preheader int
+
+	Parent   *Loop
+	Children []*Loop
+	Depth    int
+
+	blocks map[int]bool
+}
+
+func (l *Loop) Contains(b int) bool {
+	return l.blocks[b]
+}
+
+// LoopForest holds the loops of a procedure, nested by containment.
+type LoopForest struct {
+	Dom   *DomTree
+	Roots []*Loop
+
+	// Loops is ordered so that inner loops come before the loops that contain
+	// them.
+	Loops []*Loop
+
+	innermost []*Loop
+}
+
+func FindLoops(d *DomTree) *LoopForest {
+	g := d.Graph
+	f := &LoopForest{Dom: d, innermost: make([]*Loop, len(g.Succs))}
+
+	// A backedge is an edge to a block which dominates its source. Loops that
+	// share a header are merged.
+	headers := map[int]*Loop{}
+	for b := range g.Succs {
+		for _, s := range g.Succs[b] {
+			if !d.Dominates(s, b) {
+				continue
+			}
+			loop, ok := headers[s]
+			if !ok {
+				loop = &Loop{Header: s, Preheader: -1, blocks: map[int]bool{s: true}}
+				headers[s] = loop
+				f.Loops = append(f.Loops, loop)
+			}
+			loop.Latches = append(loop.Latches, b)
+		}
+	}
+
+	for _, loop := range f.Loops {
+		stack := append([]int{}, loop.Latches...)
+		for len(stack) > 0 {
+			b := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if loop.blocks[b] {
+				continue
+			}
+			loop.blocks[b] = true
+			for _, p := range g.Preds[b] {
+				if d.Reachable(p) {
+					stack = append(stack, p)
+				}
+			}
+		}
+		for b := range loop.blocks {
+			loop.Blocks = append(loop.Blocks, b)
+		}
+		sort.Ints(loop.Blocks)
+		for _, b := range loop.Blocks {
+			for _, s := range g.Succs[b] {
+				if !loop.blocks[s] {
+					loop.Exits = append(loop.Exits, s)
+				}
+			}
+		}
+
+		outside := []int{}
+		for _, p := range g.Preds[loop.Header] {
+			if !loop.blocks[p] {
+				outside = append(outside, p)
+			}
+		}
+		if len(outside) == 1 && len(g.Succs[outside[0]]) == 1 {
+			loop.Preheader = outside[0]
+		}
+	}
+
+	// Since every loop has a distinct header and loops are either disjoint or
+	// nested, sorting by size puts inner loops first and the parent of a loop
+	// is the smallest loop after it that contains its header.
+	sort.SliceStable(f.Loops, func(i, j int) bool {
+		return len(f.Loops[i].Blocks) < len(f.Loops[j].Blocks)
+	})
+	for i, loop := range f.Loops {
+		for _, outer := range f.Loops[i+1:] {
+			if outer.blocks[loop.Header] {
+				loop.Parent = outer
+				outer.Children = append(outer.Children, loop)
+				break
+			}
+		}
+		if loop.Parent == nil {
+			f.Roots = append(f.Roots, loop)
+		}
+		for _, b := range loop.Blocks {
+			if f.innermost[b] == nil {
+				f.innermost[b] = loop
+			}
+		}
+	}
+	for i := len(f.Loops) - 1; i >= 0; i-- {
+		if loop := f.Loops[i]; loop.Parent != nil {
+			loop.Depth = loop.Parent.Depth + 1
+		}
+	}
+	return f
+}
+
+// Innermost returns the innermost loop containing b, or nil if b isn't in a
+// loop.
+func (f *LoopForest) Innermost(b int) *Loop {
+	return f.innermost[b]
+}
@@ -0,0 +1,60 @@
+package opt
+
+import (
+	"github.com/yjp20/turtle/straw/pkg/ir"
+)
+
+type Pass struct {
+	Name string
+	Run  func(program *ir.Program)
+}
+
+// Passes lists every optimization pass in the order that Optimize runs them.
+var Passes = []Pass{
+	{"phis", RemoveTrivialPhis},
+	{"licm", HoistInvariants},
+	{"indvars", ReduceInductionVars},
+	{"bce", HoistBoundsChecks},
+	{"dce", EliminateDeadCode},
+}
+
+// Optimize runs every pass over the program in place.
+func Optimize(program *ir.Program) {
+	for _, pass := range Passes {
+		pass.Run(program)
+	}
+}
+
+// eachLoop calls fn for every loop in the program that has a preheader,
+// with inner loops before the loops that contain them.
+func eachLoop(program *ir.Program, fn func(loop *Loop, forest *LoopForest, d *defs)) {
+	d := newDefs(program)
+	for _, proc := range program.Procedures {
+		d.scan(proc)
+		forest := FindLoops(Dominators(NewGraph(proc)))
+		for _, loop := range forest.Loops {
+			if loop.Preheader != -1 {
+				fn(loop, forest, d)
+			}
+		}
+	}
+}
+
+// invariant reports whether a is computed outside of loop, which makes it
+// constant for the duration of the loop.
+func invariant(a ir.Assignment, loop *Loop, d *defs) bool {
+	b, ok := d.block[a]
+	return !ok || !loop.Contains(b)
+}
+
+// loopOrder returns the blocks of loop in reverse postorder, so that
+// definitions are visited before their uses.
+func loopOrder(loop *Loop, g *Graph) []int {
+	order := make([]int, 0, len(loop.Blocks))
+	for _, b := range g.ReversePostorder() {
+		if loop.Contains(b) {
+			order = append(order, b)
+		}
+	}
+	return order
+}
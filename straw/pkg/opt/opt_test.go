@@ -0,0 +1,111 @@
+package opt
+
+import (
+	"testing"
+
+	"github.com/yjp20/turtle/straw/pkg/astgen"
+	"github.com/yjp20/turtle/straw/pkg/ir"
+	"github.com/yjp20/turtle/straw/pkg/irgen"
+	"github.com/yjp20/turtle/straw/pkg/token"
+)
+
+func generate(t *testing.T, src string) *ir.Program {
+	errors := token.NewErrorList()
+	file := token.NewFile([]byte(src))
+	node := astgen.NewParser(astgen.NewLexer(file, &errors), &errors).ParseProgram()
+	program := irgen.NewGenerator(&errors).Generate(node)
+	if len(errors) != 0 {
+		t.Fatalf("%q: %v", src, errors)
+	}
+	return &program
+}
+
+// count returns how many instructions of kind k the first loop of the
+// program has, and how many its preheader has.
+func count(t *testing.T, program *ir.Program, k ir.InstKind) (inLoop, inPreheader int) {
+	proc := program.Procedures[0]
+	forest := FindLoops(Dominators(NewGraph(proc)))
+	if len(forest.Loops) == 0 || forest.Loops[0].Preheader == -1 {
+		t.Fatalf("expected a loop with a preheader in\n%s", program.String())
+	}
+	loop := forest.Loops[0]
+	for _, block := range proc.Blocks {
+		for _, inst := range block.Instructions {
+			switch {
+			case inst.Kind != k:
+			case loop.Contains(block.Index):
+				inLoop++
+			case block.Index == loop.Preheader:
+				inPreheader++
+			}
+		}
+	}
+	return inLoop, inPreheader
+}
+
+func run(program *ir.Program, passes ...func(*ir.Program)) {
+	for _, pass := range passes {
+		pass(program)
+	}
+}
+
+func TestHoistInvariants(t *testing.T) {
+	program := generate(t, "k: 3\ns: 0\n∀ i ∈ range[0‥10) → {\n\ts: s + k * 2\n}\ns\n")
+	if in, _ := count(t, program, ir.Mul); in != 1 {
+		t.Fatalf("expected k * 2 in the loop, got %d in\n%s", in, program.String())
+	}
+	run(program, RemoveTrivialPhis, HoistInvariants)
+	if in, pre := count(t, program, ir.Mul); in != 0 || pre != 1 {
+		t.Errorf("expected k * 2 in the preheader, got %d in the loop and %d in the preheader in\n%s", in, pre, program.String())
+	}
+}
+
+func TestHoistFallible(t *testing.T) {
+	// x * 2 fails, but the loop never runs
+	program := generate(t, "x: \"a\"\ns: 0\n∀ i ∈ range[0‥0) → {\n\ts: x * 2\n}\ns\n")
+	run(program, RemoveTrivialPhis, HoistInvariants)
+	if in, pre := count(t, program, ir.Mul); in != 1 || pre != 0 {
+		t.Errorf("expected x * 2 to stay in the loop, got %d in the loop and %d in the preheader in\n%s", in, pre, program.String())
+	}
+}
+
+func TestReduceInductionVars(t *testing.T) {
+	tests := []struct {
+		src     string
+		reduced bool
+	}{
+		{"s: 0\n∀ i ∈ range[0‥10) → {\n\ts: s + i * 3\n}\ns\n", true},
+		// Floats would round differently
+		{"f: 0.1\ng: 0.\n∀ i ∈ range[0‥10) → {\n\tg: g + f * 3.0\n\tf: f + 0.1\n}\ng\n", false},
+	}
+	for _, test := range tests {
+		program := generate(t, test.src)
+		run(program, RemoveTrivialPhis, HoistInvariants, ReduceInductionVars, EliminateDeadCode)
+		in, _ := count(t, program, ir.Mul)
+		if reduced := in == 0; reduced != test.reduced {
+			t.Errorf("%q: expected reduced to be %v, got %d multiplications in the loop in\n%s", test.src, test.reduced, in, program.String())
+		}
+	}
+}
+
+func TestHoistBoundsChecks(t *testing.T) {
+	tests := []struct {
+		src     string
+		hoisted bool
+	}{
+		{"a: .make array[i64] 10\ns: 0\n∀ i ∈ range[0‥10) → {\n\ts: s + a[i]\n}\ns\n", true},
+		// Indexing a[3] might never happen
+		{"a: .make array[i64] 3\ns: 0\n∀ i ∈ range[0‥10) → {\n\ti = 3 ⇒ return s\n\ts: s + a[i]\n}\ns\n", false},
+		// The range is empty, which the hoisted check lets through
+		{"a: .make array[i64] 3\nn: 0\n∀ i ∈ range[0‥n) → {\n\ta[i]: 1\n}\na\n", true},
+	}
+	for _, test := range tests {
+		program := generate(t, test.src)
+		run(program, RemoveTrivialPhis, HoistInvariants, HoistBoundsChecks)
+		in, _ := count(t, program, ir.BoundsCheck)
+		_, pre := count(t, program, ir.BoundsCheckRange)
+		if hoisted := in == 0 && pre == 1; hoisted != test.hoisted {
+			t.Errorf("%q: expected hoisted to be %v, got %d checks in the loop and %d in the preheader in\n%s", test.src, test.hoisted, in, pre, program.String())
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package opt
+
+import (
+	"github.com/yjp20/turtle/straw/pkg/ir"
+)
+
+// RemoveTrivialPhis replaces phis that only ever take a single value with
+// that value. irgen leaves a phi behind whenever a symbol is looked up in a
+// new block, so a symbol that a loop never assigns goes around the loop
+// through a cycle of them, and wouldn't look invariant otherwise.
+//
+// Phis that read each other form strongly connected groups, and a group that
+// only takes a single value from outside of it is trivial as a whole. Tarjan's
+// algorithm finds the groups after the groups they read, so the values they
+// take are already replaced by then.
+func RemoveTrivialPhis(program *ir.Program) {
+	t := &phiGroups{
+		d:       newDefs(program),
+		index:   map[ir.Assignment]int{},
+		low:     map[ir.Assignment]int{},
+		onStack: map[ir.Assignment]bool{},
+		sub:     map[ir.Assignment]ir.Assignment{},
+	}
+	for _, proc := range program.Procedures {
+		for _, block := range proc.Blocks {
+			for _, inst := range block.Instructions {
+				if _, ok := t.index[inst.Index]; !ok && inst.Kind == ir.Phi {
+					t.visit(inst.Index)
+				}
+			}
+		}
+	}
+	if len(t.sub) == 0 {
+		return
+	}
+
+	for _, proc := range program.Procedures {
+		for _, block := range proc.Blocks {
+			kept := block.Instructions[:0]
+			for _, inst := range block.Instructions {
+				if _, ok := t.sub[inst.Index]; ok {
+					continue
+				}
+				for i := range inst.Args {
+					inst.Args[i] = t.resolve(inst.Args[i])
+				}
+				for i := range inst.Phis {
+					inst.Phis[i].Assignment = t.resolve(inst.Phis[i].Assignment)
+				}
+				kept = append(kept, inst)
+			}
+			block.Instructions = kept
+			for name, a := range block.Symbols {
+				block.Symbols[name] = t.resolve(a)
+			}
+		}
+	}
+}
+
+type phiGroups struct {
+	d       *defs
+	next    int
+	index   map[ir.Assignment]int
+	low     map[ir.Assignment]int
+	stack   []ir.Assignment
+	onStack map[ir.Assignment]bool
+
+	// sub maps every trivial phi to the value it takes
+	sub map[ir.Assignment]ir.Assignment
+}
+
+func (t *phiGroups) isPhi(a ir.Assignment) bool {
+	inst, ok := t.d.inst[a]
+	return ok && inst.Kind == ir.Phi
+}
+
+func (t *phiGroups) resolve(a ir.Assignment) ir.Assignment {
+	if to, ok := t.sub[a]; ok {
+		return to
+	}
+	return a
+}
+
+func (t *phiGroups) visit(a ir.Assignment) {
+	t.index[a], t.low[a] = t.next, t.next
+	t.next++
+	t.stack = append(t.stack, a)
+	t.onStack[a] = true
+	for _, phi := range t.d.inst[a].Phis {
+		b := phi.Assignment
+		if !t.isPhi(b) {
+			continue
+		}
+		if _, ok := t.index[b]; !ok {
+			t.visit(b)
+			if t.low[b] < t.low[a] {
+				t.low[a] = t.low[b]
+			}
+		} else if t.onStack[b] && t.index[b] < t.low[a] {
+			t.low[a] = t.index[b]
+		}
+	}
+	if t.low[a] != t.index[a] {
+		return
+	}
+
+	group := map[ir.Assignment]bool{}
+	for {
+		b := t.stack[len(t.stack)-1]
+		t.stack = t.stack[:len(t.stack)-1]
+		t.onStack[b] = false
+		group[b] = true
+		if b == a {
+			break
+		}
+	}
+	var only ir.Assignment
+	found := false
+	for b := range group {
+		for _, phi := range t.d.inst[b].Phis {
+			v := t.resolve(phi.Assignment)
+			if group[v] || found && v == only {
+				continue
+			}
+			if found {
+				return
+			}
+			only, found = v, true
+		}
+	}
+	if !found {
+		return
+	}
+	for b := range group {
+		t.sub[b] = only
+	}
+}
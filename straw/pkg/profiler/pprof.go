@@ -0,0 +1,174 @@
+package profiler
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// WriteProfile writes the profile in the gzipped protobuf format of pprof,
+// described by github.com/google/pprof/proto/profile.proto, so that
+// `go tool pprof` can read it. Every sample is a stack of procedures and
+// lines, with the instructions and nanoseconds spent there.
+func (p *Profiler) WriteProfile(w io.Writer) error {
+	b := &profileBuilder{strings: map[string]int64{"": 0}, stringTable: []string{""}, functions: map[string]uint64{}, locations: map[location]uint64{}}
+
+	b.valueType(1, "instructions", "count")
+	b.valueType(1, "time", "nanoseconds")
+	p.walk(func(n *node) {
+		for line, c := range n.counts {
+			if c.instructions == 0 && c.nanos == 0 {
+				continue
+			}
+			// Locations go from the leaf to the root, each caller at the
+			// line it made the call from
+			ids := []uint64{b.location(n.name, n.file, line)}
+			for a := n; a.parent != p.root && a.parent != nil; a = a.parent {
+				ids = append(ids, b.location(a.parent.name, a.parent.file, a.line))
+			}
+			sample := message{}
+			sample.packedUints(1, ids)
+			sample.packedInts(2, []int64{c.instructions, c.nanos})
+			b.profile.bytes(2, sample)
+		}
+	})
+	// These are encoded as repeated fields already
+	b.profile = append(b.profile, b.locationBytes...)
+	b.profile = append(b.profile, b.functionBytes...)
+	period := message{}
+	period.int(1, b.str("time"))
+	period.int(2, b.str("nanoseconds"))
+	for _, s := range b.stringTable {
+		b.profile.string(6, s)
+	}
+	b.profile.int(9, p.start.UnixNano())
+	b.profile.int(10, int64(p.duration))
+	b.profile.bytes(11, period)
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(b.profile); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+type location struct {
+	name, file string
+	line       int
+}
+
+type profileBuilder struct {
+	profile message
+
+	strings     map[string]int64
+	stringTable []string
+
+	functions     map[string]uint64
+	functionBytes message
+	locations     map[location]uint64
+	locationBytes message
+}
+
+func (b *profileBuilder) str(s string) int64 {
+	if i, ok := b.strings[s]; ok {
+		return i
+	}
+	b.strings[s] = int64(len(b.stringTable))
+	b.stringTable = append(b.stringTable, s)
+	return b.strings[s]
+}
+
+func (b *profileBuilder) valueType(field int, typ, unit string) {
+	m := message{}
+	m.int(1, b.str(typ))
+	m.int(2, b.str(unit))
+	b.profile.bytes(field, m)
+}
+
+func (b *profileBuilder) function(name, file string) uint64 {
+	if id, ok := b.functions[name+"\x00"+file]; ok {
+		return id
+	}
+	id := uint64(len(b.functions) + 1)
+	b.functions[name+"\x00"+file] = id
+	f := message{}
+	f.uint(1, id)
+	f.int(2, b.str(name))
+	f.int(3, b.str(name))
+	f.int(4, b.str(file))
+	b.functionBytes.bytes(5, f)
+	return id
+}
+
+func (b *profileBuilder) location(name, file string, line int) uint64 {
+	if line < 0 {
+		line = 0
+	}
+	loc := location{name, file, line}
+	if id, ok := b.locations[loc]; ok {
+		return id
+	}
+	id := uint64(len(b.locations) + 1)
+	b.locations[loc] = id
+	l := message{}
+	l.uint(1, b.function(name, file))
+	l.int(2, int64(line))
+	m := message{}
+	m.uint(1, id)
+	m.bytes(4, l)
+	b.locationBytes.bytes(4, m)
+	return id
+}
+
+// message is an encoded protobuf message, built up a field at a time.
+type message []byte
+
+func (m *message) varint(v uint64) {
+	for v >= 0x80 {
+		*m = append(*m, byte(v)|0x80)
+		v >>= 7
+	}
+	*m = append(*m, byte(v))
+}
+
+func (m *message) key(field int, wire int) {
+	m.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (m *message) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	m.key(field, 0)
+	m.varint(v)
+}
+
+func (m *message) int(field int, v int64) {
+	m.uint(field, uint64(v))
+}
+
+func (m *message) bytes(field int, b []byte) {
+	m.key(field, 2)
+	m.varint(uint64(len(b)))
+	*m = append(*m, b...)
+}
+
+// string is always written, since the string table needs its empty string
+func (m *message) string(field int, s string) {
+	m.bytes(field, []byte(s))
+}
+
+func (m *message) packedUints(field int, vs []uint64) {
+	packed := message{}
+	for _, v := range vs {
+		packed.varint(v)
+	}
+	m.bytes(field, packed)
+}
+
+func (m *message) packedInts(field int, vs []int64) {
+	packed := message{}
+	for _, v := range vs {
+		packed.varint(uint64(v))
+	}
+	m.bytes(field, packed)
+}
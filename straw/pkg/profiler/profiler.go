@@ -0,0 +1,315 @@
+// Package profiler finds out where straw programs spend their time. A
+// Profiler is a vm.Tracer that counts every instruction a program runs, and
+// measures wall time, against the procedure and source line it's in and the
+// calls that led there. The result can be written as a pprof profile or as a
+// flat text report.
+package profiler
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yjp20/turtle/straw/pkg/token"
+	"github.com/yjp20/turtle/straw/pkg/vm"
+)
+
+// Profiler records a profile of the programs that run while it's the tracer
+// of a machine, between calls to Start and Stop.
+type Profiler struct {
+	vm.NopTracer
+
+	// Period is how many instructions run between reads of the clock, with
+	// the time between two reads charged to the line that ran last. If zero,
+	// the clock is read on every instruction, which is exact but slower.
+	Period int
+
+	root *node
+	cur  *node
+
+	// lines caches the line of every op that has run
+	lines map[*vm.Op]int
+
+	start, last time.Time
+	duration    time.Duration
+	steps       int
+}
+
+// node is a procedure called from a line of its caller. The nodes form a
+// tree of every distinct stack that was seen.
+type node struct {
+	name     string
+	file     string
+	line     int
+	parent   *node
+	children map[key]*node
+
+	// counts holds what was spent on each line of the procedure itself, and
+	// current is the line that ran last
+	counts  map[int]*counts
+	current int
+}
+
+type key struct {
+	name string
+	line int
+}
+
+type counts struct {
+	instructions int64
+	nanos        int64
+}
+
+func New() *Profiler {
+	p := &Profiler{lines: map[*vm.Op]int{}}
+	p.root = &node{children: map[key]*node{}, counts: map[int]*counts{}}
+	p.cur = p.root
+	return p
+}
+
+// NewSampling creates a profiler that reads the clock every period
+// instructions.
+func NewSampling(period int) *Profiler {
+	p := New()
+	p.Period = period
+	return p
+}
+
+func (p *Profiler) Start() {
+	p.start = time.Now()
+	p.last = p.start
+}
+
+func (p *Profiler) Stop() {
+	p.duration += time.Since(p.start)
+}
+
+func (p *Profiler) OnInstruction(x *vm.Execution, op *vm.Op, result vm.Object) {
+	p.count(p.line(x, op))
+}
+
+func (p *Profiler) OnCall(x *vm.Execution, fn vm.Object, args []vm.Object) {
+	// Time up to the call is spent by the caller
+	p.count(0)
+	name, file := "", "<builtin>"
+	caller := 0
+	switch fn := fn.(type) {
+	case *vm.Procedure:
+		name = fn.Name
+		if f := x.File(); f != nil {
+			file = f.Name
+		}
+		// The frame of the procedure is pushed already
+		caller = 1
+	case *vm.BuiltinFunction:
+		name = fn.Name
+	}
+	line := 0
+	if frames := x.Backtrace(); caller < len(frames) && x.File() != nil {
+		line = x.File().Position(frames[caller].Pos).Line
+	}
+
+	k := key{name: name, line: line}
+	child, ok := p.cur.children[k]
+	if !ok {
+		child = &node{name: name, file: file, line: line, parent: p.cur, children: map[key]*node{}, counts: map[int]*counts{}}
+		p.cur.children[k] = child
+	}
+	p.cur = child
+}
+
+func (p *Profiler) OnReturn(x *vm.Execution, result vm.Object) {
+	p.count(0)
+	if p.cur.parent != nil {
+		p.cur = p.cur.parent
+	}
+}
+
+func (p *Profiler) OnError(x *vm.Execution, err *vm.RuntimeError) {
+	p.count(0)
+	p.cur = p.root
+}
+
+// count charges an instruction on line of the current procedure, and the
+// time since the last one. A line of 0 only charges time, to the line that
+// ran last.
+func (p *Profiler) count(line int) {
+	n := p.cur
+	instruction := line != 0
+	if instruction {
+		n.current = line
+	} else {
+		line = n.current
+	}
+	c, ok := n.counts[line]
+	if !ok {
+		c = &counts{}
+		n.counts[line] = c
+	}
+	if instruction {
+		c.instructions++
+	}
+	if p.Period > 0 {
+		if !instruction {
+			return
+		}
+		if p.steps++; p.steps < p.Period {
+			return
+		}
+		p.steps = 0
+	}
+	now := time.Now()
+	c.nanos += int64(now.Sub(p.last))
+	p.last = now
+}
+
+// line returns the line op is on, or -1 if it doesn't have one.
+func (p *Profiler) line(x *vm.Execution, op *vm.Op) int {
+	if line, ok := p.lines[op]; ok {
+		return line
+	}
+	line := -1
+	if op.Inst != nil && op.Inst.Pos < op.Inst.End && x.File() != nil {
+		line = x.File().Position(op.Inst.Pos).Line
+	}
+	p.lines[op] = line
+	return line
+}
+
+// walk calls fn with every node below the root.
+func (p *Profiler) walk(fn func(n *node)) {
+	var visit func(n *node)
+	visit = func(n *node) {
+		if n != p.root {
+			fn(n)
+		}
+		keys := make([]key, 0, len(n.children))
+		for k := range n.children {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].name != keys[j].name {
+				return keys[i].name < keys[j].name
+			}
+			return keys[i].line < keys[j].line
+		})
+		for _, k := range keys {
+			visit(n.children[k])
+		}
+	}
+	visit(p.root)
+}
+
+type stat struct {
+	name      string
+	flat, cum counts
+	file      string
+	line      int
+}
+
+// lineKey tells apart procedures on the same line, like a λ and its caller.
+type lineKey struct {
+	pos  token.Position
+	name string
+}
+
+// Report writes how many instructions and how much time each procedure took,
+// by itself (flat) and with what it called (cum), followed by the top lines
+// of source.
+func (p *Profiler) Report(w io.Writer, lines int) {
+	funcs := map[string]*stat{}
+	byLine := map[lineKey]*stat{}
+	total := counts{}
+	p.walk(func(n *node) {
+		f, ok := funcs[n.name]
+		if !ok {
+			f = &stat{name: n.name}
+			funcs[n.name] = f
+		}
+		for line, c := range n.counts {
+			f.flat.add(c)
+			total.add(c)
+			k := lineKey{token.Position{Filename: n.file, Line: line}, n.name}
+			l, ok := byLine[k]
+			if !ok {
+				l = &stat{name: n.name, file: n.file, line: line}
+				byLine[k] = l
+			}
+			l.flat.add(c)
+
+			// Every procedure on the stack gets the cost once
+			seen := map[string]bool{}
+			for a := n; a != p.root; a = a.parent {
+				if !seen[a.name] {
+					seen[a.name] = true
+					g, ok := funcs[a.name]
+					if !ok {
+						g = &stat{name: a.name}
+						funcs[a.name] = g
+					}
+					g.cum.add(c)
+				}
+			}
+		}
+	})
+
+	stats := make([]*stat, 0, len(funcs))
+	for _, f := range funcs {
+		stats = append(stats, f)
+	}
+	sortStats(stats)
+	fmt.Fprintf(w, "%d instructions, %s\n\n", total.instructions, time.Duration(total.nanos))
+	fmt.Fprintf(w, "%12s %7s %12s %7s %12s %12s  %s\n", "flat", "flat%", "cum", "cum%", "flat time", "cum time", "procedure")
+	for _, f := range stats {
+		fmt.Fprintf(w, "%12d %6.2f%% %12d %6.2f%% %12s %12s  %s\n",
+			f.flat.instructions, percent(f.flat.instructions, total.instructions),
+			f.cum.instructions, percent(f.cum.instructions, total.instructions),
+			time.Duration(f.flat.nanos), time.Duration(f.cum.nanos), f.name)
+	}
+
+	if lines == 0 {
+		return
+	}
+	stats = stats[:0]
+	for _, l := range byLine {
+		if l.line > 0 {
+			stats = append(stats, l)
+		}
+	}
+	sortStats(stats)
+	if len(stats) > lines {
+		stats = stats[:lines]
+	}
+	fmt.Fprintf(w, "\n%12s %7s %12s  %s\n", "flat", "flat%", "flat time", "line")
+	for _, l := range stats {
+		fmt.Fprintf(w, "%12d %6.2f%% %12s  %s:%d (%s)\n",
+			l.flat.instructions, percent(l.flat.instructions, total.instructions),
+			time.Duration(l.flat.nanos), strings.TrimPrefix(l.file, "./"), l.line, l.name)
+	}
+}
+
+func (c *counts) add(o *counts) {
+	c.instructions += o.instructions
+	c.nanos += o.nanos
+}
+
+func sortStats(stats []*stat) {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].flat.instructions != stats[j].flat.instructions {
+			return stats[i].flat.instructions > stats[j].flat.instructions
+		}
+		if stats[i].name != stats[j].name {
+			return stats[i].name < stats[j].name
+		}
+		return stats[i].line < stats[j].line
+	})
+}
+
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
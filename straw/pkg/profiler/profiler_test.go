@@ -0,0 +1,49 @@
+package profiler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/yjp20/turtle/straw"
+)
+
+func TestProfile(t *testing.T) {
+	p := New()
+	in := straw.New(straw.Options{Tracer: p})
+	p.Start()
+	result, err := in.EvalFile("../../examples/fibo_recursion.st")
+	p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.String() != "<i64 6765>" {
+		t.Errorf("expected <i64 6765>, got %s", result)
+	}
+
+	report := &bytes.Buffer{}
+	p.Report(report, 5)
+	if !strings.Contains(report.String(), "fibo") || !strings.Contains(report.String(), "fibo_recursion.st:") {
+		t.Errorf("expected fibo and its lines in the report, got\n%s", report)
+	}
+
+	out := &bytes.Buffer{}
+	if err := p.WriteProfile(out); err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"fibo", "instructions", "nanoseconds", "fibo_recursion.st"} {
+		if !bytes.Contains(b, []byte(s)) {
+			t.Errorf("expected %q in the profile", s)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package report
+
+// This package builds a static html page that shows a program as it moves
+// through the compiler, similar to the ssa.html that Go writes when
+// GOSSAFUNC is set. Every phase is a column, and clicking an assignment like
+// %3 highlights it in every column.
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/yjp20/turtle/straw/pkg/ast"
+	"github.com/yjp20/turtle/straw/pkg/astgen"
+	"github.com/yjp20/turtle/straw/pkg/codegen/rv64"
+	"github.com/yjp20/turtle/straw/pkg/ir"
+	"github.com/yjp20/turtle/straw/pkg/irgen"
+	"github.com/yjp20/turtle/straw/pkg/macro"
+	"github.com/yjp20/turtle/straw/pkg/opt"
+	"github.com/yjp20/turtle/straw/pkg/token"
+	"github.com/yjp20/turtle/straw/pkg/vm"
+)
+
+type Report struct {
+	Title   string
+	Columns []Column
+}
+
+type Column struct {
+	Title string
+	Text  string
+}
+
+func New(title string) *Report {
+	return &Report{Title: title}
+}
+
+func (r *Report) Add(title string, text string) {
+	r.Columns = append(r.Columns, Column{Title: title, Text: text})
+}
+
+// Compile runs source through every phase of the compiler, adding a column
+// for the source, the ast with its macros expanded, the ir before and after each optimization pass,
+// and the rv64 assembly. The returned program is the optimized ir. If
+// parsing or generating fails, the report stops at the failing phase and the
+// errors are added as the last column.
+func Compile(title string, source []byte) (*Report, ir.Program, token.ErrorList) {
+	r := New(title)
+	r.Add("source", string(source))
+
+	errors := token.NewErrorList()
+	file := token.NewFile(source)
+	file.Name = title
+	lex := astgen.NewLexer(file, &errors)
+	par := astgen.NewParser(lex, &errors)
+	node := par.ParseProgram()
+	if len(errors) == 0 {
+		macro.NewExpander(vm.NewMachine()).Expand(context.Background(), node, file, &errors)
+	}
+	r.Add("ast", ast.Print(node))
+	if len(errors) != 0 {
+		r.addErrors(file, errors)
+		return r, ir.Program{}, errors
+	}
+
+	code := irgen.NewGenerator(&errors).Generate(node)
+	r.Add("start", code.String())
+	if len(errors) != 0 {
+		r.addErrors(file, errors)
+		return r, code, errors
+	}
+
+	for _, pass := range opt.Passes {
+		pass.Run(&code)
+		r.Add(pass.Name, code.String())
+	}
+	r.Add("rv64", rv64.Compile(code))
+	return r, code, errors
+}
+
+func (r *Report) addErrors(file *token.File, errors token.ErrorList) {
+	sb := strings.Builder{}
+	for _, err := range errors {
+		if err, ok := err.(token.Error); ok {
+			sb.WriteString(err.Print(file))
+		} else {
+			sb.WriteString(err.Error() + "\n")
+		}
+	}
+	r.Add("errors", sb.String())
+}
+
+var assignment = regexp.MustCompile(`%[0-9]+`)
+
+func (r *Report) WriteHTML(w io.Writer) error {
+	sb := strings.Builder{}
+	sb.WriteString("<!doctype html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	fmt.Fprintf(&sb, "<title>%s</title>\n", html.EscapeString(r.Title))
+	sb.WriteString(style)
+	sb.WriteString("</head>\n<body>\n")
+	fmt.Fprintf(&sb, "<h1>%s</h1>\n<div class=\"columns\">\n", html.EscapeString(r.Title))
+	for _, column := range r.Columns {
+		sb.WriteString("<div class=\"column\">\n")
+		fmt.Fprintf(&sb, "<h2 title=\"click to collapse\">%s</h2>\n", html.EscapeString(column.Title))
+		// Escaping never touches '%' or digits, so assignments can be marked up
+		// after escaping the text
+		text := assignment.ReplaceAllStringFunc(html.EscapeString(column.Text), func(a string) string {
+			return fmt.Sprintf("<span class=\"v v%s\">%s</span>", a[1:], a)
+		})
+		fmt.Fprintf(&sb, "<pre>%s</pre>\n</div>\n", text)
+	}
+	sb.WriteString("</div>\n")
+	sb.WriteString(script)
+	sb.WriteString("</body>\n</html>\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+const style = `<style>
+body { font-family: sans-serif; margin: 1em; }
+h1 { font-size: 1.2em; }
+.columns { display: flex; align-items: flex-start; overflow-x: auto; }
+.column { border: 1px solid #ccc; margin-right: 0.5em; padding: 0 0.5em; min-width: 2em; }
+.column h2 { font-size: 1em; cursor: pointer; white-space: nowrap; }
+.column.collapsed pre { display: none; }
+.column.collapsed h2 { writing-mode: vertical-lr; }
+pre { font-size: 0.8em; }
+.v { cursor: pointer; }
+.v.highlight { background: #ffe066; }
+</style>
+`
+
+const script = `<script>
+for (const h of document.querySelectorAll(".column h2")) {
+	h.addEventListener("click", () => h.parentElement.classList.toggle("collapsed"));
+}
+for (const v of document.querySelectorAll(".v")) {
+	v.addEventListener("click", () => {
+		const cls = [...v.classList].find(c => c !== "v" && c.startsWith("v"));
+		const on = !v.classList.contains("highlight");
+		for (const other of document.querySelectorAll(".v")) {
+			other.classList.remove("highlight");
+		}
+		if (on) {
+			for (const other of document.getElementsByClassName(cls)) {
+				other.classList.add("highlight");
+			}
+		}
+	});
+}
+</script>
+`
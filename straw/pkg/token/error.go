@@ -5,10 +5,18 @@ import (
 	"strings"
 )
 
+// Frame is an entry in the stack trace of a runtime error, naming the
+// procedure that was running and where it was.
+type Frame struct {
+	Name string
+	Pos  Pos
+}
+
 type Error struct {
-	msg string
-	pos Pos
-	end Pos
+	msg   string
+	pos   Pos
+	end   Pos
+	trace []Frame
 }
 
 var (
@@ -17,23 +25,59 @@ var (
 )
 
 func NewError(msg string, pos Pos, end Pos) Error {
-	return Error{msg, pos, end}
+	return Error{msg: msg, pos: pos, end: end}
+}
+
+// NewTracedError creates an error with a stack trace, innermost frame first.
+func NewTracedError(msg string, pos Pos, end Pos, trace []Frame) Error {
+	return Error{msg: msg, pos: pos, end: end, trace: trace}
 }
 
 func (se Error) Error() string {
 	return se.msg
 }
 
+func (se Error) Pos() Pos       { return se.pos }
+func (se Error) End() Pos       { return se.end }
+func (se Error) Trace() []Frame { return se.trace }
+
+// Print formats the error as file:line:col followed by the message, the
+// source lines it spans with the offending range highlighted, and the stack
+// trace if there is one.
 func (se Error) Print(file *File) string {
 	sb := strings.Builder{}
-	sb.WriteString(se.Error() + "\n")
-	sl := file.StartOfLine(file.SearchLine(se.pos))
-	el := file.StartOfLine(file.SearchLine(se.end) + 1)
-	sb.Write(file.Source[sl:se.pos])
-	sb.WriteString(red)
-	sb.Write(file.Source[se.pos:se.end])
-	sb.WriteString(reset)
-	sb.Write(file.Source[se.end:el])
-	sb.WriteString(fmt.Sprintf("%d:%d:%d:%d\n", sl, se.pos, se.end, el))
+	sb.WriteString(fmt.Sprintf("%s: %s\n", file.Position(se.pos), se.Error()))
+	if pos, end, ok := se.clamp(file); ok {
+		sl := file.StartOfLine(file.SearchLine(pos))
+		el := file.StartOfLine(file.SearchLine(end) + 1)
+		if end > pos && file.Source[end-1] == '\n' {
+			el = end
+		}
+		sb.Write(file.Source[sl:pos])
+		sb.WriteString(red)
+		sb.Write(file.Source[pos:end])
+		sb.WriteString(reset)
+		sb.Write(file.Source[end:el])
+		if el == sl || file.Source[el-1] != '\n' {
+			sb.WriteRune('\n')
+		}
+	}
+	for _, frame := range se.trace {
+		sb.WriteString(fmt.Sprintf("\tat %s (%s)\n", frame.Name, file.Position(frame.Pos)))
+	}
 	return sb.String()
 }
+
+func (se Error) clamp(file *File) (Pos, Pos, bool) {
+	pos, end := se.pos, se.end
+	if pos < 0 || int(pos) > len(file.Source) {
+		return 0, 0, false
+	}
+	if end < pos {
+		end = pos
+	}
+	if int(end) > len(file.Source) {
+		end = Pos(len(file.Source))
+	}
+	return pos, end, true
+}
@@ -1,6 +1,12 @@
 package token
 
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
 type File struct {
+	Name   string
 	Lines  []Pos
 	Source []byte
 }
@@ -12,11 +18,13 @@ func NewFile(source []byte) *File {
 	}
 }
 
+// SearchLine returns the index of the line that pos is on. Lines are only
+// known once the lexer has read past them.
 func (f *File) SearchLine(pos Pos) int {
 	l, r := 0, len(f.Lines)
-	for r - l > 1 {
+	for r-l > 1 {
 		m := (l + r) / 2
-		if f.Lines[m] < pos {
+		if f.Lines[m] <= pos {
 			l = m
 		} else {
 			r = m
@@ -32,6 +40,21 @@ func (f *File) StartOfLine(line int) Pos {
 	return f.Lines[line]
 }
 
+// Position converts pos into a line and column, both counted from 1. Columns
+// count runes rather than bytes.
+func (f *File) Position(pos Pos) Position {
+	if pos < 0 || int(pos) > len(f.Source) {
+		return Position{Filename: f.Name}
+	}
+	line := f.SearchLine(pos)
+	start := f.StartOfLine(line)
+	return Position{
+		Filename: f.Name,
+		Line:     line + 1,
+		Column:   utf8.RuneCount(f.Source[start:pos]) + 1,
+	}
+}
+
 type Pos int
 
 type Position struct {
@@ -39,3 +62,16 @@ type Position struct {
 	Line     int
 	Column   int
 }
+
+func (p Position) IsValid() bool { return p.Line > 0 }
+
+func (p Position) String() string {
+	name := p.Filename
+	if name == "" {
+		name = "<input>"
+	}
+	if !p.IsValid() {
+		return name
+	}
+	return fmt.Sprintf("%s:%d:%d", name, p.Line, p.Column)
+}
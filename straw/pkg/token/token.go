@@ -71,6 +71,9 @@ const (
 	GO        // go
 	SELECT    // select
 	MATCH     // match
+	DEFER     // defer
+	YIELD     // yield
+	QUOTE     // quote
 
 	MUTABLE      // μ
 	COMPILE_TIME // σ
@@ -115,6 +118,12 @@ func Lookup(lit string) Token {
 		return SELECT
 	case "match":
 		return MATCH
+	case "defer":
+		return DEFER
+	case "yield":
+		return YIELD
+	case "quote":
+		return QUOTE
 
 	case "range":
 		return RANGE
@@ -67,17 +67,20 @@ func _() {
 	_ = x[GO-56]
 	_ = x[SELECT-57]
 	_ = x[MATCH-58]
-	_ = x[MUTABLE-59]
-	_ = x[COMPILE_TIME-60]
-	_ = x[RANGE-61]
-	_ = x[CHAN-62]
-	_ = x[INTERFACE-63]
-	_ = x[STRUCT-64]
+	_ = x[DEFER-59]
+	_ = x[YIELD-60]
+	_ = x[QUOTE-61]
+	_ = x[MUTABLE-62]
+	_ = x[COMPILE_TIME-63]
+	_ = x[RANGE-64]
+	_ = x[CHAN-65]
+	_ = x[INTERFACE-66]
+	_ = x[STRUCT-67]
 }
 
-const _Token_name = "ILLEGALEOFCOMMENTIDENTINTFLOATRUNESTRINGTRUEFALSEADDSUBMULQUOMODINDEXANDORXOREXPONENTSHIFT_LEFTSHIFT_RIGHTASSIGNNOTLOGICAL_ANDLOGICAL_ORLOGICAL_XOREQUALLESSGREATERNOT_EQUALLESS_EQUALGREATER_EQUALELIPSISLEFT_PARENRIGHT_PARENLEFT_BRACKRIGHT_BRACKLEFT_BRACERIGHT_BRACECOMMAPERIODSEMICOLONLEFT_ARROWRIGHT_ARROWOPTIONALFUNCFOREACHTHENELSECONSTRUCTBREAKCONTINUERETURNDEFAULTGOSELECTMATCHMUTABLECOMPILE_TIMERANGECHANINTERFACESTRUCT"
+const _Token_name = "ILLEGALEOFCOMMENTIDENTINTFLOATRUNESTRINGTRUEFALSEADDSUBMULQUOMODINDEXANDORXOREXPONENTSHIFT_LEFTSHIFT_RIGHTASSIGNNOTLOGICAL_ANDLOGICAL_ORLOGICAL_XOREQUALLESSGREATERNOT_EQUALLESS_EQUALGREATER_EQUALELIPSISLEFT_PARENRIGHT_PARENLEFT_BRACKRIGHT_BRACKLEFT_BRACERIGHT_BRACECOMMAPERIODSEMICOLONLEFT_ARROWRIGHT_ARROWOPTIONALFUNCFOREACHTHENELSECONSTRUCTBREAKCONTINUERETURNDEFAULTGOSELECTMATCHDEFERYIELDQUOTEMUTABLECOMPILE_TIMERANGECHANINTERFACESTRUCT"
 
-var _Token_index = [...]uint16{0, 7, 10, 17, 22, 25, 30, 34, 40, 44, 49, 52, 55, 58, 61, 64, 69, 72, 74, 77, 85, 95, 106, 112, 115, 126, 136, 147, 152, 156, 163, 172, 182, 195, 202, 212, 223, 233, 244, 254, 265, 270, 276, 285, 295, 306, 314, 318, 321, 325, 329, 333, 342, 347, 355, 361, 368, 370, 376, 381, 388, 400, 405, 409, 418, 424}
+var _Token_index = [...]uint16{0, 7, 10, 17, 22, 25, 30, 34, 40, 44, 49, 52, 55, 58, 61, 64, 69, 72, 74, 77, 85, 95, 106, 112, 115, 126, 136, 147, 152, 156, 163, 172, 182, 195, 202, 212, 223, 233, 244, 254, 265, 270, 276, 285, 295, 306, 314, 318, 321, 325, 329, 333, 342, 347, 355, 361, 368, 370, 376, 381, 386, 391, 396, 403, 415, 420, 424, 433, 439}
 
 func (i Token) String() string {
 	if i < 0 || i >= Token(len(_Token_index)-1) {
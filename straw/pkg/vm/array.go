@@ -0,0 +1,144 @@
+package vm
+
+import (
+	"unicode/utf8"
+
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+// elements returns the elements of an array or slice.
+func elements(obj Object) ([]Object, *Type, bool) {
+	switch obj := obj.(type) {
+	case *Array:
+		return obj.Objects, obj.ItemType, true
+	case *Slice:
+		return obj.Objects, obj.ItemType, true
+	}
+	return nil, nil, false
+}
+
+// length returns the number of elements of an array, slice, string, tuple
+// or map, or how many values are waiting in a channel.
+func length(obj Object) (int, bool) {
+	switch obj := obj.(type) {
+	case *Array:
+		return len(obj.Objects), true
+	case *Slice:
+		return len(obj.Objects), true
+	case *String:
+		return utf8.RuneCountInString(obj.Value), true
+	case *Tuple:
+		return len(obj.Fields), true
+	case *Map:
+		return obj.Len(), true
+	case *Chan:
+		return len(obj.buffer), true
+	}
+	return 0, false
+}
+
+// slice returns the elements [from, to) of an array or slice, as a slice
+// which shares them, or the runes [from, to) of a string.
+func slice(obj Object, from, to int64) (Object, error) {
+	if s, ok := obj.(*String); ok {
+		begin, end := runeOffset(s.Value, from), runeOffset(s.Value, to)
+		if from < 0 || to < from || end < 0 {
+			return nil, Errorf(IndexOutOfRange, "range [%d, %d) out of bounds for length %d", from, to, utf8.RuneCountInString(s.Value))
+		}
+		return &String{s.Value[begin:end]}, nil
+	}
+	objects, t, ok := elements(obj)
+	if !ok {
+		return nil, Errorf(TypeError, "cannot slice %s", obj.String())
+	}
+	if from < 0 || to < from || to > int64(cap(objects)) {
+		return nil, Errorf(IndexOutOfRange, "range [%d, %d) out of bounds for capacity %d", from, to, cap(objects))
+	}
+	return &Slice{Objects: objects[from:to], ItemType: t}, nil
+}
+
+// construct makes an array or slice of type t holding items, a struct with
+// items as its fields, or an empty map.
+func construct(t *Type, items []Object) (Object, error) {
+	if t.ObjectKind == kind.Struct {
+		return constructStruct(t, nil, items)
+	}
+	for i, item := range items {
+		elem, ok := element(t.Elem, item)
+		if !ok {
+			return nil, Errorf(TypeError, "element %d is %s, not %s", i, item.String(), t.Elem.Name)
+		}
+		items[i] = elem
+	}
+	switch t.ObjectKind {
+	case kind.Array:
+		return &Array{Objects: items, ItemType: t.Elem}, nil
+	case kind.Slice:
+		return &Slice{Objects: items, ItemType: t.Elem}, nil
+	case kind.Map:
+		if len(items) > 0 {
+			return nil, Errorf(TypeError, "the elements of maps need keys, like (key: value)")
+		}
+		return NewMap(t.Key, t.Elem, 0), nil
+	}
+	return nil, Errorf(TypeError, "cannot construct %s", t.String())
+}
+
+// element returns obj as an element of type t, or false if it can't be one.
+// Numbers are converted to the kind of number t is, as long as that doesn't
+// turn a float into an integer or change an integer's value. Elements of
+// unresolved types aren't checked.
+func element(t *Type, obj Object) (Object, bool) {
+	if t == nil {
+		return obj, true
+	}
+	switch k := t.ObjectKind; {
+	case k.IsInteger() || k.IsFloat():
+		v := ValueOf(obj)
+		if !isNumber(v) || (v.kind == floatValue && k.IsInteger()) || !fits(v, k) {
+			return nil, false
+		}
+		if v.num == k {
+			return obj, true
+		}
+		v, err := convert(v, k)
+		return v.Object(), err == nil
+	case k == kind.Bool, k == kind.String, k == kind.Rune, k == kind.Array, k == kind.Slice, k == kind.Map, k == kind.Chan:
+		return obj, obj.Kind() == k
+	case k == kind.Struct:
+		tuple, ok := obj.(*Tuple)
+		return obj, ok && tuple.Type == t
+	case k == kind.Interface:
+		return obj, implements(obj, t)
+	}
+	return obj, true
+}
+
+// runeAt returns the i-th rune of s.
+func runeAt(s string, i int64) (rune, bool) {
+	offset := runeOffset(s, i)
+	if offset < 0 || offset == len(s) {
+		return 0, false
+	}
+	r, _ := utf8.DecodeRuneInString(s[offset:])
+	return r, true
+}
+
+// runeOffset returns the byte offset of the i-th rune of s, which is len(s)
+// for the rune after the last, or -1 if s is shorter than that.
+func runeOffset(s string, i int64) int {
+	if i < 0 {
+		return -1
+	}
+	n := int64(0)
+	for offset := range s {
+		if n == i {
+			return offset
+		}
+		n++
+	}
+	if n == i {
+		return len(s)
+	}
+	return -1
+}
@@ -0,0 +1,355 @@
+package vm
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+// Builtins holds the globals that a program can refer to without defining
+// them, like print or i64. Go functions are registered with Register, which
+// converts their arguments and results to and from objects.
+type Builtins struct {
+	parent  *Builtins
+	globals map[string]Object
+}
+
+// NewBuiltins creates a registry that falls back to parent, which may be
+// nil.
+func NewBuiltins(parent *Builtins) *Builtins {
+	return &Builtins{parent: parent, globals: map[string]Object{}}
+}
+
+func (b *Builtins) Lookup(name string) (Object, bool) {
+	for ; b != nil; b = b.parent {
+		if obj, ok := b.globals[name]; ok {
+			return obj, true
+		}
+	}
+	return nil, false
+}
+
+// Define makes obj visible to programs as name.
+func (b *Builtins) Define(name string, obj Object) {
+	b.globals[name] = obj
+}
+
+// DefineFunc registers a function that works on objects directly.
+func (b *Builtins) DefineFunc(name string, fn func(m *Machine, args []Object) (Object, error)) {
+	b.Define(name, &BuiltinFunction{Name: name, Fn: fn})
+}
+
+var (
+	machineType = reflect.TypeOf((*Machine)(nil))
+	objectType  = reflect.TypeOf((*Object)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Register exposes the Go function fn to programs as name. The function can
+// take a *Machine as its first parameter, and may be variadic. Its arguments
+// and results are converted with ToGo and FromGo. If the last result is an
+// error, a non-nil error is reported as a runtime error, and several other
+// results are returned as a tuple.
+func (b *Builtins) Register(name string, fn interface{}) error {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func {
+		return fmt.Errorf("%s: expected a function, got %s", name, t)
+	}
+
+	withMachine := t.NumIn() > 0 && t.In(0) == machineType
+	params := make([]reflect.Type, 0, t.NumIn())
+	for i := 0; i < t.NumIn(); i++ {
+		if i == 0 && withMachine {
+			continue
+		}
+		params = append(params, t.In(i))
+	}
+	results := t.NumOut()
+	withError := results > 0 && t.Out(results-1) == errorType
+	if withError {
+		results--
+	}
+
+	b.DefineFunc(name, func(m *Machine, args []Object) (Object, error) {
+		in := make([]reflect.Value, 0, len(args)+1)
+		if withMachine {
+			in = append(in, reflect.ValueOf(m))
+		}
+		for i, arg := range args {
+			var param reflect.Type
+			switch {
+			case t.IsVariadic() && i >= len(params)-1:
+				param = params[len(params)-1].Elem()
+			case i < len(params):
+				param = params[i]
+			default:
+				return nil, Errorf(ArgumentError, "%s takes %d arguments, got %d", name, len(params), len(args))
+			}
+			value, err := ToGo(arg, param)
+			if err != nil {
+				return nil, Errorf(TypeError, "argument %d of %s: %s", i, name, err)
+			}
+			in = append(in, value)
+		}
+		required := len(params)
+		if t.IsVariadic() {
+			required--
+		}
+		if len(args) < required {
+			return nil, Errorf(ArgumentError, "%s takes %d arguments, got %d", name, required, len(args))
+		}
+
+		out := v.Call(in)
+		if withError && !out[results].IsNil() {
+			return nil, out[results].Interface().(error)
+		}
+		switch results {
+		case 0:
+			return NULL, nil
+		case 1:
+			return FromGo(out[0])
+		}
+		fields := make([]Field, results)
+		for i := range fields {
+			obj, err := FromGo(out[i])
+			if err != nil {
+				return nil, err
+			}
+			fields[i].Value = obj
+		}
+		return &Tuple{Fields: fields}, nil
+	})
+	return nil
+}
+
+// MustRegister is like Register, but panics if fn can't be registered.
+func (b *Builtins) MustRegister(name string, fn interface{}) {
+	if err := b.Register(name, fn); err != nil {
+		panic(err)
+	}
+}
+
+// FromGo converts a Go value into an object. Integers become i64, floats
+// f64, and slices arrays.
+func FromGo(v reflect.Value) (Object, error) {
+	if v.Type().Implements(objectType) {
+		if v.IsNil() {
+			return NULL, nil
+		}
+		return v.Interface().(Object), nil
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &I64{v.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &I64{int64(v.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		return &F64{v.Float()}, nil
+	case reflect.Bool:
+		if v.Bool() {
+			return TRUE, nil
+		}
+		return FALSE, nil
+	case reflect.String:
+		return &String{v.String()}, nil
+	case reflect.Slice:
+		objects := make([]Object, v.Len())
+		for i := range objects {
+			obj, err := FromGo(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			objects[i] = obj
+		}
+		return &Array{Objects: objects}, nil
+	case reflect.Map:
+		// Go maps have no order, so the keys are sorted to have one
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return lessGo(keys[i], keys[j]) })
+		m := NewMap(nil, nil, len(keys))
+		for _, key := range keys {
+			k, err := FromGo(key)
+			if err != nil {
+				return nil, err
+			}
+			value, err := FromGo(v.MapIndex(key))
+			if err != nil {
+				return nil, err
+			}
+			m.Set(k, value)
+		}
+		return m, nil
+	case reflect.Interface:
+		if v.IsNil() {
+			return NULL, nil
+		}
+		return FromGo(v.Elem())
+	}
+	return nil, fmt.Errorf("cannot convert %s to an object", v.Type())
+}
+
+var emptyInterface = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// ToGo converts an object into a Go value of type t. Parameters of type
+// interface{} get a plain Go value where there is one, like int64 for i64.
+func ToGo(obj Object, t reflect.Type) (reflect.Value, error) {
+	if t == emptyInterface {
+		var plain interface{} = obj
+		switch obj := obj.(type) {
+		case *I8:
+			plain = obj.Value
+		case *I16:
+			plain = obj.Value
+		case *I32:
+			plain = obj.Value
+		case *I64:
+			plain = obj.Value
+		case *U8:
+			plain = obj.Value
+		case *U16:
+			plain = obj.Value
+		case *U32:
+			plain = obj.Value
+		case *U64:
+			plain = obj.Value
+		case *F32:
+			plain = obj.Value
+		case *F64:
+			plain = obj.Value
+		case *Bool:
+			plain = obj.IsTrue
+		case *String:
+			plain = obj.Value
+		case *Rune:
+			plain = obj.Value
+		case *Array, *Slice:
+			items, err := ToGo(obj, reflect.TypeOf([]interface{}{}))
+			if err != nil {
+				return items, err
+			}
+			plain = items.Interface()
+		}
+		return reflect.ValueOf(&plain).Elem(), nil
+	}
+	if reflect.TypeOf(obj).AssignableTo(t) {
+		v := reflect.New(t).Elem()
+		v.Set(reflect.ValueOf(obj))
+		return v, nil
+	}
+
+	v := reflect.New(t).Elem()
+	if n := ValueOf(obj); isNumber(n) {
+		// Integers convert to any Go number they fit in, floats only to
+		// floats
+		big := n.num.IsUnsigned() && n.Int() < 0
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if n.kind == intValue && !big && !v.OverflowInt(n.Int()) {
+				v.SetInt(n.Int())
+				return v, nil
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if n.kind == intValue && (big || n.Int() >= 0) && !v.OverflowUint(n.bits) {
+				v.SetUint(n.bits)
+				return v, nil
+			}
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(toFloat(n))
+			return v, nil
+		}
+		return v, fmt.Errorf("cannot convert %s to %s", obj.String(), t)
+	}
+	switch obj := obj.(type) {
+	case *Bool:
+		if t.Kind() == reflect.Bool {
+			v.SetBool(obj.IsTrue)
+			return v, nil
+		}
+	case *String:
+		if t.Kind() == reflect.String {
+			v.SetString(obj.Value)
+			return v, nil
+		}
+	case *Rune:
+		switch t.Kind() {
+		case reflect.Int32, reflect.Int64, reflect.Int:
+			v.SetInt(int64(obj.Value))
+			return v, nil
+		case reflect.String:
+			v.SetString(string(obj.Value))
+			return v, nil
+		}
+	case *Array, *Slice:
+		if t.Kind() == reflect.Slice {
+			objects, _, _ := elements(obj)
+			v = reflect.MakeSlice(t, len(objects), len(objects))
+			for i, item := range objects {
+				elem, err := ToGo(item, t.Elem())
+				if err != nil {
+					return v, err
+				}
+				v.Index(i).Set(elem)
+			}
+			return v, nil
+		}
+	case *Map:
+		if t.Kind() == reflect.Map {
+			v = reflect.MakeMapWithSize(t, obj.Len())
+			var err error
+			obj.each(func(key, value Object) {
+				if err != nil {
+					return
+				}
+				var k, e reflect.Value
+				if k, err = ToGo(key, t.Key()); err != nil {
+					return
+				}
+				if e, err = ToGo(value, t.Elem()); err != nil {
+					return
+				}
+				v.SetMapIndex(k, e)
+			})
+			return v, err
+		}
+	}
+	return v, fmt.Errorf("cannot convert %s to %s", obj.String(), t)
+}
+
+// lessGo orders the keys of a Go map.
+func lessGo(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return a.Uint() < b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	case reflect.String:
+		return a.String() < b.String()
+	}
+	return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+}
+
+// zero returns the zero value of t, which new elements of arrays are set to.
+func zero(t *Type) Object {
+	if t == nil {
+		return NULL
+	}
+	switch t.ObjectKind {
+	case kind.I8, kind.I16, kind.I32, kind.I64, kind.U8, kind.U16, kind.U32, kind.U64, kind.F32, kind.F64:
+		return numberOf(t.ObjectKind, 0).Object()
+	case kind.Bool:
+		return FALSE
+	case kind.String:
+		return &String{""}
+	case kind.Rune:
+		return &Rune{0}
+	case kind.Struct:
+		obj, _ := constructStruct(t, nil, nil)
+		return obj
+	}
+	return NULL
+}
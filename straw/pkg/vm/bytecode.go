@@ -0,0 +1,496 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/yjp20/turtle/straw/pkg/ir"
+	"github.com/yjp20/turtle/straw/pkg/kind"
+	"github.com/yjp20/turtle/straw/pkg/token"
+)
+
+// Code is a program compiled for the interpreter. Every procedure becomes a
+// flat list of ops over a dense set of registers, with phis replaced by
+// parallel moves on the edges into their blocks.
+type Code struct {
+	Funcs []*Func
+	Entry int
+
+	// File is the source of the program, for debuggers
+	File *token.File
+}
+
+type Func struct {
+	Name    string
+	Ops     []Op
+	NumRegs int
+
+	// Params holds the register of each parameter, which a call fills in
+	// before running the function. ParamKinds holds their kinds as far as
+	// they're known before running, and arguments for parameters which are
+	// numbers are converted to theirs. ParamNames are what arguments are
+	// passed by name with, and Optional marks the parameters that have
+	// defaults.
+	Params     []int32
+	ParamKinds []kind.Kind
+	ParamNames []string
+	Optional   []bool
+
+	// Generator is set if the function yields, in which case calling it
+	// makes an iterator that runs it bit by bit
+	Generator bool
+
+	// Blocks holds the block each op was compiled from, Symbols the
+	// registers of the names visible in each block, and Assignments the ir
+	// value each register holds. Debuggers use them to show variables.
+	Blocks      []int32
+	Symbols     []map[string]int32
+	Assignments []ir.Assignment
+
+	// code is the program the function belongs to, and static is its
+	// procedure object if it captures nothing
+	code   *Code
+	static *Procedure
+}
+
+type Opcode uint8
+
+const (
+	opNop    Opcode = iota
+	opNumber        // Imm holds the bits of a number of kind Kind
+	opBool
+	opObject
+	opMove
+	opMoves // parallel moves, Args holds dst, src pairs
+
+	opAdd
+	opSub
+	opMul
+	opQuo
+	opMod
+	opLess
+	opGreater
+	opEquals
+	opNotEquals
+	opAnd
+	opOr
+	opNot
+	opConvert // converts B to Kind
+
+	opTuple
+	opType // a struct or interface called Symbol, of kind Kind, with fields Names of the types in Args
+	opExtract
+	opClosure
+	opCapture
+	opSelf
+	opGlobal
+	opExport
+	opMember
+	opCall // Names holds the names of the arguments passed by name
+	opRet
+	opUnwind
+	opPassed
+
+	opConstruct
+	opConstructMap // Args holds the keys and values, alternating
+	opLen
+	opIndex
+	opSetIndex // Args holds the array, index and value
+	opSlice    // Args holds the array, from and to
+
+	opIterate
+	opNext
+	opCurrent
+	opClose
+	opYield
+
+	opGo
+	opSend
+	opReceive
+	opSelect // Names holds the cases, and Imm is 1 if there's a default
+
+	opBoundsCheck
+	opBoundsCheckRange
+
+	opJump
+	opJumpIf
+	opJumpIfNot
+
+	opInvalid
+)
+
+// Op is a single bytecode instruction. A is the destination register, B and
+// C the operands, and Imm holds literals, jump targets and indices.
+type Op struct {
+	Code   Opcode
+	Kind   kind.Kind
+	A      int32
+	B      int32
+	C      int32
+	Imm    int64
+	Args   []int32
+	Names  []string
+	Obj    Object
+	Symbol string
+
+	// Inst is the instruction the op was compiled from, for errors
+	Inst *ir.Inst
+}
+
+var opNames = [...]string{
+	opNop: "nop", opNumber: "number", opBool: "bool", opObject: "object", opMove: "move", opMoves: "moves",
+	opAdd: "add", opSub: "sub", opMul: "mul", opQuo: "quo", opMod: "mod",
+	opLess: "less", opGreater: "greater", opEquals: "equals", opNotEquals: "notequals",
+	opAnd: "and", opOr: "or", opNot: "not", opConvert: "convert",
+	opTuple: "tuple", opType: "type", opExtract: "extract", opClosure: "closure", opCapture: "capture", opSelf: "self", opGlobal: "global", opExport: "export", opMember: "member",
+	opCall: "call", opRet: "ret", opUnwind: "unwind", opPassed: "passed",
+	opConstruct: "construct", opConstructMap: "constructmap", opLen: "len", opIndex: "index", opSetIndex: "setindex", opSlice: "slice",
+	opIterate: "iterate", opNext: "next", opCurrent: "current", opClose: "close", opYield: "yield",
+	opGo: "go", opSend: "send", opReceive: "receive", opSelect: "select",
+	opBoundsCheck: "boundscheck", opBoundsCheckRange: "boundscheckrange",
+	opJump: "jump", opJumpIf: "jumpif", opJumpIfNot: "jumpifnot",
+	opInvalid: "invalid",
+}
+
+func (c Opcode) String() string {
+	if int(c) < len(opNames) {
+		return opNames[c]
+	}
+	return fmt.Sprintf("op(%d)", c)
+}
+
+func (op Op) String() string {
+	s := fmt.Sprintf("%-12s r%d r%d r%d %d", op.Code, op.A, op.B, op.C, op.Imm)
+	if op.Args != nil {
+		s += fmt.Sprintf(" %v", op.Args)
+	}
+	return s
+}
+
+func (c *Code) String() string {
+	sb := strings.Builder{}
+	for i, fn := range c.Funcs {
+		fmt.Fprintf(&sb, "[%s()] %d regs:%d\n", fn.Name, i, fn.NumRegs)
+		for pc, op := range fn.Ops {
+			fmt.Fprintf(&sb, "%4d %s\n", pc, op)
+		}
+	}
+	return sb.String()
+}
+
+var binaryOps = map[ir.InstKind]Opcode{
+	ir.Add:       opAdd,
+	ir.Sub:       opSub,
+	ir.Mul:       opMul,
+	ir.Quo:       opQuo,
+	ir.Mod:       opMod,
+	ir.Less:      opLess,
+	ir.Greater:   opGreater,
+	ir.Equals:    opEquals,
+	ir.NotEquals: opNotEquals,
+	ir.And:       opAnd,
+	ir.Or:        opOr,
+}
+
+// literalKinds are the kinds of number that literals make. Literals of the
+// unsigned kinds are I64s with the kind as their type.
+var literalKinds = map[ir.InstKind]kind.Kind{
+	ir.I8:  kind.I8,
+	ir.I16: kind.I16,
+	ir.I32: kind.I32,
+	ir.I64: kind.I64,
+	ir.F32: kind.F32,
+	ir.F64: kind.F64,
+}
+
+// Compile translates the program into bytecode.
+func Compile(program ir.Program) *Code {
+	code := &Code{Funcs: make([]*Func, len(program.Procedures)), File: program.File}
+	for i, proc := range program.Procedures {
+		fn := compileProc(proc)
+		fn.code = code
+		fn.static = &Procedure{Name: proc.Name, Index: i, Func: fn}
+		code.Funcs[i] = fn
+	}
+	if proc := program.Lookup("_init"); proc != nil {
+		code.Entry = proc.Index
+	}
+	return code
+}
+
+type compiler struct {
+	proc *ir.Proc
+	fn   *Func
+	regs map[ir.Assignment]int32
+
+	// blocks holds the pc each block starts at, and jumps the ops whose Imm
+	// should be patched to the start of the block it names
+	blocks []int
+	jumps  []int
+}
+
+func compileProc(proc *ir.Proc) *Func {
+	c := &compiler{
+		proc:   proc,
+		fn:     &Func{Name: proc.Name, Generator: proc.Generator},
+		regs:   map[ir.Assignment]int32{},
+		blocks: make([]int, len(proc.Blocks)),
+	}
+
+	// Register 0 always holds NULL, for missing values
+	c.fn.Assignments = []ir.Assignment{0}
+	for _, block := range proc.Blocks {
+		for _, inst := range block.Instructions {
+			c.regs[inst.Index] = int32(len(c.regs) + 1)
+			c.fn.Assignments = append(c.fn.Assignments, inst.Index)
+			if inst.Kind == ir.Param {
+				for len(c.fn.Params) <= int(inst.Int) {
+					c.fn.Params = append(c.fn.Params, -1)
+					c.fn.ParamNames = append(c.fn.ParamNames, "")
+					c.fn.Optional = append(c.fn.Optional, false)
+				}
+				c.fn.Params[inst.Int] = c.regs[inst.Index]
+				c.fn.ParamNames[inst.Int] = inst.Symbol
+				c.fn.Optional[inst.Int] = inst.Bool
+				for len(c.fn.ParamKinds) <= int(inst.Int) {
+					c.fn.ParamKinds = append(c.fn.ParamKinds, kind.Unresolved)
+				}
+				c.fn.ParamKinds[inst.Int] = inst.Type.Kind
+			}
+		}
+	}
+	c.fn.NumRegs = len(c.regs) + 1
+
+	for _, block := range proc.Blocks {
+		c.blocks[block.Index] = len(c.fn.Ops)
+		c.compileBlock(block)
+		for len(c.fn.Blocks) < len(c.fn.Ops) {
+			c.fn.Blocks = append(c.fn.Blocks, int32(block.Index))
+		}
+	}
+	for _, pc := range c.jumps {
+		c.fn.Ops[pc].Imm = int64(c.blocks[c.fn.Ops[pc].Imm])
+	}
+	c.symbols()
+	return c.fn
+}
+
+// symbols finds the names visible in each block: its own, and those of the
+// blocks before it, following the first predecessor. Names of globals are
+// left out, since they aren't local.
+func (c *compiler) symbols() {
+	kinds := map[ir.Assignment]ir.InstKind{}
+	for _, block := range c.proc.Blocks {
+		for _, inst := range block.Instructions {
+			kinds[inst.Index] = inst.Kind
+		}
+	}
+	c.fn.Symbols = make([]map[string]int32, len(c.proc.Blocks))
+	for _, block := range c.proc.Blocks {
+		symbols := map[string]int32{}
+		for b := block; b != nil; {
+			for name, a := range b.Symbols {
+				reg, ok := c.regs[a]
+				if _, seen := symbols[name]; seen || !ok || kinds[a] == ir.Global {
+					continue
+				}
+				symbols[name] = reg
+			}
+			next := b
+			b = nil
+			for _, pred := range next.Predecesors {
+				if pred.Index < next.Index {
+					b = pred
+					break
+				}
+			}
+		}
+		c.fn.Symbols[block.Index] = symbols
+	}
+}
+
+func (c *compiler) reg(a ir.Assignment) int32 {
+	return c.regs[a]
+}
+
+func (c *compiler) emit(op Op) int {
+	c.fn.Ops = append(c.fn.Ops, op)
+	return len(c.fn.Ops) - 1
+}
+
+func (c *compiler) jump(code Opcode, cond int32, block int, inst *ir.Inst) {
+	c.jumps = append(c.jumps, c.emit(Op{Code: code, B: cond, Imm: int64(block), Inst: inst}))
+}
+
+func (c *compiler) compileBlock(block *ir.Block) {
+	for _, inst := range block.Instructions {
+		dst := c.reg(inst.Index)
+		args := make([]int32, len(inst.Args))
+		for i, a := range inst.Args {
+			args[i] = c.reg(a)
+		}
+
+		if code, ok := binaryOps[inst.Kind]; ok {
+			c.emit(Op{Code: code, A: dst, B: args[0], C: args[1], Inst: inst})
+			continue
+		}
+
+		switch inst.Kind {
+		case ir.Phi, ir.Param:
+			// Filled in by moves on the incoming edges, or by the call
+
+		case ir.I8, ir.I16, ir.I32, ir.I64:
+			k := literalKinds[inst.Kind]
+			if inst.Type.Kind.IsInteger() {
+				k = inst.Type.Kind
+			}
+			c.emit(Op{Code: opNumber, Kind: k, A: dst, Imm: inst.Int, Inst: inst})
+		case ir.F32, ir.F64:
+			c.emit(Op{Code: opNumber, Kind: literalKinds[inst.Kind], A: dst, Imm: int64(math.Float64bits(inst.Float)), Inst: inst})
+		case ir.Bool:
+			imm := int64(0)
+			if inst.Bool {
+				imm = 1
+			}
+			c.emit(Op{Code: opBool, A: dst, Imm: imm, Inst: inst})
+		case ir.String:
+			c.emit(Op{Code: opObject, A: dst, Obj: &String{inst.Text}, Inst: inst})
+		case ir.Rune:
+			c.emit(Op{Code: opObject, A: dst, Obj: &Rune{rune(inst.Int)}, Inst: inst})
+		case ir.Default:
+			c.emit(Op{Code: opObject, A: dst, Obj: &Default{}, Inst: inst})
+		case ir.ProcedureType:
+			c.emit(Op{Code: opObject, A: dst, Obj: procedureType(inst.Type), Inst: inst})
+		case ir.Move:
+			c.emit(Op{Code: opMove, A: dst, B: args[0], Inst: inst})
+		case ir.Not:
+			c.emit(Op{Code: opNot, A: dst, B: args[0], Inst: inst})
+		case ir.Convert:
+			c.emit(Op{Code: opConvert, Kind: inst.Type.Kind, A: dst, B: args[0], Inst: inst})
+
+		case ir.ConstructTuple:
+			c.emit(Op{Code: opTuple, A: dst, Args: args, Names: inst.Names, Inst: inst})
+		case ir.MakeType:
+			c.emit(Op{Code: opType, Kind: kind.Kind(inst.Int), A: dst, Args: args, Names: inst.Names, Symbol: inst.Symbol, Inst: inst})
+		case ir.Extract:
+			c.emit(Op{Code: opExtract, A: dst, B: args[0], Imm: inst.Int, Inst: inst})
+
+		case ir.ProcedureDefinition:
+			c.emit(Op{Code: opClosure, A: dst, Imm: int64(inst.Proc), Inst: inst})
+		case ir.MakeClosure:
+			c.emit(Op{Code: opClosure, A: dst, Imm: int64(inst.Proc), Args: args, Inst: inst})
+		case ir.Capture:
+			c.emit(Op{Code: opCapture, A: dst, Imm: inst.Int, Inst: inst})
+		case ir.Self:
+			c.emit(Op{Code: opSelf, A: dst, Inst: inst})
+		case ir.Global:
+			c.emit(Op{Code: opGlobal, A: dst, Symbol: inst.Symbol, Inst: inst})
+		case ir.Export:
+			c.emit(Op{Code: opExport, B: args[0], Symbol: inst.Symbol, Inst: inst})
+		case ir.Member:
+			c.emit(Op{Code: opMember, A: dst, B: args[0], Symbol: inst.Symbol, Inst: inst})
+		case ir.Call:
+			op := Op{Code: opCall, A: dst, B: args[0], Args: args[1:], Inst: inst}
+			if inst.Names != nil {
+				op.Names = inst.Names[1:]
+			}
+			c.emit(op)
+		case ir.Unwind:
+			c.emit(Op{Code: opUnwind, Args: args, Inst: inst})
+		case ir.Passed:
+			c.emit(Op{Code: opPassed, A: dst, Imm: inst.Int, Inst: inst})
+
+		case ir.Construct:
+			c.emit(Op{Code: opConstruct, A: dst, B: args[0], Args: args[1:], Inst: inst})
+		case ir.ConstructMap:
+			c.emit(Op{Code: opConstructMap, A: dst, B: args[0], Args: args[1:], Inst: inst})
+		case ir.Len:
+			c.emit(Op{Code: opLen, A: dst, B: args[0], Inst: inst})
+		case ir.Index:
+			c.emit(Op{Code: opIndex, A: dst, B: args[0], C: args[1], Inst: inst})
+		case ir.SetIndex:
+			c.emit(Op{Code: opSetIndex, Args: args, Inst: inst})
+		case ir.Slice:
+			c.emit(Op{Code: opSlice, A: dst, Args: args, Inst: inst})
+
+		case ir.Iterate:
+			c.emit(Op{Code: opIterate, A: dst, B: args[0], Inst: inst})
+		case ir.Next:
+			c.emit(Op{Code: opNext, A: dst, B: args[0], Inst: inst})
+		case ir.Current:
+			c.emit(Op{Code: opCurrent, A: dst, B: args[0], Inst: inst})
+		case ir.Close:
+			c.emit(Op{Code: opClose, B: args[0], Inst: inst})
+		case ir.Yield:
+			c.emit(Op{Code: opYield, B: args[0], Inst: inst})
+
+		case ir.Go:
+			c.emit(Op{Code: opGo, B: args[0], Args: args[1:], Inst: inst})
+		case ir.Send:
+			c.emit(Op{Code: opSend, B: args[0], C: args[1], Inst: inst})
+		case ir.Receive:
+			c.emit(Op{Code: opReceive, A: dst, B: args[0], Inst: inst})
+		case ir.Select:
+			imm := int64(0)
+			if inst.Bool {
+				imm = 1
+			}
+			c.emit(Op{Code: opSelect, A: dst, Args: args, Names: inst.Names, Imm: imm, Inst: inst})
+
+		case ir.BoundsCheck:
+			c.emit(Op{Code: opBoundsCheck, B: args[0], C: args[1], Inst: inst})
+		case ir.BoundsCheckRange:
+			c.emit(Op{Code: opBoundsCheckRange, Args: args, Inst: inst})
+
+		case ir.GotoIf:
+			moves := c.moves(block, inst.Block)
+			if moves == nil {
+				c.jump(opJumpIf, args[0], inst.Block, inst)
+				break
+			}
+			skip := c.emit(Op{Code: opJumpIfNot, B: args[0], Inst: inst})
+			c.emit(Op{Code: opMoves, Args: moves, Inst: inst})
+			c.jump(opJump, 0, inst.Block, inst)
+			c.fn.Ops[skip].Imm = int64(len(c.fn.Ops))
+		case ir.Goto:
+			if moves := c.moves(block, inst.Block); moves != nil {
+				c.emit(Op{Code: opMoves, Args: moves, Inst: inst})
+			}
+			c.jump(opJump, 0, inst.Block, inst)
+			return
+		case ir.Ret, ir.End:
+			c.emit(Op{Code: opRet, Args: args, Inst: inst})
+			return
+
+		default:
+			c.emit(Op{Code: opInvalid, Inst: inst})
+		}
+	}
+
+	if block.Index+1 == len(c.proc.Blocks) {
+		c.emit(Op{Code: opRet})
+		return
+	}
+	if moves := c.moves(block, block.Index+1); moves != nil {
+		c.emit(Op{Code: opMoves, Args: moves})
+	}
+}
+
+// moves returns the dst, src pairs that the phis of the target block need
+// when coming from block, or nil if there are none.
+func (c *compiler) moves(block *ir.Block, target int) []int32 {
+	var moves []int32
+	for _, inst := range c.proc.Blocks[target].Instructions {
+		if inst.Kind != ir.Phi {
+			continue
+		}
+		for _, phi := range inst.Phis {
+			if phi.BlockIndex == block.Index {
+				moves = append(moves, c.reg(inst.Index), c.reg(phi.Assignment))
+				break
+			}
+		}
+	}
+	return moves
+}
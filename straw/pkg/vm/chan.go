@@ -0,0 +1,255 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+// Chan is a channel that tasks send values to each other with, like in Go. A
+// send waits until there's room in the buffer, or until a receiver takes the
+// value if the channel has no buffer. Receiving from a closed channel gives
+// the zero value of its elements once the buffer is empty.
+type Chan struct {
+	ElemType *Type
+
+	size   int
+	buffer []Object
+	closed bool
+
+	// The tasks waiting to send and receive, in the order they started to
+	sendq []*waiter
+	recvq []*waiter
+}
+
+// waiter is a task blocked on a channel, either on its own or as a case of
+// a select.
+type waiter struct {
+	task  *task
+	value Object // what to send, or what was received
+	ok    bool   // false if the channel was closed instead
+
+	sel  *selection
+	pick int // the case of sel
+}
+
+// selection is shared by the waiters of a select, so that only one of its
+// cases goes ahead.
+type selection struct {
+	done bool
+	pick int
+}
+
+func NewChan(elem *Type, size int) *Chan {
+	return &Chan{ElemType: elem, size: size}
+}
+
+func (c *Chan) Kind() kind.Kind { return kind.Chan }
+func (c *Chan) String() string {
+	name := "any"
+	if c.ElemType != nil {
+		name = c.ElemType.Name
+	}
+	return fmt.Sprintf("<chan %s (%d/%d)>", name, len(c.buffer), c.size)
+}
+
+// pop returns the first waiter in q that hasn't been woken already, which the
+// other cases of a select may have done.
+func pop(q *[]*waiter) *waiter {
+	for len(*q) > 0 {
+		w := (*q)[0]
+		*q = (*q)[1:]
+		if w.sel == nil {
+			return w
+		}
+		if !w.sel.done {
+			w.sel.done, w.sel.pick = true, w.pick
+			return w
+		}
+	}
+	return nil
+}
+
+// trySend sends v if that can be done without waiting.
+func (c *Chan) trySend(s *scheduler, v Object) (bool, error) {
+	if c.closed {
+		return false, Errorf(TypeError, "send on a closed channel")
+	}
+	if w := pop(&c.recvq); w != nil {
+		w.value, w.ok = v, true
+		s.wakeUp(w.task)
+		return true, nil
+	}
+	if len(c.buffer) < c.size {
+		c.buffer = append(c.buffer, v)
+		return true, nil
+	}
+	return false, nil
+}
+
+// tryReceive receives a value if that can be done without waiting.
+func (c *Chan) tryReceive(s *scheduler) (Object, bool, bool) {
+	if len(c.buffer) > 0 {
+		v := c.buffer[0]
+		c.buffer = c.buffer[1:]
+		if w := pop(&c.sendq); w != nil {
+			c.buffer = append(c.buffer, w.value)
+			w.ok = true
+			s.wakeUp(w.task)
+		}
+		return v, true, true
+	}
+	if w := pop(&c.sendq); w != nil {
+		w.ok = true
+		s.wakeUp(w.task)
+		return w.value, true, true
+	}
+	if c.closed {
+		return zero(c.ElemType), false, true
+	}
+	return nil, false, false
+}
+
+// close closes c, waking every task waiting on it. Receivers get the zero
+// value, and senders fail.
+func (c *Chan) close(s *scheduler) error {
+	if c.closed {
+		return Errorf(TypeError, "close of a closed channel")
+	}
+	c.closed = true
+	for w := pop(&c.recvq); w != nil; w = pop(&c.recvq) {
+		w.value, w.ok = zero(c.ElemType), false
+		s.wakeUp(w.task)
+	}
+	for w := pop(&c.sendq); w != nil; w = pop(&c.sendq) {
+		w.ok = false
+		s.wakeUp(w.task)
+	}
+	return nil
+}
+
+// send sends v on c, blocking the current task until it can.
+func (state *state) send(c *Chan, v Object, op *Op) bool {
+	elem, ok := element(c.ElemType, v)
+	if !ok {
+		state.fail(TypeError, fmt.Sprintf("cannot send %s on %s", v.String(), c.String()), op)
+		return false
+	}
+	s := state.machine.sched
+	sent, err := c.trySend(s, elem)
+	if err != nil {
+		state.failWith(err, op)
+		return false
+	}
+	if sent {
+		return true
+	}
+	w := &waiter{task: s.current, value: elem}
+	c.sendq = append(c.sendq, w)
+	if !state.block(op, "sending") {
+		return false
+	}
+	if !w.ok {
+		state.fail(TypeError, "send on a closed channel", op)
+		return false
+	}
+	return true
+}
+
+// receive receives from c, blocking the current task until it can. more is
+// false if c was closed instead.
+func (state *state) receive(c *Chan, op *Op) (v Object, more bool, ok bool) {
+	s := state.machine.sched
+	if v, more, ok := c.tryReceive(s); ok {
+		return v, more, true
+	}
+	w := &waiter{task: s.current}
+	c.recvq = append(c.recvq, w)
+	if !state.block(op, "receiving") {
+		return nil, false, false
+	}
+	return w.value, w.ok, true
+}
+
+// choose does whichever case of a select can go ahead first, waiting for
+// one unless there's a default, and returns its index and what it received.
+// Cases that are ready at once are picked in order, and the default is -1.
+func (state *state) choose(op *Op, regs []Value) (int, Object, bool) {
+	s := state.machine.sched
+	type selectCase struct {
+		c     *Chan
+		send  bool
+		value Object
+	}
+	cases := []selectCase{}
+	for i := 0; i < len(op.Args); i++ {
+		c, ok := regs[op.Args[i]].obj.(*Chan)
+		if !ok {
+			state.fail(TypeError, fmt.Sprintf("cannot select on %s", regs[op.Args[i]].String()), op)
+			return 0, nil, false
+		}
+		sc := selectCase{c: c, send: op.Names[i] == "send"}
+		if sc.send {
+			i++
+			v, ok := element(c.ElemType, regs[op.Args[i]].Object())
+			if !ok {
+				state.fail(TypeError, fmt.Sprintf("cannot send %s on %s", regs[op.Args[i]].String(), c.String()), op)
+				return 0, nil, false
+			}
+			sc.value = v
+		}
+		cases = append(cases, sc)
+	}
+
+	for i, sc := range cases {
+		if sc.send {
+			sent, err := sc.c.trySend(s, sc.value)
+			if err != nil {
+				state.failWith(err, op)
+				return 0, nil, false
+			}
+			if sent {
+				return i, NULL, true
+			}
+		} else if v, _, ok := sc.c.tryReceive(s); ok {
+			return i, v, true
+		}
+	}
+	if op.Imm != 0 {
+		return -1, NULL, true
+	}
+
+	sel := &selection{}
+	waiters := make([]*waiter, len(cases))
+	for i, sc := range cases {
+		waiters[i] = &waiter{task: s.current, value: sc.value, sel: sel, pick: i}
+		if sc.send {
+			sc.c.sendq = append(sc.c.sendq, waiters[i])
+		} else {
+			sc.c.recvq = append(sc.c.recvq, waiters[i])
+		}
+	}
+	if !state.block(op, "selecting") {
+		return 0, nil, false
+	}
+	w := waiters[sel.pick]
+	if cases[sel.pick].send {
+		if !w.ok {
+			state.fail(TypeError, "send on a closed channel", op)
+			return 0, nil, false
+		}
+		return sel.pick, NULL, true
+	}
+	return sel.pick, w.value, true
+}
+
+// block blocks the current task at op. If the run is over by the time it's
+// woken, the task stops with the error the run failed with.
+func (state *state) block(op *Op, doing string) bool {
+	s := state.machine.sched
+	if s.block(s.current, op, doing) {
+		return true
+	}
+	state.err = s.err
+	return false
+}
@@ -0,0 +1,202 @@
+package vm
+
+import (
+	"strings"
+
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+// Equal reports whether a and b are equal. Numbers are equal if they have the
+// same value, whatever their kinds, and strings, runes and bools if they're
+// the same. Tuples, arrays, slices and maps are equal if their elements are,
+// and tuples also need the same names, and to be of the same struct if
+// they're one. Types are equal if they're the same type. Anything else, like
+// a function, is only equal to itself. Null is only equal to null, and
+// comparing any other values of different kinds is an error.
+func Equal(a, b Object) (bool, error) {
+	return equalSeen(a, b, nil)
+}
+
+// visits holds the pairs of containers that are being compared, so that
+// ones that contain themselves are only gone through once. A pair that comes
+// up again is taken to be equal, since whatever makes it unequal will be
+// found where it was first compared.
+type visits map[[2]Object]bool
+
+// visit reports whether a and b are being compared already, and records that
+// they are otherwise.
+func (v visits) visit(a, b Object) bool {
+	key := [2]Object{a, b}
+	if v[key] {
+		return true
+	}
+	v[key] = true
+	return false
+}
+
+func equalSeen(a, b Object, seen visits) (bool, error) {
+	a, b = orNull(a), orNull(b)
+	switch a.(type) {
+	case *Tuple, *Array, *Slice, *Map:
+		if seen == nil {
+			seen = visits{}
+		}
+		if a == b || seen.visit(a, b) {
+			return true, nil
+		}
+	}
+	if va, vb := ValueOf(a), ValueOf(b); isNumber(va) && isNumber(vb) {
+		c, ok := compareNumbers(va, vb)
+		return ok && c == 0, nil
+	}
+	if a.Kind() == kind.Null || b.Kind() == kind.Null {
+		return a.Kind() == b.Kind(), nil
+	}
+
+	switch a := a.(type) {
+	case *Bool:
+		if b, ok := b.(*Bool); ok {
+			return a.IsTrue == b.IsTrue, nil
+		}
+	case *String:
+		if b, ok := b.(*String); ok {
+			return a.Value == b.Value, nil
+		}
+	case *Rune:
+		if b, ok := b.(*Rune); ok {
+			return a.Value == b.Value, nil
+		}
+	case *Tuple:
+		if b, ok := b.(*Tuple); ok {
+			if len(a.Fields) != len(b.Fields) || a.Type != b.Type {
+				return false, nil
+			}
+			for i := range a.Fields {
+				if a.Fields[i].Name != b.Fields[i].Name {
+					return false, nil
+				}
+				if eq, err := equalSeen(a.Fields[i].Value, b.Fields[i].Value, seen); err != nil || !eq {
+					return false, err
+				}
+			}
+			return true, nil
+		}
+	case *Type:
+		if b, ok := b.(*Type); ok {
+			return sameType(a, b), nil
+		}
+	case *Array, *Slice:
+		if a.Kind() == b.Kind() {
+			x, _, _ := elements(a)
+			y, _, _ := elements(b)
+			if len(x) != len(y) {
+				return false, nil
+			}
+			for i := range x {
+				if eq, err := equalSeen(x[i], y[i], seen); err != nil || !eq {
+					return false, err
+				}
+			}
+			return true, nil
+		}
+	case *Map:
+		if b, ok := b.(*Map); ok {
+			if a.Len() != b.Len() {
+				return false, nil
+			}
+			for _, e := range a.entries {
+				if e.deleted {
+					continue
+				}
+				other, ok := b.Get(e.Key)
+				if !ok {
+					return false, nil
+				}
+				if eq, err := equalSeen(e.Value, other, seen); err != nil || !eq {
+					return false, err
+				}
+			}
+			return true, nil
+		}
+	default:
+		if a.Kind() == b.Kind() {
+			return a == b, nil
+		}
+	}
+	return false, Errorf(TypeError, "cannot compare %s and %s", a.String(), b.String())
+}
+
+// Compare returns -1, 0 or 1 as a is less than, equal to or greater than b.
+// Numbers are ordered by value, strings by their runes, and tuples, arrays
+// and slices by their elements in turn, with a shorter one first if it's the
+// start of the other. Nothing else is ordered.
+func Compare(a, b Object) (int, error) {
+	return compareSeen(a, b, nil)
+}
+
+func compareSeen(a, b Object, seen visits) (int, error) {
+	a, b = orNull(a), orNull(b)
+	switch a.(type) {
+	case *Tuple, *Array, *Slice:
+		if seen == nil {
+			seen = visits{}
+		}
+		if a == b || seen.visit(a, b) {
+			return 0, nil
+		}
+	}
+	if va, vb := ValueOf(a), ValueOf(b); isNumber(va) && isNumber(vb) {
+		c, ok := compareNumbers(va, vb)
+		if !ok {
+			return 0, Errorf(TypeError, "cannot order %s and %s", a.String(), b.String())
+		}
+		return c, nil
+	}
+
+	switch a := a.(type) {
+	case *String:
+		if b, ok := b.(*String); ok {
+			return strings.Compare(a.Value, b.Value), nil
+		}
+	case *Rune:
+		if b, ok := b.(*Rune); ok {
+			c, _ := compareNumbers(intOf(int64(a.Value)), intOf(int64(b.Value)))
+			return c, nil
+		}
+	case *Tuple:
+		if b, ok := b.(*Tuple); ok {
+			x := make([]Object, len(a.Fields))
+			for i, field := range a.Fields {
+				x[i] = field.Value
+			}
+			y := make([]Object, len(b.Fields))
+			for i, field := range b.Fields {
+				y[i] = field.Value
+			}
+			return compareAll(x, y, seen)
+		}
+	case *Array, *Slice:
+		if a.Kind() == b.Kind() {
+			x, _, _ := elements(a)
+			y, _, _ := elements(b)
+			return compareAll(x, y, seen)
+		}
+	}
+	return 0, Errorf(TypeError, "cannot order %s and %s", a.String(), b.String())
+}
+
+func compareAll(x, y []Object, seen visits) (int, error) {
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if c, err := compareSeen(x[i], y[i], seen); err != nil || c != 0 {
+			return c, err
+		}
+	}
+	return compareUints(uint64(len(x)), uint64(len(y))), nil
+}
+
+func orNull(obj Object) Object {
+	if obj == nil {
+		return NULL
+	}
+	return obj
+}
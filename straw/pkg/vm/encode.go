@@ -0,0 +1,324 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+// Values are serialized as JSON, following their types:
+//
+//	numbers, strings, bools   as themselves, with runes as strings of one rune
+//	null                      null
+//	arrays and slices         arrays
+//	structs and tuples        objects, or arrays if none of their fields have names
+//	maps                      objects if their keys are strings, otherwise arrays of [key, value]
+//
+// Decoding takes the type to decode to, which decides how the JSON is read.
+// Anything decoded as any gets the most general type it can have, like
+// map[string, any] for objects and slice[any] for arrays.
+
+func init() {
+	j := NewBuiltins(nil)
+	j.MustRegister("encode", func(m *Machine, obj Object) (string, error) {
+		data, err := Encode(obj)
+		if err != nil {
+			return "", err
+		}
+		return string(data), m.Alloc(1, int64(len(data)))
+	})
+	j.MustRegister("decode", func(t *Type, text string) (Object, error) {
+		return Decode(t, []byte(text))
+	})
+	Modules["json"] = j
+}
+
+// Encode serializes obj. Procedures, channels and the like can't be, and
+// neither can values that contain themselves.
+func Encode(obj Object) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encode(&buf, obj, map[Object]bool{}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encode writes obj to buf, where encoding holds the containers that it's in
+// the middle of writing.
+func encode(buf *bytes.Buffer, obj Object, encoding map[Object]bool) error {
+	obj = orNull(obj)
+	switch obj.(type) {
+	case *Array, *Slice, *Map:
+		if encoding[obj] {
+			return Errorf(TypeError, "cannot encode a value that contains itself")
+		}
+		encoding[obj] = true
+		defer delete(encoding, obj)
+	}
+	t := TypeOf(obj)
+	switch k := t.ObjectKind; {
+	case k == kind.Null:
+		buf.WriteString("null")
+	case k == kind.Bool:
+		buf.WriteString(strconv.FormatBool(obj.(*Bool).IsTrue))
+	case k.IsInteger(), k.IsFloat():
+		v := ValueOf(obj)
+		if v.kind == floatValue && (math.IsNaN(v.Float()) || math.IsInf(v.Float(), 0)) {
+			return Errorf(TypeError, "cannot encode %s", obj.String())
+		}
+		buf.WriteString(numberText(v))
+	case k == kind.String, k == kind.Rune:
+		text, _ := json.Marshal(display(obj))
+		buf.Write(text)
+	case k == kind.Array, k == kind.Slice:
+		objects, _, _ := elements(obj)
+		return encodeList(buf, len(objects), func(i int) error { return encode(buf, objects[i], encoding) })
+	case k == kind.Tuple, k == kind.Struct:
+		fields := obj.(*Tuple).Fields
+		named := false
+		for _, f := range fields {
+			named = named || !positional(f.Name)
+		}
+		if !named {
+			return encodeList(buf, len(fields), func(i int) error { return encode(buf, fields[i].Value, encoding) })
+		}
+		return encodeObject(buf, len(fields), encoding, func(i int) (string, Object) { return fields[i].Name, fields[i].Value })
+	case k == kind.Map:
+		m := obj.(*Map)
+		keys := m.Keys()
+		if t.Key.ObjectKind == kind.String || allStrings(keys) {
+			return encodeObject(buf, len(keys), encoding, func(i int) (string, Object) {
+				v, _ := m.Get(keys[i])
+				return keys[i].(*String).Value, v
+			})
+		}
+		return encodeList(buf, len(keys), func(i int) error {
+			v, _ := m.Get(keys[i])
+			return encode(buf, &Tuple{Fields: []Field{{Name: "0", Value: keys[i]}, {Name: "1", Value: v}}}, encoding)
+		})
+	default:
+		return Errorf(TypeError, "cannot encode %s", obj.String())
+	}
+	return nil
+}
+
+func encodeList(buf *bytes.Buffer, n int, item func(i int) error) error {
+	buf.WriteByte('[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := item(i); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte(']')
+	return nil
+}
+
+func encodeObject(buf *bytes.Buffer, n int, encoding map[Object]bool, field func(i int) (string, Object)) error {
+	buf.WriteByte('{')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, obj := field(i)
+		text, _ := json.Marshal(name)
+		buf.Write(text)
+		buf.WriteByte(':')
+		if err := encode(buf, obj, encoding); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+func allStrings(objects []Object) bool {
+	for _, obj := range objects {
+		if obj.Kind() != kind.String {
+			return false
+		}
+	}
+	return true
+}
+
+// Decode reads a value of type t from data.
+func Decode(t *Type, data []byte) (Object, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	obj, err := decode(dec, t)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, Errorf(ArgumentError, "cannot decode %s: there's more after the value", typeText(t))
+	}
+	return obj, nil
+}
+
+func decode(dec *json.Decoder, t *Type) (Object, error) {
+	t = orAny(t)
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, Errorf(ArgumentError, "cannot decode %s: %s", typeText(t), err)
+	}
+	var obj Object
+	switch tok := tok.(type) {
+	case json.Delim:
+		if tok == '[' {
+			obj, err = decodeArray(dec, t)
+		} else {
+			obj, err = decodeObject(dec, t)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The closing delimiter
+		dec.Token()
+	case nil:
+		return NULL, nil
+	case bool:
+		obj = FALSE
+		if tok {
+			obj = TRUE
+		}
+	case json.Number:
+		if i, err := strconv.ParseInt(string(tok), 10, 64); err == nil {
+			obj = &I64{i}
+		} else if f, err := strconv.ParseFloat(string(tok), 64); err == nil {
+			obj = &F64{f}
+		} else {
+			return nil, Errorf(ArgumentError, "cannot decode %s as %s", tok, typeText(t))
+		}
+		if !fits(ValueOf(obj), t.ObjectKind) {
+			return nil, Errorf(TypeError, "cannot decode %s as %s, it's out of range", tok, typeText(t))
+		}
+	case string:
+		obj = &String{tok}
+		if t.ObjectKind == kind.Rune {
+			r, size := utf8.DecodeRuneInString(tok)
+			if size == 0 || size != len(tok) {
+				return nil, Errorf(ArgumentError, "cannot decode %q as a rune", tok)
+			}
+			obj = &Rune{r}
+		}
+	}
+	elem, ok := element(t, obj)
+	if !ok {
+		return nil, Errorf(TypeError, "cannot decode %s as %s", display(obj), typeText(t))
+	}
+	return elem, nil
+}
+
+// decodeArray reads the elements of a JSON array, after its [.
+func decodeArray(dec *json.Decoder, t *Type) (Object, error) {
+	var objects []Object
+	for i := 0; dec.More(); i++ {
+		var elem *Type
+		switch t.ObjectKind {
+		case kind.Array, kind.Slice:
+			elem = t.Elem
+		case kind.Tuple:
+			if i >= len(t.Spec) {
+				return nil, Errorf(TypeError, "cannot decode more than %d fields as %s", len(t.Spec), typeText(t))
+			}
+			elem = t.Spec[i].Type
+		case kind.Map:
+			elem = &Type{Name: "tuple", ObjectKind: kind.Tuple, Spec: []Field{{Type: t.Key}, {Type: t.Elem}}}
+		case kind.Any:
+		default:
+			return nil, Errorf(TypeError, "cannot decode an array as %s", typeText(t))
+		}
+		obj, err := decode(dec, elem)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, obj)
+	}
+
+	if objects == nil {
+		objects = []Object{}
+	}
+	switch t.ObjectKind {
+	case kind.Array:
+		return &Array{Objects: objects, ItemType: t.Elem}, nil
+	case kind.Tuple:
+		tuple := &Tuple{}
+		for i, obj := range objects {
+			tuple.Fields = append(tuple.Fields, Field{Name: strconv.Itoa(i), Value: obj})
+		}
+		return tuple, nil
+	case kind.Map:
+		m := NewMap(t.Key, t.Elem, len(objects))
+		for _, pair := range objects {
+			fields := pair.(*Tuple).Fields
+			if len(fields) != 2 {
+				return nil, Errorf(TypeError, "cannot decode %s as a key and value of %s", pair.String(), typeText(t))
+			}
+			if _, err := store(m, fields[0].Value, fields[1].Value); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return &Slice{Objects: objects, ItemType: t.Elem}, nil
+}
+
+// decodeObject reads the fields of a JSON object, after its {.
+func decodeObject(dec *json.Decoder, t *Type) (Object, error) {
+	var names []string
+	var objects []Object
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, Errorf(ArgumentError, "cannot decode %s: %s", typeText(t), err)
+		}
+		name := tok.(string)
+		var elem *Type
+		switch t.ObjectKind {
+		case kind.Struct, kind.Tuple:
+			i := fieldIndex(t, name)
+			if i < 0 {
+				return nil, Errorf(TypeError, "%s has no field %s", typeText(t), name)
+			}
+			elem = t.Spec[i].Type
+		case kind.Map:
+			elem = t.Elem
+		case kind.Any:
+		default:
+			return nil, Errorf(TypeError, "cannot decode an object as %s", typeText(t))
+		}
+		obj, err := decode(dec, elem)
+		if err != nil {
+			return nil, err
+		}
+		names, objects = append(names, name), append(objects, obj)
+	}
+
+	switch t.ObjectKind {
+	case kind.Struct:
+		return constructStruct(t, names, objects)
+	case kind.Tuple:
+		tuple := &Tuple{}
+		for i, obj := range objects {
+			tuple.Fields = append(tuple.Fields, Field{Name: names[i], Value: obj})
+		}
+		return tuple, nil
+	}
+	m := NewMap(t.Key, t.Elem, len(objects))
+	if t.ObjectKind == kind.Any {
+		m = NewMap(builtinType("string", kind.String), nil, len(objects))
+	}
+	for i, obj := range objects {
+		if _, err := store(m, &String{names[i]}, obj); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
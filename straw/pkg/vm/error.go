@@ -0,0 +1,79 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/yjp20/turtle/straw/pkg/token"
+)
+
+//go:generate stringer -type=ErrorKind
+type ErrorKind uint8
+
+const (
+	// BuiltinError is any other error returned by a builtin function
+	BuiltinError ErrorKind = iota
+	TypeError
+	DivisionByZero
+	IndexOutOfRange
+	NilCall
+	UndefinedError
+	ArgumentError
+	Deadlock
+
+	// The limits a program can exceed, see Limits
+	InstructionLimit
+	CallDepthLimit
+	AllocationLimit
+	MemoryLimit
+	Timeout
+	Canceled
+)
+
+// RuntimeError is an error raised while running a program. It has the
+// position of the operation that failed and a trace of the procedures that
+// were running, innermost first.
+type RuntimeError struct {
+	Kind  ErrorKind
+	Msg   string
+	Pos   token.Pos
+	End   token.Pos
+	Trace []token.Frame
+
+	// Tasks has the traces of the other tasks that were blocked, for a
+	// Deadlock
+	Tasks [][]token.Frame
+}
+
+// Errorf creates a runtime error of the given kind for builtins to return.
+// The machine fills in where it happened.
+func Errorf(kind ErrorKind, format string, args ...interface{}) error {
+	return &RuntimeError{Kind: kind, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *RuntimeError) Error() string {
+	return "[vm] " + e.Msg
+}
+
+// Print formats the error with the source it points at and its trace.
+func (e *RuntimeError) Print(file *token.File) string {
+	text := token.NewTracedError(e.Error(), e.Pos, e.End, e.Trace).Print(file)
+	for _, trace := range e.Tasks {
+		text += "blocked task:\n"
+		for _, frame := range trace {
+			text += fmt.Sprintf("\tat %s (%s)\n", frame.Name, file.Position(frame.Pos))
+		}
+	}
+	return text
+}
+
+// runtimeError converts an error returned by a builtin into a runtime
+// error, keeping its kind if it is, or wraps, one.
+func runtimeError(err error) *RuntimeError {
+	var rerr *RuntimeError
+	if errors.As(err, &rerr) {
+		copy := *rerr
+		return &copy
+	}
+	return &RuntimeError{Kind: BuiltinError, Msg: err.Error()}
+}
@@ -1,41 +1,46 @@
 package vm
 
 import (
-	"github.com/yjp20/turtle/straw/pkg/ir"
+	"sort"
+
 	"github.com/yjp20/turtle/straw/pkg/kind"
 )
 
+// Frame holds named variables. Values computed by a program live in the
+// registers of the interpreter instead.
 type Frame struct {
 	parent    *Frame
-	registers map[ir.Assignment]Object
 	variables map[string]Object
 }
 
 func NewFrame(parent *Frame) *Frame {
 	return &Frame{
 		parent:    parent,
-		registers: make(map[ir.Assignment]Object),
 		variables: make(map[string]Object),
 	}
 }
 
 func (f *Frame) Kind() kind.Kind { return kind.Frame }
 func (f *Frame) Inspect() string { return "<frame>" }
-func (f *Frame) Get(a ir.Assignment) Object {
-	if val, ok := f.registers[a]; ok {
-		return val
+func (f *Frame) GetVar(name string) Object {
+	if obj, ok := f.variables[name]; ok {
+		return obj
 	}
 	if f.parent != nil {
-		return f.parent.Get(a)
+		return f.parent.GetVar(name)
 	}
-	return NULL
-}
-func (f *Frame) Set(a ir.Assignment, obj Object) {
-	f.registers[a] = obj
-}
-func (f *Frame) GetVar(name string) Object {
-	return f.variables[name]
+	return nil
 }
 func (f *Frame) SetVar(name string, obj Object) {
 	f.variables[name] = obj
 }
+
+// Variables returns the variables of the frame itself, sorted by name.
+func (f *Frame) Variables() []Variable {
+	vars := make([]Variable, 0, len(f.variables))
+	for name, obj := range f.variables {
+		vars = append(vars, Variable{Name: name, Value: obj})
+	}
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	return vars
+}
@@ -0,0 +1,324 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+// Iterator is what a loop steps through. Looping over anything else makes
+// one: arrays, slices, strings, maps and ranges are stepped through in order,
+// and channels are received from until they're closed. Calling a generator
+// makes one that runs it until each time it yields. Any other value can be
+// looped over by being a procedure, or a tuple with a next member, that
+// returns (value, more) each time it's called.
+type Iterator struct {
+	name    string
+	step    func(state *state, op *Op) (Object, bool)
+	current Object
+	done    bool
+
+	// onClose cleans up after iterators that a loop can leave partway
+	// through, like generators and readers
+	onClose func()
+}
+
+func (it *Iterator) Kind() kind.Kind { return kind.Iterator }
+func (it *Iterator) String() string  { return fmt.Sprintf("<iterator %s>", it.name) }
+
+// NewIterator makes an iterator that calls next for each value, until it
+// reports there are no more. Hosts use it to hand programs values lazily.
+func NewIterator(name string, next func() (Object, bool, error)) *Iterator {
+	return &Iterator{name: name, step: func(state *state, op *Op) (Object, bool) {
+		obj, more, err := next()
+		if err != nil {
+			state.failWith(err, op)
+			return nil, false
+		}
+		return obj, more
+	}}
+}
+
+// advance moves it on to its next value, reporting false once there are no
+// more, or if getting the next one failed.
+func (state *state) advance(it *Iterator, op *Op) bool {
+	if it.done {
+		return false
+	}
+	obj, more := it.step(state, op)
+	if !more || state.err != nil {
+		it.current, it.done = nil, true
+		return false
+	}
+	it.current = orNull(obj)
+	return true
+}
+
+// close ends it before it's done, cleaning up if it needs to.
+func (it *Iterator) close() {
+	if !it.done && it.onClose != nil {
+		it.onClose()
+	}
+	it.current, it.done = nil, true
+}
+
+// iterate returns an iterator over obj, or fails if it can't be looped over.
+func (state *state) iterate(obj Object, op *Op) *Iterator {
+	switch obj := obj.(type) {
+	case *Iterator:
+		return obj
+	case *Array, *Slice:
+		objects, _, _ := elements(obj)
+		return objectIterator(kindName(obj.Kind()), objects)
+	case *Map:
+		if !state.alloc(arraySize(obj.Len()), op) {
+			return nil
+		}
+		return objectIterator("map", obj.Keys())
+	case *String:
+		return stringIterator(obj.Value)
+	case *Range:
+		return rangeIterator(obj.Start, obj.End)
+	case *Chan:
+		return chanIterator(obj)
+	case *Procedure, *BuiltinFunction:
+		return callIterator(obj)
+	case *Tuple:
+		if next, ok := member(obj, "next"); ok {
+			return callIterator(next)
+		}
+	}
+	state.fail(TypeError, fmt.Sprintf("cannot loop over %s", obj.String()), op)
+	return nil
+}
+
+func objectIterator(name string, objects []Object) *Iterator {
+	i := 0
+	return &Iterator{name: name, step: func(state *state, op *Op) (Object, bool) {
+		if i >= len(objects) {
+			return nil, false
+		}
+		i++
+		return objects[i-1], true
+	}}
+}
+
+func stringIterator(text string) *Iterator {
+	return &Iterator{name: "string", step: func(state *state, op *Op) (Object, bool) {
+		if text == "" {
+			return nil, false
+		}
+		r, size := utf8.DecodeRuneInString(text)
+		text = text[size:]
+		return &Rune{r}, true
+	}}
+}
+
+func rangeIterator(i, end int64) *Iterator {
+	return &Iterator{name: "range", step: func(state *state, op *Op) (Object, bool) {
+		if i >= end {
+			return nil, false
+		}
+		i++
+		return intOf(i - 1).Object(), true
+	}}
+}
+
+// chanIterator receives from c until it's closed.
+func chanIterator(c *Chan) *Iterator {
+	return &Iterator{name: "chan", step: func(state *state, op *Op) (Object, bool) {
+		v, more, ok := state.receive(c, op)
+		return v, more && ok
+	}}
+}
+
+// callIterator makes an iterator that calls next for each value.
+func callIterator(next Object) *Iterator {
+	return &Iterator{name: "next", step: func(state *state, op *Op) (Object, bool) {
+		result, err := state.machine.Call(state.machine.Context(), next, nil)
+		if err != nil {
+			state.failFrom(err, op)
+			return nil, false
+		}
+		tuple, ok := result.(*Tuple)
+		if !ok || len(tuple.Fields) != 2 || tuple.Fields[1].Value.Kind() != kind.Bool {
+			state.fail(TypeError, fmt.Sprintf("next must return (value, more), got %s", result.String()), op)
+			return nil, false
+		}
+		return tuple.Fields[0].Value, tuple.Fields[1].Value == TRUE
+	}}
+}
+
+// generator runs a procedure that yields on a goroutine of its own, which
+// takes turns with whatever is looping over it, so that only one of them
+// runs at a time like tasks do. It starts the first time it's asked for a
+// value.
+type generator struct {
+	procedure *Procedure
+	args      []Object
+	missing   []bool
+
+	// resume hands over to the generator, or ends it if false, and
+	// yielded hands back, with false once it has returned
+	resume  chan bool
+	yielded chan bool
+	value   Object
+	err     *RuntimeError
+
+	started, finished bool
+
+	// stopped is set if the run it started in ended before it did
+	stopped bool
+}
+
+func newGenerator(procedure *Procedure, args []Object, missing []bool) *Iterator {
+	g := &generator{
+		procedure: procedure,
+		args:      args,
+		missing:   missing,
+		resume:    make(chan bool, 1),
+		yielded:   make(chan bool, 1),
+	}
+	return &Iterator{name: procedure.Name, step: g.step, onClose: g.close}
+}
+
+func (g *generator) step(state *state, op *Op) (Object, bool) {
+	if g.finished {
+		return nil, false
+	}
+	if g.stopped {
+		state.fail(TypeError, fmt.Sprintf("%s was stopped when the run it started in ended", g.procedure.Name), op)
+		return nil, false
+	}
+	if !g.started {
+		g.started = true
+		s := state.machine.sched
+		s.generators = append(s.generators, g)
+		go g.run(state.machine)
+	}
+	g.resume <- true
+	more := <-g.yielded
+	state.track()
+	if !more {
+		g.finished = true
+		if s := state.machine.sched; s.done {
+			// The run is over, which is what stopped the generator
+			state.err = s.err
+		} else if g.err != nil {
+			state.failFrom(g.err, op)
+		}
+		return nil, false
+	}
+	return g.value, true
+}
+
+func (g *generator) run(m *Machine) {
+	if !<-g.resume {
+		return
+	}
+	st := &state{machine: m, gen: g, depth: m.budget.depth}
+	st.run(g.procedure, g.args, g.missing)
+	g.err = st.err
+	g.yielded <- false
+}
+
+// yield hands v to the loop, and waits until it wants the next value. It
+// reports false if the generator has been closed or stopped instead.
+func (g *generator) yield(v Object) bool {
+	g.value = v
+	g.yielded <- true
+	return <-g.resume
+}
+
+// close is called when the loop over g is left before g returns, and lets g
+// run its deferred calls before waiting for it to return.
+func (g *generator) close() {
+	if !g.started || g.finished || g.stopped {
+		g.finished = true
+		return
+	}
+	g.finished = true
+	g.resume <- false
+	<-g.yielded
+}
+
+// stop stops g if it's waiting to be resumed, so that its goroutine returns.
+func (g *generator) stop() {
+	g.stopped = true
+	select {
+	case g.resume <- false:
+	default:
+	}
+}
+
+// failFrom raises err, which a call made at op failed with, keeping where it
+// failed and continuing its trace with the frames here.
+func (state *state) failFrom(err error, op *Op) {
+	rerr := runtimeError(err)
+	state.fail(rerr.Kind, rerr.Msg, op)
+	if len(rerr.Trace) > 0 {
+		state.err.Pos, state.err.End = rerr.Pos, rerr.End
+		state.err.Trace = append(rerr.Trace, state.err.Trace...)
+	}
+	state.err.Tasks = rerr.Tasks
+}
+
+// Reader is a stream of text that a host gives programs, like a file, which
+// the lines builtin reads a line at a time.
+type Reader struct {
+	Name string
+	R    io.Reader
+}
+
+func (r *Reader) Kind() kind.Kind { return kind.Reader }
+func (r *Reader) String() string  { return fmt.Sprintf("<reader %s>", r.Name) }
+
+// lines returns an iterator over the lines of a string or reader, without
+// the newlines. A reader is read as the lines are needed, and closed once
+// it's been read to the end or the loop over it is left, if it can be.
+func lines(m *Machine, obj Object) (*Iterator, error) {
+	switch obj := obj.(type) {
+	case *String:
+		text := obj.Value
+		return NewIterator("lines", func() (Object, bool, error) {
+			if text == "" {
+				return nil, false, nil
+			}
+			line := text
+			if i := strings.IndexByte(text, '\n'); i >= 0 {
+				line, text = text[:i], text[i+1:]
+			} else {
+				text = ""
+			}
+			return &String{strings.TrimSuffix(line, "\r")}, true, nil
+		}), nil
+	case *Reader:
+		scanner := bufio.NewScanner(obj.R)
+		closeReader := func() {
+			if c, ok := obj.R.(io.Closer); ok {
+				c.Close()
+			}
+		}
+		it := NewIterator("lines", func() (Object, bool, error) {
+			if scanner.Scan() {
+				if err := m.Alloc(1, int64(len(scanner.Bytes()))); err != nil {
+					closeReader()
+					return nil, false, err
+				}
+				return &String{scanner.Text()}, true, nil
+			}
+			closeReader()
+			if err := scanner.Err(); err != nil {
+				return nil, false, fmt.Errorf("cannot read %s: %w", obj.Name, err)
+			}
+			return nil, false, nil
+		})
+		it.onClose = closeReader
+		return it, nil
+	}
+	return nil, Errorf(TypeError, "cannot read lines from %s", obj.String())
+}
@@ -0,0 +1,86 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+// Limits bound what a program may use, so that untrusted programs can be run
+// safely. Zero means unlimited. Allocations are counted roughly: every tuple,
+// closure and array that the program creates counts as one object, and its
+// size in bytes is estimated from its fields.
+type Limits struct {
+	MaxInstructions int64
+	MaxCallDepth    int
+	MaxAllocations  int64
+	MaxBytes        int64
+	Timeout         time.Duration
+}
+
+// pollInterval is how many instructions run between checks of the context
+const pollInterval = 1024
+
+// budget tracks what a run of the machine has used so far. Nested calls made
+// by builtins share the budget of the run they're part of.
+type budget struct {
+	ctx    context.Context
+	limits Limits
+
+	// steps is the number of instructions executed, and next is when poll
+	// should be called again
+	steps int64
+	next  int64
+
+	objects int64
+	bytes   int64
+
+	// depth is how deep the calls of the state that's running are, counting
+	// the calls of the states that it was called from, see state.track
+	depth int
+}
+
+func (b *budget) poll() *RuntimeError {
+	if max := b.limits.MaxInstructions; max > 0 && b.steps > max {
+		return &RuntimeError{Kind: InstructionLimit, Msg: fmt.Sprintf("exceeded the maximum of %d instructions", max)}
+	}
+	if err := b.ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return &RuntimeError{Kind: Timeout, Msg: "timed out"}
+		}
+		return &RuntimeError{Kind: Canceled, Msg: "canceled"}
+	}
+	b.next = b.steps + pollInterval
+	if max := b.limits.MaxInstructions; max > 0 && b.next > max+1 {
+		b.next = max + 1
+	}
+	return nil
+}
+
+func (b *budget) alloc(objects, bytes int64) *RuntimeError {
+	b.objects += objects
+	b.bytes += bytes
+	if max := b.limits.MaxAllocations; max > 0 && b.objects > max {
+		return &RuntimeError{Kind: AllocationLimit, Msg: fmt.Sprintf("exceeded the maximum of %d allocations", max)}
+	}
+	if max := b.limits.MaxBytes; max > 0 && b.bytes > max {
+		return &RuntimeError{Kind: MemoryLimit, Msg: fmt.Sprintf("exceeded the maximum of %d bytes", max)}
+	}
+	return nil
+}
+
+var (
+	objectSize    = int64(unsafe.Sizeof(Object(nil)))
+	fieldSize     = int64(unsafe.Sizeof(Field{}))
+	tupleBase     = int64(unsafe.Sizeof(Tuple{}))
+	procedureBase = int64(unsafe.Sizeof(Procedure{}))
+	arrayBase     = int64(unsafe.Sizeof(Array{}))
+	// entrySize counts the index of a map as well as the entry
+	entrySize = int64(unsafe.Sizeof(mapEntry{})) + 2*objectSize
+)
+
+func tupleSize(n int) int64   { return tupleBase + int64(n)*fieldSize }
+func closureSize(n int) int64 { return procedureBase + int64(n)*objectSize }
+func arraySize(n int) int64   { return arrayBase + int64(n)*objectSize }
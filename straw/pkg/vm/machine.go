@@ -0,0 +1,138 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/yjp20/turtle/straw/pkg/ir"
+)
+
+// Machine holds what programs run against: the globals and builtins they can
+// refer to, and where they print. Builtins registered with Register can take
+// the machine as their first argument.
+type Machine struct {
+	Globals  *Frame
+	Builtins *Builtins
+	Stdout   io.Writer
+	Limits   Limits
+
+	// Tracer, if set, is told about every instruction the machine runs
+	Tracer Tracer
+
+	// Import loads the module at path for the import builtin
+	Import func(ctx context.Context, path string) (*Module, error)
+
+	// budget is what the current run has used, nil if nothing is running,
+	// and sched runs its tasks
+	budget *budget
+	sched  *scheduler
+}
+
+func NewMachine() *Machine {
+	return &Machine{
+		Globals:  NewFrame(nil),
+		Builtins: NewBuiltins(Std),
+		Stdout:   os.Stdout,
+	}
+}
+
+// Eval runs program, returning the value of its last expression. Errors
+// raised while running it are *RuntimeError. The program stops once ctx is
+// done or it exceeds the machine's limits.
+func (m *Machine) Eval(ctx context.Context, program ir.Program) (Object, error) {
+	return m.Run(ctx, Compile(program))
+}
+
+func (m *Machine) Run(ctx context.Context, code *Code) (Object, error) {
+	return m.Call(ctx, code.Funcs[code.Entry].static, nil)
+}
+
+// Call calls a procedure or builtin function with args. When a builtin calls
+// back into the machine, the call counts towards the limits of the run that
+// is already going.
+func (m *Machine) Call(ctx context.Context, fn Object, args []Object) (Object, error) {
+	if m.budget == nil {
+		if m.Limits.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, m.Limits.Timeout)
+			defer cancel()
+		}
+		m.budget = &budget{ctx: ctx, limits: m.Limits}
+		defer func() { m.budget = nil }()
+	}
+
+	switch fn := fn.(type) {
+	case *Procedure:
+		if fn.Func.Generator {
+			return newGenerator(fn, args, nil), nil
+		}
+		s := &state{machine: m, depth: m.budget.depth}
+		defer func(depth int) { m.budget.depth = depth }(s.depth)
+		if m.sched == nil {
+			m.sched = newScheduler(s)
+			defer func() {
+				m.sched.stop(s.err)
+				m.sched = nil
+			}()
+		}
+		result := s.run(fn, args, nil)
+		if s.err != nil {
+			return nil, s.err
+		}
+		return result.Object(), nil
+	case *BuiltinFunction:
+		result, err := m.callBuiltin(fn, args)
+		if err != nil {
+			return nil, runtimeError(err)
+		}
+		return result, nil
+	case nil, *Null:
+		return nil, &RuntimeError{Kind: NilCall, Msg: "cannot call NULL"}
+	}
+	return nil, &RuntimeError{Kind: TypeError, Msg: fmt.Sprintf("cannot call %s", fn.String())}
+}
+
+// callBuiltin calls fn, turning a panic into an error so that a faulty
+// builtin can't take down the program embedding the machine.
+func (m *Machine) callBuiltin(fn *BuiltinFunction, args []Object) (result Object, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, fmt.Errorf("%s panicked: %v", fn.Name, r)
+		}
+	}()
+	result, err = fn.Fn(m, args)
+	if err == nil && result == nil {
+		result = NULL
+	}
+	return result, err
+}
+
+// Context returns the context of the current run, for builtins that block.
+func (m *Machine) Context() context.Context {
+	if m.budget == nil {
+		return context.Background()
+	}
+	return m.budget.ctx
+}
+
+// Alloc charges objects taking up bytes against the limits of the current
+// run. Builtins that allocate call it, and return the error if there is one.
+func (m *Machine) Alloc(objects, bytes int64) error {
+	if m.budget == nil {
+		return nil
+	}
+	if err := m.budget.alloc(objects, bytes); err != nil {
+		return err
+	}
+	return nil
+}
+
+// lookup resolves a global, preferring the machine's globals to builtins.
+func (m *Machine) lookup(name string) (Object, bool) {
+	if obj := m.Globals.GetVar(name); obj != nil {
+		return obj, true
+	}
+	return m.Builtins.Lookup(name)
+}
@@ -0,0 +1,263 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+// Map maps keys to values, and remembers the order the keys were added in,
+// which is the order they're looped over in. Setting a key that's already
+// there keeps its place, and deleting one forgets it. Like arrays, maps are
+// shared rather than copied.
+type Map struct {
+	KeyType   *Type
+	ValueType *Type
+
+	entries []mapEntry
+	index   map[interface{}]int
+	deleted int
+}
+
+type mapEntry struct {
+	Key, Value Object
+	deleted    bool
+}
+
+func NewMap(key, value *Type, size int) *Map {
+	return &Map{KeyType: key, ValueType: value, entries: make([]mapEntry, 0, size), index: make(map[interface{}]int, size)}
+}
+
+func (m *Map) Kind() kind.Kind { return kind.Map }
+func (m *Map) String() string  { return stringOf(m, nil) }
+
+func (m *Map) Len() int { return len(m.entries) - m.deleted }
+
+// Get returns the value of key, and whether it's there.
+func (m *Map) Get(key Object) (Object, bool) {
+	if i, ok := m.index[hashKey(key)]; ok {
+		return m.entries[i].Value, true
+	}
+	return nil, false
+}
+
+// Set sets key to value, and reports whether key is new.
+func (m *Map) Set(key, value Object) bool {
+	h := hashKey(key)
+	if i, ok := m.index[h]; ok {
+		m.entries[i].Value = value
+		return false
+	}
+	m.index[h] = len(m.entries)
+	m.entries = append(m.entries, mapEntry{Key: key, Value: value})
+	return true
+}
+
+// Delete removes key, and reports whether it was there.
+func (m *Map) Delete(key Object) bool {
+	h := hashKey(key)
+	i, ok := m.index[h]
+	if !ok {
+		return false
+	}
+	delete(m.index, h)
+	m.entries[i] = mapEntry{deleted: true}
+	m.deleted++
+	// Deleted entries are left in place until they're most of the map, so
+	// that deleting doesn't move every entry after it
+	if m.deleted > len(m.entries)/2 {
+		m.compact()
+	}
+	return true
+}
+
+func (m *Map) compact() {
+	live := m.entries[:0]
+	for _, e := range m.entries {
+		if !e.deleted {
+			m.index[hashKey(e.Key)] = len(live)
+			live = append(live, e)
+		}
+	}
+	for i := len(live); i < len(m.entries); i++ {
+		m.entries[i] = mapEntry{}
+	}
+	m.entries, m.deleted = live, 0
+}
+
+// Keys returns the keys in the order they were added.
+func (m *Map) Keys() []Object {
+	keys := make([]Object, 0, m.Len())
+	m.each(func(key, _ Object) { keys = append(keys, key) })
+	return keys
+}
+
+func (m *Map) each(fn func(key, value Object)) {
+	for _, e := range m.entries {
+		if !e.deleted {
+			fn(e.Key, e.Value)
+		}
+	}
+}
+
+type nullKey struct{}
+
+// Numbers are hashed by value, as an intKey if they're an integer, a uintKey
+// if they're an integer too big for that, and a floatKey otherwise.
+type intKey int64
+
+type uintKey uint64
+
+type floatKey uint64
+
+type runeKey rune
+
+// Tuples are hashed by their fields, and by their type if they're structs,
+// which are only equal to values of the same struct.
+type tupleKey struct {
+	t      *Type
+	fields string
+}
+
+// Types other than structs and interfaces are hashed by how they're written,
+// like sameType compares them.
+type typeKey string
+
+// hashKey returns a Go value which is the same for keys that are Equal, to
+// look them up by. Keys can't be arrays, slices or maps, see mapKey, and
+// tuples can't be changed once they're made, so a key can't contain itself.
+func hashKey(obj Object) interface{} {
+	if v := ValueOf(obj); isNumber(v) {
+		f := toFloat(v)
+		switch {
+		case v.kind == intValue && v.num.IsUnsigned() && int64(v.bits) < 0:
+			return uintKey(v.bits)
+		case v.kind == intValue:
+			return intKey(v.Int())
+		case f == math.Trunc(f) && inRange(kind.I64, f):
+			return intKey(int64(f))
+		case f == math.Trunc(f) && inRange(kind.U64, f):
+			return uintKey(uint64(f))
+		}
+		return floatKey(v.bits)
+	}
+	switch obj := obj.(type) {
+	case nil, *Null:
+		return nullKey{}
+	case *Bool:
+		return obj.IsTrue
+	case *String:
+		return obj.Value
+	case *Rune:
+		return runeKey(obj.Value)
+	case *Tuple:
+		sb := strings.Builder{}
+		for _, field := range obj.Fields {
+			fmt.Fprintf(&sb, "%q=%#v;", field.Name, hashKey(field.Value))
+		}
+		return tupleKey{obj.Type, sb.String()}
+	case *Type:
+		if obj.ObjectKind == kind.Struct || obj.ObjectKind == kind.Interface {
+			return obj
+		}
+		return typeKey(typeText(obj))
+	}
+	return obj
+}
+
+// mapKey returns obj as a key of m, converting numbers like element does.
+// Arrays, slices and maps can't be keys, because they're equal by their
+// elements, which can change after they're added.
+func mapKey(m *Map, obj Object) (Object, error) {
+	key, ok := element(m.KeyType, obj)
+	if !ok {
+		return nil, Errorf(TypeError, "%s is not a key of %s", obj.String(), m.typeName())
+	}
+	if v := ValueOf(key); v.kind == floatValue && math.IsNaN(v.Float()) {
+		return nil, Errorf(TypeError, "NaN can't be a key of a map")
+	}
+	if !hashable(key) {
+		return nil, Errorf(TypeError, "%s can't be a key of a map", key.String())
+	}
+	return key, nil
+}
+
+func hashable(obj Object) bool {
+	switch obj := obj.(type) {
+	case *Array, *Slice, *Map:
+		return false
+	case *Tuple:
+		for _, field := range obj.Fields {
+			if !hashable(field.Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// typeName is the name of the type of m, like map[string, i64].
+func (m *Map) typeName() string {
+	name := func(t *Type) string {
+		if t == nil {
+			return "any"
+		}
+		return t.Name
+	}
+	return fmt.Sprintf("map[%s, %s]", name(m.KeyType), name(m.ValueType))
+}
+
+// lookup returns the value of key in m, or the zero value of its values if
+// it isn't there, like in Go.
+func lookup(m *Map, key Object) (Object, error) {
+	key, err := mapKey(m, key)
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := m.Get(key); ok {
+		return value, nil
+	}
+	return zero(m.ValueType), nil
+}
+
+// store sets key to value in m, and reports whether key is new.
+func store(m *Map, key, value Object) (bool, error) {
+	key, err := mapKey(m, key)
+	if err != nil {
+		return false, err
+	}
+	elem, ok := element(m.ValueType, value)
+	if !ok {
+		return false, Errorf(TypeError, "cannot set %s of %s to %s", key.String(), m.typeName(), value.String())
+	}
+	return m.Set(key, elem), nil
+}
+
+// constructMap makes a map of type t from keys and values alternating in
+// items, or a struct from the names of its fields and their values.
+func constructMap(t *Type, items []Object) (Object, error) {
+	if t.ObjectKind == kind.Struct {
+		names := make([]string, 0, len(items)/2)
+		values := make([]Object, 0, len(items)/2)
+		for i := 0; i+1 < len(items); i += 2 {
+			name, ok := items[i].(*String)
+			if !ok {
+				return nil, Errorf(TypeError, "%s is not the name of a field of %s", items[i].String(), t.Name)
+			}
+			names, values = append(names, name.Value), append(values, items[i+1])
+		}
+		return constructStruct(t, names, values)
+	}
+	if t.ObjectKind != kind.Map {
+		return nil, Errorf(TypeError, "cannot construct %s from keys and values", t.String())
+	}
+	m := NewMap(t.Key, t.Elem, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		if _, err := store(m, items[i], items[i+1]); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
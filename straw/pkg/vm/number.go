@@ -0,0 +1,247 @@
+package vm
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+// Integers are stored in 64 bits, sign extended for the signed kinds and zero
+// extended for the unsigned ones, and wrap around to their width on
+// overflow. An f32 is stored as the float64 of its value, so that it's
+// rounded after every operation.
+
+// numberOf makes a number of kind k from bits, wrapping them to fit.
+func numberOf(k kind.Kind, bits uint64) Value {
+	if k.IsFloat() {
+		if k == kind.F32 {
+			bits = math.Float64bits(float64(float32(math.Float64frombits(bits))))
+		}
+		return Value{kind: floatValue, num: k, bits: bits}
+	}
+	return Value{kind: intValue, num: k, bits: wrap(k, bits)}
+}
+
+func wrap(k kind.Kind, bits uint64) uint64 {
+	switch k {
+	case kind.I8:
+		return uint64(int8(bits))
+	case kind.I16:
+		return uint64(int16(bits))
+	case kind.I32:
+		return uint64(int32(bits))
+	case kind.U8:
+		return uint64(uint8(bits))
+	case kind.U16:
+		return uint64(uint16(bits))
+	case kind.U32:
+		return uint64(uint32(bits))
+	}
+	return bits
+}
+
+func isNumber(v Value) bool {
+	return v.kind == intValue || v.kind == floatValue
+}
+
+// arith applies an arithmetic op to two numbers of the same kind.
+func arith(code Opcode, l, r Value) (Value, error) {
+	if !isNumber(l) || !isNumber(r) {
+		return Value{}, Errorf(TypeError, "cannot %s %s and %s", code, l.String(), r.String())
+	}
+	if l.num != r.num {
+		return Value{}, Errorf(TypeError, "cannot %s %s and %s, they are different types", code, l.String(), r.String())
+	}
+
+	k := l.num
+	if l.kind == floatValue {
+		a, b := l.Float(), r.Float()
+		var f float64
+		switch code {
+		case opAdd:
+			f = a + b
+		case opSub:
+			f = a - b
+		case opMul:
+			f = a * b
+		case opQuo:
+			f = a / b
+		case opMod:
+			f = math.Mod(a, b)
+		}
+		return numberOf(k, math.Float64bits(f)), nil
+	}
+
+	a, b := l.bits, r.bits
+	switch code {
+	case opAdd:
+		return numberOf(k, a+b), nil
+	case opSub:
+		return numberOf(k, a-b), nil
+	case opMul:
+		return numberOf(k, a*b), nil
+	}
+	if b == 0 {
+		return Value{}, Errorf(DivisionByZero, "division by zero")
+	}
+	if k.IsUnsigned() {
+		if code == opQuo {
+			return numberOf(k, a/b), nil
+		}
+		return numberOf(k, a%b), nil
+	}
+	if int64(b) == -1 {
+		// Avoids the overflow of the most negative number divided by -1,
+		// which wraps around to itself
+		if code == opQuo {
+			return numberOf(k, -a), nil
+		}
+		return numberOf(k, 0), nil
+	}
+	if code == opQuo {
+		return numberOf(k, uint64(int64(a)/int64(b))), nil
+	}
+	return numberOf(k, uint64(int64(a)%int64(b))), nil
+}
+
+// compareNumbers returns -1, 0 or 1 as l is less than, equal to or greater
+// than r. Numbers of different kinds are compared by their values. The
+// comparison fails if either is NaN.
+func compareNumbers(l, r Value) (int, bool) {
+	if l.kind == floatValue || r.kind == floatValue {
+		a, b := toFloat(l), toFloat(r)
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		case a == b:
+			return 0, true
+		}
+		return 0, false
+	}
+	// Unsigned numbers past the range of i64 are greater than any signed one
+	lu, ru := l.num.IsUnsigned() && int64(l.bits) < 0, r.num.IsUnsigned() && int64(r.bits) < 0
+	switch {
+	case lu && ru:
+		return compareUints(l.bits, r.bits), true
+	case lu:
+		return 1, true
+	case ru:
+		return -1, true
+	}
+	a, b := l.Int(), r.Int()
+	switch {
+	case a < b:
+		return -1, true
+	case a > b:
+		return 1, true
+	}
+	return 0, true
+}
+
+func compareUints(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func toFloat(v Value) float64 {
+	switch {
+	case v.kind == floatValue:
+		return v.Float()
+	case v.num.IsUnsigned():
+		return float64(v.bits)
+	}
+	return float64(v.Int())
+}
+
+// convert converts v to the kind k. Integers wrap around to fit, and floats
+// are truncated towards zero, which fails if the result doesn't fit. Runes
+// convert to and from integers, and to strings.
+func convert(v Value, k kind.Kind) (Value, error) {
+	if r, ok := v.obj.(*Rune); ok {
+		switch {
+		case k == kind.Rune:
+			return v, nil
+		case k == kind.String:
+			return objectOf(&String{string(r.Value)}), nil
+		case k.IsNumber():
+			v = numberOf(kind.I32, uint64(r.Value))
+		}
+	}
+	if s, ok := v.obj.(*String); ok && k == kind.String {
+		return objectOf(s), nil
+	}
+	if !isNumber(v) || !(k.IsInteger() || k.IsFloat() || k == kind.Rune) {
+		return Value{}, Errorf(TypeError, "cannot convert %s to %s", v.String(), kindName(k))
+	}
+
+	if k == kind.Rune {
+		if v.kind == floatValue {
+			return Value{}, Errorf(TypeError, "cannot convert %s to %s", v.String(), kindName(k))
+		}
+		return objectOf(&Rune{rune(v.Int())}), nil
+	}
+	if k.IsFloat() {
+		return numberOf(k, math.Float64bits(toFloat(v))), nil
+	}
+	if v.kind == intValue {
+		return numberOf(k, v.bits), nil
+	}
+	f := math.Trunc(v.Float())
+	if !inRange(k, f) {
+		return Value{}, Errorf(TypeError, "cannot convert %s to %s, it's out of range", v.String(), kindName(k))
+	}
+	if k.IsUnsigned() {
+		return numberOf(k, uint64(f)), nil
+	}
+	return numberOf(k, uint64(int64(f))), nil
+}
+
+// fits reports whether converting the integer v to the integer kind k keeps
+// its value, rather than wrapping around.
+func fits(v Value, k kind.Kind) bool {
+	if v.kind != intValue || !k.IsInteger() {
+		return true
+	}
+	bits := wrap(k, v.bits)
+	negative := !v.num.IsUnsigned() && int64(v.bits) < 0
+	return bits == v.bits && negative == (!k.IsUnsigned() && int64(bits) < 0)
+}
+
+// inRange reports whether the integer f fits in the integer kind k.
+func inRange(k kind.Kind, f float64) bool {
+	width := map[kind.Kind]int{
+		kind.I8: 8, kind.I16: 16, kind.I32: 32, kind.I64: 64,
+		kind.U8: 8, kind.U16: 16, kind.U32: 32, kind.U64: 64,
+	}[k]
+	if k.IsUnsigned() {
+		return 0 <= f && f < math.Ldexp(1, width)
+	}
+	return -math.Ldexp(1, width-1) <= f && f < math.Ldexp(1, width-1)
+}
+
+// kindName is the name of the builtin type of kind k, like i64.
+func kindName(k kind.Kind) string {
+	return strings.ToLower(k.String())
+}
+
+// numberText formats a number the way print shows it.
+func numberText(v Value) string {
+	switch {
+	case v.kind == floatValue && v.num == kind.F32:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 32)
+	case v.kind == floatValue:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	case v.num.IsUnsigned():
+		return strconv.FormatUint(v.bits, 10)
+	}
+	return strconv.FormatInt(v.Int(), 10)
+}
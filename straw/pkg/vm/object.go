@@ -2,13 +2,17 @@ package vm
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/yjp20/turtle/straw/pkg/kind"
 )
 
+// Field is a field of a tuple, or of a type's spec, params or results, which
+// have a Type instead of a Value.
 type Field struct {
 	Name  string
-	Type  Type
+	Type  *Type
 	Value Object
 }
 
@@ -27,6 +31,16 @@ type Default struct{}
 func (d *Default) Kind() kind.Kind { return kind.Default }
 func (d *Default) String() string  { return "<default>" }
 
+type I8 struct{ Value int8 }
+
+func (i *I8) Kind() kind.Kind { return kind.I8 }
+func (i *I8) String() string  { return fmt.Sprintf("<i8 %d>", i.Value) }
+
+type I16 struct{ Value int16 }
+
+func (i *I16) Kind() kind.Kind { return kind.I16 }
+func (i *I16) String() string  { return fmt.Sprintf("<i16 %d>", i.Value) }
+
 type I32 struct{ Value int32 }
 
 func (i *I32) Kind() kind.Kind { return kind.I32 }
@@ -37,6 +51,31 @@ type I64 struct{ Value int64 }
 func (i *I64) Kind() kind.Kind { return kind.I64 }
 func (i *I64) String() string  { return fmt.Sprintf("<i64 %d>", i.Value) }
 
+type U8 struct{ Value uint8 }
+
+func (i *U8) Kind() kind.Kind { return kind.U8 }
+func (i *U8) String() string  { return fmt.Sprintf("<u8 %d>", i.Value) }
+
+type U16 struct{ Value uint16 }
+
+func (i *U16) Kind() kind.Kind { return kind.U16 }
+func (i *U16) String() string  { return fmt.Sprintf("<u16 %d>", i.Value) }
+
+type U32 struct{ Value uint32 }
+
+func (i *U32) Kind() kind.Kind { return kind.U32 }
+func (i *U32) String() string  { return fmt.Sprintf("<u32 %d>", i.Value) }
+
+type U64 struct{ Value uint64 }
+
+func (i *U64) Kind() kind.Kind { return kind.U64 }
+func (i *U64) String() string  { return fmt.Sprintf("<u64 %d>", i.Value) }
+
+type F32 struct{ Value float32 }
+
+func (i *F32) Kind() kind.Kind { return kind.F32 }
+func (i *F32) String() string  { return fmt.Sprintf("<f32 %f>", i.Value) }
+
 type F64 struct{ Value float64 }
 
 func (i *F64) Kind() kind.Kind { return kind.F64 }
@@ -47,16 +86,23 @@ type Bool struct{ IsTrue bool }
 func (b *Bool) Kind() kind.Kind { return kind.Bool }
 func (b *Bool) String() string  { return fmt.Sprintf("<bool %t>", b.IsTrue) }
 
+// String is a string of UTF-8 text. Strings are indexed, sliced and iterated
+// over by rune rather than by byte, so their length is the number of runes.
 type String struct{ Value string }
 
 func (s *String) Kind() kind.Kind { return kind.String }
-func (s *String) String() string  { return fmt.Sprintf("\"%s\"", s.Value) }
+func (s *String) String() string  { return strconv.Quote(s.Value) }
+
+type Rune struct{ Value rune }
+
+func (r *Rune) Kind() kind.Kind { return kind.Rune }
+func (r *Rune) String() string  { return fmt.Sprintf("<rune %s>", strconv.QuoteRune(r.Value)) }
 
 type Procedure struct {
-	Name  string
-	Index int
-	Args  []Field
-	Frame *Frame
+	Name     string
+	Index    int
+	Func     *Func
+	Captures []Object
 }
 
 func (f *Procedure) Kind() kind.Kind { return kind.Function }
@@ -64,40 +110,98 @@ func (f *Procedure) String() string  { return fmt.Sprintf("<function '%s'>", f.N
 
 type BuiltinFunction struct {
 	Name string
+	Fn   func(m *Machine, args []Object) (Object, error)
 }
 
 func (pf *BuiltinFunction) Kind() kind.Kind { return kind.BuiltinFunction }
 func (pf *BuiltinFunction) String() string  { return fmt.Sprintf("<builtin function '%s'>", pf.Name) }
 
+// Tuple is a list of values that can be named. Constructing a struct makes
+// a tuple with its fields, which keeps the struct as its Type.
 type Tuple struct {
 	Fields []Field
+	Type   *Type
 }
 
 func (t *Tuple) Kind() kind.Kind { return kind.Tuple }
-func (t *Tuple) String() string {
-	s := "<tuple ("
-	for i, f := range t.Fields {
-		s = s + fmt.Sprintf("%s:%v", f.Name, f.Value.String())
-		if i != len(t.Fields)-1 {
-			s = s + ", "
+func (t *Tuple) String() string  { return stringOf(t, nil) }
+
+// stringOf returns the String of obj. Containers that are already being
+// written further out are written as <...>, like fmt does, so that ones that
+// contain themselves can be printed.
+func stringOf(obj Object, printing map[Object]bool) string {
+	switch obj.(type) {
+	case *Tuple, *Array, *Slice, *Map:
+	default:
+		return obj.String()
+	}
+	if printing[obj] {
+		return "<...>"
+	}
+	if printing == nil {
+		printing = map[Object]bool{}
+	}
+	printing[obj] = true
+	defer delete(printing, obj)
+
+	switch obj := obj.(type) {
+	case *Tuple:
+		s := "<tuple ("
+		if obj.Type != nil {
+			s = "<" + obj.Type.Name + " ("
+		}
+		for i, f := range obj.Fields {
+			s = s + fmt.Sprintf("%s:%v", f.Name, stringOf(f.Value, printing))
+			if i != len(obj.Fields)-1 {
+				s = s + ", "
+			}
+		}
+		return s + ")>"
+	case *Array:
+		s := "<array ["
+		for _, obj := range obj.Objects {
+			s += stringOf(obj, printing)
 		}
+		return s + "]>"
+	case *Slice:
+		s := "<slice ["
+		for _, obj := range obj.Objects {
+			s += stringOf(obj, printing)
+		}
+		return s + "]>"
 	}
-	return s + ")>"
+	m := obj.(*Map)
+	items := make([]string, 0, m.Len())
+	m.each(func(key, value Object) {
+		items = append(items, stringOf(key, printing)+":"+stringOf(value, printing))
+	})
+	return "<map [" + strings.Join(items, ", ") + "]>"
 }
 
 type Type struct {
 	Name       string
 	ObjectKind kind.Kind
-	Spec       []Field
+
+	// Spec holds the fields of structs and interfaces, and of the tuples
+	// that typeof describes
+	Spec []Field
+
+	// Elem is the type of the elements of arrays and slices, and of the
+	// values of maps, whose keys are of type Key
+	Elem *Type
+	Key  *Type
+
+	// Params and Returns are the arguments and results of procedures
+	Params  []Field
+	Returns []Field
 }
 
 func (t *Type) Kind() kind.Kind { return kind.Type }
 func (t *Type) String() string {
 	if t.Spec != nil {
-		// TODO
-		return fmt.Sprintf("<type '%s' of kind '%s'>", t.Name, t.ObjectKind.String())
+		return fmt.Sprintf("<type '%s' of kind '%s' %s>", t.Name, t.ObjectKind.String(), fieldsText(t.Spec))
 	}
-	return fmt.Sprintf("<type '%s' of kind '%s'>", t.Name, t.ObjectKind.String())
+	return fmt.Sprintf("<type '%s' of kind '%s'>", typeText(t), t.ObjectKind.String())
 }
 
 // Factory can configure either a function, a struct, or some builtin types like arrays, slices, etc.
@@ -109,21 +213,39 @@ type Factory struct {
 func (f *Factory) Kind() kind.Kind { return kind.Factory }
 func (f *Factory) String() string  { return fmt.Sprintf("<factory of '%T'>", f.ProductKind.String()) }
 
+// Array is a fixed number of elements. Arrays are shared rather than copied
+// when they're assigned or passed to a procedure, so setting an element is
+// seen through every name for the array. Appending to an array copies it
+// into a new one, and .copy copies elements explicitly.
 type Array struct {
 	Objects  []Object
 	ItemType *Type
 }
 
 func (a *Array) Kind() kind.Kind { return kind.Array }
-func (a *Array) String() string {
-	s := "<array ["
-	for _, obj := range a.Objects {
-		s += obj.String()
-	}
-	s += "]>"
-	return s
+func (a *Array) String() string  { return stringOf(a, nil) }
+
+// Slice is a window onto the elements of an array, which it shares with the
+// array and with other slices of it, like slices in Go. Appending to a slice
+// writes into the array past its end if it has the capacity, and otherwise
+// copies its elements into a new array with room to grow.
+type Slice struct {
+	Objects  []Object
+	ItemType *Type
 }
 
+func (s *Slice) Kind() kind.Kind { return kind.Slice }
+func (s *Slice) String() string  { return stringOf(s, nil) }
+
+// Module is a program that was imported, whose globals are its members.
+type Module struct {
+	Name    string
+	Globals *Frame
+}
+
+func (m *Module) Kind() kind.Kind { return kind.Module }
+func (m *Module) String() string  { return fmt.Sprintf("<module '%s'>", m.Name) }
+
 type Range struct {
 	Start int64
 	End   int64
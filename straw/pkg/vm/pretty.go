@@ -0,0 +1,161 @@
+package vm
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+// prettyWidth is how wide Pretty lets a line get before it puts the elements
+// of a value on lines of their own.
+const prettyWidth = 80
+
+// Pretty writes obj the way a program would construct it, with its type, like
+// ■ array[i64] (1, 2, 3). Values too wide for a line have their elements
+// written one to a line, indented by a tab. Values that contain themselves
+// are written as <...> where they come up again, like String does.
+func Pretty(obj Object) string {
+	var sb strings.Builder
+	pretty(&sb, obj, 0, nil)
+	return sb.String()
+}
+
+func pretty(sb *strings.Builder, obj Object, depth int, printing map[Object]bool) {
+	if printing[obj] {
+		sb.WriteString("<...>")
+		return
+	}
+	header, items := prettyParts(obj)
+	if items == nil {
+		sb.WriteString(header)
+		return
+	}
+	flat := flatText(obj, printing)
+	if depth*4+len(flat) <= prettyWidth {
+		sb.WriteString(flat)
+		return
+	}
+	if printing == nil {
+		printing = map[Object]bool{}
+	}
+	printing[obj] = true
+	defer delete(printing, obj)
+	if header != "" {
+		sb.WriteString(header + " ")
+	}
+	sb.WriteString("(\n")
+	for _, item := range items {
+		sb.WriteString(strings.Repeat("\t", depth+1))
+		if item.name != "" {
+			sb.WriteString(item.name + ": ")
+		}
+		pretty(sb, item.value, depth+1, printing)
+		sb.WriteString("\n")
+	}
+	sb.WriteString(strings.Repeat("\t", depth) + ")")
+}
+
+// flatText writes obj all on one line.
+func flatText(obj Object, printing map[Object]bool) string {
+	if printing[obj] {
+		return "<...>"
+	}
+	header, items := prettyParts(obj)
+	if items == nil {
+		return header
+	}
+	if printing == nil {
+		printing = map[Object]bool{}
+	}
+	printing[obj] = true
+	defer delete(printing, obj)
+	text := make([]string, len(items))
+	for i, item := range items {
+		text[i] = flatText(item.value, printing)
+		if item.name != "" {
+			text[i] = item.name + ": " + text[i]
+		}
+	}
+	list := "(" + strings.Join(text, ", ") + ")"
+	if header == "" {
+		return list
+	}
+	return header + " " + list
+}
+
+type prettyItem struct {
+	name  string
+	value Object
+}
+
+// prettyParts splits obj into what it's constructed as and its elements,
+// which are nil if it's written as a whole.
+func prettyParts(obj Object) (string, []prettyItem) {
+	obj = orNull(obj)
+	t := TypeOf(obj)
+	items := []prettyItem{}
+	switch obj := obj.(type) {
+	case *String:
+		return strconv.Quote(obj.Value), nil
+	case *Rune:
+		return strconv.QuoteRune(obj.Value), nil
+	case *Bool:
+		return strconv.FormatBool(obj.IsTrue), nil
+	case *Array, *Slice:
+		objects, _, _ := elements(obj)
+		for _, item := range objects {
+			items = append(items, prettyItem{value: item})
+		}
+		return "■ " + typeText(t), items
+	case *Map:
+		obj.each(func(key, value Object) {
+			name := flatText(key, nil)
+			if s, ok := key.(*String); ok && isIdentifier(s.Value) {
+				name = s.Value
+			}
+			items = append(items, prettyItem{name: name, value: value})
+		})
+		return "■ " + typeText(t), items
+	case *Tuple:
+		for _, f := range obj.Fields {
+			name := f.Name
+			if positional(name) {
+				name = ""
+			}
+			items = append(items, prettyItem{name: name, value: f.Value})
+		}
+		if obj.Type != nil {
+			return "■ " + typeText(t), items
+		}
+		return "", items
+	case *Procedure:
+		return "λ " + obj.Name + " " + fieldsText(t.Params), nil
+	case *Type:
+		return typeText(obj), nil
+	}
+	if v := ValueOf(obj); isNumber(v) {
+		text := numberText(v)
+		if v.kind == floatValue && !strings.ContainsAny(text, ".eNI") {
+			// So that it reads back as a float
+			text += "."
+		}
+		return text, nil
+	}
+	if obj.Kind() == kind.Null {
+		return "NULL", nil
+	}
+	return obj.String(), nil
+}
+
+// isIdentifier reports whether s can be written as an identifier, which map
+// constructions take as a string key.
+func isIdentifier(s string) bool {
+	for i, r := range s {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
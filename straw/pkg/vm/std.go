@@ -0,0 +1,252 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+// Std holds the builtins that every program can use.
+var Std = NewBuiltins(nil)
+
+func init() {
+	for name, k := range map[string]kind.Kind{
+		"bool": kind.Bool, "string": kind.String, "rune": kind.Rune, "any": kind.Any,
+		"i8": kind.I8, "i16": kind.I16, "i32": kind.I32, "i64": kind.I64,
+		"u8": kind.U8, "u16": kind.U16, "u32": kind.U32, "u64": kind.U64,
+		"f32": kind.F32, "f64": kind.F64,
+	} {
+		Std.Define(name, &Type{Name: name, ObjectKind: k})
+	}
+
+	Std.MustRegister("array", func(elem *Type) *Type {
+		return &Type{Name: "array", ObjectKind: kind.Array, Elem: elem}
+	})
+	Std.MustRegister("slice", func(elem *Type) *Type {
+		return &Type{Name: "slice", ObjectKind: kind.Slice, Elem: elem}
+	})
+	Std.MustRegister("map", func(key, value *Type) *Type {
+		return &Type{Name: "map", ObjectKind: kind.Map, Key: key, Elem: value}
+	})
+	Std.MustRegister("chan", func(elem *Type) *Type {
+		return &Type{Name: "chan", ObjectKind: kind.Chan, Elem: elem}
+	})
+
+	Std.MustRegister("print", func(m *Machine, args ...Object) {
+		text := make([]string, len(args))
+		for i, arg := range args {
+			text[i] = display(arg)
+		}
+		fmt.Fprintln(m.Stdout, strings.Join(text, " "))
+	})
+	Std.MustRegister("debug", func(m *Machine, obj Object) Object {
+		fmt.Fprintln(m.Stdout, obj.String())
+		return obj
+	})
+
+	Std.MustRegister("import", func(m *Machine, path string) (*Module, error) {
+		if b, ok := Modules[path]; ok {
+			return b.Module(path), nil
+		}
+		if m.Import == nil {
+			return nil, fmt.Errorf("cannot import %s, imports are not supported", path)
+		}
+		return m.Import(m.Context(), path)
+	})
+
+	// make creates an array of n zero elements, a slice of n with room for
+	// capacity, an empty map with room for n keys, or a channel which buffers
+	// n values
+	Std.MustRegister("make", func(m *Machine, t *Type, n int, capacity ...int) (Object, error) {
+		c := n
+		if len(capacity) > 1 {
+			return nil, Errorf(ArgumentError, "make takes at most 3 arguments, got %d", len(capacity)+2)
+		} else if len(capacity) == 1 {
+			c = capacity[0]
+		}
+		switch t.ObjectKind {
+		case kind.Array, kind.Slice:
+			if n < 0 || c < n {
+				return nil, Errorf(ArgumentError, "invalid length %d and capacity %d", n, c)
+			}
+			if t.ObjectKind == kind.Array && c != n {
+				return nil, Errorf(ArgumentError, "arrays have no spare capacity")
+			}
+			if err := m.Alloc(1, arraySize(c)); err != nil {
+				return nil, err
+			}
+			objects := make([]Object, n, c)
+			for i := range objects {
+				objects[i] = zero(t.Elem)
+			}
+			if t.ObjectKind == kind.Array {
+				return &Array{Objects: objects, ItemType: t.Elem}, nil
+			}
+			return &Slice{Objects: objects, ItemType: t.Elem}, nil
+		case kind.Map:
+			if n < 0 || len(capacity) > 0 {
+				return nil, Errorf(ArgumentError, "invalid size %d for a map", n)
+			}
+			if err := m.Alloc(1, arraySize(n)); err != nil {
+				return nil, err
+			}
+			return NewMap(t.Key, t.Elem, n), nil
+		case kind.Chan:
+			if n < 0 || len(capacity) > 0 {
+				return nil, Errorf(ArgumentError, "invalid buffer size %d for a channel", n)
+			}
+			if err := m.Alloc(1, arraySize(n)); err != nil {
+				return nil, err
+			}
+			return NewChan(t.Elem, n), nil
+		}
+		return nil, Errorf(TypeError, "cannot make %s", t.String())
+	})
+	Std.MustRegister("len", func(obj Object) (int, error) {
+		if n, ok := length(obj); ok {
+			return n, nil
+		}
+		return 0, Errorf(TypeError, "%s has no length", obj.String())
+	})
+	Std.MustRegister("cap", func(obj Object) (int, error) {
+		if objects, _, ok := elements(obj); ok {
+			return cap(objects), nil
+		}
+		if c, ok := obj.(*Chan); ok {
+			return c.size, nil
+		}
+		return 0, Errorf(TypeError, "%s has no capacity", obj.String())
+	})
+	// delete removes a key from a map, and reports whether it was there
+	Std.MustRegister("delete", func(m *Map, key Object) (bool, error) {
+		key, err := mapKey(m, key)
+		if err != nil {
+			return false, err
+		}
+		return m.Delete(key), nil
+	})
+	Std.MustRegister("has", func(m *Map, key Object) (bool, error) {
+		key, err := mapKey(m, key)
+		if err != nil {
+			return false, err
+		}
+		_, ok := m.Get(key)
+		return ok, nil
+	})
+	// close closes a channel, so that nothing more can be sent on it
+	Std.MustRegister("close", func(m *Machine, c *Chan) error {
+		return c.close(m.sched)
+	})
+	Std.MustRegister("lines", lines)
+	Std.MustRegister("append", func(m *Machine, obj Object, items ...Object) (Object, error) {
+		objects, t, ok := elements(obj)
+		if !ok {
+			return nil, Errorf(TypeError, "cannot append to %s", obj.String())
+		}
+		for i, item := range items {
+			elem, ok := element(t, item)
+			if !ok {
+				return nil, Errorf(TypeError, "cannot append %s to %s", item.String(), obj.String())
+			}
+			items[i] = elem
+		}
+		if _, ok := obj.(*Array); ok {
+			if err := m.Alloc(1, arraySize(len(objects)+len(items))); err != nil {
+				return nil, err
+			}
+			grown := make([]Object, 0, len(objects)+len(items))
+			grown = append(grown, objects...)
+			grown = append(grown, items...)
+			return &Array{Objects: grown, ItemType: t}, nil
+		}
+		grown := append(objects, items...)
+		if cap(grown) != cap(objects) {
+			if err := m.Alloc(1, arraySize(cap(grown))); err != nil {
+				return nil, err
+			}
+		}
+		return &Slice{Objects: grown, ItemType: t}, nil
+	})
+	// copy copies as many elements as fit from src to dst, and returns how
+	// many it copied
+	Std.MustRegister("copy", func(dst, src Object) (int, error) {
+		to, t, ok := elements(dst)
+		if !ok {
+			return 0, Errorf(TypeError, "cannot copy to %s", dst.String())
+		}
+		from, _, ok := elements(src)
+		if !ok {
+			return 0, Errorf(TypeError, "cannot copy from %s", src.String())
+		}
+		n := len(from)
+		if len(to) < n {
+			n = len(to)
+		}
+		items := make([]Object, n)
+		for i, item := range from[:n] {
+			elem, ok := element(t, item)
+			if !ok {
+				return 0, Errorf(TypeError, "cannot copy %s to %s", item.String(), dst.String())
+			}
+			items[i] = elem
+		}
+		return copy(to, items), nil
+	})
+}
+
+// display is how print shows an object, which is plainer than String, like
+// fmt's %v.
+func display(obj Object) string {
+	return displaySeen(obj, nil)
+}
+
+// displaySeen is display, which shows containers that it's already showing
+// further out as <...>, like stringOf.
+func displaySeen(obj Object, printing map[Object]bool) string {
+	switch obj.(type) {
+	case *Tuple, *Array, *Slice, *Map:
+		if printing[obj] {
+			return "<...>"
+		}
+		if printing == nil {
+			printing = map[Object]bool{}
+		}
+		printing[obj] = true
+		defer delete(printing, obj)
+	}
+	switch obj := obj.(type) {
+	case *String:
+		return obj.Value
+	case *Rune:
+		return string(obj.Value)
+	case *Bool:
+		return fmt.Sprint(obj.IsTrue)
+	case *Array, *Slice:
+		objects, _, _ := elements(obj)
+		items := make([]string, len(objects))
+		for i, item := range objects {
+			items[i] = displaySeen(item, printing)
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	case *Tuple:
+		fields := make([]string, len(obj.Fields))
+		for i, field := range obj.Fields {
+			fields[i] = displaySeen(field.Value, printing)
+			if field.Name != "" {
+				fields[i] = field.Name + ": " + fields[i]
+			}
+		}
+		return "(" + strings.Join(fields, ", ") + ")"
+	case *Map:
+		items := make([]string, 0, obj.Len())
+		obj.each(func(key, value Object) {
+			items = append(items, displaySeen(key, printing)+":"+displaySeen(value, printing))
+		})
+		return "map[" + strings.Join(items, " ") + "]"
+	}
+	if v := ValueOf(obj); isNumber(v) {
+		return numberText(v)
+	}
+	return obj.String()
+}
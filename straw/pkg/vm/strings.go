@@ -0,0 +1,93 @@
+package vm
+
+import (
+	"math"
+	"strings"
+)
+
+// Modules holds the modules that are written in Go. Import finds these
+// before looking for files.
+var Modules = map[string]*Builtins{}
+
+func init() {
+	s := NewBuiltins(nil)
+	s.MustRegister("Split", func(m *Machine, s, sep string) ([]string, error) {
+		parts := strings.Split(s, sep)
+		return parts, allocStrings(m, parts)
+	})
+	s.MustRegister("Join", func(m *Machine, elems []string, sep string) (string, error) {
+		n := len(sep) * (len(elems) - 1)
+		for _, e := range elems {
+			n += len(e)
+		}
+		if err := m.Alloc(1, int64(n)); err != nil {
+			return "", err
+		}
+		return strings.Join(elems, sep), nil
+	})
+	s.MustRegister("Fields", func(m *Machine, s string) ([]string, error) {
+		fields := strings.Fields(s)
+		return fields, allocStrings(m, fields)
+	})
+	s.MustRegister("Contains", strings.Contains)
+	s.MustRegister("HasPrefix", strings.HasPrefix)
+	s.MustRegister("HasSuffix", strings.HasSuffix)
+	s.MustRegister("Trim", strings.Trim)
+	s.MustRegister("TrimSpace", strings.TrimSpace)
+	s.MustRegister("Replace", func(m *Machine, s, old, new string) (string, error) {
+		// The size is worked out before replacing, so that a string too big
+		// for the limits is never made
+		size := int64(len(s)) + int64(strings.Count(s, old))*int64(len(new)-len(old))
+		if err := m.Alloc(1, size); err != nil {
+			return "", err
+		}
+		return strings.ReplaceAll(s, old, new), nil
+	})
+	s.MustRegister("Repeat", func(m *Machine, s string, n int) (string, error) {
+		if n < 0 {
+			return "", Errorf(ArgumentError, "negative repeat count %d", n)
+		}
+		if len(s) > 0 && n > math.MaxInt32/len(s) {
+			return "", Errorf(ArgumentError, "repeating %d bytes %d times is too long", len(s), n)
+		}
+		if err := m.Alloc(1, int64(len(s)*n)); err != nil {
+			return "", err
+		}
+		return strings.Repeat(s, n), nil
+	})
+	s.MustRegister("ToUpper", func(m *Machine, s string) (string, error) {
+		upper := strings.ToUpper(s)
+		return upper, m.Alloc(1, int64(len(upper)))
+	})
+	s.MustRegister("ToLower", func(m *Machine, s string) (string, error) {
+		lower := strings.ToLower(s)
+		return lower, m.Alloc(1, int64(len(lower)))
+	})
+	// Index counts runes, like indexing a string does
+	s.MustRegister("Index", func(s, substr string) int {
+		i := strings.Index(s, substr)
+		if i < 0 {
+			return i
+		}
+		return len([]rune(s[:i]))
+	})
+	Modules["strings"] = s
+}
+
+// Module makes a module out of the builtins, not including their parent's.
+func (b *Builtins) Module(name string) *Module {
+	globals := NewFrame(nil)
+	for name, obj := range b.globals {
+		globals.SetVar(name, obj)
+	}
+	return &Module{Name: name, Globals: globals}
+}
+
+// allocStrings charges for the slice of strings that parts becomes.
+func allocStrings(m *Machine, parts []string) error {
+	size := arraySize(len(parts))
+	for _, part := range parts {
+		size += int64(len(part))
+	}
+	return m.Alloc(int64(len(parts))+1, size)
+}
@@ -0,0 +1,197 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Tasks are run by goroutines, but only one of them runs at a time, so that
+// they can share objects without locking. The running task hands over to the
+// next one that's ready when it blocks on a channel, finishes, or has run
+// for a while, by waking it and then waiting to be woken itself.
+//
+// The run is over once its first task, which the machine was called with,
+// returns, or any task fails. If every task is blocked, none of them can ever
+// be woken, and the run fails with a Deadlock.
+
+type task struct {
+	id    int
+	state *state
+	wake  chan struct{}
+
+	// op is what the task is blocked at, and doing is what it's waiting to
+	// do there
+	op    *Op
+	doing string
+}
+
+type scheduler struct {
+	tasks   []*task // every task that hasn't returned, the first one first
+	ready   []*task
+	current *task
+	next    int
+
+	// done is set once the run is over, with err if it failed
+	done bool
+	err  *RuntimeError
+
+	// generators are the ones started during the run, which are stopped
+	// with it
+	generators []*generator
+}
+
+func newScheduler(main *state) *scheduler {
+	s := &scheduler{}
+	s.current = s.add(main)
+	return s
+}
+
+func (s *scheduler) add(st *state) *task {
+	t := &task{id: s.next, state: st, wake: make(chan struct{}, 1)}
+	s.next++
+	s.tasks = append(s.tasks, t)
+	return t
+}
+
+// spawn starts a task calling fn with args, which runs once it's its turn.
+func (s *scheduler) spawn(m *Machine, fn Object, args []Object) {
+	st := &state{machine: m}
+	t := s.add(st)
+	s.ready = append(s.ready, t)
+	go func() {
+		<-t.wake
+		if s.done {
+			return
+		}
+		st.track()
+		switch fn := fn.(type) {
+		case *Procedure:
+			st.run(fn, args, nil)
+		case *BuiltinFunction:
+			if _, err := m.callBuiltin(fn, args); err != nil {
+				st.err = runtimeError(err)
+			}
+		}
+		if s.done {
+			// Stopped while it was waiting
+			return
+		}
+		if st.err != nil {
+			s.stop(st.err)
+			return
+		}
+		s.exit(t)
+	}()
+}
+
+// switchTo hands over to the next ready task, and waits until t is woken
+// again. It reports false if the run is over by then.
+func (s *scheduler) switchTo(t *task) bool {
+	next := s.ready[0]
+	s.ready = s.ready[1:]
+	s.current = next
+	// The other tasks have calls of their own, which don't count towards
+	// the depth of t's
+	budget := t.state.machine.budget
+	depth := budget.depth
+	next.wake <- struct{}{}
+	<-t.wake
+	budget.depth = depth
+	return !s.done
+}
+
+// yield lets the tasks that are ready run before t carries on.
+func (s *scheduler) yield(t *task) bool {
+	if len(s.ready) == 0 {
+		return !s.done
+	}
+	s.ready = append(s.ready, t)
+	return s.switchTo(t)
+}
+
+// block waits until another task makes t ready, because it's waiting to do
+// something at op. It reports false if the run is over by then, which it is
+// if nothing else can run.
+func (s *scheduler) block(t *task, op *Op, doing string) bool {
+	t.op, t.doing = op, doing
+	defer func() { t.op, t.doing = nil, "" }()
+	if len(s.ready) == 0 {
+		s.deadlock()
+		return false
+	}
+	return s.switchTo(t)
+}
+
+// wakeUp makes a blocked task ready.
+func (s *scheduler) wakeUp(t *task) {
+	s.ready = append(s.ready, t)
+}
+
+// exit removes t, which has returned, and hands over to the next task.
+func (s *scheduler) exit(t *task) {
+	for i, other := range s.tasks {
+		if other == t {
+			s.tasks = append(s.tasks[:i], s.tasks[i+1:]...)
+			break
+		}
+	}
+	if len(s.ready) == 0 {
+		s.deadlock()
+		return
+	}
+	next := s.ready[0]
+	s.ready = s.ready[1:]
+	s.current = next
+	next.wake <- struct{}{}
+}
+
+// deadlock fails the run, blaming the first task, and reporting where every
+// other task is blocked.
+func (s *scheduler) deadlock() {
+	main := s.tasks[0]
+	blocked := make([]string, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		blocked = append(blocked, fmt.Sprintf("%s %s", t.name(), t.doing))
+	}
+	err := &RuntimeError{
+		Kind:  Deadlock,
+		Msg:   "deadlock, every task is blocked: " + strings.Join(blocked, ", "),
+		Trace: main.state.backtrace(main.op),
+	}
+	if main.op != nil && main.op.Inst != nil {
+		err.Pos, err.End = main.op.Inst.Pos, main.op.Inst.End
+	}
+	for _, t := range s.tasks[1:] {
+		err.Tasks = append(err.Tasks, t.state.backtrace(t.op))
+	}
+	s.stop(err)
+}
+
+// stop ends the run, waking every task and generator so that their
+// goroutines return.
+func (s *scheduler) stop(err *RuntimeError) {
+	if s.done {
+		return
+	}
+	s.done, s.err = true, err
+	for _, t := range s.tasks {
+		if t != s.current {
+			select {
+			case t.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+	for _, g := range s.generators {
+		g.stop()
+	}
+}
+
+// name is how t is referred to in errors, by the procedure it's in.
+func (t *task) name() string {
+	name := "task"
+	if n := len(t.state.frames); n > 0 {
+		name = t.state.frames[n-1].fn.Name
+	}
+	return fmt.Sprintf("%s (task %d)", name, t.id)
+}
@@ -0,0 +1,279 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/yjp20/turtle/straw/pkg/token"
+)
+
+// Tracer is told what a machine does as it runs a program. Tracing is off
+// unless Machine.Tracer is set.
+type Tracer interface {
+	// OnInstruction is called after op runs, with the value it produced, or
+	// nil if it doesn't produce one. Calls to procedures are reported once
+	// they return.
+	OnInstruction(x *Execution, op *Op, result Object)
+
+	// OnCall is called when a procedure or builtin function is called. For
+	// procedures, the frame of the callee has been pushed already.
+	OnCall(x *Execution, fn Object, args []Object)
+	OnReturn(x *Execution, result Object)
+	OnError(x *Execution, err *RuntimeError)
+}
+
+// Execution is the state of a running program, as tracers see it. It is
+// only valid during the call to the tracer.
+type Execution struct {
+	state *state
+	op    *Op
+}
+
+// Depth is the number of procedures being evaluated.
+func (x *Execution) Depth() int {
+	return len(x.state.frames)
+}
+
+// Func is the function being evaluated.
+func (x *Execution) Func() *Func {
+	return x.state.frames[len(x.state.frames)-1].fn
+}
+
+// Steps is the number of instructions executed so far.
+func (x *Execution) Steps() int64 {
+	return x.state.machine.budget.steps
+}
+
+// Backtrace returns the procedures being evaluated and where they are,
+// innermost first.
+func (x *Execution) Backtrace() []token.Frame {
+	return x.state.backtrace(x.op)
+}
+
+// Machine is the machine running the program.
+func (x *Execution) Machine() *Machine {
+	return x.state.machine
+}
+
+// File is the source of the function being evaluated, if known.
+func (x *Execution) File() *token.File {
+	return x.Func().code.File
+}
+
+// PC is the index of the op that will run next in the innermost frame.
+func (x *Execution) PC() int {
+	return x.state.frames[len(x.state.frames)-1].pc
+}
+
+// Next is the op that will run next in the innermost frame.
+func (x *Execution) Next() *Op {
+	top := x.state.frames[len(x.state.frames)-1]
+	if top.pc >= len(top.fn.Ops) {
+		return nil
+	}
+	return &top.fn.Ops[top.pc]
+}
+
+// Variable is a named value in a frame.
+type Variable struct {
+	Name  string
+	Value Object
+}
+
+// frame returns the frame level calls out from the innermost one, and the
+// pc it's at.
+func (x *Execution) frame(level int) (*frame, int, bool) {
+	if level < 0 || level >= len(x.state.frames) {
+		return nil, 0, false
+	}
+	f := &x.state.frames[len(x.state.frames)-1-level]
+	pc := f.pc
+	if level > 0 && pc > 0 {
+		// Outer frames are stopped just after their call
+		pc--
+	}
+	if pc >= len(f.fn.Ops) {
+		pc = len(f.fn.Ops) - 1
+	}
+	return f, pc, true
+}
+
+// Locals returns the named values visible in the frame level calls out from
+// the innermost one, sorted by name.
+func (x *Execution) Locals(level int) []Variable {
+	f, pc, ok := x.frame(level)
+	if !ok || pc < 0 {
+		return nil
+	}
+	symbols := f.fn.Symbols[f.fn.Blocks[pc]]
+	locals := make([]Variable, 0, len(symbols))
+	for name, reg := range symbols {
+		locals = append(locals, Variable{Name: name, Value: x.state.stack[f.base+int(reg)].Object()})
+	}
+	sort.Slice(locals, func(i, j int) bool { return locals[i].Name < locals[j].Name })
+	return locals
+}
+
+// Registers returns every register of the frame level calls out from the
+// innermost one, named by the ir value it holds.
+func (x *Execution) Registers(level int) []Variable {
+	f, _, ok := x.frame(level)
+	if !ok {
+		return nil
+	}
+	regs := make([]Variable, 0, f.fn.NumRegs-1)
+	for reg := 1; reg < f.fn.NumRegs; reg++ {
+		regs = append(regs, Variable{Name: f.fn.Assignments[reg].String(), Value: x.state.stack[f.base+reg].Object()})
+	}
+	return regs
+}
+
+// NopTracer ignores everything. Tracers embed it to only implement the
+// methods they need.
+type NopTracer struct{}
+
+func (NopTracer) OnInstruction(x *Execution, op *Op, result Object) {}
+func (NopTracer) OnCall(x *Execution, fn Object, args []Object)     {}
+func (NopTracer) OnReturn(x *Execution, result Object)              {}
+func (NopTracer) OnError(x *Execution, err *RuntimeError)           {}
+
+// TextTracer prints the value of every instruction as it's computed, like
+// "%3 = <i64 1>".
+type TextTracer struct {
+	NopTracer
+	W io.Writer
+}
+
+func (t *TextTracer) OnInstruction(x *Execution, op *Op, result Object) {
+	if result != nil && op.Inst != nil {
+		fmt.Fprintf(t.W, "%s = %s\n", op.Inst.Index, result.String())
+	}
+}
+
+// JSONTracer writes every event as a JSON object on a line of its own.
+type JSONTracer struct {
+	enc *json.Encoder
+}
+
+func NewJSONTracer(w io.Writer) *JSONTracer {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &JSONTracer{enc: enc}
+}
+
+type traceEvent struct {
+	Event  string   `json:"event"`
+	Depth  int      `json:"depth"`
+	Func   string   `json:"func"`
+	Op     string   `json:"op,omitempty"`
+	Inst   string   `json:"inst,omitempty"`
+	Pos    int      `json:"pos,omitempty"`
+	Callee string   `json:"callee,omitempty"`
+	Args   []string `json:"args,omitempty"`
+	Result string   `json:"result,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+func (t *JSONTracer) event(x *Execution, event string) traceEvent {
+	return traceEvent{Event: event, Depth: x.Depth(), Func: x.Func().Name}
+}
+
+func (t *JSONTracer) OnInstruction(x *Execution, op *Op, result Object) {
+	e := t.event(x, "instruction")
+	e.Op = op.Code.String()
+	if op.Inst != nil {
+		e.Inst = op.Inst.Index.String()
+		e.Pos = int(op.Inst.Pos)
+	}
+	if result != nil {
+		e.Result = result.String()
+	}
+	t.enc.Encode(e)
+}
+
+func (t *JSONTracer) OnCall(x *Execution, fn Object, args []Object) {
+	e := t.event(x, "call")
+	e.Callee = fn.String()
+	e.Args = make([]string, len(args))
+	for i, arg := range args {
+		e.Args[i] = fmt.Sprint(arg)
+	}
+	t.enc.Encode(e)
+}
+
+func (t *JSONTracer) OnReturn(x *Execution, result Object) {
+	e := t.event(x, "return")
+	e.Result = fmt.Sprint(result)
+	t.enc.Encode(e)
+}
+
+func (t *JSONTracer) OnError(x *Execution, err *RuntimeError) {
+	e := t.event(x, "error")
+	e.Pos = int(err.Pos)
+	e.Error = err.Error()
+	t.enc.Encode(e)
+}
+
+// MultiTracer passes everything on to each of its tracers in turn.
+type MultiTracer []Tracer
+
+func (m MultiTracer) OnInstruction(x *Execution, op *Op, result Object) {
+	for _, t := range m {
+		t.OnInstruction(x, op, result)
+	}
+}
+
+func (m MultiTracer) OnCall(x *Execution, fn Object, args []Object) {
+	for _, t := range m {
+		t.OnCall(x, fn, args)
+	}
+}
+
+func (m MultiTracer) OnReturn(x *Execution, result Object) {
+	for _, t := range m {
+		t.OnReturn(x, result)
+	}
+}
+
+func (m MultiTracer) OnError(x *Execution, err *RuntimeError) {
+	for _, t := range m {
+		t.OnError(x, err)
+	}
+}
+
+// Histogram counts the instructions executed by opcode.
+type Histogram struct {
+	NopTracer
+	Counts map[Opcode]int64
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{Counts: map[Opcode]int64{}}
+}
+
+func (h *Histogram) OnInstruction(x *Execution, op *Op, result Object) {
+	h.Counts[op.Code]++
+}
+
+// Report writes the counts, most frequent first.
+func (h *Histogram) Report(w io.Writer) {
+	codes := make([]Opcode, 0, len(h.Counts))
+	total := int64(0)
+	for code, n := range h.Counts {
+		codes = append(codes, code)
+		total += n
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if h.Counts[codes[i]] != h.Counts[codes[j]] {
+			return h.Counts[codes[i]] > h.Counts[codes[j]]
+		}
+		return codes[i] < codes[j]
+	})
+	for _, code := range codes {
+		n := h.Counts[code]
+		fmt.Fprintf(w, "%-10s %10d %6.2f%%\n", code, n, 100*float64(n)/float64(total))
+	}
+	fmt.Fprintf(w, "%-10s %10d\n", "total", total)
+}
@@ -0,0 +1,358 @@
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/yjp20/turtle/straw/pkg/ir"
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+func init() {
+	Std.MustRegister("typeof", TypeOf)
+
+	r := NewBuiltins(nil)
+	// fields lists the fields of a tuple or struct, as (name, type, value)
+	r.MustRegister("fields", func(tuple *Tuple) *Array {
+		t := TypeOf(tuple)
+		fields := make([]Object, len(tuple.Fields))
+		for i, f := range tuple.Fields {
+			fields[i] = &Tuple{Fields: []Field{
+				{Name: "name", Value: &String{f.Name}},
+				{Name: "type", Value: t.Spec[i].Type},
+				{Name: "value", Value: f.Value},
+			}}
+		}
+		return &Array{Objects: fields}
+	})
+	r.MustRegister("field", func(obj Object, name string) (Object, error) {
+		if v, ok := member(obj, name); ok {
+			return v, nil
+		}
+		return nil, Errorf(TypeError, "%s has no member %s", obj.String(), name)
+	})
+	// call calls fn with the elements of args, which is an array, slice or
+	// tuple
+	r.MustRegister("call", func(m *Machine, fn Object, args Object) (Object, error) {
+		var objects []Object
+		switch args := args.(type) {
+		case *Tuple:
+			for _, f := range args.Fields {
+				objects = append(objects, f.Value)
+			}
+		default:
+			var ok bool
+			if objects, _, ok = elements(args); !ok {
+				return nil, Errorf(TypeError, "cannot call %s with %s", fn.String(), args.String())
+			}
+		}
+		return m.Call(m.Context(), fn, append([]Object(nil), objects...))
+	})
+	// new makes a value of type t from items, the way ■ t (items) does, or
+	// the zero value of t without any
+	r.MustRegister("new", func(m *Machine, t *Type, items ...Object) (Object, error) {
+		switch t.ObjectKind {
+		case kind.Array, kind.Slice, kind.Map, kind.Struct:
+			if err := m.Alloc(1, arraySize(len(items))); err != nil {
+				return nil, err
+			}
+			return construct(t, items)
+		}
+		if len(items) == 0 {
+			return zero(t), nil
+		}
+		if len(items) == 1 {
+			if obj, ok := element(t, items[0]); ok {
+				return obj, nil
+			}
+		}
+		return nil, Errorf(TypeError, "cannot make %s from %d values", typeText(t), len(items))
+	})
+	Modules["reflect"] = r
+}
+
+// TypeOf describes the type of obj. Values of the builtin types, like i64 or
+// string, have the same type objects that programs refer to by name. Tuples
+// that aren't structs get a type listing the types of their fields.
+func TypeOf(obj Object) *Type {
+	switch obj := orNull(obj).(type) {
+	case *Array:
+		return &Type{Name: "array", ObjectKind: kind.Array, Elem: orAny(obj.ItemType)}
+	case *Slice:
+		return &Type{Name: "slice", ObjectKind: kind.Slice, Elem: orAny(obj.ItemType)}
+	case *Map:
+		return &Type{Name: "map", ObjectKind: kind.Map, Key: orAny(obj.KeyType), Elem: orAny(obj.ValueType)}
+	case *Chan:
+		return &Type{Name: "chan", ObjectKind: kind.Chan, Elem: orAny(obj.ElemType)}
+	case *Tuple:
+		if obj.Type != nil {
+			return obj.Type
+		}
+		t := &Type{Name: "tuple", ObjectKind: kind.Tuple, Spec: make([]Field, len(obj.Fields))}
+		for i, f := range obj.Fields {
+			t.Spec[i] = Field{Name: f.Name, Type: TypeOf(f.Value)}
+		}
+		return t
+	case *Procedure:
+		return procedureTypeOf(obj.Func)
+	case *Type:
+		return builtinType("type", kind.Type)
+	}
+	return builtinType(kindName(obj.Kind()), obj.Kind())
+}
+
+func procedureTypeOf(fn *Func) *Type {
+	t := &Type{Name: "function", ObjectKind: kind.Function, Params: make([]Field, len(fn.Params))}
+	for i := range t.Params {
+		if i < len(fn.ParamNames) {
+			t.Params[i].Name = fn.ParamNames[i]
+		}
+		t.Params[i].Type = kindType(kind.Unresolved)
+		if i < len(fn.ParamKinds) {
+			t.Params[i].Type = kindType(fn.ParamKinds[i])
+		}
+	}
+	return t
+}
+
+// procedureType describes a procedure type written in a program, like
+// λ (a i64) string. Types that aren't builtin aren't known until runtime, so
+// they're left as any.
+func procedureType(t ir.Type) *Type {
+	fields := func(fs []ir.Field) []Field {
+		var result []Field
+		for _, f := range fs {
+			result = append(result, Field{Name: f.Name, Type: kindType(f.Type.Kind)})
+		}
+		return result
+	}
+	return &Type{Name: "function", ObjectKind: kind.Function, Params: fields(t.Extra), Returns: fields(t.Returns)}
+}
+
+// kindType is the builtin type of kind k, or any if there isn't one.
+func kindType(k kind.Kind) *Type {
+	if t, ok := Std.Lookup(kindName(k)); ok && k != kind.Unresolved {
+		if t, ok := t.(*Type); ok {
+			return t
+		}
+	}
+	return builtinType("any", kind.Any)
+}
+
+// builtinType returns the type called name from Std, or makes one of kind k
+// if there isn't one.
+func builtinType(name string, k kind.Kind) *Type {
+	if t, ok := Std.Lookup(name); ok {
+		if t, ok := t.(*Type); ok {
+			return t
+		}
+	}
+	return &Type{Name: name, ObjectKind: k}
+}
+
+func orAny(t *Type) *Type {
+	if t == nil {
+		return builtinType("any", kind.Any)
+	}
+	return t
+}
+
+// typeText writes t the way programs do, like map[string, array[i64]]. Structs
+// and interfaces are written by name, unless they don't have one.
+func typeText(t *Type) string {
+	if t == nil {
+		return "any"
+	}
+	switch t.ObjectKind {
+	case kind.Struct, kind.Interface:
+		if t.Name == kindName(t.ObjectKind) {
+			return t.Name + " " + fieldsText(t.Spec)
+		}
+	case kind.Tuple:
+		if t.Spec != nil {
+			return fieldsText(t.Spec)
+		}
+	case kind.Array, kind.Slice, kind.Chan:
+		if t.Elem != nil {
+			return fmt.Sprintf("%s[%s]", t.Name, typeText(t.Elem))
+		}
+	case kind.Map:
+		if t.Key != nil || t.Elem != nil {
+			return fmt.Sprintf("map[%s, %s]", typeText(t.Key), typeText(t.Elem))
+		}
+	case kind.Function:
+		text := "λ " + fieldsText(t.Params)
+		if len(t.Returns) == 1 {
+			text += " " + typeText(t.Returns[0].Type)
+		} else if len(t.Returns) > 1 {
+			text += " " + fieldsText(t.Returns)
+		}
+		return text
+	}
+	if t.Name == "" {
+		return kindName(t.ObjectKind)
+	}
+	return t.Name
+}
+
+// fieldsText writes fields like the arguments of a procedure, (a i64, b), or
+// like the fields of a tuple, leaving out the names of those without one.
+func fieldsText(fields []Field) string {
+	text := make([]string, len(fields))
+	for i, f := range fields {
+		text[i] = typeText(f.Type)
+		if f.Name != "" && !positional(f.Name) {
+			text[i] = f.Name + " " + text[i]
+		}
+	}
+	return "(" + strings.Join(text, ", ") + ")"
+}
+
+// sameType reports whether a and b are the same type. Every struct and
+// interface is a type of its own, and other types are the same if they're
+// written the same.
+func sameType(a, b *Type) bool {
+	if a == b {
+		return true
+	}
+	if a == nil || b == nil || a.ObjectKind != b.ObjectKind {
+		return false
+	}
+	if a.ObjectKind == kind.Struct || a.ObjectKind == kind.Interface {
+		return false
+	}
+	return typeText(a) == typeText(b)
+}
+
+// typeMember returns a part of the description of t, which programs get
+// with t/name:
+//
+//	name     what t is called, like array or the name of a struct
+//	kind     what kind of type t is, like i64, array or struct
+//	fields   the fields of structs, interfaces and tuples, as (name, type)
+//	params   the arguments of procedures, as (name, type)
+//	returns  the results of procedures, as (name, type)
+//	elem     the type of the elements of arrays, slices, channels and maps
+//	key      the type of the keys of maps
+func typeMember(t *Type, name string) (Object, bool) {
+	switch name {
+	case "name":
+		if t.Name == "" {
+			return &String{typeText(t)}, true
+		}
+		return &String{t.Name}, true
+	case "kind":
+		return &String{kindName(t.ObjectKind)}, true
+	case "fields":
+		return fieldTypes(t.Spec), true
+	case "params":
+		return fieldTypes(t.Params), true
+	case "returns":
+		return fieldTypes(t.Returns), true
+	case "elem":
+		return orNull(typeObject(t.Elem)), true
+	case "key":
+		return orNull(typeObject(t.Key)), true
+	}
+	return nil, false
+}
+
+// typeObject keeps a nil *Type from becoming a non-nil Object.
+func typeObject(t *Type) Object {
+	if t == nil {
+		return nil
+	}
+	return t
+}
+
+func fieldTypes(fields []Field) *Array {
+	objects := make([]Object, len(fields))
+	for i, f := range fields {
+		objects[i] = &Tuple{Fields: []Field{
+			{Name: "name", Value: &String{f.Name}},
+			{Name: "type", Value: orAny(f.Type)},
+		}}
+	}
+	return &Array{Objects: objects}
+}
+
+// makeType makes the struct or interface called name, with fields of the
+// types in types, where a default stands for any.
+func makeType(name string, k kind.Kind, names []string, types []Object) (*Type, error) {
+	t := &Type{Name: name, ObjectKind: k, Spec: make([]Field, len(names))}
+	for i, obj := range types {
+		switch obj := obj.(type) {
+		case *Type:
+			t.Spec[i] = Field{Name: names[i], Type: obj}
+		case *Default:
+			t.Spec[i] = Field{Name: names[i], Type: builtinType("any", kind.Any)}
+		default:
+			return nil, Errorf(TypeError, "field %s of %s has type %s, which isn't a type", names[i], name, obj.String())
+		}
+	}
+	return t, nil
+}
+
+// constructStruct makes a value of the struct t, with the fields in items
+// in order, or by name if names is given. Fields that are left out are zero.
+func constructStruct(t *Type, names []string, items []Object) (Object, error) {
+	if len(names) == 0 && len(items) > len(t.Spec) {
+		return nil, Errorf(TypeError, "%s has %d fields, got %d", t.Name, len(t.Spec), len(items))
+	}
+	tuple := &Tuple{Fields: make([]Field, len(t.Spec)), Type: t}
+	set := make([]bool, len(t.Spec))
+	for i, item := range items {
+		at := i
+		if len(names) > 0 {
+			at = fieldIndex(t, names[i])
+			if at < 0 {
+				return nil, Errorf(TypeError, "%s has no field %s", t.Name, names[i])
+			}
+		}
+		f := t.Spec[at]
+		obj, ok := element(f.Type, item)
+		if !ok {
+			return nil, Errorf(TypeError, "cannot use %s as %s, the field %s of %s", item.String(), typeText(f.Type), f.Name, t.Name)
+		}
+		tuple.Fields[at] = Field{Name: f.Name, Value: obj}
+		set[at] = true
+	}
+	for i, f := range t.Spec {
+		if !set[i] {
+			tuple.Fields[i] = Field{Name: f.Name, Value: zero(f.Type)}
+		}
+	}
+	return tuple, nil
+}
+
+func fieldIndex(t *Type, name string) int {
+	for i, f := range t.Spec {
+		if f.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// implements reports whether obj has a member for every field of the
+// interface t.
+func implements(obj Object, t *Type) bool {
+	for _, f := range t.Spec {
+		v, ok := member(obj, f.Name)
+		if !ok {
+			return false
+		}
+		if _, ok := element(f.Type, v); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// positional reports whether name is one that tuples give fields without a
+// name, which is their index.
+func positional(name string) bool {
+	_, err := strconv.Atoi(name)
+	return err == nil
+}
@@ -0,0 +1,129 @@
+package vm
+
+import (
+	"math"
+
+	"github.com/yjp20/turtle/straw/pkg/kind"
+)
+
+type valueKind uint8
+
+const (
+	nullValue valueKind = iota
+	intValue
+	floatValue
+	boolValue
+	objectValue
+)
+
+// Value is what a register holds. Numbers and bools are stored inline in
+// bits so that arithmetic doesn't allocate, and everything else is kept as an
+// Object. The zero Value is NULL.
+type Value struct {
+	kind valueKind
+	num  kind.Kind // the kind of number, for intValue and floatValue
+	bits uint64
+	obj  Object
+}
+
+func intOf(i int64) Value { return Value{kind: intValue, num: kind.I64, bits: uint64(i)} }
+func floatOf(f float64) Value {
+	return Value{kind: floatValue, num: kind.F64, bits: math.Float64bits(f)}
+}
+func objectOf(o Object) Value { return Value{kind: objectValue, obj: o} }
+
+func boolOf(b bool) Value {
+	if b {
+		return Value{kind: boolValue, bits: 1}
+	}
+	return Value{kind: boolValue}
+}
+
+func (v Value) Int() int64     { return int64(v.bits) }
+func (v Value) Float() float64 { return math.Float64frombits(v.bits) }
+func (v Value) Bool() bool     { return v.bits != 0 }
+
+// Kind returns the kind of the object that the value holds.
+func (v Value) Kind() kind.Kind {
+	switch v.kind {
+	case intValue, floatValue:
+		return v.num
+	case boolValue:
+		return kind.Bool
+	case objectValue:
+		return v.obj.Kind()
+	}
+	return kind.Null
+}
+
+// Object boxes the value.
+func (v Value) Object() Object {
+	switch v.kind {
+	case intValue:
+		switch v.num {
+		case kind.I8:
+			return &I8{int8(v.bits)}
+		case kind.I16:
+			return &I16{int16(v.bits)}
+		case kind.I32:
+			return &I32{int32(v.bits)}
+		case kind.U8:
+			return &U8{uint8(v.bits)}
+		case kind.U16:
+			return &U16{uint16(v.bits)}
+		case kind.U32:
+			return &U32{uint32(v.bits)}
+		case kind.U64:
+			return &U64{v.bits}
+		}
+		return &I64{v.Int()}
+	case floatValue:
+		if v.num == kind.F32 {
+			return &F32{float32(v.Float())}
+		}
+		return &F64{v.Float()}
+	case boolValue:
+		if v.Bool() {
+			return TRUE
+		}
+		return FALSE
+	case objectValue:
+		return v.obj
+	}
+	return NULL
+}
+
+// ValueOf unboxes an object if it has an inline representation.
+func ValueOf(o Object) Value {
+	switch o := o.(type) {
+	case nil, *Null:
+		return Value{}
+	case *I8:
+		return numberOf(kind.I8, uint64(o.Value))
+	case *I16:
+		return numberOf(kind.I16, uint64(o.Value))
+	case *I32:
+		return numberOf(kind.I32, uint64(o.Value))
+	case *I64:
+		return intOf(o.Value)
+	case *U8:
+		return numberOf(kind.U8, uint64(o.Value))
+	case *U16:
+		return numberOf(kind.U16, uint64(o.Value))
+	case *U32:
+		return numberOf(kind.U32, uint64(o.Value))
+	case *U64:
+		return numberOf(kind.U64, o.Value)
+	case *F32:
+		return numberOf(kind.F32, math.Float64bits(float64(o.Value)))
+	case *F64:
+		return floatOf(o.Value)
+	case *Bool:
+		return boolOf(o.IsTrue)
+	}
+	return objectOf(o)
+}
+
+func (v Value) String() string {
+	return v.Object().String()
+}
@@ -1,229 +1,1038 @@
 package vm
 
 import (
+	"context"
 	"fmt"
+	"unicode/utf8"
 
 	"github.com/yjp20/turtle/straw/pkg/ir"
 	"github.com/yjp20/turtle/straw/pkg/kind"
 	"github.com/yjp20/turtle/straw/pkg/token"
 )
 
-func Eval(program ir.Program, errors *token.ErrorList, env *Frame) Object {
-	s := state{
-		program: program,
-		errors:  errors,
+// Eval compiles the program to bytecode and runs it on a new machine, with
+// env holding its globals.
+func Eval(ctx context.Context, program ir.Program, env *Frame) (Object, error) {
+	return Run(ctx, Compile(program), env)
+}
+
+func Run(ctx context.Context, code *Code, env *Frame) (Object, error) {
+	m := NewMachine()
+	if env != nil {
+		m.Globals = env
 	}
-	proc := program.Lookup("_init")
-	return s.eval(program, proc, env)
+	return m.Run(ctx, code)
 }
 
 type state struct {
-	stack      []Object
-	stackIndex int
-	errors     *token.ErrorList
-	program    ir.Program
-}
-
-func (state *state) push(obj Object) {
-	if state.stackIndex == len(state.stack) {
-		state.stack = append(state.stack, obj)
-	} else {
-		state.stack[state.stackIndex] = obj
-	}
-	state.stackIndex += 1
-}
-
-func (state *state) pop() Object {
-	state.stackIndex -= 1
-	return state.stack[state.stackIndex]
-}
-
-func (state *state) get(selector string) Object {
-	switch selector {
-	case "print":
-		return &BuiltinFunction{Name: "print"}
-	case "debug":
-		return &BuiltinFunction{Name: "debug"}
-	case "make":
-		return &BuiltinFunction{Name: "make"}
-	case "import":
-		return &BuiltinFunction{Name: "import"}
-	case "i32":
-		return &Type{ObjectKind: kind.I32}
-	case "i64":
-		return &Type{ObjectKind: kind.I64}
-	case "bool":
-		return &Type{ObjectKind: kind.Bool}
-	case "f64":
-		return &Type{ObjectKind: kind.F64}
-	case "any":
-		return &Type{ObjectKind: kind.Any}
-	case "array":
-		return &Factory{
-			Params:      []Field{{Name: "T", Type: Type{ObjectKind: kind.Type}}},
-			ProductKind: kind.Array,
-		}
-	case "slice":
-		return &Factory{
-			Params:      []Field{{Name: "T", Type: Type{ObjectKind: kind.Type}}},
-			ProductKind: kind.Slice,
-		}
-	}
-	return NULL
-}
-
-func (state *state) eval(program ir.Program, proc *ir.Proc, env *Frame) Object {
-	var (
-		lastBlock = 0
-		block     = proc.Blocks[0]
-		res       = NULL
-	)
-
-	for block != nil {
-		for _, inst := range block.Instructions {
-			l := env.Get(inst.Left)
-			r := env.Get(inst.Right)
-			switch inst.Kind {
-			case ir.I64:
-				res = &I64{inst.Literal.(int64)}
-			case ir.Bool:
-				res = &Bool{inst.Literal.(bool)}
-			case ir.Default:
-				res = &Default{}
-
-			case ir.Not:
-				l := l.(*Bool)
-				res = &Bool{!l.IsTrue}
-
-			case ir.Quo:
-				switch l := l.(type) {
-				case *I64:
-					res = &I64{l.Value / r.(*I64).Value}
-				}
-			case ir.Mod:
-				switch l := l.(type) {
-				case *I64:
-					res = &I64{l.Value % r.(*I64).Value}
-				}
-			case ir.Mul:
-				switch l := l.(type) {
-				case *I64:
-					res = &I64{l.Value * r.(*I64).Value}
-				}
-			case ir.Add:
-				switch l := l.(type) {
-				case *I64:
-					res = &I64{l.Value + r.(*I64).Value}
-				}
-			case ir.Sub:
-				switch l := l.(type) {
-				case *I64:
-					res = &I64{l.Value - r.(*I64).Value}
-				}
-			case ir.Equals:
-				if l.Kind() == kind.Default || r.Kind() == kind.Default {
-					res = &Bool{true}
-				} else {
-					res = &Bool{l.String() == r.String()}
-				}
-			case ir.NotEquals:
-				res = &Bool{l.String() != r.String()}
-			case ir.Less:
-				if l, ok := l.(*I64); ok {
-					if r, ok := r.(*I64); ok {
-						res = &Bool{l.Value < r.Value}
+	machine *Machine
+	err     *RuntimeError
+
+	// stack holds the registers of every active call, and frames the calls
+	// themselves, outermost first
+	stack  []Value
+	frames []frame
+
+	// scratch is used by parallel moves
+	scratch []Value
+
+	// gen is the generator the state runs, if it's running one
+	gen *generator
+
+	// depth is how many calls deep the state was started, by a builtin or
+	// an iterator calling back into the machine
+	depth int
+}
+
+type frame struct {
+	fn      *Func
+	closure *Procedure
+	base    int
+	pc      int
+
+	// dst is the register of the caller that receives the result, and op
+	// is the call the frame is making, if any
+	dst int32
+	op  *Op
+
+	// unwind is called if the frame fails, to clean up after it, and
+	// missing marks the parameters that weren't passed, if there are any
+	unwind  Object
+	missing []bool
+
+	// iters are the iterators the frame is looping over that need closing
+	// if it's left before they're done
+	iters []*Iterator
+}
+
+func (state *state) push(fn *Func, closure *Procedure, dst int32) []Value {
+	base := 0
+	if len(state.frames) > 0 {
+		top := state.frames[len(state.frames)-1]
+		base = top.base + top.fn.NumRegs
+	}
+	if need := base + fn.NumRegs; need > len(state.stack) {
+		stack := make([]Value, need*2)
+		copy(stack, state.stack)
+		state.stack = stack
+	}
+	regs := state.stack[base : base+fn.NumRegs]
+	for i := range regs {
+		regs[i] = Value{}
+	}
+	state.frames = append(state.frames, frame{fn: fn, closure: closure, base: base, dst: dst})
+	state.track()
+	return regs
+}
+
+// track records how deep the calls of state are in the budget, for the calls
+// it makes back into the machine to start from. It's called whenever state
+// calls or returns, and when it carries on after another state has run.
+func (state *state) track() {
+	state.machine.budget.depth = state.depth + len(state.frames)
+}
+
+// tooDeep reports whether making another call would exceed the call depth.
+func (state *state) tooDeep() bool {
+	limit := state.machine.Limits.MaxCallDepth
+	return limit > 0 && state.depth+len(state.frames) >= limit
+}
+
+func callDepthMsg(limit int) string {
+	return fmt.Sprintf("exceeded the maximum call depth of %d", limit)
+}
+
+// run calls procedure with args, and returns its result once it returns. If
+// it fails instead, the frames it fails in are unwound.
+func (state *state) run(procedure *Procedure, args []Object, missing []bool) Value {
+	result := state.exec(procedure, args, missing)
+	if state.err != nil {
+		state.unwind()
+	}
+	return result
+}
+
+// unwind closes the iterators and makes the calls that the frames of a
+// failed run deferred, innermost first. Errors in them are dropped in favour
+// of the one being unwound. Tasks that are stopped because another one failed
+// only have their iterators closed, since they can't run anymore.
+func (state *state) unwind() {
+	done := state.machine.sched != nil && state.machine.sched.done
+	for i := len(state.frames) - 1; i >= 0; i-- {
+		f := &state.frames[i]
+		for j := len(f.iters) - 1; j >= 0; j-- {
+			f.iters[j].close()
+		}
+		f.iters = nil
+		if fn := f.unwind; fn != nil && !done {
+			state.machine.Call(state.machine.Context(), fn, nil)
+		}
+	}
+}
+
+// forget stops tracking it, once it's done or closed.
+func (f *frame) forget(it *Iterator) {
+	for i := len(f.iters) - 1; i >= 0; i-- {
+		if f.iters[i] == it {
+			f.iters = append(f.iters[:i], f.iters[i+1:]...)
+			return
+		}
+	}
+}
+
+// exec calls procedure with args. Unless missing says which parameters were
+// left to their defaults, args are bound to the parameters by position.
+func (state *state) exec(procedure *Procedure, args []Object, missing []bool) Value {
+	f := &state.frames
+	fn := procedure.Func
+	if missing == nil && len(args) != len(fn.Params) {
+		order, m, err := bindArgs(procedure, len(args), nil)
+		if err != nil {
+			state.err = runtimeError(err)
+			return Value{}
+		}
+		bound := make([]Object, len(order))
+		for i, j := range order {
+			if j >= 0 {
+				bound[i] = args[j]
+			}
+		}
+		args, missing = bound, m
+	}
+	if state.tooDeep() {
+		state.err = &RuntimeError{Kind: CallDepthLimit, Msg: callDepthMsg(state.machine.Limits.MaxCallDepth)}
+		return Value{}
+	}
+	regs := state.push(fn, procedure, 0)
+	for i, reg := range fn.Params {
+		if reg >= 0 {
+			regs[reg] = ValueOf(args[i])
+		}
+	}
+	top := &(*f)[0]
+	top.missing = missing
+	if err := convertParams(fn, regs, missing); err != nil {
+		state.err = runtimeError(err)
+		return Value{}
+	}
+	ops := fn.Ops
+	pc := 0
+
+	budget := state.machine.budget
+	tracer := state.machine.Tracer
+	var x *Execution
+	if tracer != nil {
+		x = &Execution{state: state}
+		tracer.OnCall(x, procedure, args)
+	}
+
+	for {
+		op := &ops[pc]
+		pc++
+		budget.steps++
+		if budget.steps >= budget.next && !state.poll(op) {
+			return Value{}
+		}
+		switch op.Code {
+		case opNop:
+		case opNumber:
+			regs[op.A] = numberOf(op.Kind, uint64(op.Imm))
+		case opBool:
+			regs[op.A] = boolOf(op.Imm != 0)
+		case opObject:
+			regs[op.A] = objectOf(op.Obj)
+		case opMove:
+			regs[op.A] = regs[op.B]
+		case opMoves:
+			// Read every source before writing, since phis can swap values
+			scratch := state.scratch[:0]
+			for i := 1; i < len(op.Args); i += 2 {
+				scratch = append(scratch, regs[op.Args[i]])
+			}
+			for i := 0; i < len(op.Args); i += 2 {
+				regs[op.Args[i]] = scratch[i/2]
+			}
+			state.scratch = scratch
+
+		case opAdd, opSub, opMul, opQuo, opMod:
+			l, r := regs[op.B], regs[op.C]
+			if ls, ok := l.obj.(*String); ok && op.Code == opAdd {
+				if rs, ok := r.obj.(*String); ok {
+					if !state.alloc(int64(len(ls.Value)+len(rs.Value)), op) {
+						return Value{}
 					}
+					regs[op.A] = objectOf(&String{ls.Value + rs.Value})
+					break
+				}
+			}
+			if l.kind != intValue || r.kind != intValue || l.num != kind.I64 || r.num != kind.I64 {
+				v, err := arith(op.Code, l, r)
+				if err != nil {
+					state.failWith(err, op)
+					return Value{}
+				}
+				regs[op.A] = v
+				break
+			}
+			switch op.Code {
+			case opAdd:
+				regs[op.A] = intOf(l.Int() + r.Int())
+			case opSub:
+				regs[op.A] = intOf(l.Int() - r.Int())
+			case opMul:
+				regs[op.A] = intOf(l.Int() * r.Int())
+			case opQuo, opMod:
+				if r.Int() == 0 {
+					state.fail(DivisionByZero, "division by zero", op)
+					return Value{}
+				}
+				if op.Code == opQuo {
+					regs[op.A] = intOf(l.Int() / r.Int())
 				} else {
-					res = &Bool{l.String() < r.String()}
-				}
-			case ir.And:
-				l := l.(*Bool)
-				r := r.(*Bool)
-				res = &Bool{l.IsTrue && r.IsTrue}
-			case ir.ConstructTuple:
-				args := make([]Field, 0)
-				for _, arg := range inst.Literal.([]ir.Field) {
-					args = append(args, Field{
-						Name:  arg.Name,
-						Value: env.Get(arg.Value),
-					})
-				}
-				res = &Tuple{args}
-
-			case ir.ProcedureType:
-				// l := l.(*Tuple)
-				r := r.(*Tuple)
-				_ = env.Get(inst.Literal.(ir.Assignment))
-				res = &Procedure{Name: "fibo", Args: r.Fields}
-			case ir.LoadEnv:
-				proctype := env.Get(inst.Literal.(ir.Assignment)).(*Procedure)
-				for i := len(proctype.Args) - 1; i >= 0; i-- {
-					env.SetVar(proctype.Args[i].Name, state.pop())
-				}
-				env.SetVar(proctype.Name, proctype)
-			case ir.Env:
-				res = env.GetVar(inst.Literal.(string))
-			case ir.Push:
-				state.push(l)
-			case ir.Pop:
-				res = state.pop()
-
-			case ir.Ret, ir.End:
-				res = l
-				return res
-
-			case ir.Phi:
-				for _, k := range inst.Literal.([]ir.PhiLiteral) {
-					if lastBlock == k.BlockIndex {
-						res = env.Get(k.Assignment)
-						break
-					}
+					regs[op.A] = intOf(l.Int() % r.Int())
+				}
+			}
+		case opLess, opGreater:
+			l, r := regs[op.B], regs[op.C]
+			if op.Code == opGreater {
+				l, r = r, l
+			}
+			if l.kind == intValue && r.kind == intValue && l.num == r.num && !l.num.IsUnsigned() {
+				regs[op.A] = boolOf(l.Int() < r.Int())
+			} else if isNumber(l) && isNumber(r) {
+				c, ok := compareNumbers(l, r)
+				regs[op.A] = boolOf(ok && c < 0)
+			} else {
+				c, err := Compare(l.Object(), r.Object())
+				if err != nil {
+					state.failWith(err, op)
+					return Value{}
 				}
-				if res == NULL {
-					// TODO ERROR
+				regs[op.A] = boolOf(c < 0)
+			}
+		case opEquals, opNotEquals:
+			l, r := regs[op.B], regs[op.C]
+			if l.kind == intValue && r.kind == intValue && l.num == r.num {
+				regs[op.A] = boolOf((l.bits == r.bits) == (op.Code == opEquals))
+				break
+			}
+			eq, err := equal(l, r)
+			if err != nil {
+				state.failWith(err, op)
+				return Value{}
+			}
+			regs[op.A] = boolOf(eq == (op.Code == opEquals))
+		case opConvert:
+			v, err := convert(regs[op.B], op.Kind)
+			if err != nil {
+				state.failWith(err, op)
+				return Value{}
+			}
+			regs[op.A] = v
+
+		case opAnd, opOr, opNot:
+			l, r := regs[op.B], regs[op.C]
+			if l.kind != boolValue || (op.Code != opNot && r.kind != boolValue) {
+				state.fail(TypeError, fmt.Sprintf("cannot %s %s and %s", op.Code, l.String(), r.String()), op)
+				return Value{}
+			}
+			switch op.Code {
+			case opAnd:
+				regs[op.A] = boolOf(l.Bool() && r.Bool())
+			case opOr:
+				regs[op.A] = boolOf(l.Bool() || r.Bool())
+			case opNot:
+				regs[op.A] = boolOf(!l.Bool())
+			}
+
+		case opTuple:
+			if !state.alloc(tupleSize(len(op.Args)), op) {
+				return Value{}
+			}
+			fields := make([]Field, len(op.Args))
+			for i, arg := range op.Args {
+				fields[i].Value = regs[arg].Object()
+				if i < len(op.Names) {
+					fields[i].Name = op.Names[i]
 				}
+			}
+			regs[op.A] = objectOf(&Tuple{Fields: fields})
+		case opType:
+			types := make([]Object, len(op.Args))
+			for i, arg := range op.Args {
+				types[i] = regs[arg].Object()
+			}
+			t, err := makeType(op.Symbol, op.Kind, op.Names, types)
+			if err != nil {
+				state.failWith(err, op)
+				return Value{}
+			}
+			regs[op.A] = objectOf(t)
+		case opExtract:
+			tuple, ok := regs[op.B].obj.(*Tuple)
+			if !ok || int(op.Imm) >= len(tuple.Fields) {
+				state.fail(TypeError, fmt.Sprintf("cannot take field %d of %s", op.Imm, regs[op.B].String()), op)
+				return Value{}
+			}
+			regs[op.A] = ValueOf(tuple.Fields[op.Imm].Value)
 
-			case ir.ProcedureDefinition:
-				res = &Procedure{Index: inst.Literal.(int), Frame: env}
+		case opClosure:
+			callee := top.fn.code.Funcs[op.Imm]
+			if op.Args == nil {
+				regs[op.A] = objectOf(callee.static)
+				break
+			}
+			if !state.alloc(closureSize(len(op.Args)), op) {
+				return Value{}
+			}
+			captures := make([]Object, len(op.Args))
+			for i, arg := range op.Args {
+				captures[i] = regs[arg].Object()
+			}
+			regs[op.A] = objectOf(&Procedure{Name: callee.Name, Index: int(op.Imm), Func: callee, Captures: captures})
+		case opCapture:
+			if top.closure == nil || int(op.Imm) >= len(top.closure.Captures) {
+				state.fail(TypeError, fmt.Sprintf("%s has no capture %d", top.fn.Name, op.Imm), op)
+				return Value{}
+			}
+			regs[op.A] = ValueOf(top.closure.Captures[op.Imm])
+		case opSelf:
+			regs[op.A] = objectOf(top.closure)
+		case opGlobal:
+			obj, ok := state.machine.lookup(op.Symbol)
+			if !ok {
+				state.fail(UndefinedError, fmt.Sprintf("undefined: %s", op.Symbol), op)
+				return Value{}
+			}
+			regs[op.A] = ValueOf(obj)
+		case opExport:
+			state.machine.Globals.SetVar(op.Symbol, regs[op.B].Object())
+		case opMember:
+			obj, ok := member(regs[op.B].Object(), op.Symbol)
+			if !ok {
+				state.fail(TypeError, fmt.Sprintf("%s has no member %s", regs[op.B].String(), op.Symbol), op)
+				return Value{}
+			}
+			regs[op.A] = ValueOf(obj)
 
-			case ir.Call:
-				if l, ok := l.(*Procedure); ok {
-					proc := program.Procedures[l.Index]
-					newEnv := NewFrame(env)
-					for _, field := range l.Args {
-						newEnv.SetVar(field.Name, field.Value)
+		case opCall:
+			if builtin, ok := regs[op.B].obj.(*BuiltinFunction); ok {
+				if op.Names != nil {
+					state.fail(ArgumentError, fmt.Sprintf("%s doesn't take arguments by name, put the tuple in braces to pass it", builtin.Name), op)
+					return Value{}
+				}
+				args := make([]Object, len(op.Args))
+				for i, arg := range op.Args {
+					args[i] = regs[arg].Object()
+				}
+				if tracer != nil {
+					x.op, top.pc = op, pc
+					tracer.OnCall(x, builtin, args)
+				}
+				result, err := state.machine.callBuiltin(builtin, args)
+				if err != nil {
+					state.failWith(err, op)
+					return Value{}
+				}
+				if tracer != nil {
+					tracer.OnReturn(x, result)
+				}
+				regs[op.A] = ValueOf(result)
+				break
+			}
+			procedure, ok := regs[op.B].obj.(*Procedure)
+			if !ok {
+				if regs[op.B].Kind() == kind.Null {
+					state.fail(NilCall, "cannot call NULL", op)
+				} else {
+					state.fail(TypeError, fmt.Sprintf("cannot call %s", regs[op.B].String()), op)
+				}
+				return Value{}
+			}
+			callee := procedure.Func
+			if state.tooDeep() {
+				state.fail(CallDepthLimit, callDepthMsg(state.machine.Limits.MaxCallDepth), op)
+				return Value{}
+			}
+			args, names := op.Args, op.Names
+			var packed Value
+			if names != nil && !takesNames(callee, names) && takesTuple(callee, args, names) {
+				// The names are those of a tuple, which is passed as it was
+				// written
+				var tuple *Tuple
+				if tuple, args = namedTuple(regs, args, names); !state.alloc(tupleSize(len(tuple.Fields)), op) {
+					return Value{}
+				}
+				packed, names = objectOf(tuple), nil
+			}
+			var missing []bool
+			if names != nil || len(args) != len(callee.Params) {
+				order, m, err := bindArgs(procedure, len(args), names)
+				if err != nil {
+					state.failWith(err, op)
+					return Value{}
+				}
+				// Register 0 holds NULL for the missing ones
+				given := args
+				args = make([]int32, len(order))
+				for i, j := range order {
+					if j >= 0 {
+						args[i] = given[j]
+					}
+				}
+				missing = m
+			}
+			if callee.Generator {
+				if !state.alloc(closureSize(len(args)), op) {
+					return Value{}
+				}
+				objects := make([]Object, len(args))
+				for i, arg := range args {
+					if arg == packedArg {
+						objects[i] = packed.Object()
+					} else {
+						objects[i] = regs[arg].Object()
 					}
-					res = state.eval(program, proc, newEnv)
 				}
+				regs[op.A] = objectOf(newGenerator(procedure, objects, missing))
+				break
+			}
+			top.pc, top.op = pc, op
+			caller := regs
+			regs = state.push(callee, procedure, op.A)
+			// The stack may have moved
+			caller = state.stack[top.base : top.base+top.fn.NumRegs]
+			for i, reg := range callee.Params {
+				if reg >= 0 && args[i] == packedArg {
+					regs[reg] = packed
+				} else if reg >= 0 {
+					regs[reg] = caller[args[i]]
+				}
+			}
+			(*f)[len(*f)-1].missing = missing
+			if err := convertParams(callee, regs, missing); err != nil {
+				state.frames = state.frames[:len(state.frames)-1]
+				state.failWith(err, op)
+				return Value{}
+			}
+			top = &(*f)[len(*f)-1]
+			ops, pc = callee.Ops, 0
+			if tracer != nil {
+				// The call is reported as an instruction once it returns
+				args := make([]Object, len(callee.Params))
+				for i, reg := range callee.Params {
+					if reg >= 0 {
+						args[i] = regs[reg].Object()
+					}
+				}
+				x.op = nil
+				tracer.OnCall(x, procedure, args)
+			}
+			continue
 
-			case ir.GotoIf:
-				if good, ok := l.(*Bool); ok && good.IsTrue {
-					lastBlock = block.Index
-					block = proc.Blocks[inst.Literal.(int)]
-					goto block_loop
+		case opRet:
+			var result Value
+			switch len(op.Args) {
+			case 0:
+			case 1:
+				result = regs[op.Args[0]]
+			default:
+				if !state.alloc(tupleSize(len(op.Args)), op) {
+					return Value{}
+				}
+				fields := make([]Field, len(op.Args))
+				for i, arg := range op.Args {
+					fields[i].Value = regs[arg].Object()
 				}
+				result = objectOf(&Tuple{Fields: fields})
+			}
+			if tracer != nil {
+				x.op, top.pc = op, pc
+				tracer.OnInstruction(x, op, nil)
+				tracer.OnReturn(x, result.Object())
+			}
+			dst := top.dst
+			*f = (*f)[:len(*f)-1]
+			state.track()
+			if len(*f) == 0 {
+				return result
+			}
+			top = &(*f)[len(*f)-1]
+			regs = state.stack[top.base : top.base+top.fn.NumRegs]
+			regs[dst] = result
+			ops, pc = top.fn.Ops, top.pc
+			op, top.op = top.op, nil
 
-			case ir.Goto:
-				lastBlock = block.Index
-				block = proc.Blocks[inst.Literal.(int)]
-				goto block_loop
+		case opConstruct, opConstructMap:
+			t, ok := regs[op.B].obj.(*Type)
+			if !ok {
+				state.fail(TypeError, fmt.Sprintf("cannot construct %s", regs[op.B].String()), op)
+				return Value{}
+			}
+			if !state.alloc(arraySize(len(op.Args)), op) {
+				return Value{}
+			}
+			items := make([]Object, len(op.Args))
+			for i, arg := range op.Args {
+				items[i] = regs[arg].Object()
+			}
+			var obj Object
+			var err error
+			if op.Code == opConstructMap {
+				obj, err = constructMap(t, items)
+			} else {
+				obj, err = construct(t, items)
+			}
+			if err != nil {
+				state.failWith(err, op)
+				return Value{}
+			}
+			regs[op.A] = objectOf(obj)
+		case opLen:
+			if _, ok := regs[op.B].obj.(*Map); ok {
+				// Maps are indexed by key, so there are no bounds to check
+				regs[op.A] = Value{}
+				break
+			}
+			n, ok := length(regs[op.B].obj)
+			if !ok {
+				state.fail(TypeError, fmt.Sprintf("%s has no length", regs[op.B].String()), op)
+				return Value{}
+			}
+			regs[op.A] = intOf(int64(n))
+		case opIndex:
+			if str, ok := regs[op.B].obj.(*String); ok && regs[op.C].kind == intValue {
+				r, ok := runeAt(str.Value, regs[op.C].Int())
+				if !ok {
+					state.fail(IndexOutOfRange, fmt.Sprintf("index %d out of bounds for length %d", regs[op.C].Int(), utf8.RuneCountInString(str.Value)), op)
+					return Value{}
+				}
+				regs[op.A] = objectOf(&Rune{r})
+				break
+			}
+			if m, ok := regs[op.B].obj.(*Map); ok {
+				value, err := lookup(m, regs[op.C].Object())
+				if err != nil {
+					state.failWith(err, op)
+					return Value{}
+				}
+				regs[op.A] = ValueOf(value)
+				break
+			}
+			objects, _, ok := elements(regs[op.B].obj)
+			if !ok {
+				state.fail(TypeError, fmt.Sprintf("cannot index %s", regs[op.B].String()), op)
+				return Value{}
+			}
+			if !state.ints(op, op.C) {
+				return Value{}
+			}
+			// The index is usually checked already, but a bad one mustn't crash
+			i := regs[op.C].Int()
+			if i < 0 || i >= int64(len(objects)) {
+				state.fail(IndexOutOfRange, fmt.Sprintf("index %d out of bounds for length %d", i, len(objects)), op)
+				return Value{}
+			}
+			regs[op.A] = ValueOf(objects[i])
+		case opSetIndex:
+			if m, ok := regs[op.Args[0]].obj.(*Map); ok {
+				added, err := store(m, regs[op.Args[1]].Object(), regs[op.Args[2]].Object())
+				if err != nil {
+					state.failWith(err, op)
+					return Value{}
+				}
+				if added && !state.alloc(entrySize, op) {
+					return Value{}
+				}
+				break
+			}
+			objects, t, ok := elements(regs[op.Args[0]].obj)
+			if !ok {
+				state.fail(TypeError, fmt.Sprintf("cannot index %s", regs[op.Args[0]].String()), op)
+				return Value{}
+			}
+			if !state.ints(op, op.Args[1]) {
+				return Value{}
+			}
+			i, value := regs[op.Args[1]].Int(), regs[op.Args[2]].Object()
+			if i < 0 || i >= int64(len(objects)) {
+				state.fail(IndexOutOfRange, fmt.Sprintf("index %d out of bounds for length %d", i, len(objects)), op)
+				return Value{}
+			}
+			elem, ok := element(t, value)
+			if !ok {
+				state.fail(TypeError, fmt.Sprintf("cannot set an element of %s to %s", regs[op.Args[0]].String(), value.String()), op)
+				return Value{}
+			}
+			objects[i] = elem
+		case opSlice:
+			if !state.ints(op, op.Args[1], op.Args[2]) || !state.alloc(arrayBase, op) {
+				return Value{}
+			}
+			s, err := slice(regs[op.Args[0]].Object(), regs[op.Args[1]].Int(), regs[op.Args[2]].Int())
+			if err != nil {
+				state.failWith(err, op)
+				return Value{}
+			}
+			regs[op.A] = objectOf(s)
+
+		case opIterate:
+			it := state.iterate(regs[op.B].Object(), op)
+			if it == nil {
+				return Value{}
+			}
+			if it.onClose != nil {
+				top.iters = append(top.iters, it)
+			}
+			regs[op.A] = objectOf(it)
+		case opNext:
+			it, ok := regs[op.B].obj.(*Iterator)
+			if !ok {
+				state.fail(TypeError, fmt.Sprintf("%s is not an iterator", regs[op.B].String()), op)
+				return Value{}
+			}
+			more := state.advance(it, op)
+			if state.err != nil {
+				return Value{}
+			}
+			if !more && it.onClose != nil {
+				top.forget(it)
+			}
+			regs[op.A] = boolOf(more)
+		case opCurrent:
+			it, ok := regs[op.B].obj.(*Iterator)
+			if !ok {
+				state.fail(TypeError, fmt.Sprintf("%s is not an iterator", regs[op.B].String()), op)
+				return Value{}
+			}
+			regs[op.A] = ValueOf(it.current)
+		case opClose:
+			if it, ok := regs[op.B].obj.(*Iterator); ok {
+				it.close()
+				top.forget(it)
+			}
+		case opYield:
+			if state.gen == nil {
+				state.fail(TypeError, "yield outside of a generator", op)
+				return Value{}
+			}
+			top.pc = pc
+			if !state.gen.yield(regs[op.B].Object()) {
+				// Nothing wants more values, but its deferred calls still run
+				state.unwind()
+				return Value{}
+			}
+			state.track()
+
+		case opPassed:
+			regs[op.A] = boolOf(top.missing == nil || !top.missing[op.Imm])
+		case opUnwind:
+			top.unwind = nil
+			if len(op.Args) > 0 {
+				top.unwind = regs[op.Args[0]].Object()
+			}
 
+		case opGo:
+			args := make([]Object, len(op.Args))
+			for i, arg := range op.Args {
+				args[i] = regs[arg].Object()
+			}
+			switch fn := regs[op.B].obj.(type) {
+			case *Procedure:
+				if _, _, err := bindArgs(fn, len(args), nil); err != nil {
+					state.failWith(err, op)
+					return Value{}
+				}
+
+			case *BuiltinFunction:
 			default:
-				state.appendError(fmt.Sprintf("COULDN'T EVAL: %s\n", inst.String()), 0, 0)
-				res = NULL
+				state.fail(TypeError, fmt.Sprintf("cannot call %s", regs[op.B].String()), op)
+				return Value{}
+			}
+			if !state.alloc(tupleSize(len(args)), op) {
+				return Value{}
 			}
-			if res != nil {
-				fmt.Printf("%s = %s\n", inst.Index, res.String())
+			if fn, ok := regs[op.B].obj.(*Procedure); ok && fn.Func.Generator {
+				// There's nothing to run until it's iterated over
+				break
+			}
+			state.machine.sched.spawn(state.machine, regs[op.B].obj, args)
+		case opSend:
+			c, ok := regs[op.B].obj.(*Chan)
+			if !ok {
+				state.fail(TypeError, fmt.Sprintf("cannot send on %s", regs[op.B].String()), op)
+				return Value{}
+			}
+			if !state.send(c, regs[op.C].Object(), op) {
+				return Value{}
+			}
+		case opReceive:
+			c, ok := regs[op.B].obj.(*Chan)
+			if !ok {
+				state.fail(TypeError, fmt.Sprintf("cannot receive from %s", regs[op.B].String()), op)
+				return Value{}
+			}
+			v, _, ok := state.receive(c, op)
+			if !ok {
+				return Value{}
+			}
+			regs[op.A] = ValueOf(v)
+		case opSelect:
+			pick, v, ok := state.choose(op, regs)
+			if !ok || !state.alloc(tupleSize(2), op) {
+				return Value{}
+			}
+			regs[op.A] = objectOf(&Tuple{Fields: []Field{{Value: intOf(int64(pick)).Object()}, {Value: orNull(v)}}})
+
+		case opBoundsCheck:
+			if regs[op.C].kind == nullValue {
+				break
+			}
+			if !state.ints(op, op.B, op.C) {
+				return Value{}
+			}
+			index, length := regs[op.B].Int(), regs[op.C].Int()
+			if index < 0 || index >= length {
+				state.fail(IndexOutOfRange, fmt.Sprintf("index %d out of bounds for length %d", index, length), op)
+				return Value{}
+			}
+		case opBoundsCheckRange:
+			if !state.ints(op, op.Args[0], op.Args[1]) {
+				return Value{}
+			}
+			from, to := regs[op.Args[0]].Int(), regs[op.Args[1]].Int()
+			if _, ok := regs[op.Args[2]].obj.(*Map); ok || from >= to {
+				break
+			}
+			n, ok := length(regs[op.Args[2]].obj)
+			if !ok {
+				state.fail(TypeError, fmt.Sprintf("%s has no length", regs[op.Args[2]].String()), op)
+				return Value{}
+			}
+			if length := int64(n); from < 0 || to > length {
+				state.fail(IndexOutOfRange, fmt.Sprintf("range [%d, %d) out of bounds for length %d", from, to, length), op)
+				return Value{}
+			}
+
+		case opJump:
+			pc = int(op.Imm)
+		case opJumpIf, opJumpIfNot:
+			cond := regs[op.B]
+			if cond.kind != boolValue {
+				state.fail(TypeError, fmt.Sprintf("condition must be a bool, got %s", cond.String()), op)
+				return Value{}
+			}
+			if cond.Bool() == (op.Code == opJumpIf) {
+				pc = int(op.Imm)
+			}
+
+		default:
+			state.fail(TypeError, fmt.Sprintf("cannot evaluate %s", op.Inst.String()), op)
+			return Value{}
+		}
+
+		if tracer != nil {
+			var result Object
+			if op.A != 0 {
+				result = regs[op.A].Object()
+			}
+			x.op, top.pc = op, pc
+			tracer.OnInstruction(x, op, result)
+		}
+	}
+}
+
+// equal is Equal for registers, where a default matches anything so that it
+// can be the last case of a match.
+func equal(l, r Value) (bool, error) {
+	switch {
+	case isNumber(l) && isNumber(r):
+		c, ok := compareNumbers(l, r)
+		return ok && c == 0, nil
+	case l.Kind() == kind.Default || r.Kind() == kind.Default:
+		return true, nil
+	}
+	return Equal(l.Object(), r.Object())
+}
+
+// member selects a global of a module, a named field of a tuple, or part of
+// the description of a type.
+func member(obj Object, name string) (Object, bool) {
+	switch obj := obj.(type) {
+	case *Module:
+		if obj := obj.Globals.GetVar(name); obj != nil {
+			return obj, true
+		}
+	case *Tuple:
+		for _, field := range obj.Fields {
+			if field.Name == name {
+				return field.Value, true
 			}
-			env.Set(inst.Index, res)
 		}
-		lastBlock = block.Index
-		block = proc.Next(block)
-	block_loop:
+	case *Type:
+		return typeMember(obj, name)
 	}
-	return NULL
+	return nil, false
 }
 
-func (state *state) appendError(msg string, pos token.Pos, end token.Pos) {
-	*state.errors = append(*state.errors, token.NewError("[vm] "+msg, pos, end))
+// convertParams converts the arguments in regs to the kinds of number their
+// parameters are, as long as that doesn't turn a float into an integer.
+func convertParams(fn *Func, regs []Value, missing []bool) error {
+	for i, k := range fn.ParamKinds {
+		reg := fn.Params[i]
+		if !k.IsInteger() && !k.IsFloat() || reg < 0 || regs[reg].num == k && isNumber(regs[reg]) {
+			continue
+		}
+		if missing != nil && missing[i] {
+			continue
+		}
+		if !isNumber(regs[reg]) || regs[reg].kind == floatValue && k.IsInteger() {
+			return Errorf(TypeError, "cannot use %s as %s", regs[reg].String(), kindName(k))
+		}
+		if !fits(regs[reg], k) {
+			return Errorf(TypeError, "cannot use %s as %s, it's out of range", regs[reg].String(), kindName(k))
+		}
+		v, err := convert(regs[reg], k)
+		if err != nil {
+			return err
+		}
+		regs[reg] = v
+	}
+	return nil
+}
+
+// packedArg stands for the tuple namedTuple makes, in place of a register.
+const packedArg = -1
+
+// takesNames reports whether fn has a parameter for each of names.
+func takesNames(fn *Func, names []string) bool {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, param := range fn.ParamNames {
+			found = found || param == name
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// takesTuple reports whether the arguments passed by name can be put back
+// into a tuple for fn, which they can if they'd be its last argument, and it
+// takes a tuple or anything there. Otherwise the names are checked against
+// the parameters.
+func takesTuple(fn *Func, args []int32, names []string) bool {
+	n := len(args)
+	for n > 0 && names[n-1] != "" {
+		n--
+	}
+	if n != len(fn.Params)-1 || n >= len(fn.ParamKinds) {
+		return false
+	}
+	switch fn.ParamKinds[n] {
+	case kind.Tuple, kind.Struct, kind.Any, kind.Unresolved:
+		return true
+	}
+	return false
+}
+
+// namedTuple puts the arguments passed by name back into the tuple they were
+// written as, for procedures that don't take arguments by those names. The
+// arguments are returned with packedArg in place of the tuple.
+func namedTuple(regs []Value, args []int32, names []string) (*Tuple, []int32) {
+	n := len(args)
+	for n > 0 && names[n-1] != "" {
+		n--
+	}
+	tuple := &Tuple{Fields: make([]Field, len(args)-n)}
+	for i := range tuple.Fields {
+		tuple.Fields[i] = Field{Name: names[n+i], Value: regs[args[n+i]].Object()}
+	}
+	return tuple, append(args[:n:n], packedArg)
+}
+
+// bindArgs matches n arguments, the last of which are passed by the names in
+// names if it isn't empty, to the parameters of procedure. It returns which
+// argument each parameter gets, or -1 if it's left to its default, in which
+// case missing marks it. Arguments without names are matched by position.
+func bindArgs(procedure *Procedure, n int, names []string) (order []int, missing []bool, err error) {
+	fn := procedure.Func
+	order = make([]int, len(fn.Params))
+	for i := range order {
+		order[i] = -1
+	}
+	next := 0
+	for i := 0; i < n; i++ {
+		if i >= len(names) || names[i] == "" {
+			if next >= len(order) {
+				return nil, nil, Errorf(ArgumentError, "%s takes %d arguments, got %d", procedure.Name, len(order), n)
+			}
+			order[next] = i
+			next++
+			continue
+		}
+		j := 0
+		for j < len(fn.ParamNames) && fn.ParamNames[j] != names[i] {
+			j++
+		}
+		if j == len(fn.ParamNames) {
+			return nil, nil, Errorf(ArgumentError, "%s has no argument named %s", procedure.Name, names[i])
+		}
+		if order[j] >= 0 {
+			return nil, nil, Errorf(ArgumentError, "%s got argument %s twice", procedure.Name, names[i])
+		}
+		order[j] = i
+	}
+	for j, i := range order {
+		if i >= 0 {
+			continue
+		}
+		if !fn.Optional[j] {
+			return nil, nil, Errorf(ArgumentError, "%s is missing argument %s", procedure.Name, fn.ParamNames[j])
+		}
+		if missing == nil {
+			missing = make([]bool, len(order))
+		}
+		missing[j] = true
+	}
+	return order, missing, nil
+}
+
+// fail raises an error of kind at op, with a trace of the procedures that
+// were being evaluated.
+func (state *state) fail(kind ErrorKind, msg string, op *Op) {
+	var pos, end token.Pos
+	if op.Inst != nil {
+		pos, end = op.Inst.Pos, op.Inst.End
+	}
+	state.err = &RuntimeError{Kind: kind, Msg: msg, Pos: pos, End: end, Trace: state.backtrace(op)}
+	if tracer := state.machine.Tracer; tracer != nil {
+		tracer.OnError(&Execution{state: state, op: op}, state.err)
+	}
+}
+
+// backtrace returns the procedures being evaluated, innermost first, where
+// the innermost is at op.
+func (state *state) backtrace(op *Op) []token.Frame {
+	trace := make([]token.Frame, len(state.frames))
+	for i, frame := range state.frames {
+		t := &trace[len(trace)-1-i]
+		t.Name = frame.fn.Name
+		if frame.op != nil && frame.op.Inst != nil {
+			t.Pos = frame.op.Inst.Pos
+		}
+	}
+	if len(trace) > 0 {
+		trace[0].Pos = 0
+		if op != nil && op.Inst != nil {
+			trace[0].Pos = op.Inst.Pos
+		}
+	}
+	return trace
+}
+
+// failWith raises err, which a builtin returned, at op.
+func (state *state) failWith(err error, op *Op) {
+	rerr := runtimeError(err)
+	state.fail(rerr.Kind, rerr.Msg, op)
+}
+
+// poll checks the limits that are only looked at every so often: the
+// instruction count and the context.
+func (state *state) poll(op *Op) bool {
+	if err := state.machine.budget.poll(); err != nil {
+		state.fail(err.Kind, err.Msg, op)
+		return false
+	}
+	// Let the other tasks have a turn
+	if s := state.machine.sched; s != nil && !s.yield(s.current) {
+		state.err = s.err
+		return false
+	}
+	return true
+}
+
+// alloc charges an allocation of size bytes against the limits.
+func (state *state) alloc(size int64, op *Op) bool {
+	if err := state.machine.budget.alloc(1, size); err != nil {
+		state.fail(err.Kind, err.Msg, op)
+		return false
+	}
+	return true
+}
+
+// ints checks that the registers hold integers.
+func (state *state) ints(op *Op, regs ...int32) bool {
+	top := state.frames[len(state.frames)-1]
+	for _, reg := range regs {
+		if v := state.stack[top.base+int(reg)]; v.kind != intValue {
+			state.fail(TypeError, fmt.Sprintf("expected an integer, got %s", v.String()), op)
+			return false
+		}
+	}
+	return true
 }
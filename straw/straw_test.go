@@ -1,14 +1,19 @@
 package straw
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/yjp20/turtle/straw/pkg/ast"
 	"github.com/yjp20/turtle/straw/pkg/astgen"
-	"github.com/yjp20/turtle/straw/pkg/irgen"
 	"github.com/yjp20/turtle/straw/pkg/token"
 	"github.com/yjp20/turtle/straw/pkg/vm"
 )
@@ -48,38 +53,537 @@ func TestStraw(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			errors := token.NewErrorList()
+			in := New(Options{})
+			object, err := in.Eval(string(test.in))
 
-			file := token.NewFile([]byte(test.in))
-			lex := astgen.NewLexer(file, &errors)
-			par := astgen.NewParser(lex, &errors)
-			gen := irgen.NewGenerator(&errors)
-
-			t.Log(string(test.in))
-			node := par.ParseProgram()
-			t.Log(ast.Print(node))
-			code := gen.Generate(node)
-			t.Log(code.String())
-
-			if len(errors) != 0 && !test.shouldError {
+			if err != nil && !test.shouldError {
 				t.Errorf("didn't expect to error")
-				for i := 0; i < len(errors); i++ {
-					t.Errorf(errors[i].(token.Error).Print(file))
+				if err, ok := err.(*Error); ok {
+					t.Error(err.Print())
+				} else {
+					t.Error(err)
 				}
+				logProgram(t, test.name, test.in)
 				return
 			}
-			if len(errors) == 0 && test.shouldError {
-				t.Errorf("expected error, but parser didn't throw any\nast: %s", ast.Print(node))
+			if err == nil && test.shouldError {
+				t.Errorf("expected error, but didn't get any")
+				logProgram(t, test.name, test.in)
 				return
 			}
 
-			frame := vm.NewFrame(nil)
-			object := vm.Eval(code, &errors, frame)
-
 			if object == nil {
 				t.Errorf("expected: %s  got: nil\n", test.out)
 			} else if test.out != object.String() {
 				t.Errorf("expected: %s  got: %s\n", test.out, object.String())
+				logProgram(t, test.name, test.in)
+			}
+		})
+	}
+}
+
+// logProgram logs the ast and ir of a failing test.
+func logProgram(t *testing.T, name string, in []byte) {
+	errors := token.NewErrorList()
+	file := token.NewFile(in)
+	file.Name = name
+	node := astgen.NewParser(astgen.NewLexer(file, &errors), &errors).ParseProgram()
+	t.Log(ast.Print(node))
+	if code, _, err := Compile(name, in); err == nil {
+		t.Log(code.String())
+	}
+}
+
+func TestGoFunction(t *testing.T) {
+	stdout := bytes.Buffer{}
+	in := New(Options{Stdout: &stdout})
+	in.Register("divmod", func(a, b int64) (int64, int64, error) {
+		if b == 0 {
+			return 0, 0, fmt.Errorf("divmod by zero")
+		}
+		return a / b, a % b, nil
+	})
+	in.Register("scale", func(x float64, n int) float64 {
+		return x * float64(n)
+	})
+	in.Register("total", func(m map[string]int) int {
+		n := 0
+		for _, v := range m {
+			n += v
+		}
+		return n
+	})
+
+	_, err := in.Eval(`
+q: .divmod 17 5
+.print q {.scale 3 2} {.total {■ map[string, i64] (a: 1, b: 2)}}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != "(3, 2) 6 3\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+	if _, err := in.Eval(".divmod 1 0"); err == nil || !strings.Contains(err.Error(), "divmod by zero") {
+		t.Errorf("expected a divmod error, got %v", err)
+	}
+}
+
+func TestInterpreter(t *testing.T) {
+	in := New(Options{Limits: vm.Limits{MaxCallDepth: 100}})
+	if err := in.Set("base", 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := in.Eval(`add: λ (x i64) → x + base`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := in.Eval(`twice: λ (x i64) → .add {.add x}`); err != nil {
+		t.Fatal(err)
+	}
+	result, err := in.Call("twice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.String() != "<i64 21>" {
+		t.Errorf("expected <i64 21>, got %s", result.String())
+	}
+	if in.Get("add") == nil || in.Get("missing") != nil {
+		t.Errorf("unexpected globals")
+	}
+
+	_, err = in.Eval(`λ loop (n i64) → .loop n
+.loop 1`)
+	if err == nil || !strings.Contains(err.Error(), "call depth") {
+		t.Errorf("expected to exceed the call depth, got %v", err)
+	}
+}
+
+// closer counts how many times the reader it wraps is closed.
+type closer struct {
+	io.Reader
+	closed int
+}
+
+func (c *closer) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		src, out string
+	}{
+		{"n: 0\n∀ line ∈ .lines file → { n: n + 1 }\nn", "<i64 3>"},
+		// Leaving the loop early closes the file too
+		{"find: λ () → {\n\t∀ line ∈ .lines file → { line = \"two\" ⇒ return line }\n\t\"\"\n}\n.find", `"two"`},
+	}
+	for _, test := range tests {
+		file := &closer{Reader: strings.NewReader("one\ntwo\nthree\n")}
+		in := New(Options{})
+		if err := in.Set("file", &vm.Reader{Name: "file", R: file}); err != nil {
+			t.Fatal(err)
+		}
+		result, err := in.Eval(test.src)
+		if err != nil {
+			t.Fatalf("%q: %v", test.src, err)
+		}
+		if result.String() != test.out {
+			t.Errorf("%q: expected %s, got %s", test.src, test.out, result.String())
+		}
+		if file.closed != 1 {
+			t.Errorf("%q: expected the file to be closed once, it was closed %d times", test.src, file.closed)
+		}
+	}
+}
+
+func TestSelfContaining(t *testing.T) {
+	stdout := bytes.Buffer{}
+	in := New(Options{Stdout: &stdout})
+	result, err := in.Eval(`xs: ■ array[any] (1, 2)
+xs[0]: xs
+m: ■ map[string, any] ()
+m["self"]: m
+m["xs"]: xs
+.print xs m
+(xs, m)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != "[<...> 2] map[self:<...> xs:[<...> 2]]\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+	if want := `<tuple (0:<array [<...><i64 2>]>, 1:<map ["self":<...>, "xs":<array [<...><i64 2>]>]>)>`; result.String() != want {
+		t.Errorf("expected %s, got %s", want, result.String())
+	}
+}
+
+func TestRuntimeError(t *testing.T) {
+	in := New(Options{})
+	in.Register("boom", func() int { panic("boom") })
+	tests := []struct {
+		src   string
+		kind  vm.ErrorKind
+		trace []string
+	}{
+		{"div: λ (a i64, b i64) → a % b\n.div 1 0", vm.DivisionByZero, []string{"div", "_init"}},
+		{"x: 1\nx + true", vm.TypeError, []string{"_init"}},
+		{"λ f (n i64) → n ⇒ 1\n.f 2", vm.TypeError, []string{"f", "_init"}},
+		{".boom", vm.BuiltinError, []string{"_init"}},
+		{".len 3", vm.TypeError, []string{"_init"}},
+		{".missing 3", vm.UndefinedError, []string{"_init"}},
+		{"xs: .make array[i64] 3\nxs[3]", vm.IndexOutOfRange, []string{"_init"}},
+		{"xs: .make slice[i64] 3\nxs[range[2‥5)]", vm.IndexOutOfRange, []string{"_init"}},
+		{"xs: .make array[i64] 3\nxs[0]: true", vm.TypeError, []string{"_init"}},
+		{"s: \"héllo\"\ns[5]", vm.IndexOutOfRange, []string{"_init"}},
+		{"{1 u8} % {0 u8}", vm.DivisionByZero, []string{"_init"}},
+		{"f: λ (a any) → a + 1\n.f {1 i8}", vm.TypeError, []string{"f", "_init"}},
+		{"f: λ (a i8) → a\n.f 1.5", vm.TypeError, []string{"_init"}},
+		{"x: 1.5\n{x * 10000000000000000000} i64", vm.TypeError, []string{"_init"}},
+		{"m: ■ map[string, i64] ()\nm[1]", vm.TypeError, []string{"_init"}},
+		{"m: ■ map[string, i64] (a: 1)\nm[\"a\"]: \"b\"", vm.TypeError, []string{"_init"}},
+		{"x: \"1\"\nx = 1", vm.TypeError, []string{"_init"}},
+		{"(1, 2) < (1, \"a\")", vm.TypeError, []string{"_init"}},
+		{"m: ■ map[any, i64] ()\nm[■ array[i64] (1)]: 1", vm.TypeError, []string{"_init"}},
+		{"f: λ (a i64, b i64: 2) → a + b\n.f (b: 1)", vm.ArgumentError, []string{"_init"}},
+		{"f: λ (a i64) → a\n.f (a: 1, c: 2)", vm.ArgumentError, []string{"_init"}},
+		{"f: λ (a i64, b i64: 2) → a + b\n.f (b: 5, aa: 1)", vm.ArgumentError, []string{"_init"}},
+		{"f: λ (a i64) → a\n.f 1 (a: 2)", vm.ArgumentError, []string{"_init"}},
+		{".print (x: 1)", vm.ArgumentError, []string{"_init"}},
+		{"f: λ (a i64) → a\n.f 1 2 3", vm.ArgumentError, []string{"_init"}},
+		{"c: .make chan[i64] 0\n← c", vm.Deadlock, []string{"_init"}},
+		{"c: .make chan[i64] 1\n.close c\nc ← 1", vm.TypeError, []string{"_init"}},
+		{"f: λ (a i64) → a % 0\ngo .f 1\nc: .make chan[i64] 0\n← c", vm.DivisionByZero, []string{"f"}},
+		{"∀ x ∈ 3 → x", vm.TypeError, []string{"_init"}},
+		{"f: λ () → 1\n∀ x ∈ f → x", vm.TypeError, []string{"_init"}},
+		{"g: λ (n i64) → { yield n % 0 }\n∀ x ∈ .g 1 → x", vm.DivisionByZero, []string{"g", "_init"}},
+		{"c: .make chan[i64] 0\ng: λ () → { yield ← c }\n∀ x ∈ .g → x", vm.Deadlock, []string{"_init"}},
+		{"point: struct (x i64)\n■ point (\"a\")", vm.TypeError, []string{"_init"}},
+		{"point: struct (x i64)\n■ point (z: 1)", vm.TypeError, []string{"_init"}},
+		{"one: 1\npoint: struct (x one)", vm.TypeError, []string{"_init"}},
+		{"json: .import \"json\"\n.json/decode i64 \"1.5\"", vm.TypeError, []string{"_init"}},
+		{"json: .import \"json\"\n.json/decode i8 \"300\"", vm.TypeError, []string{"_init"}},
+		{"json: .import \"json\"\n.json/decode u8 \"-1\"", vm.TypeError, []string{"_init"}},
+		{"f: λ (a u8) → a\n.f 300", vm.TypeError, []string{"_init"}},
+		{"xs: .make array[u8] 1\nxs[0]: 300", vm.TypeError, []string{"_init"}},
+		{"xs: .make array[u8] 1\n.append xs {-1}", vm.TypeError, []string{"_init"}},
+		{"json: .import \"json\"\n.json/encode {λ () → 1}", vm.TypeError, []string{"_init"}},
+		{"json: .import \"json\"\nm: ■ map[string, any] ()\nm[\"self\"]: m\n.json/encode m", vm.TypeError, []string{"_init"}},
+	}
+	for _, test := range tests {
+		_, err := in.Eval(test.src)
+		var rerr *vm.RuntimeError
+		if !errors.As(err, &rerr) {
+			t.Errorf("%q: expected a runtime error, got %v", test.src, err)
+			continue
+		}
+		if rerr.Kind != test.kind {
+			t.Errorf("%q: expected %s, got %s: %s", test.src, test.kind, rerr.Kind, rerr.Msg)
+		}
+		names := make([]string, len(rerr.Trace))
+		for i, frame := range rerr.Trace {
+			names[i] = frame.Name
+		}
+		if strings.Join(names, " ") != strings.Join(test.trace, " ") {
+			t.Errorf("%q: expected trace %v, got %v", test.src, test.trace, names)
+		}
+	}
+}
+
+func TestDeferOnError(t *testing.T) {
+	in := New(Options{})
+	cleaned := []string{}
+	in.Register("cleanup", func(s string) { cleaned = append(cleaned, s) })
+	_, err := in.Eval(`
+f: λ (a i64) → {
+	defer .cleanup "f"
+	a % 0
+}
+defer .cleanup "init"
+.f 1
+`)
+	var rerr *vm.RuntimeError
+	if !errors.As(err, &rerr) || rerr.Kind != vm.DivisionByZero {
+		t.Fatalf("expected a division by zero, got %v", err)
+	}
+	if strings.Join(cleaned, " ") != "f init" {
+		t.Errorf("expected both defers to run, innermost first, got %v", cleaned)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		msg string
+	}{
+		{"x: 1\nx <", "Expected an expression after '<'"},
+		{"1 << 2", "Expected an expression after '<'"},
+		{"-", "Expected an expression after '-'"},
+		{"x:", "Expected an expression after ':'"},
+	}
+	for _, test := range tests {
+		_, err := New(Options{}).Eval(test.src)
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("%q: expected %q, got %v", test.src, test.msg, err)
+		}
+	}
+}
+
+func TestMismatchedTypes(t *testing.T) {
+	tests := []struct {
+		src string
+		msg string
+	}{
+		{"a: 1 i8\na + {2 i64}", "Mismatched types i8 and i64 in +"},
+		{"1.5 < {2 u32}", "Mismatched types float constant and u32 in <"},
+		{"{1 u8} + 300", "Constant 300 overflows u8"},
+		{"\"a\" f64", "Cannot convert string to f64"},
+		{"f: λ (b i64, c f64: {b * 2}) → c", "Cannot use i64 as f64, the default of c"},
+		{"f: λ (c u8: 300) → c", "Constant 300 overflows u8"},
+	}
+	for _, test := range tests {
+		_, _, err := Compile("", []byte(test.src))
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("%q: expected %q, got %v", test.src, test.msg, err)
+		}
+	}
+}
+
+func TestAssignCaptured(t *testing.T) {
+	tests := []struct {
+		src string
+		ok  bool
+	}{
+		{"count: 0\ntimes: λ (n i64, body any) → { ∀ i ∈ range[1‥n] → { .body } }\n.times 3 λ { count: count + 1 }", false},
+		{"n: 1\nf: λ () → {\n\t(a, n): (n, 2)\n\ta\n}", false},
+		// A name that's assigned before it's used is the procedure's own
+		{"n: 1\nf: λ () → {\n\tn: 2\n\tn + 1\n}", true},
+	}
+	for _, test := range tests {
+		_, _, err := Compile("", []byte(test.src))
+		if test.ok && err != nil {
+			t.Errorf("%q: didn't expect an error, got %v", test.src, err)
+		}
+		if !test.ok && (err == nil || !strings.Contains(err.Error(), "Can't assign")) {
+			t.Errorf("%q: expected an error assigning a captured name, got %v", test.src, err)
+		}
+	}
+}
+
+func TestMacroErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		msg string
+	}{
+		{"σ m: λ (x any) → 1 % 0\n.m 2", "[macro] division by zero"},
+		{"σ m: λ (x any) → (kind: \"Nope\")\n.m 2", "no kind of node called Nope"},
+		{"σ m: λ (x any) → (kind: \"Infix\", operator: \"PLUS\")\n.m 2", "no token called PLUS"},
+		{"σ m: λ () → (kind: \"Call\", procedure: (kind: \"Identifier\", value: \"m\"))\n.m", "Macros expanded more than 100 times over"},
+		{"σ {λ () → 1}", "cannot write <function"},
+	}
+	for _, test := range tests {
+		_, _, err := Compile("", []byte(test.src))
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("%q: expected %q, got %v", test.src, test.msg, err)
+		}
+	}
+}
+
+func TestPretty(t *testing.T) {
+	in := New(Options{})
+	obj, err := in.Eval(`point: struct (x i64, y f64)
+(■ point (1, 2), ■ map[string, i64] (a: 1, "b c": 2), 'r', ■ array[i8] (1, 2), λ f (a i64) → a, ■ slice[string] ("a long string that goes on and on", "and on and on"))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `(
+	■ point (x: 1, y: 2.)
+	■ map[string, i64] (a: 1, "b c": 2)
+	'r'
+	■ array[i8] (1, 2)
+	λ f (a i64)
+	■ slice[string] ("a long string that goes on and on", "and on and on")
+)`
+	if text := vm.Pretty(obj); text != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, text)
+	}
+
+	obj, err = in.Eval(`m: ■ map[string, any] ()
+m["self"]: m
+m["text"]: "a long string that goes on and on, and on and on and on"
+m`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `■ map[string, any] (
+	self: <...>
+	text: "a long string that goes on and on, and on and on and on"
+)`
+	if text := vm.Pretty(obj); text != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, text)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	spin := `∀ i ∈ range[0‥1000000000000) → { t: i }
+0`
+	grow := `xs: .make {.array i64} 0
+∀ i ∈ range[0‥1000) → { xs: .append xs i }
+.len xs`
+	insert := `m: ■ map[i64, i64] ()
+∀ i ∈ range[0‥200000) → { m[i]: i }
+.len m`
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		src    string
+		ctx    context.Context
+		limits vm.Limits
+		kind   vm.ErrorKind
+	}{
+		{spin, context.Background(), vm.Limits{MaxInstructions: 10000}, vm.InstructionLimit},
+		{spin, context.Background(), vm.Limits{Timeout: 10 * time.Millisecond}, vm.Timeout},
+		{spin, canceled, vm.Limits{}, vm.Canceled},
+		{grow, context.Background(), vm.Limits{MaxAllocations: 100}, vm.AllocationLimit},
+		{grow, context.Background(), vm.Limits{MaxBytes: 4096}, vm.MemoryLimit},
+		{insert, context.Background(), vm.Limits{MaxAllocations: 10000}, vm.AllocationLimit},
+		{insert, context.Background(), vm.Limits{MaxBytes: 1 << 20}, vm.MemoryLimit},
+		{`strings: .import "strings"
+.strings/Repeat "x" 100000000`, context.Background(), vm.Limits{MaxBytes: 1 << 20}, vm.MemoryLimit},
+		{`strings: .import "strings"
+.strings/Replace {.strings/Repeat "x" 1000} "x" {.strings/Repeat "y" 10000}`, context.Background(), vm.Limits{MaxBytes: 1 << 20}, vm.MemoryLimit},
+		{`strings: .import "strings"
+xs: .strings/Split {.strings/Repeat "x," 1000} ","
+.strings/Join xs {.strings/Repeat "y" 10000}`, context.Background(), vm.Limits{MaxBytes: 1 << 20}, vm.MemoryLimit},
+		{`strings: .import "strings"
+.strings/Split {.strings/Repeat "," 50000} ","`, context.Background(), vm.Limits{MaxBytes: 100000}, vm.MemoryLimit},
+		{`strings: .import "strings"
+.strings/Fields {.strings/Repeat "x " 30000}`, context.Background(), vm.Limits{MaxBytes: 100000}, vm.MemoryLimit},
+		{`strings: .import "strings"
+.strings/ToUpper {.strings/Repeat "x" 60000}`, context.Background(), vm.Limits{MaxBytes: 100000}, vm.MemoryLimit},
+		{"λ loop (n i64) → .loop n\n.loop 1", context.Background(), vm.Limits{MaxCallDepth: 100}, vm.CallDepthLimit},
+		{"reflect: .import \"reflect\"\nλ loop () → .reflect/call loop ()\n.loop", context.Background(), vm.Limits{MaxCallDepth: 100}, vm.CallDepthLimit},
+		// Each call to next is made by the iterator rather than by a call
+		{"λ next () → {\n\t∀ x ∈ next → x\n\t(0, false)\n}\n∀ x ∈ next → x", context.Background(), vm.Limits{MaxCallDepth: 100}, vm.CallDepthLimit},
+		{"λ next () → {\n\t∀ x ∈ (next: next) → x\n\t(0, false)\n}\n.next", context.Background(), vm.Limits{MaxCallDepth: 100}, vm.CallDepthLimit},
+	}
+	for _, test := range tests {
+		_, err := New(Options{Limits: test.limits}).EvalContext(test.ctx, test.src)
+		var rerr *vm.RuntimeError
+		if !errors.As(err, &rerr) || rerr.Kind != test.kind {
+			t.Errorf("%+v: expected %s, got %v", test.limits, test.kind, err)
+		}
+	}
+
+	result, err := New(Options{Limits: vm.Limits{MaxInstructions: 100000, MaxAllocations: 2000}}).Eval(grow)
+	if err != nil || result.String() != "<i64 1000>" {
+		t.Errorf("expected to stay within the limits, got %v, %v", result, err)
+	}
+
+	// Compile time code stops with the context too
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = New(Options{}).EvalContext(ctx, "σ { ∀ i ∈ range[0‥1000000000000) → { t: i } }")
+	if err == nil || time.Since(start) > time.Second {
+		t.Errorf("expected the macro to stop, got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestTracer(t *testing.T) {
+	text := bytes.Buffer{}
+	in := New(Options{Tracer: &vm.TextTracer{W: &text}})
+	if _, err := in.Eval("f: λ (a i64) → a + 4\n.f 5"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text.String(), "= <i64 9>\n") {
+		t.Errorf("expected the result of the call in the trace, got\n%s", text.String())
+	}
+
+	histogram := vm.NewHistogram()
+	in = New(Options{Tracer: histogram})
+	if _, err := in.Eval("∀ i ∈ range[0‥10) → { t: i }"); err != nil {
+		t.Fatal(err)
+	}
+	total := int64(0)
+	for _, n := range histogram.Counts {
+		total += n
+	}
+	if total < 10 {
+		t.Errorf("expected to count at least 10 instructions, got %d", total)
+	}
+}
+
+func TestParseTrace(t *testing.T) {
+	var read []string
+	in := New(Options{ParseTrace: func(file *token.File, tok token.Token, pos token.Pos, lit string) {
+		p := file.Position(pos)
+		read = append(read, fmt.Sprintf("%d:%d %s", p.Line, p.Column, tok))
+	}})
+	if _, err := in.Eval("x: 1\nx + 2"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"1:1 IDENT", "1:2 ASSIGN", "1:4 INT", "1:5 SEMICOLON", "2:1 IDENT", "2:3 ADD", "2:5 INT"}
+	if len(read) < len(want) || strings.Join(read[:len(want)], ", ") != strings.Join(want, ", ") {
+		t.Errorf("expected the tokens %v, got %v", want, read)
+	}
+}
+
+func benchmarkExample(b *testing.B, name string) {
+	in, err := os.ReadFile(filepath.Join("examples", name))
+	if err != nil {
+		b.Fatal(err)
+	}
+	code, _, err := Compile(name, in)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	bytecode := vm.Compile(code)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vm.NewMachine().Run(context.Background(), bytecode)
+	}
+}
+
+func BenchmarkFiboRecursion(b *testing.B) { benchmarkExample(b, "fibo_recursion.st") }
+func BenchmarkFiboIteration(b *testing.B) { benchmarkExample(b, "fibo_iteration.st") }
+
+// BenchmarkExamples runs every example, so that they serve as benchmarks of
+// the whole vm. Examples that don't work yet are skipped.
+func BenchmarkExamples(b *testing.B) {
+	entries, err := os.ReadDir("examples")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".st") {
+			continue
+		}
+		b.Run(strings.TrimSuffix(entry.Name(), ".st"), func(b *testing.B) {
+			in, err := os.ReadFile(filepath.Join("examples", entry.Name()))
+			if err != nil {
+				b.Fatal(err)
+			}
+			code, _, err := Compile(entry.Name(), in)
+			if err != nil {
+				b.Skip(err)
+			}
+			bytecode := vm.Compile(code)
+			run := func() error {
+				m := vm.NewMachine()
+				m.Stdout = io.Discard
+				_, err := m.Run(context.Background(), bytecode)
+				return err
+			}
+			if err := run(); err != nil {
+				b.Skip(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				run()
 			}
 		})
 	}